@@ -0,0 +1,134 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/run/v2"
+)
+
+// annotationBackends configures the backend services of a service as a JSON
+// list, as an alternative to the controller's labels, whose values can't hold
+// decimals, upper case letters or structure. Labels are then only used to
+// select services. For example:
+//
+//	[{"name": "web-bs", "capacityScaler": 0.5},
+//	 {"name": "internal-bs", "scope": "regional", "localityPolicy": "LEAST_REQUEST"}]
+const annotationBackends = controllerName + "/backends"
+
+// annotationBackend is a backend service in annotationBackends. Unset
+// settings are left alone, like their labels.
+type annotationBackend struct {
+	Name string `json:"name"`
+	// Scope is "global" (default) or "regional".
+	Scope string `json:"scope"`
+	// CapacityScaler is 0 or 0.1-1; the default is 1.
+	CapacityScaler *float64 `json:"capacityScaler"`
+	// Protocol is HTTP2, HTTPS or HTTP, in any case.
+	Protocol string `json:"protocol"`
+	// ConnectionDraining is the timeout in seconds.
+	ConnectionDraining *int64 `json:"connectionDraining"`
+	// LocalityPolicy is a Compute Engine policy, e.g. LEAST_REQUEST, or
+	// the value of its label, e.g. least-request.
+	LocalityPolicy string `json:"localityPolicy"`
+	// OutlierDetection is the number of consecutive errors ejecting a
+	// backend.
+	OutlierDetection *int64 `json:"outlierDetection"`
+	// Auth is the authentication mode: iap, token or public.
+	Auth string `json:"auth"`
+}
+
+// annotatedBackends returns the backend services configured by the
+// backends annotation of svc.
+func annotatedBackends(svc *run.GoogleCloudRunV2Service, v, region string) ([]desiredBackend, error) {
+	if _, ok := svc.Labels[labelBackendService]; ok {
+		return nil, errors.Errorf("annotation %q and label %q are mutually exclusive", annotationBackends, labelBackendService)
+	}
+	var abs []annotationBackend
+	dec := json.NewDecoder(bytes.NewReader([]byte(v)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&abs); err != nil {
+		return nil, errors.Wrapf(err, "annotation %q: invalid JSON", annotationBackends)
+	}
+	if len(abs) == 0 {
+		return nil, errors.Errorf("annotation %q: no backend services", annotationBackends)
+	}
+
+	seen := make(map[backendServiceRef]bool)
+	var out []desiredBackend
+	for i, ab := range abs {
+		fail := func(format string, args ...interface{}) error {
+			return errors.Errorf("annotation %q: backend service %d: %s", annotationBackends, i, fmt.Sprintf(format, args...))
+		}
+		if !validResourceName(ab.Name) {
+			return nil, fail("invalid backend service name %q", ab.Name)
+		}
+		d := desiredBackend{Capacity: 1, DrainingTimeout: ab.ConnectionDraining, OutlierErrors: ab.OutlierDetection}
+		switch ab.Scope {
+		case "", "global":
+			d.Ref = backendServiceRef{Name: ab.Name}
+		case "regional":
+			d.Ref = backendServiceRef{Region: region, Name: ab.Name}
+		default:
+			return nil, fail("unknown scope %q", ab.Scope)
+		}
+		if seen[d.Ref] {
+			return nil, fail("backend service %q listed twice", ab.Name)
+		}
+		seen[d.Ref] = true
+
+		if c := ab.CapacityScaler; c != nil {
+			if *c != 0 && (*c < 0.1 || *c > 1) {
+				return nil, fail("capacity scaler must be 0 or 0.1-1, got %g", *c)
+			}
+			d.Capacity = *c
+		}
+		switch p := strings.ToLower(ab.Protocol); p {
+		case "", "http2", "https", "http":
+			d.Protocol, _ = parseBackendProtocol(svc, p)
+		default:
+			return nil, fail("unknown protocol %q", ab.Protocol)
+		}
+		if t := ab.ConnectionDraining; t != nil && (*t < 0 || *t > maxConnectionDraining) {
+			return nil, fail("connection draining timeout must be 0-%d seconds, got %d", maxConnectionDraining, *t)
+		}
+		if lp := ab.LocalityPolicy; lp != "" {
+			if d.LocalityPolicy = localityPolicies[lp]; d.LocalityPolicy == "" {
+				for _, policy := range localityPolicies {
+					if policy == lp {
+						d.LocalityPolicy = policy
+					}
+				}
+			}
+			if d.LocalityPolicy == "" {
+				return nil, fail("unknown locality policy %q", lp)
+			}
+		}
+		if n := ab.OutlierDetection; n != nil && *n < 1 {
+			return nil, fail("number of consecutive errors must be positive, got %d", *n)
+		}
+		var err error
+		if d.Auth, err = parseAuthMode(strings.ToLower(ab.Auth)); err != nil {
+			return nil, fail("unknown auth mode %q", ab.Auth)
+		}
+		out = append(out, d)
+	}
+	return out, nil
+}
@@ -0,0 +1,204 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"path"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/apply"
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/discovery"
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/planner"
+	"github.com/pkg/errors"
+	"google.golang.org/api/compute/v1"
+)
+
+// apply executes the plan's mutations in order. All changes of a backend
+// service in the same stage are applied together when the first of them is
+// reached.
+// Independent mutations of the same stage (see planner.Op.Stage) run in
+// parallel, bounded by the concurrency budget of their project, so that a
+// busy project doesn't hold up the others. A failed mutation does not
+// prevent the remaining ones from being attempted; the number of failures
+// and the first error of every service with failed mutations are returned.
+func (r *reconciler) apply(ctx context.Context, p *plan) (failed int, serviceErrors map[string]error) {
+	var mu sync.Mutex
+	serviceErrors = make(map[string]error)
+	report := func(m mutation, before, after interface{}, changes []apply.Change, err error) {
+		r.audit.record(m, before, after, changes, err)
+		lg := r.log(ctx).WithFields(m.Fields())
+		if err != nil {
+			kind := errorKindOf(err)
+			lg.WithError(err).WithField("errorKind", kind).Error("mutation failed")
+			r.metrics.failedMutation(kind)
+			mu.Lock()
+			failed++
+			if _, ok := serviceErrors[m.Service]; !ok && m.Service != "" {
+				serviceErrors[m.Service] = err
+			}
+			mu.Unlock()
+			return
+		}
+		lg.Info("mutation applied")
+	}
+
+	var stages [][]applyUnit
+	stage := -1
+	type batchKey struct {
+		ref   backendServiceRef
+		stage int
+	}
+	updated := make(map[batchKey]bool)
+	for _, m := range p.Mutations {
+		m := m
+		var u applyUnit
+		switch m.Op {
+		case opAttachBackend, opAdoptBackend, opUpdateBackend, opLabelBackend, opSetProtocol, opSetDraining, opSetLocalityPolicy, opSetOutlierDetection, opSetIAP, opDetachBackend:
+			ref := m.BackendServiceRef()
+			key := batchKey{ref, m.Op.Stage()}
+			if updated[key] {
+				continue
+			}
+			updated[key] = true
+			var batch []mutation
+			for _, o := range p.Mutations {
+				if o.BackendService != "" && o.BackendServiceRef() == ref && o.Op.Stage() == key.stage {
+					batch = append(batch, o)
+				}
+			}
+			u = applyUnit{project: m.Project, run: func() {
+				unlock := r.backendLocks.lock(ref)
+				before, after, changes, err := r.applier.UpdateBackends(ctx, r.project, ref, r.cache.backendService(ref), batch)
+				unlock()
+				for _, o := range batch {
+					report(o, backendsState(before), backendsState(after), changes, err)
+				}
+			}}
+		case opHardenIngress, opRestoreIngress:
+			u = applyUnit{project: m.Project, run: func() {
+				mu.Lock()
+				_, failedBefore := serviceErrors[m.Service]
+				mu.Unlock()
+				if m.Op == opHardenIngress && failedBefore {
+					// The NEG may not be attached; hardening would cut
+					// the service off.
+					r.log(ctx).WithFields(m.Fields()).Warn("not hardening ingress, an earlier mutation of the service failed")
+					return
+				}
+				before, after, err := r.applyIngressMutation(ctx, m)
+				report(m, before, after, nil, err)
+			}}
+		default:
+			u = applyUnit{project: m.Project, run: func() {
+				before, after, err := r.applyNEGMutation(ctx, m)
+				report(m, before, after, nil, err)
+			}}
+		}
+		if m.Op.Stage() != stage {
+			stage = m.Op.Stage()
+			stages = append(stages, nil)
+		}
+		stages[len(stages)-1] = append(stages[len(stages)-1], u)
+	}
+
+	sems := make(map[string]chan struct{})
+	for _, units := range stages {
+		var wg sync.WaitGroup
+		for _, u := range units {
+			sem, ok := sems[u.project]
+			if !ok {
+				sem = make(chan struct{}, r.cfg.budget(u.project).concurrency())
+				sems[u.project] = sem
+			}
+			wg.Add(1)
+			go func(u applyUnit, sem chan struct{}) {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				u.run()
+			}(u, sem)
+		}
+		wg.Wait()
+	}
+
+	if err := r.audit.flush(ctx); err != nil {
+		r.log(ctx).WithError(err).WithField("errorKind", errorKindOf(err)).Error("failed to write audit log")
+		r.metrics.failedMutation(errorKindOf(err))
+		failed++
+	}
+	return failed, serviceErrors
+}
+
+// applyUnit is a unit of work of apply: a NEG or ingress mutation, or all
+// changes of one backend service.
+type applyUnit struct {
+	project string
+	run     func()
+}
+
+// applyNEGMutation creates or deletes a NEG and returns its state before and
+// after the mutation.
+func (r *reconciler) applyNEGMutation(ctx context.Context, m mutation) (before, after interface{}, err error) {
+	switch m.Op {
+	case opCreateNEG:
+		if m.PSCTarget != "" {
+			spec, ok := r.cfg.pscNEGsIn(m.Region)[m.NEG]
+			if !ok {
+				return nil, nil, errors.Errorf("PSC NEG %q is no longer configured", m.NEG)
+			}
+			neg := &compute.NetworkEndpointGroup{
+				Name:                m.NEG,
+				NetworkEndpointType: "PRIVATE_SERVICE_CONNECT",
+				PscTargetService:    spec.ServiceAttachment,
+				Network:             spec.Network,
+				Subnetwork:          spec.Subnetwork,
+				Description:         planner.NewOwnership("").String(),
+			}
+			return nil, neg, r.applier.CreateNEG(ctx, m.Project, m.Region, neg)
+		}
+		// NEGs can't be changed after creation, so their labels are only
+		// set once; backends keep them in sync.
+		neg := &compute.NetworkEndpointGroup{
+			Name:                m.NEG,
+			NetworkEndpointType: "SERVERLESS",
+			CloudRun:            &compute.NetworkEndpointGroupCloudRun{Service: path.Base(m.Service), Tag: m.Tag},
+			Description:         planner.NewOwnership(m.Service).WithLabels(m.Labels).String(),
+			Annotations:         m.Labels,
+		}
+		return nil, neg, r.applier.CreateNEG(ctx, m.Project, m.Region, neg)
+	case opDeleteNEG:
+		var neg *compute.NetworkEndpointGroup
+		if m.Project == r.project {
+			neg = r.cache.neg(m.Region, m.NEG)
+		}
+		if neg == nil {
+			if neg, err = discovery.GetRegionNEG(ctx, r.computeService, m.Project, m.Region, m.NEG); err != nil {
+				return nil, nil, err
+			}
+		}
+		return neg, nil, r.applier.DeleteNEG(ctx, m.Project, m.Region, m.NEG)
+	}
+	return nil, nil, errors.Errorf("unknown mutation %q", m.Op)
+}
+
+// backendsState converts backends for the audit log, mapping a nil list
+// (backend service not read) to no state.
+func backendsState(backends []*compute.Backend) interface{} {
+	if backends == nil {
+		return nil
+	}
+	return backends
+}
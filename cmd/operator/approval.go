@@ -0,0 +1,107 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/idtoken"
+)
+
+// approvalRequest is posted to the approval webhook before a plan is applied.
+type approvalRequest struct {
+	ReconcileID string       `json:"reconcileId"`
+	Project     string       `json:"project"`
+	Regions     []string     `json:"regions"`
+	Service     string       `json:"service,omitempty"`
+	Mutations   []mutation   `json:"mutations"`
+	Changes     []changeDiff `json:"changes"`
+}
+
+// approvalResponse is the answer of the approval webhook.
+type approvalResponse struct {
+	Approved bool   `json:"approved"`
+	Reason   string `json:"reason"`
+}
+
+// approvalWebhook asks an external endpoint to approve plans. Anything but an
+// explicit approval within the timeout denies the plan.
+type approvalWebhook struct {
+	url     string
+	timeout time.Duration
+	client  *http.Client
+}
+
+// newApprovalWebhook returns a webhook posting to url. If audience is not
+// empty, requests are authenticated with an ID token for that audience, e.g.
+// for webhooks deployed on Cloud Run.
+func newApprovalWebhook(ctx context.Context, url, audience string, timeout time.Duration) (*approvalWebhook, error) {
+	client := http.DefaultClient
+	if audience != "" {
+		var err error
+		if client, err = idtoken.NewClient(ctx, audience); err != nil {
+			return nil, errors.Wrap(err, "failed to initialize approval webhook client")
+		}
+	}
+	return &approvalWebhook{url: url, timeout: timeout, client: client}, nil
+}
+
+// approve posts the request and returns nil only if the webhook approved it.
+func (a *approvalWebhook) approve(ctx context.Context, req approvalRequest) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode approval request")
+	}
+	if a.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.timeout)
+		defer cancel()
+	}
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrap(err, "failed to create approval request")
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(hreq)
+	if err != nil {
+		return errors.Wrap(err, "plan not approved: approval webhook failed")
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return withKind(kindUnavailable, errors.Wrap(err, "plan not approved: failed to read approval response"))
+	}
+	if resp.StatusCode/100 != 2 {
+		err := errors.Errorf("plan not approved: approval webhook returned %s", resp.Status)
+		if resp.StatusCode >= 500 {
+			return withKind(kindUnavailable, err)
+		}
+		return err
+	}
+	var ar approvalResponse
+	if err := json.Unmarshal(body, &ar); err != nil {
+		return errors.Wrap(err, "plan not approved: invalid approval response")
+	}
+	if !ar.Approved {
+		return errors.Errorf("plan not approved: %s", ar.Reason)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// runServiceAssetType is the Cloud Asset Inventory type of Cloud Run
+// services.
+const runServiceAssetType = "run.googleapis.com/Service"
+
+// pubsubPushRequest is the body of Pub/Sub push deliveries.
+type pubsubPushRequest struct {
+	Message struct {
+		Data      []byte `json:"data"`
+		MessageID string `json:"messageId"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// temporalAsset is the part of Cloud Asset feed notifications the controller
+// uses.
+type temporalAsset struct {
+	Asset struct {
+		Name      string `json:"name"`
+		AssetType string `json:"assetType"`
+		Resource  struct {
+			Location string `json:"location"`
+		} `json:"resource"`
+	} `json:"asset"`
+	Deleted bool `json:"deleted"`
+}
+
+// handleAssetFeed consumes Cloud Asset feed notifications for Cloud Run
+// services pushed by a Pub/Sub subscription, and queues the changed
+// service. A single feed can cover a folder or organization; changes in
+// other projects are acknowledged and ignored.
+func (s *server) handleAssetFeed(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var push pubsubPushRequest
+	if err := json.NewDecoder(req.Body).Decode(&push); err != nil {
+		http.Error(w, "invalid push request", http.StatusBadRequest)
+		return
+	}
+	var ta temporalAsset
+	if err := json.Unmarshal(push.Message.Data, &ta); err != nil {
+		// Redelivering a malformed message won't help.
+		s.logger.WithError(err).WithField("messageID", push.Message.MessageID).Warn("ignoring malformed asset feed message")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	lg := s.logger.WithContext(req.Context()).WithFields(logrus.Fields{
+		"messageID": push.Message.MessageID,
+		"asset":     ta.Asset.Name,
+		"deleted":   ta.Deleted,
+	})
+	if ta.Asset.AssetType != runServiceAssetType {
+		lg.WithField("assetType", ta.Asset.AssetType).Debug("ignoring asset of other type")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	project, region, service, ok := parseRunResourceName(strings.TrimPrefix(ta.Asset.Name, "//run.googleapis.com/"))
+	if region == "" {
+		region = ta.Asset.Resource.Location
+	}
+	if !ok || region == "" {
+		lg.Warn("ignoring asset with unknown name")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if project != s.r.project {
+		lg.Debug("ignoring asset of other project")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	// Notifications don't tell creations from updates.
+	kind := changeCreated
+	if ta.Deleted {
+		kind = changeDeleted
+	}
+	s.enqueueChangedService(w, lg, region, service, kind)
+}
@@ -0,0 +1,165 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/apply"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/storage/v1"
+)
+
+// auditRecord describes a single mutation made by the controller.
+type auditRecord struct {
+	Time     time.Time   `json:"time"`
+	Actor    string      `json:"actor"`
+	Mutation mutation    `json:"mutation"`
+	Before   interface{} `json:"before,omitempty"`
+	After    interface{} `json:"after,omitempty"`
+	// Changes holds the field-level changes of the backend service patch
+	// that applied the mutation, together with the other mutations of the
+	// backend service.
+	Changes []apply.Change `json:"changes,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// auditLog collects the mutations of a reconcile pass and writes them as a
+// JSONL object to Cloud Storage. Each flush creates a new object that must
+// not exist yet, so the log is append-only. Object names carry the replica
+// ID so that replicas flushing at the same time don't collide. A nil
+// *auditLog discards records.
+type auditLog struct {
+	storageService *storage.Service
+	bucket         string
+	prefix         string
+	actor          string
+	replica        string
+
+	mu      sync.Mutex
+	records []auditRecord
+}
+
+// newAuditLog returns an audit log writing to the given gs://bucket/prefix
+// location.
+func newAuditLog(ctx context.Context, location string, cfg *config) (*auditLog, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme != "gs" || u.Host == "" {
+		return nil, errors.Errorf("invalid audit log location %q, expected gs://bucket[/prefix]", location)
+	}
+	opts, err := clientOptions(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	storageService, err := storage.NewService(ctx, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialize Cloud Storage client")
+	}
+	return &auditLog{
+		storageService: storageService,
+		bucket:         u.Host,
+		prefix:         strings.Trim(u.Path, "/"),
+		actor:          determineIdentity(ctx),
+		replica:        replicaID(),
+	}, nil
+}
+
+func (a *auditLog) record(m mutation, before, after interface{}, changes []apply.Change, err error) {
+	if a == nil {
+		return
+	}
+	rec := auditRecord{
+		Time:     time.Now().UTC(),
+		Actor:    a.actor,
+		Mutation: m,
+		Before:   before,
+		After:    after,
+		Changes:  changes,
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	a.mu.Lock()
+	a.records = append(a.records, rec)
+	a.mu.Unlock()
+}
+
+// flush writes the pending records to a new object. If the write fails,
+// the records are kept for the next flush.
+func (a *auditLog) flush(ctx context.Context) error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	records := a.records
+	a.records = nil
+	a.mu.Unlock()
+	if len(records) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			return errors.Wrap(err, "failed to encode audit record")
+		}
+	}
+	now := time.Now().UTC()
+	name := fmt.Sprintf("%s/%s-%s.jsonl", now.Format("2006/01/02"), now.Format("20060102T150405.000000000Z"), a.replica)
+	if a.prefix != "" {
+		name = a.prefix + "/" + name
+	}
+	_, err := a.storageService.Objects.Insert(a.bucket, &storage.Object{Name: name, ContentType: "application/x-ndjson"}).
+		Media(&buf).
+		IfGenerationMatch(0).
+		Context(ctx).
+		Do()
+	if err != nil {
+		a.mu.Lock()
+		a.records = append(records, a.records...)
+		a.mu.Unlock()
+		return errors.Wrapf(err, "failed to write audit log object gs://%s/%s", a.bucket, name)
+	}
+	return nil
+}
+
+// determineIdentity returns the email of the account the controller acts as,
+// or "unknown" if it cannot be determined.
+func determineIdentity(ctx context.Context) string {
+	if metadata.OnGCE() {
+		if v, err := metadata.Email(""); err == nil {
+			return v
+		}
+	}
+	if creds, err := google.FindDefaultCredentials(ctx, cloudPlatformScope); err == nil && len(creds.JSON) != 0 {
+		var f struct {
+			ClientEmail string `json:"client_email"`
+		}
+		if json.Unmarshal(creds.JSON, &f) == nil && f.ClientEmail != "" {
+			return f.ClientEmail
+		}
+	}
+	return "unknown"
+}
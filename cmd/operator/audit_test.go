@@ -0,0 +1,93 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/option"
+	"google.golang.org/api/storage/v1"
+)
+
+func TestAuditLogFlushKeepsRecordsOnFailure(t *testing.T) {
+	fail := true
+	var names []string
+	var lines int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if fail {
+			http.Error(w, `{"error":{"code":503,"message":"unavailable"}}`, http.StatusServiceUnavailable)
+			return
+		}
+		_, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		mr := multipart.NewReader(req.Body, params["boundary"])
+		meta, err := mr.NextPart()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var obj storage.Object
+		if err := json.NewDecoder(meta).Decode(&obj); err != nil {
+			t.Error(err)
+			return
+		}
+		names = append(names, obj.Name)
+		media, err := mr.NextPart()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for sc := bufio.NewScanner(media); sc.Scan(); {
+			lines++
+		}
+		io.WriteString(w, "{}")
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	storageService, err := storage.NewService(ctx, option.WithEndpoint(srv.URL), option.WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &auditLog{storageService: storageService, bucket: "b", prefix: "audit", replica: "host-1234"}
+	a.record(mutation{Service: "hello"}, nil, nil, nil, nil)
+	if err := a.flush(ctx); err == nil {
+		t.Fatal("flush succeeded against a failing bucket")
+	}
+	a.record(mutation{Service: "world"}, nil, nil, nil, nil)
+
+	fail = false
+	if err := a.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if lines != 2 {
+		t.Errorf("flushed %d records, want 2", lines)
+	}
+	if len(names) != 1 || !strings.HasPrefix(names[0], "audit/") || !strings.HasSuffix(names[0], "-host-1234.jsonl") {
+		t.Errorf("object names = %q, want one under audit/ with the replica ID", names)
+	}
+}
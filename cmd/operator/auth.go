@@ -0,0 +1,134 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/planner"
+	"github.com/pkg/errors"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/run/v2"
+)
+
+// authMode is how requests through the load balancer are authenticated, set
+// by labelAuth.
+type authMode = planner.AuthMode
+
+const (
+	authIAP    = planner.AuthIAP
+	authToken  = planner.AuthToken
+	authPublic = planner.AuthPublic
+)
+
+// parseAuthMode converts the value of the auth label, returning "" if the
+// controller doesn't manage IAP.
+func parseAuthMode(v string) (authMode, error) {
+	switch m := authMode(v); m {
+	case "", authIAP, authToken, authPublic:
+		return m, nil
+	}
+	return "", errors.Errorf("label %q: unknown auth mode %q", labelAuth, v)
+}
+
+const (
+	runInvokerRole = "roles/run.invoker"
+	// iapServiceAgentSuffix identifies the IAP service agent,
+	// service-PROJECT_NUMBER@gcp-sa-iap.iam.gserviceaccount.com.
+	iapServiceAgentSuffix = "@gcp-sa-iap.iam.gserviceaccount.com"
+)
+
+// checkAuth checks for the desired NEGs of the region whether requests
+// through their backend services will be authorized by Cloud Run, based on
+// the IAM policy of the service and the IAP setting the backend services
+// have or are given. Services whose policy can't be read are skipped.
+func (r *reconciler) checkAuth(ctx context.Context, region string, svcs []*run.GoogleCloudRunV2Service, backends map[backendServiceRef]*compute.BackendService, p *plan) {
+	byName := make(map[string]*run.GoogleCloudRunV2Service, len(svcs))
+	for _, svc := range svcs {
+		byName[svc.Name] = svc
+	}
+	for _, name := range sortedKeys(p.desired[region]) {
+		d := p.desired[region][name]
+		svc, ok := byName[d.Service]
+		if !ok {
+			continue
+		}
+		if _, checked := p.auth[d.Service]; checked {
+			// The NEGs of the revision tags of a service share its
+			// backend services.
+			continue
+		}
+		lg := r.log(ctx).WithField("service", d.Service)
+		issue, err := r.serviceAuthIssue(ctx, d.Service, d.Backends, backends)
+		if err != nil {
+			lg.WithError(err).WithField("errorKind", errorKindOf(err)).Warn("skipping authentication check")
+			continue
+		}
+		if issue != "" && issue != svc.Annotations[annotationStatusReason] {
+			lg.WithField("issue", issue).Warn("requests through the load balancer will be rejected")
+		}
+		if p.auth == nil {
+			p.auth = make(map[string]string)
+		}
+		p.auth[d.Service] = issue
+	}
+}
+
+// serviceAuthIssue returns why requests through the backend services of a
+// service will be rejected, or "".
+func (r *reconciler) serviceAuthIssue(ctx context.Context, service string, dbs []desiredBackend, backends map[backendServiceRef]*compute.BackendService) (string, error) {
+	policy, err := r.runService.Projects.Locations.Services.GetIamPolicy(service).Context(ctx).Do()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get IAM policy of service %q", service)
+	}
+	var public, iapInvoker bool
+	for _, b := range policy.Bindings {
+		if b.Role != runInvokerRole {
+			continue
+		}
+		for _, m := range b.Members {
+			public = public || m == "allUsers"
+			iapInvoker = iapInvoker || (strings.HasPrefix(m, "serviceAccount:service-") && strings.HasSuffix(m, iapServiceAgentSuffix))
+		}
+	}
+	for _, db := range dbs {
+		if bs, ok := backends[db.Ref]; ok {
+			if issue := authIssue(db, bs, public, iapInvoker); issue != "" {
+				return issue, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// authIssue returns why requests through backend service bs will be
+// rejected, or "".
+func authIssue(db desiredBackend, bs *compute.BackendService, public, iapInvoker bool) string {
+	iap := planner.IAPEnabled(bs)
+	if db.Auth != "" {
+		iap = db.Auth == authIAP
+	}
+	switch {
+	case db.Auth == authPublic && !public:
+		return fmt.Sprintf("%s is %s, but the service doesn't allow unauthenticated invocations; grant allUsers %s", labelAuth, authPublic, runInvokerRole)
+	case iap && !iapInvoker:
+		return fmt.Sprintf("backend service %s uses IAP, but the IAP service agent (service-PROJECT_NUMBER%s) can't invoke the service; grant it %s", db.Ref, iapServiceAgentSuffix, runInvokerRole)
+	case db.Auth == "" && !iap && !public:
+		return fmt.Sprintf("the service requires authentication, but backend service %s doesn't use IAP: requests without an ID token for the service are rejected with 403; set %s to %s, or to %s if clients send ID tokens", db.Ref, labelAuth, authIAP, authToken)
+	}
+	return ""
+}
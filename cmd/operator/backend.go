@@ -0,0 +1,93 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/apply"
+	"github.com/sirupsen/logrus"
+)
+
+// keyedMutex provides one mutex per backend service.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[backendServiceRef]*sync.Mutex
+}
+
+func (k *keyedMutex) lock(ref backendServiceRef) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[backendServiceRef]*sync.Mutex)
+	}
+	l, ok := k.locks[ref]
+	if !ok {
+		l = &sync.Mutex{}
+		k.locks[ref] = l
+	}
+	k.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// logPatch logs the field-level changes of a backend service patch before it
+// is sent, so that every change made in production can be explained.
+func (r *reconciler) logPatch(ctx context.Context, project string, ref backendServiceRef, changes []apply.Change) {
+	r.log(ctx).WithFields(logrus.Fields{"project": project, "backendService": ref.String(), "changes": changes}).Info("patching backend service")
+}
+
+// http2Incompatible reports whether a backend service served by target
+// proxies of the given protocols can't use HTTP2: target HTTP proxies can't
+// carry gRPC, so it must be served by target HTTPS proxies.
+func http2Incompatible(proxyProtocols []string) bool {
+	return contains(proxyProtocols, "HTTP") && !contains(proxyProtocols, "HTTPS")
+}
+
+// holdBackIncompatibleProtocols drops the mutations switching backend
+// services to HTTP2 behind target proxies that can't carry it, and those of
+// backend services whose proxies can't be listed.
+func (r *reconciler) holdBackIncompatibleProtocols(ctx context.Context, p *plan) {
+	// proxyProtocols caches the target proxy protocols per scope.
+	proxyProtocols := make(map[string]map[backendServiceRef][]string)
+	held := make(map[backendServiceRef]bool)
+	for _, m := range p.Mutations {
+		if m.Op != opSetProtocol || m.Protocol != "HTTP2" {
+			continue
+		}
+		ref := m.BackendServiceRef()
+		lg := r.log(ctx).WithFields(logrus.Fields{"backendService": ref.String(), "protocol": m.Protocol})
+		pp, ok := proxyProtocols[ref.Scope()]
+		if !ok {
+			var err error
+			if pp, err = r.listAllProxyProtocols(ctx, ref.Region); err != nil {
+				lg.WithError(err).WithField("errorKind", errorKindOf(err)).Warn("failed to list target proxies, not changing the backend service protocol")
+				held[ref] = true
+				continue
+			}
+			proxyProtocols[ref.Scope()] = pp
+		}
+		if http2Incompatible(pp[ref]) {
+			lg.Warn("conflict: backend service is only served by target HTTP proxies, which can't carry gRPC; not changing its protocol")
+			held[ref] = true
+		}
+	}
+	if len(held) == 0 {
+		return
+	}
+	p.filter(func(m mutation) bool {
+		return m.Op != opSetProtocol || !held[m.BackendServiceRef()]
+	})
+}
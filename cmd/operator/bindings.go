@@ -0,0 +1,372 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// The ServerlessNEGBinding custom resource, see deploy/crd.yaml.
+const (
+	bindingGroup    = "autoneg.serverless.cloud.google.com"
+	bindingVersion  = "v1alpha1"
+	bindingResource = "serverlessnegbindings"
+	bindingKind     = "ServerlessNEGBinding"
+)
+
+var bindingGVR = schema.GroupVersionResource{Group: bindingGroup, Version: bindingVersion, Resource: bindingResource}
+
+// Reasons of the Ready condition of bindings.
+const (
+	reasonReconciled      = "Reconciled"
+	reasonInvalidSpec     = "InvalidSpec"
+	reasonUnmanagedRegion = "UnmanagedRegion"
+	reasonServiceNotFound = "ServiceNotFound"
+	reasonNotManaged      = "NotManaged"
+	reasonPlanFailed      = "PlanFailed"
+	reasonApplyFailed     = "ApplyFailed"
+	reasonReconcileFailed = "ReconcileFailed"
+)
+
+// serverlessNEGBinding declares the backend services the NEG of a Cloud Run
+// service is attached to. Its spec mirrors the controller's labels.
+type serverlessNEGBinding struct {
+	Metadata metav1.ObjectMeta `json:"metadata"`
+	Spec     serviceBinding    `json:"spec"`
+	Status   bindingStatus     `json:"status"`
+}
+
+type bindingStatus struct {
+	ObservedGeneration int64           `json:"observedGeneration,omitempty"`
+	NEG                string          `json:"neg,omitempty"`
+	Conditions         []kubeCondition `json:"conditions,omitempty"`
+}
+
+// kubeCondition is a standard Kubernetes status condition.
+type kubeCondition struct {
+	Type               string `json:"type"`
+	Status             string `json:"status"`
+	Reason             string `json:"reason,omitempty"`
+	Message            string `json:"message,omitempty"`
+	LastTransitionTime string `json:"lastTransitionTime,omitempty"`
+}
+
+func (b *serverlessNEGBinding) ref() string {
+	return b.Metadata.Namespace + "/" + b.Metadata.Name
+}
+
+// bindingSource makes ServerlessNEGBinding resources the desired state of the
+// controller instead of the labels of Cloud Run services, and reports the
+// outcome of reconcile passes in their status and as Kubernetes events.
+// Bindings are read from the cache of an informer, which lists and watches
+// them once first needed, until the context the source was created with is
+// done.
+type bindingSource struct {
+	serviceLabels
+	client   *kubeClient
+	logger   *logrus.Logger
+	informer cache.SharedIndexInformer
+	start    sync.Once
+	stop     <-chan struct{}
+
+	mu sync.Mutex
+	// bindings are all bindings and invalid the errors of invalid ones by
+	// reference.
+	bindings []*serverlessNEGBinding
+	invalid  map[string]error
+}
+
+func newBindingSource(ctx context.Context, client *kubeClient, logger *logrus.Logger) *bindingSource {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client.dynamic, 0)
+	return &bindingSource{
+		client:   client,
+		logger:   logger,
+		informer: factory.ForResource(bindingGVR).Informer(),
+		stop:     ctx.Done(),
+	}
+}
+
+// synced starts the informer if needed and waits until its cache is filled.
+func (s *bindingSource) synced(ctx context.Context) error {
+	s.start.Do(func() {
+		go s.informer.Run(s.stop)
+	})
+	if !cache.WaitForCacheSync(ctx.Done(), s.informer.HasSynced) {
+		return errors.New("failed to sync ServerlessNEGBindings")
+	}
+	return nil
+}
+
+// list returns the bindings of all namespaces from the informer's cache.
+// Objects that don't decode are skipped.
+func (s *bindingSource) list(ctx context.Context) ([]*serverlessNEGBinding, error) {
+	if err := s.synced(ctx); err != nil {
+		return nil, err
+	}
+	var bindings []*serverlessNEGBinding
+	for _, obj := range s.informer.GetStore().List() {
+		b, err := toBinding(obj)
+		if err != nil {
+			s.logger.WithError(err).Warn("skipping invalid ServerlessNEGBinding")
+			continue
+		}
+		bindings = append(bindings, b)
+	}
+	return bindings, nil
+}
+
+// toBinding decodes an object of the informer, which may be the final state
+// of a deleted one.
+func toBinding(obj interface{}) (*serverlessNEGBinding, error) {
+	if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = d.Obj
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, errors.Errorf("unexpected object %T", obj)
+	}
+	b := &serverlessNEGBinding{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, b); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode ServerlessNEGBinding %s/%s", u.GetNamespace(), u.GetName())
+	}
+	return b, nil
+}
+
+// refresh lists the bindings. Bindings of the same service conflict and are
+// all treated as invalid.
+func (s *bindingSource) refresh(ctx context.Context) error {
+	bindings, err := s.list(ctx)
+	if err != nil {
+		return err
+	}
+	sort.Slice(bindings, func(i, j int) bool { return bindings[i].ref() < bindings[j].ref() })
+
+	labels := make(map[string]map[string]string)
+	invalid := make(map[string]error)
+	refs := make(map[string][]string)
+	for _, b := range bindings {
+		key := bindingKey(b.Spec.Region, b.Spec.Service)
+		refs[key] = append(refs[key], b.ref())
+		l, err := b.Spec.labels()
+		if err != nil {
+			invalid[b.ref()] = err
+			l = invalidServiceLabels
+		}
+		labels[key] = l
+	}
+	for key, rs := range refs {
+		if len(rs) < 2 {
+			continue
+		}
+		labels[key] = invalidServiceLabels
+		for _, ref := range rs {
+			invalid[ref] = errors.Errorf("service is bound by several bindings: %s", strings.Join(rs, ", "))
+		}
+	}
+
+	s.set(labels)
+	s.mu.Lock()
+	s.bindings, s.invalid = bindings, invalid
+	s.mu.Unlock()
+	return nil
+}
+
+// report updates the Ready condition of the bindings covered by a reconcile
+// pass and records events for applied changes and failures.
+func (s *bindingSource) report(ctx context.Context, r *reconciler, res *reconcileResult, regions []string, service string, err error) {
+	s.mu.Lock()
+	bindings := s.bindings
+	s.mu.Unlock()
+
+	failedRegions := make(map[string]string)
+	for _, st := range res.Regions {
+		if !st.OK {
+			failedRegions[st.Region] = st.Error
+		}
+	}
+	var pe *partialError
+	applied := err == nil || errors.As(err, &pe)
+
+	for _, b := range bindings {
+		if service != "" && b.Spec.Service != service {
+			continue
+		}
+		if b.Spec.Region != "" && contains(r.regions, b.Spec.Region) && !contains(regions, b.Spec.Region) {
+			continue
+		}
+		neg := r.negNames.render(b.Spec.Service, b.Spec.Region, r.project)
+		var ops []string
+		for _, m := range res.Plan.Mutations {
+			if m.Region == b.Spec.Region && path.Base(m.Service) == b.Spec.Service {
+				ops = append(ops, string(m.Op))
+			}
+		}
+
+		st := bindingStatus{ObservedGeneration: b.Metadata.Generation}
+		cond := kubeCondition{Type: "Ready", Status: "False"}
+		s.mu.Lock()
+		ierr, isInvalid := s.invalid[b.ref()]
+		s.mu.Unlock()
+		found := s.seen(b.Spec.Region, b.Spec.Service)
+		_, desired := res.Plan.desired[b.Spec.Region][neg]
+		switch {
+		case isInvalid:
+			cond.Reason, cond.Message = reasonInvalidSpec, ierr.Error()
+		case !contains(r.regions, b.Spec.Region):
+			cond.Reason, cond.Message = reasonUnmanagedRegion, fmt.Sprintf("region %q is not managed by the controller", b.Spec.Region)
+		case failedRegions[b.Spec.Region] != "":
+			cond.Reason, cond.Message = reasonPlanFailed, failedRegions[b.Spec.Region]
+		case !found:
+			cond.Reason, cond.Message = reasonServiceNotFound, fmt.Sprintf("Cloud Run service %q not found in region %q", b.Spec.Service, b.Spec.Region)
+		case !desired:
+			cond.Reason, cond.Message = reasonNotManaged, "the service is excluded, denied, outside of the canary or its NEG name collides; see the controller logs"
+		case !applied:
+			cond.Reason, cond.Message = reasonReconcileFailed, err.Error()
+		case len(ops) != 0 && res.Failed != 0:
+			cond.Reason, cond.Message = reasonApplyFailed, fmt.Sprintf("%d mutations of the pass failed; see the controller logs", res.Failed)
+		default:
+			cond.Status, cond.Reason = "True", reasonReconciled
+			st.NEG = neg
+		}
+		if err := s.updateStatus(ctx, b, st, cond); err != nil {
+			r.log(ctx).WithError(err).WithField("binding", b.ref()).Warn("failed to update binding status")
+		}
+
+		var eventType, reason, message string
+		switch {
+		case cond.Status == "True" && len(ops) != 0:
+			eventType, reason, message = "Normal", reasonReconciled, "applied "+strings.Join(ops, ", ")
+		case cond.Status == "False" && !sameCondition(b.Status.Conditions, cond):
+			eventType, reason, message = "Warning", cond.Reason, cond.Message
+		default:
+			continue
+		}
+		if err := s.recordEvent(ctx, b, eventType, reason, message); err != nil {
+			r.log(ctx).WithError(err).WithField("binding", b.ref()).Warn("failed to record binding event")
+		}
+	}
+}
+
+// sameCondition reports whether conds holds a condition of the same type,
+// status, reason and message as c.
+func sameCondition(conds []kubeCondition, c kubeCondition) bool {
+	for _, o := range conds {
+		if o.Type == c.Type {
+			return o.Status == c.Status && o.Reason == c.Reason && o.Message == c.Message
+		}
+	}
+	return false
+}
+
+// updateStatus writes the status of a binding if it changed.
+func (s *bindingSource) updateStatus(ctx context.Context, b *serverlessNEGBinding, st bindingStatus, cond kubeCondition) error {
+	cond.LastTransitionTime = time.Now().UTC().Format(time.RFC3339)
+	for _, o := range b.Status.Conditions {
+		if o.Type == cond.Type && o.Status == cond.Status {
+			cond.LastTransitionTime = o.LastTransitionTime
+		}
+	}
+	if b.Status.ObservedGeneration == st.ObservedGeneration && b.Status.NEG == st.NEG && sameCondition(b.Status.Conditions, cond) {
+		return nil
+	}
+	st.Conditions = []kubeCondition{cond}
+	patch, err := json.Marshal(map[string]interface{}{"status": st})
+	if err != nil {
+		return err
+	}
+	_, err = s.client.dynamic.Resource(bindingGVR).Namespace(b.Metadata.Namespace).
+		Patch(ctx, b.Metadata.Name, types.MergePatchType, patch, metav1.PatchOptions{FieldManager: controllerName}, "status")
+	return err
+}
+
+// recordEvent creates a core/v1 Event about a binding.
+func (s *bindingSource) recordEvent(ctx context.Context, b *serverlessNEGBinding, eventType, reason, message string) error {
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: b.Metadata.Name + ".", Namespace: b.Metadata.Namespace},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion:      bindingGroup + "/" + bindingVersion,
+			Kind:            bindingKind,
+			Namespace:       b.Metadata.Namespace,
+			Name:            b.Metadata.Name,
+			UID:             b.Metadata.UID,
+			ResourceVersion: b.Metadata.ResourceVersion,
+		},
+		Type:           eventType,
+		Reason:         reason,
+		Message:        message,
+		Source:         corev1.EventSource{Component: controllerName},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	_, err := s.client.core.CoreV1().Events(b.Metadata.Namespace).Create(ctx, event, metav1.CreateOptions{})
+	return err
+}
+
+// watch reconciles the region of every added or deleted binding and of
+// bindings whose spec changed, until ctx is done. The whole region is
+// reconciled, as a changed binding may have released another service.
+// Updates of the status alone, like the controller's own, are ignored.
+func (s *bindingSource) watch(ctx context.Context, changed func(regions []string)) {
+	notify := func(obj interface{}) {
+		b, err := toBinding(obj)
+		if err != nil {
+			s.logger.WithError(err).Warn("skipping invalid ServerlessNEGBinding")
+			return
+		}
+		s.logger.WithFields(logrus.Fields{"binding": b.ref(), "region": b.Spec.Region}).Debug("binding changed")
+		changed([]string{b.Spec.Region})
+	}
+	reg, err := s.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: notify,
+		UpdateFunc: func(old, obj interface{}) {
+			o, n := old.(*unstructured.Unstructured), obj.(*unstructured.Unstructured)
+			if o.GetGeneration() == n.GetGeneration() {
+				return
+			}
+			notify(old)
+			notify(obj)
+		},
+		DeleteFunc: notify,
+	})
+	if err != nil {
+		s.logger.WithError(err).Error("failed to watch ServerlessNEGBindings")
+		return
+	}
+	defer s.informer.RemoveEventHandler(reg)
+	if err := s.synced(ctx); err != nil && ctx.Err() == nil {
+		s.logger.WithError(err).Error("failed to watch ServerlessNEGBindings")
+	}
+	<-ctx.Done()
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// regionBreakers are per-region circuit breakers: a region whose planning
+// failed threshold times in a row, e.g. because its Cloud Run or Compute
+// Engine API is unavailable, is skipped for a cooldown instead of spending
+// the time of every pass on retries. The first pass after the cooldown
+// probes the region again; a success closes the circuit, a failure reopens
+// it. A nil *regionBreakers never opens.
+type regionBreakers struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu      sync.Mutex
+	regions map[string]*regionBreaker
+}
+
+// regionBreaker is the state of a region that failed recently.
+type regionBreaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+func newRegionBreakers(threshold int, cooldown time.Duration) *regionBreakers {
+	if threshold <= 0 {
+		return nil
+	}
+	return &regionBreakers{threshold: threshold, cooldown: cooldown, regions: make(map[string]*regionBreaker)}
+}
+
+// allow reports whether the region may be planned and, if not, until when
+// its circuit is open.
+func (b *regionBreakers) allow(region string, now time.Time) (bool, time.Time) {
+	if b == nil {
+		return true, time.Time{}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rb, ok := b.regions[region]
+	if !ok || !now.Before(rb.openUntil) {
+		return true, time.Time{}
+	}
+	return false, rb.openUntil
+}
+
+// record updates the breaker of a region after planning it, and reports
+// whether its circuit opened or closed.
+func (b *regionBreakers) record(region string, err error, now time.Time) (opened, closed bool) {
+	if b == nil {
+		return false, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rb, ok := b.regions[region]
+	if err == nil {
+		delete(b.regions, region)
+		return false, ok && rb.failures >= b.threshold
+	}
+	if !ok {
+		rb = &regionBreaker{}
+		b.regions[region] = rb
+	}
+	rb.failures++
+	if rb.failures < b.threshold {
+		return false, false
+	}
+	rb.openUntil = now.Add(b.cooldown)
+	return true, false
+}
+
+// open returns the regions whose circuit is open or awaiting a probe,
+// sorted.
+func (b *regionBreakers) open() []string {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []string
+	for region, rb := range b.regions {
+		if rb.failures >= b.threshold {
+			out = append(out, region)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,239 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/discovery"
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/planner"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/compute/v1"
+)
+
+// computeCache keeps the compute state listed by the last full resync, so
+// that frequent syncs only need to list Cloud Run services, and so that the
+// services sharing a backend service read it once per pass rather than once
+// each. Entries expire after the TTL, if any; the entries of the scopes the
+// controller mutates are dropped after every apply, and all of them on every
+// full resync.
+type computeCache struct {
+	// ttl is how long listed state is reused, or 0 to keep it until it is
+	// invalidated.
+	ttl time.Duration
+
+	mu             sync.Mutex
+	globalBackends map[backendServiceRef]*compute.BackendService
+	globalListed   time.Time
+	regions        map[string]*regionComputeState
+}
+
+// regionComputeState is the compute state of one region.
+type regionComputeState struct {
+	negs map[string]*compute.NetworkEndpointGroup
+	// otherNEGs holds the regional NEGs that are not serverless, e.g. PSC
+	// NEGs.
+	otherNEGs map[string]*compute.NetworkEndpointGroup
+	backends  map[backendServiceRef]*compute.BackendService
+	listed    time.Time
+}
+
+// fresh reports whether state listed at the given time can still be used.
+// Must be called with mu held.
+func (c *computeCache) fresh(listed time.Time) bool {
+	return c.ttl <= 0 || time.Since(listed) < c.ttl
+}
+
+// invalidate drops all cached state.
+func (c *computeCache) invalidate() {
+	c.mu.Lock()
+	c.globalBackends = nil
+	c.regions = nil
+	c.mu.Unlock()
+}
+
+// invalidateRegions drops the cached state of the given regions and the
+// global backend services, which they may be attached to.
+func (c *computeCache) invalidateRegions(regions []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.globalBackends = nil
+	for _, region := range regions {
+		delete(c.regions, region)
+	}
+}
+
+// invalidateMutations drops the cached state of the scopes changed by the
+// given mutations: the global backend services if any of them was patched,
+// and the regions whose NEGs or regional backend services were changed.
+// Ingress mutations change Cloud Run services only and keep the cache.
+func (c *computeCache) invalidateMutations(ms []mutation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, m := range ms {
+		switch {
+		case m.Op == opHardenIngress || m.Op == opRestoreIngress:
+		case m.BackendService == "":
+			delete(c.regions, m.Region)
+		case m.BackendRegion == "":
+			c.globalBackends = nil
+		default:
+			delete(c.regions, m.BackendRegion)
+		}
+	}
+}
+
+// backendService returns the cached state of a backend service of the
+// project, or nil if it is not cached or has expired. Patches based on it may
+// use a stale fingerprint; they are retried on the state read from the API.
+func (c *computeCache) backendService(ref backendServiceRef) *compute.BackendService {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ref.Region == "" {
+		if c.globalBackends == nil || !c.fresh(c.globalListed) {
+			return nil
+		}
+		return c.globalBackends[ref]
+	}
+	st := c.regions[ref.Region]
+	if st == nil || !c.fresh(st.listed) {
+		return nil
+	}
+	return st.backends[ref]
+}
+
+// neg returns the cached state of a regional NEG of the project, or nil if it
+// is not cached or has expired.
+func (c *computeCache) neg(region, name string) *compute.NetworkEndpointGroup {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := c.regions[region]
+	if st == nil || !c.fresh(st.listed) {
+		return nil
+	}
+	if neg, ok := st.negs[name]; ok {
+		return neg
+	}
+	return st.otherNEGs[name]
+}
+
+// globalBackendServices returns the global backend services, listing them if
+// they are not cached or have expired.
+func (r *reconciler) globalBackendServices(ctx context.Context) (map[backendServiceRef]*compute.BackendService, error) {
+	r.cache.mu.Lock()
+	cached := r.cache.globalBackends
+	if cached != nil && !r.cache.fresh(r.cache.globalListed) {
+		cached = nil
+	}
+	r.cache.mu.Unlock()
+	if cached != nil {
+		return cached, nil
+	}
+
+	bss, err := discovery.ListBackendServices(ctx, r.computeService, r.project, "")
+	if err != nil {
+		return nil, err
+	}
+	r.cache.mu.Lock()
+	r.cache.globalBackends, r.cache.globalListed = bss, time.Now()
+	r.cache.mu.Unlock()
+	return bss, nil
+}
+
+// regionComputeState returns the serverless NEGs and regional backend
+// services of a region, listing them if they are not cached or have expired.
+// The returned maps must not be modified.
+func (r *reconciler) regionComputeState(ctx context.Context, region string) (*regionComputeState, error) {
+	r.cache.mu.Lock()
+	cached := r.cache.regions[region]
+	if cached != nil && !r.cache.fresh(cached.listed) {
+		cached = nil
+	}
+	r.cache.mu.Unlock()
+	if cached != nil {
+		return cached, nil
+	}
+
+	negs, otherNEGs, err := discovery.ListRegionNEGs(ctx, r.computeService, r.project, region)
+	if err != nil {
+		return nil, err
+	}
+	backends, err := discovery.ListBackendServices(ctx, r.computeService, r.project, region)
+	if err != nil {
+		return nil, err
+	}
+	st := &regionComputeState{negs: negs, otherNEGs: otherNEGs, backends: backends, listed: time.Now()}
+	r.cache.mu.Lock()
+	if r.cache.regions == nil {
+		r.cache.regions = make(map[string]*regionComputeState)
+	}
+	r.cache.regions[region] = st
+	r.cache.mu.Unlock()
+	return st, nil
+}
+
+// warmCache lists the compute state of the given regions, bounded by the
+// region concurrency, so that the first pass of serve mode plans against the
+// existing NEGs and backends rather than an empty cache that is filled while
+// events are already being processed.
+func (r *reconciler) warmCache(ctx context.Context, regions []string) error {
+	globalBackends, err := r.globalBackendServices(ctx)
+	if err != nil {
+		return err
+	}
+	limit := r.regionConcurrency
+	if limit <= 0 || limit > len(regions) {
+		limit = len(regions)
+	}
+	sem := make(chan struct{}, limit)
+	errs := make([]error, len(regions))
+	owned := make([]int, len(regions))
+	attached := make([]int, len(regions))
+	var wg sync.WaitGroup
+	for i, region := range regions {
+		wg.Add(1)
+		go func(i int, region string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			st, err := r.regionComputeState(ctx, region)
+			if err != nil {
+				errs[i] = errors.Wrapf(err, "failed to list compute state of region %s", region)
+				return
+			}
+			backends := mergeBackends(st.backends, globalBackends)
+			owners := planner.NEGOwners(r.project, region, st.negs, backends)
+			owned[i] = len(owners)
+			for _, bs := range backends {
+				for name := range owners {
+					if discovery.FindBackend(bs, r.project, region, name) != nil {
+						attached[i]++
+					}
+				}
+			}
+		}(i, region)
+	}
+	wg.Wait()
+	for i, region := range regions {
+		if errs[i] != nil {
+			return errs[i]
+		}
+		r.logger.WithFields(logrus.Fields{"region": region, "negs": owned[i], "backends": attached[i]}).Info("loaded existing compute state")
+	}
+	return nil
+}
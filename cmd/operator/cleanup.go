@@ -0,0 +1,125 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/discovery"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// runCleanup implements the cleanup command: it detaches and deletes every
+// NEG owned by the controller in the managed regions and restores the ingress
+// of hardened services, for decommissioning the controller. Backend services
+// themselves are never created by the controller and are left in place,
+// without the controller's backends.
+func runCleanup(ctx context.Context, logger *logrus.Logger, args []string) error {
+	fs := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only print the mutations cleanup would make")
+	yes := fs.Bool("yes", false, "don't ask for confirmation")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	r, err := newReconciler(ctx, logger)
+	if err != nil {
+		return err
+	}
+	p, err := r.cleanupPlan(ctx)
+	if err != nil {
+		return err
+	}
+	if p.empty() {
+		fmt.Println("nothing to clean up")
+		return nil
+	}
+	printPlan(os.Stdout, p)
+	if *dryRun {
+		return nil
+	}
+	if !*yes {
+		ok, err := confirm(os.Stdin, os.Stdout, fmt.Sprintf("apply %d mutations in project %s?", len(p.Mutations), r.project))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("aborted")
+		}
+	}
+	if failed, _ := r.apply(ctx, p); failed != 0 {
+		return errors.Errorf("%d of %d mutations failed", failed, len(p.Mutations))
+	}
+	return nil
+}
+
+// cleanupPlan plans the removal of all controller-owned NEGs and ingress
+// restrictions, by planning each region as if no services were selected. The
+// deletion budget does not apply.
+func (r *reconciler) cleanupPlan(ctx context.Context) (*plan, error) {
+	globalBackends, err := r.globalBackendServices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p := &plan{}
+	for _, region := range r.regions {
+		st, err := r.regionComputeState(ctx, region)
+		if err != nil {
+			return nil, err
+		}
+		svcs, err := discovery.Services(ctx, r.logger, r.runService, r.project, region)
+		if err != nil {
+			return nil, err
+		}
+		backends := mergeBackends(st.backends, globalBackends)
+		p.merge(r.computePlan(ctx, region, nil, nil, st.negs, backends))
+		p.merge(r.planPSC(ctx, region, nil, st.otherNEGs, backends))
+		p.merge(r.planIngress(region, svcs, nil, nil, backends, nil))
+	}
+	return p, nil
+}
+
+// printPlan writes the mutations of a plan for review.
+func printPlan(w io.Writer, p *plan) {
+	for _, m := range p.Mutations {
+		fmt.Fprintf(w, "%-14s %s/%s", m.Op, m.Region, m.NEG)
+		if m.BackendService != "" {
+			fmt.Fprintf(w, " backend service %s", m.BackendServiceRef())
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// confirm asks a yes/no question and reports whether it was answered with
+// yes.
+func confirm(in io.Reader, out io.Writer, question string) (bool, error) {
+	fmt.Fprintf(out, "%s [y/N] ", question)
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, errors.Wrap(err, "failed to read answer")
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
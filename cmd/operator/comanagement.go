@@ -0,0 +1,89 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"regexp"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/discovery"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/compute/v1"
+)
+
+// defaultCoManagementMarkers match the descriptions of backend services that
+// are managed by Terraform or Config Connector, unless the configuration file
+// sets other markers. Backend services have no labels, so the description is
+// the only place such tools, or their users, leave a marker.
+var defaultCoManagementMarkers = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)terraform`),
+	regexp.MustCompile(`(?i)managed-by-cnrm|config connector`),
+}
+
+// coManagementMarker returns the marker matching the description of a
+// backend service managed by another tool, or "" if there is none.
+func (c *config) coManagementMarker(bs *compute.BackendService) string {
+	markers := c.coManagementMarkers
+	if markers == nil {
+		markers = defaultCoManagementMarkers
+	}
+	for _, re := range markers {
+		if re.MatchString(bs.Description) {
+			return re.String()
+		}
+	}
+	return ""
+}
+
+// holdBackCoManaged drops the mutations of backend services managed by
+// another tool, which would revert the controller's changes or have them
+// reverted, unless -allow-co-management is set. NEGs that stay attached to
+// such backend services are not deleted either.
+func (r *reconciler) holdBackCoManaged(ctx context.Context, p *plan, backends map[backendServiceRef]*compute.BackendService) {
+	if r.allowCoManagement {
+		return
+	}
+	conflicts := make(map[backendServiceRef]string)
+	attached := make(map[string]bool) // region/NEG
+	for _, m := range p.Mutations {
+		if m.BackendService == "" {
+			continue
+		}
+		bs, ok := backends[m.BackendServiceRef()]
+		if !ok {
+			continue
+		}
+		if marker := r.cfg.coManagementMarker(bs); marker != "" {
+			conflicts[m.BackendServiceRef()] = marker
+			if m.Op == opDetachBackend {
+				attached[m.Region+"/"+m.NEG] = true
+			}
+		}
+	}
+	if len(conflicts) == 0 {
+		return
+	}
+	p.filter(func(m mutation) bool {
+		if m.BackendService != "" {
+			_, conflict := conflicts[m.BackendServiceRef()]
+			return !conflict
+		}
+		return m.Op != opDeleteNEG || !attached[m.Region+"/"+m.NEG]
+	})
+	for _, ref := range discovery.SortedBackendRefs(conflicts) {
+		r.log(ctx).WithFields(logrus.Fields{"backendService": ref.String(), "marker": conflicts[ref]}).
+			Warn("conflict: backend service appears to be managed by another tool, not modifying it without -allow-co-management")
+	}
+}
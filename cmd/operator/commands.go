@@ -0,0 +1,165 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Exit codes of the run command.
+const (
+	exitPartialFailure = 2
+	exitFatal          = 3
+)
+
+// exitError is an error that makes the process exit with a specific code.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+
+func (e *exitError) Unwrap() error { return e.err }
+
+// runCommand runs one of the commands given as positional argument. Without a
+// command, the controller runs a single reconcile pass.
+func runCommand(ctx context.Context, logger *logrus.Logger, name string, args []string) error {
+	switch name {
+	case "run":
+		return runOnce(ctx, logger, args)
+	case "serve":
+		return runServe(ctx, logger, args)
+	case "validate":
+		return runValidate(ctx, logger, args)
+	case "migrate":
+		return runMigrate(ctx, logger, args)
+	case "export":
+		return runExport(ctx, logger, args)
+	case "cleanup":
+		return runCleanup(ctx, logger, args)
+	case "report":
+		return runReport(ctx, logger, args)
+	case "onboard":
+		return runOnboard(ctx, logger, args)
+	case "simulate":
+		return runSimulate(ctx, logger, args)
+	default:
+		return errors.Errorf("unknown command %q", name)
+	}
+}
+
+// runOnce implements the run command: a single reconcile pass suitable for
+// Cloud Run jobs. It exits with 0 if the pass was clean, 2 if some regions or
+// mutations failed and 3 if the pass could not run at all. In jobs with
+// several tasks, each task reconciles its shard of the regions.
+func runOnce(ctx context.Context, logger *logrus.Logger, args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	r, err := newReconciler(ctx, logger)
+	if err != nil {
+		return &exitError{code: exitFatal, err: err}
+	}
+	if err := r.operations.resume(ctx, r.computeService); err != nil {
+		return &exitError{code: exitFatal, err: err}
+	}
+	index, count, err := cloudRunTask()
+	if err != nil {
+		return &exitError{code: exitFatal, err: err}
+	}
+	start := time.Now()
+	var res *reconcileResult
+	if count > 1 {
+		r.regions = taskShard(r.regions, index, count)
+		logger.WithFields(logrus.Fields{"task": index, "taskCount": count, "regions": r.regions}).Info("reconciling shard of regions")
+	}
+	if len(r.regions) != 0 {
+		res, err = r.reconcile(ctx, r.regions, "")
+	}
+	if flCloudMonitoring && res != nil {
+		if merr := exportMetricsOnce(ctx, r); merr != nil {
+			logger.WithError(merr).Warn("failed to export metrics")
+		}
+	}
+	if flSummary != "" {
+		if serr := writeSummary(ctx, flSummary, r.cfg, newRunSummary(start, r.project, r.regions, res, err)); serr != nil {
+			// Pipelines rely on the summary to judge the run.
+			logger.WithError(serr).Error("failed to write run summary")
+			if err == nil {
+				err = serr
+			}
+		}
+	}
+	if err != nil {
+		var pe *partialError
+		if errors.As(err, &pe) {
+			return &exitError{code: exitPartialFailure, err: err}
+		}
+		return &exitError{code: exitFatal, err: err}
+	}
+	return nil
+}
+
+// cloudRunTask returns the index of the task and the number of tasks of the
+// Cloud Run job execution, or 0 and 1 outside of jobs.
+func cloudRunTask() (index, count int, err error) {
+	index, count = 0, 1
+	if v := os.Getenv("CLOUD_RUN_TASK_COUNT"); v != "" {
+		if count, err = strconv.Atoi(v); err != nil || count < 1 {
+			return 0, 0, errors.Errorf("invalid CLOUD_RUN_TASK_COUNT %q", v)
+		}
+	}
+	if v := os.Getenv("CLOUD_RUN_TASK_INDEX"); v != "" {
+		if index, err = strconv.Atoi(v); err != nil || index < 0 || index >= count {
+			return 0, 0, errors.Errorf("invalid CLOUD_RUN_TASK_INDEX %q", v)
+		}
+	}
+	return index, count, nil
+}
+
+// taskShard returns the regions reconciled by the task with the given index:
+// every count-th of the sorted regions, so that all tasks of an execution
+// agree on the shards regardless of the order of -regions.
+func taskShard(regions []string, index, count int) []string {
+	sorted := append([]string(nil), regions...)
+	sort.Strings(sorted)
+	var shard []string
+	for i, region := range sorted {
+		if i%count == index {
+			shard = append(shard, region)
+		}
+	}
+	return shard
+}
+
+// exportMetricsOnce writes the metrics of a single run to Cloud Monitoring.
+func exportMetricsOnce(ctx context.Context, r *reconciler) error {
+	e, err := newMonitoringExporter(ctx, r.project, r.cfg)
+	if err != nil {
+		return err
+	}
+	return e.export(ctx, r.metrics.snapshot())
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/discovery"
+	"github.com/pkg/errors"
+	"google.golang.org/api/compute/v1"
+)
+
+// listServerlessNEGs returns the serverless network endpoint groups in the
+// given region, keyed by name.
+func listServerlessNEGs(ctx context.Context, computeService *compute.Service, project, region string) (map[string]*compute.NetworkEndpointGroup, error) {
+	negs, _, err := discovery.ListRegionNEGs(ctx, computeService, project, region)
+	return negs, err
+}
+
+// listProxyProtocols returns, for each backend service of backendProject
+// referenced by a URL map of project in the given scope, the protocols
+// ("HTTP" or "HTTPS") of the target proxies using that URL map. The projects
+// differ for load balancers using cross-project service referencing.
+func listProxyProtocols(ctx context.Context, computeService *compute.Service, project, region, backendProject string) (map[backendServiceRef][]string, error) {
+	scope := backendServiceRef{Region: region}.Scope()
+	urlMaps := make(map[string]*compute.UrlMap)
+	addURLMaps := func(l *compute.UrlMapList) error {
+		for _, um := range l.Items {
+			urlMaps[um.SelfLink] = um
+		}
+		return nil
+	}
+	protocols := make(map[backendServiceRef][]string)
+	addProxy := func(urlMap, protocol string) {
+		um, ok := urlMaps[urlMap]
+		if !ok {
+			return
+		}
+		for _, svc := range urlMapServices(um) {
+			if p, ref, ok := discovery.ParseBackendServiceURL(svc); ok && p == backendProject && !contains(protocols[ref], protocol) {
+				protocols[ref] = append(protocols[ref], protocol)
+			}
+		}
+	}
+	addHTTP := func(l *compute.TargetHttpProxyList) error {
+		for _, p := range l.Items {
+			addProxy(p.UrlMap, "HTTP")
+		}
+		return nil
+	}
+	addHTTPS := func(l *compute.TargetHttpsProxyList) error {
+		for _, p := range l.Items {
+			addProxy(p.UrlMap, "HTTPS")
+		}
+		return nil
+	}
+
+	var err error
+	if region == "" {
+		err = computeService.UrlMaps.List(project).Pages(ctx, addURLMaps)
+	} else {
+		err = computeService.RegionUrlMaps.List(project, region).Pages(ctx, addURLMaps)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list URL maps in %q", scope)
+	}
+	if region == "" {
+		err = computeService.TargetHttpProxies.List(project).Pages(ctx, addHTTP)
+	} else {
+		err = computeService.RegionTargetHttpProxies.List(project, region).Pages(ctx, addHTTP)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list target HTTP proxies in %q", scope)
+	}
+	if region == "" {
+		err = computeService.TargetHttpsProxies.List(project).Pages(ctx, addHTTPS)
+	} else {
+		err = computeService.RegionTargetHttpsProxies.List(project, region).Pages(ctx, addHTTPS)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list target HTTPS proxies in %q", scope)
+	}
+	return protocols, nil
+}
+
+// urlMapServices returns the backend services a URL map routes to directly.
+func urlMapServices(um *compute.UrlMap) []string {
+	var svcs []string
+	add := func(s string) {
+		if s != "" {
+			svcs = append(svcs, s)
+		}
+	}
+	add(um.DefaultService)
+	for _, pm := range um.PathMatchers {
+		add(pm.DefaultService)
+		for _, pr := range pm.PathRules {
+			add(pr.Service)
+		}
+		for _, rr := range pm.RouteRules {
+			add(rr.Service)
+		}
+	}
+	return svcs
+}
+
+// backendServiceRef identifies a backend service of the managed project.
+type backendServiceRef = discovery.BackendServiceRef
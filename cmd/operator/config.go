@@ -0,0 +1,288 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/run/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// config is the optional configuration file of the controller, given with
+// -config. Settings that are awkward to express as flags live here.
+type config struct {
+	// Denylist holds Cloud Run service names or shell patterns (e.g.
+	// "tf-*") that the controller never touches, even if they match the
+	// label selector.
+	Denylist []string `yaml:"denylist"`
+	// Projects holds the budgets of the projects the controller writes to,
+	// keyed by project ID, so that one busy project can't use up the
+	// controller's throughput or quota.
+	Projects map[string]projectBudget `yaml:"projects"`
+	// Credentials holds the credentials of the projects the controller's
+	// own service account has no access to, keyed by project ID.
+	Credentials map[string]projectCredentials `yaml:"credentials"`
+	// TenantLabel is the service label naming the team a service belongs
+	// to. If set, services may only be attached to the backend services of
+	// their tenant.
+	TenantLabel string `yaml:"tenantLabel"`
+	// Tenants holds the teams, keyed by the value of TenantLabel.
+	Tenants map[string]tenant `yaml:"tenants"`
+	// PSCNEGs holds Private Service Connect NEGs the controller manages
+	// besides the serverless NEGs of Cloud Run services.
+	PSCNEGs []pscNEG `yaml:"pscNEGs"`
+	// MutationWindows holds the times in which NEGs may be detached and
+	// deleted and drift may be corrected. Outside of them these changes are
+	// deferred; if empty, they are made at any time.
+	MutationWindows []mutationWindow `yaml:"mutationWindows"`
+	// Rollout orders the rollout of detachments and deletions across
+	// regions.
+	Rollout rolloutConfig `yaml:"rollout"`
+	// CoManagementMarkers holds regular expressions matching the
+	// descriptions of backend services managed by other tools, e.g.
+	// Terraform. Defaults to defaultCoManagementMarkers if unset.
+	CoManagementMarkers []string `yaml:"coManagementMarkers"`
+	// Flags sets flags not given on the command line or by environment
+	// variables, keyed by flag name without the dash.
+	Flags map[string]string `yaml:"flags"`
+
+	coManagementMarkers []*regexp.Regexp
+	// pacers pace the writes to the projects with a write QPS budget. They
+	// are shared by the clients of all projects, as every client may write
+	// to any project.
+	pacers map[string]*pacer
+}
+
+// pscNEG is a Private Service Connect NEG pointing at a published service
+// attachment, and the backend services to attach it to.
+type pscNEG struct {
+	Name   string `yaml:"name"`
+	Region string `yaml:"region"`
+	// ServiceAttachment is the target service, e.g.
+	// projects/P/regions/R/serviceAttachments/S.
+	ServiceAttachment string `yaml:"serviceAttachment"`
+	// Network and Subnetwork are required for NEGs used by regional
+	// internal load balancers.
+	Network    string       `yaml:"network"`
+	Subnetwork string       `yaml:"subnetwork"`
+	Backends   []pscBackend `yaml:"backends"`
+}
+
+// pscBackend is a backend service a PSC NEG is attached to.
+type pscBackend struct {
+	Name string `yaml:"name"`
+	// Scope is "global" (default) or "regional".
+	Scope string `yaml:"scope"`
+}
+
+// tenant restricts the load balancer wiring of one team.
+type tenant struct {
+	// BackendServicePrefixes holds the name prefixes of the backend
+	// services the team's services may be attached to.
+	BackendServicePrefixes []string `yaml:"backendServicePrefixes"`
+	// Projects holds the projects the team's services may be managed in.
+	// All projects are allowed if empty.
+	Projects []string `yaml:"projects"`
+}
+
+// projectBudget limits the writes to one project.
+type projectBudget struct {
+	// MaxConcurrentMutations bounds the number of mutations applied in
+	// parallel. The default of 1 applies them one by one.
+	MaxConcurrentMutations int `yaml:"maxConcurrentMutations"`
+	// WriteQPS bounds the rate of write requests to Google APIs. Zero, the
+	// default, means no limit.
+	WriteQPS float64 `yaml:"writeQPS"`
+}
+
+// projectCredentials are the credentials the controller accesses a project
+// with instead of its own.
+type projectCredentials struct {
+	// CredentialsFile is a service account key file, and
+	// ImpersonateServiceAccount the email of a service account the
+	// controller impersonates. Exactly one must be set.
+	CredentialsFile           string `yaml:"credentialsFile"`
+	ImpersonateServiceAccount string `yaml:"impersonateServiceAccount"`
+}
+
+// budget returns the budget of a project.
+func (c *config) budget(project string) projectBudget {
+	return c.Projects[project]
+}
+
+func (b projectBudget) concurrency() int {
+	if b.MaxConcurrentMutations < 1 {
+		return 1
+	}
+	return b.MaxConcurrentMutations
+}
+
+func loadConfig(file string) (*config, error) {
+	cfg := &config{}
+	if file == "" {
+		return cfg, nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read config file %q", file)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && err != io.EOF {
+		return nil, errors.Wrapf(err, "failed to parse config file %q", file)
+	}
+	cfg.pacers = make(map[string]*pacer)
+	for project, b := range cfg.Projects {
+		if b.MaxConcurrentMutations < 0 || b.WriteQPS < 0 {
+			return nil, errors.Errorf("invalid budget of project %q: limits must not be negative", project)
+		}
+		if b.WriteQPS > 0 {
+			cfg.pacers[project] = &pacer{interval: time.Duration(float64(time.Second) / b.WriteQPS)}
+		}
+	}
+	for project, c := range cfg.Credentials {
+		if (c.CredentialsFile == "") == (c.ImpersonateServiceAccount == "") {
+			return nil, errors.Errorf("credentials of project %q: exactly one of credentialsFile and impersonateServiceAccount must be set", project)
+		}
+	}
+	if _, ok := cfg.Flags["config"]; ok {
+		return nil, errors.New("flags: config can't be set in the configuration file")
+	}
+	if cfg.TenantLabel == "" && len(cfg.Tenants) != 0 {
+		return nil, errors.New("tenants require tenantLabel")
+	}
+	for name, t := range cfg.Tenants {
+		if len(t.BackendServicePrefixes) == 0 {
+			return nil, errors.Errorf("tenant %q must allow at least one backend service prefix", name)
+		}
+	}
+	seen := make(map[string]bool)
+	for i, n := range cfg.PSCNEGs {
+		if n.Name == "" || n.Region == "" || n.ServiceAttachment == "" {
+			return nil, errors.Errorf("pscNEGs[%d]: name, region and serviceAttachment are required", i)
+		}
+		if seen[n.Region+"/"+n.Name] {
+			return nil, errors.Errorf("pscNEGs[%d]: NEG %q in region %q declared twice", i, n.Name, n.Region)
+		}
+		seen[n.Region+"/"+n.Name] = true
+		for j, b := range n.Backends {
+			if _, err := b.ref(n.Region); err != nil {
+				return nil, errors.Wrapf(err, "pscNEGs[%d].backends[%d]", i, j)
+			}
+		}
+	}
+	for i := range cfg.MutationWindows {
+		if err := cfg.MutationWindows[i].compile(); err != nil {
+			return nil, errors.Wrapf(err, "mutationWindows[%d]", i)
+		}
+	}
+	if err := cfg.Rollout.validate(); err != nil {
+		return nil, errors.Wrap(err, "rollout")
+	}
+	if cfg.CoManagementMarkers != nil {
+		cfg.coManagementMarkers = make([]*regexp.Regexp, 0, len(cfg.CoManagementMarkers))
+	}
+	for _, m := range cfg.CoManagementMarkers {
+		re, err := regexp.Compile(m)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid co-management marker %q", m)
+		}
+		cfg.coManagementMarkers = append(cfg.coManagementMarkers, re)
+	}
+	for _, p := range cfg.Denylist {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid denylist pattern %q", p)
+		}
+	}
+	return cfg, nil
+}
+
+// pscNEGsIn returns the PSC NEGs of the region, keyed by name.
+func (c *config) pscNEGsIn(region string) map[string]pscNEG {
+	negs := make(map[string]pscNEG)
+	for _, n := range c.PSCNEGs {
+		if n.Region == region {
+			negs[n.Name] = n
+		}
+	}
+	return negs
+}
+
+// ref returns the backend service of b for a NEG in the region.
+func (b pscBackend) ref(region string) (backendServiceRef, error) {
+	if b.Name == "" {
+		return backendServiceRef{}, errors.New("backend service name is required")
+	}
+	switch b.Scope {
+	case "", "global":
+		return backendServiceRef{Name: b.Name}, nil
+	case "regional":
+		return backendServiceRef{Region: region, Name: b.Name}, nil
+	}
+	return backendServiceRef{}, errors.Errorf("invalid scope %q, expected global or regional", b.Scope)
+}
+
+// checkTenant returns an error if the service's tenant may not attach it to
+// the given backend services in the project. Without tenants, everything is
+// allowed.
+func (c *config) checkTenant(svc *run.GoogleCloudRunV2Service, project string, backends []desiredBackend) error {
+	if c.TenantLabel == "" {
+		return nil
+	}
+	name, ok := svc.Labels[c.TenantLabel]
+	if !ok {
+		return errors.Errorf("tenancy violation: missing tenant label %q", c.TenantLabel)
+	}
+	t, ok := c.Tenants[name]
+	if !ok {
+		return errors.Errorf("tenancy violation: unknown tenant %q", name)
+	}
+	if len(t.Projects) != 0 && !contains(t.Projects, project) {
+		return errors.Errorf("tenancy violation: tenant %q may not use project %q", name, project)
+	}
+	for _, db := range backends {
+		if !hasAnyPrefix(db.Ref.Name, t.BackendServicePrefixes) {
+			return errors.Errorf("tenancy violation: tenant %q may not use backend service %s", name, db.Ref)
+		}
+	}
+	return nil
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// denied reports whether the service name matches an entry of the denylist.
+func (c *config) denied(name string) bool {
+	for _, p := range c.Denylist {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/discovery"
+	"github.com/pkg/errors"
+	"google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/compute/v1"
+)
+
+// Serverless NEGs must live in the project of their Cloud Run service, and
+// backend services in the project of their NEGs. Load balancers of a central
+// project reach them through cross-project service referencing: URL maps of
+// the central project, given with -frontend-projects, route to backend
+// services of the managed project.
+
+// restrictCrossProjectServices is the organization policy constraint limiting
+// the backend services that URL maps of other projects may reference.
+const restrictCrossProjectServices = "constraints/compute.restrictCrossProjectServices"
+
+// listAllProxyProtocols returns the protocols of the target proxies of the
+// managed project and the frontend projects serving each backend service of
+// the managed project in the given scope.
+func (r *reconciler) listAllProxyProtocols(ctx context.Context, region string) (map[backendServiceRef][]string, error) {
+	protocols, err := listProxyProtocols(ctx, r.computeService, r.project, region, r.project)
+	if err != nil {
+		return nil, err
+	}
+	for _, fp := range r.frontendProjects {
+		pp, err := listProxyProtocols(ctx, r.frontendCompute[fp], fp, region, r.project)
+		if err != nil {
+			return nil, errors.Wrapf(err, "frontend project %q", fp)
+		}
+		for ref, ps := range pp {
+			for _, p := range ps {
+				if !contains(protocols[ref], p) {
+					protocols[ref] = append(protocols[ref], p)
+				}
+			}
+		}
+	}
+	return protocols, nil
+}
+
+// validateCrossProject checks the prerequisites of cross-project service
+// referencing for the given backend services of the managed project that
+// URL maps of the frontend projects route to: the controller must be able to
+// list those URL maps, the backend services must not use the classic
+// EXTERNAL scheme, and the organization policy must allow the reference.
+func (r *reconciler) validateCrossProject(ctx context.Context, used map[backendServiceRef]*compute.BackendService) ([]diagnostic, error) {
+	var diags []diagnostic
+	add := func(sev severity, subject, format string, args ...interface{}) {
+		diags = append(diags, diagnostic{Severity: sev, Subject: subject, Message: fmt.Sprintf(format, args...)})
+	}
+
+	// referrers holds the URL maps of frontend projects by the backend
+	// service they route to.
+	referrers := make(map[backendServiceRef][]string)
+	for _, fp := range r.frontendProjects {
+		subject := "project " + fp
+		for _, region := range append([]string{""}, r.regions...) {
+			var err error
+			collect := func(l *compute.UrlMapList) error {
+				for _, um := range l.Items {
+					for _, svc := range urlMapServices(um) {
+						if p, ref, ok := discovery.ParseBackendServiceURL(svc); ok && p == r.project {
+							referrers[ref] = append(referrers[ref], fp+"/"+um.Name)
+						}
+					}
+				}
+				return nil
+			}
+			if region == "" {
+				err = r.frontendCompute[fp].UrlMaps.List(fp).Pages(ctx, collect)
+			} else {
+				err = r.frontendCompute[fp].RegionUrlMaps.List(fp, region).Pages(ctx, collect)
+			}
+			if errorKindOf(err) == kindPermissionDenied {
+				add(severityError, subject, "the controller can't list its URL maps; grant it roles/compute.viewer on the project")
+				break
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to list URL maps of frontend project %q", fp)
+			}
+		}
+	}
+
+	var referenced []backendServiceRef
+	for _, ref := range discovery.SortedBackendRefs(used) {
+		if len(referrers[ref]) == 0 {
+			continue
+		}
+		referenced = append(referenced, ref)
+		if bs := used[ref]; bs.LoadBalancingScheme == "EXTERNAL" {
+			add(severityError, "backend service "+ref.String(), "is referenced by URL maps %s of other projects, but classic load balancers (scheme EXTERNAL) don't support cross-project service referencing; use EXTERNAL_MANAGED",
+				strings.Join(referrers[ref], ", "))
+		}
+	}
+	if len(referenced) == 0 {
+		return diags, nil
+	}
+
+	opts, err := projectClientOptions(ctx, r.cfg, r.project)
+	if err != nil {
+		return nil, err
+	}
+	crm, err := cloudresourcemanager.NewService(ctx, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialize Resource Manager client")
+	}
+	subject := "project " + r.project
+	policy, err := crm.Projects.GetEffectiveOrgPolicy("projects/"+r.project, &cloudresourcemanager.GetEffectiveOrgPolicyRequest{
+		Constraint: restrictCrossProjectServices,
+	}).Context(ctx).Do()
+	if errorKindOf(err) == kindPermissionDenied {
+		add(severityWarning, subject, "can't check the %s organization policy; grant the controller roles/orgpolicy.policyViewer", restrictCrossProjectServices)
+		return diags, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get the %s organization policy", restrictCrossProjectServices)
+	}
+	lp := policy.ListPolicy
+	if lp == nil {
+		return diags, nil
+	}
+	for _, ref := range referenced {
+		value := fmt.Sprintf("projects/%s/%s", r.project, ref.Path())
+		switch {
+		case lp.AllValues == "DENY" || contains(lp.DeniedValues, value):
+			add(severityError, "backend service "+ref.String(), "the %s organization policy denies references from other projects", restrictCrossProjectServices)
+		case len(lp.AllowedValues) != 0 && !contains(lp.AllowedValues, value):
+			add(severityWarning, "backend service "+ref.String(), "is not explicitly allowed by the %s organization policy", restrictCrossProjectServices)
+		}
+	}
+	return diags, nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"embed"
+	"html/template"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed dashboard
+var dashboardAssets embed.FS
+
+var dashboardTemplate = template.Must(template.ParseFS(dashboardAssets, "dashboard/index.html"))
+
+// handleDashboard renders the read-only status page.
+func (s *server) handleDashboard(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/" {
+		http.NotFound(w, req)
+		return
+	}
+	s.statusMu.RLock()
+	data := struct {
+		Project        string
+		Regions        []string
+		Status         syncStatus
+		NEGs           []managedNEG
+		InventoryError string
+		Degraded       []serviceHealth
+	}{
+		Project:        s.r.project,
+		Regions:        s.r.regions,
+		Status:         s.status,
+		NEGs:           s.inventory,
+		InventoryError: s.inventoryError,
+		Degraded:       s.r.failures.degraded(),
+	}
+	s.statusMu.RUnlock()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, data); err != nil {
+		s.logger.WithError(err).Error("failed to render dashboard")
+	}
+}
+
+func dashboardStaticHandler() http.Handler {
+	static, _ := fs.Sub(dashboardAssets, "dashboard")
+	return http.StripPrefix("/static/", http.FileServer(http.FS(static)))
+}
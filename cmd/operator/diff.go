@@ -0,0 +1,141 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/planner"
+	"github.com/pkg/errors"
+)
+
+// changeDiff describes the change a mutation makes to one field of a resource,
+// in the style of a JSON patch operation.
+type changeDiff struct {
+	// Op is add, remove or replace.
+	Op string `json:"op"`
+	// Resource is the path of the changed resource, relative to the Compute
+	// Engine or Cloud Run API.
+	Resource string `json:"resource"`
+	// Field is the changed field of the resource; empty if the whole
+	// resource is created or deleted.
+	Field    string      `json:"field,omitempty"`
+	Old      interface{} `json:"old,omitempty"`
+	New      interface{} `json:"new,omitempty"`
+	Mutation mutationOp  `json:"mutation"`
+	Service  string      `json:"service,omitempty"`
+	Drift    bool        `json:"drift,omitempty"`
+}
+
+// planDiff is the change set of one reconcile pass.
+type planDiff struct {
+	Time    time.Time    `json:"time"`
+	Project string       `json:"project"`
+	Regions []string     `json:"regions"`
+	DryRun  bool         `json:"dryRun"`
+	Changes []changeDiff `json:"changes"`
+}
+
+// diffs returns the changes made by the mutations of the plan.
+func (p *plan) diffs() []changeDiff {
+	out := make([]changeDiff, 0, len(p.Mutations))
+	for _, m := range p.Mutations {
+		d := changeDiff{Mutation: m.Op, Service: m.Service, Drift: m.Drift}
+		negPath := fmt.Sprintf("projects/%s/regions/%s/networkEndpointGroups/%s", m.Project, m.Region, m.NEG)
+		bsPath := fmt.Sprintf("projects/%s/%s", m.Project, backendServiceRef{Region: m.BackendRegion, Name: m.BackendService}.Path())
+		// Backends are identified by their group rather than their index,
+		// which is not stable.
+		backendField := fmt.Sprintf("backends[group=%s]", negPath)
+		switch m.Op {
+		case opCreateNEG:
+			d.Op, d.Resource, d.New = "add", negPath, m.Service
+			if m.PSCTarget != "" {
+				d.New = m.PSCTarget
+			}
+		case opDeleteNEG:
+			d.Op, d.Resource, d.Old = "remove", negPath, m.Service
+		case opAttachBackend:
+			d.Op, d.Resource, d.Field, d.New = "add", bsPath, backendField+".capacityScaler", *m.CapacityScaler
+		case opAdoptBackend:
+			d.Op, d.Resource, d.Field, d.New = "replace", bsPath, backendField+".description", planner.NewOwnership(m.Service).WithLabels(m.Labels).String()
+		case opLabelBackend:
+			d.Op, d.Resource, d.Field, d.New = "replace", bsPath, backendField+".description.labels", m.Labels
+		case opUpdateBackend:
+			d.Op, d.Resource, d.Field, d.New = "replace", bsPath, backendField+".capacityScaler", *m.CapacityScaler
+		case opDetachBackend:
+			d.Op, d.Resource, d.Field = "remove", bsPath, backendField
+		case opSetProtocol:
+			d.Op, d.Resource, d.Field, d.New = "replace", bsPath, "protocol", m.Protocol
+		case opSetDraining:
+			d.Op, d.Resource, d.Field, d.New = "replace", bsPath, "connectionDraining.drainingTimeoutSec", *m.DrainingTimeout
+		case opSetLocalityPolicy:
+			d.Op, d.Resource, d.Field, d.New = "replace", bsPath, "localityLbPolicy", m.LocalityPolicy
+		case opSetOutlierDetection:
+			d.Op, d.Resource, d.Field, d.New = "replace", bsPath, "outlierDetection.consecutiveErrors", *m.OutlierErrors
+		case opSetIAP:
+			d.Op, d.Resource, d.Field, d.New = "replace", bsPath, "iap.enabled", *m.IAP
+		case opHardenIngress, opRestoreIngress:
+			d.Op, d.Resource, d.Field, d.New = "replace", m.Service, "ingress", m.Ingress
+		}
+		if d.Old == nil {
+			d.Old = m.Previous
+		}
+		out = append(out, d)
+	}
+	return out
+}
+
+// diffWriter writes the change set of every reconcile pass to a file, or to
+// stdout as JSON lines if the location is "-".
+type diffWriter struct {
+	mu       sync.Mutex
+	location string
+}
+
+func (w *diffWriter) write(d planDiff) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.location == "-" {
+		return errors.Wrap(json.NewEncoder(os.Stdout).Encode(d), "failed to write diff")
+	}
+	b, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode diff")
+	}
+	return errors.Wrapf(writeFileAtomic(w.location, append(b, '\n')), "failed to write diff to %s", w.location)
+}
+
+// writeFileAtomic replaces a file atomically, so that tooling never reads a
+// partial file.
+func writeFileAtomic(name string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Drift modes, selecting what happens to out-of-band changes.
+const (
+	driftCorrect = "correct"
+	driftReport  = "report"
+)
+
+func parseDriftMode(mode string) (string, error) {
+	switch mode {
+	case driftCorrect, driftReport:
+		return mode, nil
+	}
+	return "", errors.Errorf("unknown drift mode %q", mode)
+}
+
+// convergedState remembers the desired NEGs of each region as of the last
+// reconcile pass that applied cleanly. Mutations restoring NEGs whose
+// desired state hasn't changed since are caused by out-of-band changes.
+type convergedState struct {
+	mu      sync.Mutex
+	regions map[string]map[string]desiredNEG
+}
+
+// drifted reports whether the NEG had the same desired state when the region
+// last converged.
+func (c *convergedState) drifted(region, name string, d desiredNEG) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prev, ok := c.regions[region][name]
+	return ok && reflect.DeepEqual(prev, d)
+}
+
+// update records the desired NEGs of the given regions as converged.
+func (c *convergedState) update(desired map[string]map[string]desiredNEG) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.regions == nil {
+		c.regions = make(map[string]map[string]desiredNEG)
+	}
+	for region, negs := range desired {
+		c.regions[region] = negs
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/apply"
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+)
+
+// errorKind classifies errors for retry decisions, metrics and status
+// reporting, separating misconfiguration, which needs a user to act, from
+// platform failures, which resolve on their own.
+type errorKind string
+
+const (
+	// kindPermissionDenied: the controller's service account lacks a role.
+	kindPermissionDenied errorKind = "PermissionDenied"
+	// kindQuotaExceeded: a quota or rate limit was exhausted.
+	kindQuotaExceeded errorKind = "QuotaExceeded"
+	// kindConflict: a resource changed concurrently or is being changed.
+	kindConflict errorKind = "Conflict"
+	// kindNotFound: a resource does not exist (anymore).
+	kindNotFound errorKind = "NotFound"
+	// kindInvalidAnnotation: the labels or annotations of a service can't
+	// be applied.
+	kindInvalidAnnotation errorKind = "InvalidAnnotation"
+	// kindUnavailable: an API failed or timed out.
+	kindUnavailable errorKind = "Unavailable"
+	// kindUnknown: anything else. Unclassified errors are not retried, as
+	// nothing suggests that they go away.
+	kindUnknown errorKind = "Unknown"
+)
+
+// errorKinds lists all error kinds, in the order they are reported.
+var errorKinds = []errorKind{kindPermissionDenied, kindQuotaExceeded, kindConflict, kindNotFound, kindInvalidAnnotation, kindUnavailable, kindUnknown}
+
+// misconfiguration reports whether errors of the kind persist until a user
+// changes a service or the controller's permissions.
+func (k errorKind) misconfiguration() bool {
+	return k == kindPermissionDenied || k == kindInvalidAnnotation
+}
+
+// retryable reports whether an operation failing with errors of the kind may
+// succeed when it's retried unchanged.
+func (k errorKind) retryable() bool {
+	switch k {
+	case kindQuotaExceeded, kindConflict, kindNotFound, kindUnavailable:
+		return true
+	}
+	return false
+}
+
+// kindError is an error classified explicitly.
+type kindError struct {
+	kind errorKind
+	err  error
+}
+
+func (e *kindError) Error() string { return e.err.Error() }
+func (e *kindError) Unwrap() error { return e.err }
+
+// withKind classifies err as kind. It returns nil if err is nil.
+func withKind(kind errorKind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &kindError{kind: kind, err: err}
+}
+
+// errorKindOf classifies err by the kind it was given with withKind or,
+// failing that, by the Google API, operation or transport error it wraps.
+func errorKindOf(err error) errorKind {
+	var ke *kindError
+	if errors.As(err, &ke) {
+		return ke.kind
+	}
+	var oerr *apply.OperationError
+	if errors.As(err, &oerr) {
+		return operationErrorKind(oerr.Codes())
+	}
+	if errors.Is(err, apply.ErrStale) {
+		return kindConflict
+	}
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		for _, e := range gerr.Errors {
+			switch e.Reason {
+			case "quotaExceeded", "rateLimitExceeded", "userRateLimitExceeded", "RATE_LIMIT_EXCEEDED":
+				return kindQuotaExceeded
+			}
+		}
+		switch {
+		case gerr.Code == http.StatusUnauthorized || gerr.Code == http.StatusForbidden:
+			return kindPermissionDenied
+		case gerr.Code == http.StatusTooManyRequests:
+			return kindQuotaExceeded
+		case gerr.Code == http.StatusConflict || gerr.Code == http.StatusPreconditionFailed:
+			return kindConflict
+		case gerr.Code == http.StatusNotFound:
+			return kindNotFound
+		case gerr.Code >= 500:
+			return kindUnavailable
+		}
+		return kindUnknown
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return kindUnavailable
+	}
+	// Requests that failed in transport, e.g. on a reset connection, never
+	// reached the API.
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		return kindUnavailable
+	}
+	return kindUnknown
+}
+
+// operationErrorKind classifies the error codes of a failed compute
+// operation by the first code it recognizes.
+func operationErrorKind(codes []string) errorKind {
+	for _, code := range codes {
+		switch {
+		case strings.Contains(code, "QUOTA") || strings.Contains(code, "RATE_EXCEEDED"):
+			return kindQuotaExceeded
+		case strings.Contains(code, "PERMISSION") || strings.Contains(code, "FORBIDDEN"):
+			return kindPermissionDenied
+		case strings.Contains(code, "NOT_FOUND"):
+			return kindNotFound
+		case strings.Contains(code, "IN_USE") || strings.Contains(code, "ALREADY_EXISTS") || strings.Contains(code, "NOT_READY") || strings.Contains(code, "FINGERPRINT"):
+			return kindConflict
+		case strings.Contains(code, "INTERNAL") || strings.Contains(code, "UNAVAILABLE") || strings.Contains(code, "TIMEOUT"):
+			return kindUnavailable
+		}
+	}
+	return kindUnknown
+}
+
+// rpcStatusKind classifies the google.rpc.Code of a failed long-running
+// operation of the Cloud Run API.
+func rpcStatusKind(code int64) errorKind {
+	switch code {
+	case 4, 13, 14: // DEADLINE_EXCEEDED, INTERNAL, UNAVAILABLE
+		return kindUnavailable
+	case 5: // NOT_FOUND
+		return kindNotFound
+	case 6, 9, 10: // ALREADY_EXISTS, FAILED_PRECONDITION, ABORTED
+		return kindConflict
+	case 7, 16: // PERMISSION_DENIED, UNAUTHENTICATED
+		return kindPermissionDenied
+	case 8: // RESOURCE_EXHAUSTED
+		return kindQuotaExceeded
+	}
+	return kindUnknown
+}
+
+// commonErrorKind returns the kind shared by all errs, or kindUnknown if
+// their kinds differ.
+func commonErrorKind(errs []error) errorKind {
+	kind := kindUnknown
+	for i, err := range errs {
+		k := errorKindOf(err)
+		if i > 0 && k != kind {
+			return kindUnknown
+		}
+		kind = k
+	}
+	return kind
+}
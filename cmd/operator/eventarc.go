@@ -0,0 +1,223 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/eventarc/v1"
+)
+
+// cloudEventAuditLogWritten is the type of CloudEvents Eventarc delivers for
+// Cloud Audit Logs entries.
+const cloudEventAuditLogWritten = "google.cloud.audit.log.v1.written"
+
+// handleEventarc consumes Cloud Run service create, update and delete events
+// that Eventarc delivers as binary-mode CloudEvents, and reconciles the
+// affected service through the work queue.
+func (s *server) handleEventarc(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	lg := s.logger.WithContext(req.Context()).WithFields(logrus.Fields{
+		"eventID":    req.Header.Get("Ce-Id"),
+		"eventType":  req.Header.Get("Ce-Type"),
+		"methodName": req.Header.Get("Ce-Methodname"),
+	})
+	if req.Header.Get("Ce-Type") != cloudEventAuditLogWritten || !isServiceLifecycleMethod(req.Header.Get("Ce-Methodname")) {
+		lg.Debug("ignoring event")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var entry struct {
+		Resource struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"resource"`
+	}
+	// The body is only needed for the location of v1 API events, and the
+	// project ID of events naming the project by number.
+	json.NewDecoder(req.Body).Decode(&entry)
+	project, region, service, ok := parseRunResourceName(req.Header.Get("Ce-Resourcename"))
+	if region == "" {
+		region = entry.Resource.Labels["location"]
+	}
+	if !ok || region == "" {
+		lg.WithField("resourceName", req.Header.Get("Ce-Resourcename")).Warn("ignoring event for unknown resource")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if project != s.r.project && entry.Resource.Labels["project_id"] != s.r.project {
+		lg.WithField("resourceName", req.Header.Get("Ce-Resourcename")).Debug("ignoring event of other project")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	kind := changeUpdated
+	switch method := req.Header.Get("Ce-Methodname"); method[strings.LastIndex(method, ".")+1:] {
+	case "CreateService":
+		kind = changeCreated
+	case "DeleteService":
+		kind = changeDeleted
+	}
+	s.enqueueChangedService(w, lg, region, service, kind)
+}
+
+// enqueueChangedService queues a service after a change notification. The
+// queue retries failed passes, so the notification is always acknowledged.
+// Changes of denylisted services, and of recently deleted services that
+// were not recreated, are ignored.
+func (s *server) enqueueChangedService(w http.ResponseWriter, lg *logrus.Entry, region, service string, kind changeKind) {
+	lg = lg.WithFields(logrus.Fields{"region": region, "service": service})
+	item := workItem{region: region, service: service}
+	switch {
+	case !s.manages(region):
+		lg.Debug("ignoring change in unmanaged or unowned region")
+	case s.r.cfg.denied(service):
+		lg.Debug("ignoring change of denylisted service")
+	case !s.deleted.observe(item, kind, time.Now()):
+		lg.Debug("ignoring change of recently deleted service")
+	default:
+		lg.Info("queueing changed service")
+		s.queue.addDebounced(item)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// isServiceLifecycleMethod reports whether an audit-logged method creates,
+// updates, replaces or deletes a Cloud Run service, in the v1 or v2 API.
+func isServiceLifecycleMethod(method string) bool {
+	if !strings.HasPrefix(method, "google.cloud.run.") {
+		return false
+	}
+	switch method[strings.LastIndex(method, ".")+1:] {
+	case "CreateService", "UpdateService", "ReplaceService", "DeleteService":
+		return true
+	}
+	return false
+}
+
+// parseRunResourceName extracts project, region and service name from a v2
+// (projects/P/locations/R/services/S) or v1 (namespaces/P/services/S) Cloud
+// Run service resource name. The region is empty for v1.
+func parseRunResourceName(name string) (project, region, service string, ok bool) {
+	parts := strings.Split(name, "/")
+	switch {
+	case len(parts) == 6 && parts[0] == "projects" && parts[2] == "locations" && parts[4] == "services":
+		return parts[1], parts[3], parts[5], true
+	case len(parts) == 4 && parts[0] == "namespaces" && parts[2] == "services":
+		return parts[1], "", parts[3], true
+	}
+	return "", "", "", false
+}
+
+// eventarcMethods are the audit-logged methods Eventarc triggers are
+// registered for: every create, update and delete of a Cloud Run service, in
+// the v1 API used by gcloud and the v2 API.
+var eventarcMethods = []string{
+	"google.cloud.run.v1.Services.CreateService",
+	"google.cloud.run.v1.Services.ReplaceService",
+	"google.cloud.run.v1.Services.DeleteService",
+	"google.cloud.run.v2.Services.CreateService",
+	"google.cloud.run.v2.Services.UpdateService",
+	"google.cloud.run.v2.Services.DeleteService",
+}
+
+// eventarcTriggerID returns the ID of the trigger of a method, e.g.
+// autoneg-v2-updateservice.
+func eventarcTriggerID(method string) string {
+	parts := strings.Split(method, ".")
+	return "autoneg-" + parts[3] + "-" + strings.ToLower(parts[len(parts)-1])
+}
+
+// registerEventarcTriggers creates the global Eventarc triggers delivering
+// the Cloud Run service lifecycle events of the project to /eventarc of the
+// controller's Cloud Run service, given as REGION/SERVICE, with the service
+// account the triggers invoke it as. Existing triggers are left alone.
+func (r *reconciler) registerEventarcTriggers(ctx context.Context, destination, serviceAccount string) error {
+	region, service, ok := strings.Cut(destination, "/")
+	if !ok || region == "" || service == "" {
+		return errors.Errorf("invalid Eventarc destination %q, expected REGION/SERVICE", destination)
+	}
+	opts, err := clientOptions(ctx, r.cfg)
+	if err != nil {
+		return err
+	}
+	eventarcService, err := eventarc.NewService(ctx, opts...)
+	if err != nil {
+		return errors.Wrap(err, "failed to initialize Eventarc client")
+	}
+	parent := "projects/" + r.project + "/locations/global"
+	for _, method := range eventarcMethods {
+		id := eventarcTriggerID(method)
+		lg := r.logger.WithFields(logrus.Fields{"trigger": id, "methodName": method})
+		_, err := eventarcService.Projects.Locations.Triggers.Get(parent + "/triggers/" + id).Context(ctx).Do()
+		if err == nil {
+			lg.Debug("Eventarc trigger already exists")
+			continue
+		}
+		if errorKindOf(err) != kindNotFound {
+			return errors.Wrapf(err, "failed to get Eventarc trigger %s", id)
+		}
+		trigger := &eventarc.Trigger{
+			EventFilters: []*eventarc.EventFilter{
+				{Attribute: "type", Value: cloudEventAuditLogWritten},
+				{Attribute: "serviceName", Value: "run.googleapis.com"},
+				{Attribute: "methodName", Value: method},
+			},
+			Destination:    &eventarc.Destination{CloudRun: &eventarc.CloudRun{Service: service, Region: region, Path: "/eventarc"}},
+			ServiceAccount: serviceAccount,
+			Labels:         map[string]string{"managed-by": controllerName},
+		}
+		if err := waitEventarcOperation(ctx, eventarcService, func() (*eventarc.GoogleLongrunningOperation, error) {
+			return eventarcService.Projects.Locations.Triggers.Create(parent, trigger).TriggerId(id).Context(ctx).Do()
+		}); err != nil {
+			return errors.Wrapf(err, "failed to create Eventarc trigger %s", id)
+		}
+		lg.Info("created Eventarc trigger")
+	}
+	return nil
+}
+
+// waitEventarcOperation starts an Eventarc operation and waits for it to
+// complete, at most for -operation-wait-timeout.
+func waitEventarcOperation(ctx context.Context, eventarcService *eventarc.Service, start func() (*eventarc.GoogleLongrunningOperation, error)) error {
+	ctx, cancel := context.WithTimeout(ctx, flOperationWaitTimeout)
+	defer cancel()
+	op, err := start()
+	for err == nil && !op.Done {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(runOperationPollInterval):
+		}
+		op, err = eventarcService.Projects.Locations.Operations.Get(op.Name).Context(ctx).Do()
+	}
+	if err != nil {
+		return err
+	}
+	if op.Error != nil {
+		return errors.New(op.Error.Message)
+	}
+	return nil
+}
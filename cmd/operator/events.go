@@ -0,0 +1,152 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type eventType string
+
+// Reconcile lifecycle events.
+const (
+	eventStarted eventType = "started"
+	eventPlanned eventType = "planned"
+	eventApplied eventType = "applied"
+	eventFailed  eventType = "failed"
+	// eventDrift reports mutations undoing out-of-band changes.
+	eventDrift eventType = "drift"
+	// eventCircuitOpened and eventCircuitClosed report regions that are
+	// skipped after repeated failures, and that recovered.
+	eventCircuitOpened eventType = "circuitOpened"
+	eventCircuitClosed eventType = "circuitClosed"
+)
+
+// reconcileEvent reports progress of a reconcile pass to subscribers.
+type reconcileEvent struct {
+	Type      eventType  `json:"type"`
+	Time      time.Time  `json:"time"`
+	Regions   []string   `json:"regions,omitempty"`
+	Service   string     `json:"service,omitempty"`
+	Mutations []mutation `json:"mutations,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	ErrorKind errorKind  `json:"errorKind,omitempty"`
+}
+
+// eventSubscriberBuffer is the number of events buffered per subscriber.
+// Events are dropped for subscribers that fall further behind.
+const eventSubscriberBuffer = 64
+
+// eventBus fans out reconcile events to subscribers. A nil *eventBus
+// discards events.
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[chan reconcileEvent]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[chan reconcileEvent]struct{})}
+}
+
+// subscribe returns a channel receiving all future events and a function to
+// cancel the subscription.
+func (b *eventBus) subscribe() (<-chan reconcileEvent, func()) {
+	ch := make(chan reconcileEvent, eventSubscriberBuffer)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch, func() {
+		b.mu.Lock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+		b.mu.Unlock()
+	}
+}
+
+func (b *eventBus) publish(e reconcileEvent) {
+	if b == nil {
+		return
+	}
+	e.Time = time.Now().UTC()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// eventStreamKeepalive is the interval of the comments sent on idle event
+// streams, so that proxies don't close them.
+const eventStreamKeepalive = 15 * time.Second
+
+// handleEvents streams reconcile events as Server-Sent Events, each with the
+// event type as its name and the JSON-encoded event as its data, until the
+// client disconnects. Events are dropped for clients that can't keep up.
+func (s *server) handleEvents(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	events, cancel := s.events.subscribe()
+	defer cancel()
+
+	lg := s.logger.WithContext(req.Context()).WithField("admin", req.Context().Value(adminEmailKey{}))
+	lg.Info("event stream opened through admin API")
+	defer lg.Info("event stream closed")
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventStreamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case e := <-events:
+			b, err := json.Marshal(e)
+			if err != nil {
+				lg.WithError(err).WithField("type", e.Type).Error("failed to encode event")
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, b); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/discovery"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// runExport implements the export command, in the terraform or the state
+// format.
+func runExport(ctx context.Context, logger *logrus.Logger, args []string) error {
+	if len(args) != 0 && args[0] == "state" {
+		return runExportState(ctx, logger, args[1:])
+	}
+	if len(args) == 0 || args[0] != "terraform" {
+		return errors.New("usage: export terraform|state [flags]")
+	}
+	fs := flag.NewFlagSet("export terraform", flag.ExitOnError)
+	outDir := fs.String("out-dir", ".", "directory to write autoneg.tf and the import file to")
+	imports := fs.String("imports", "commands", "how to emit imports: commands (import.sh) or blocks (imports.tf, terraform >= 1.5)")
+	if err := parseFlags(fs, args[1:]); err != nil {
+		return err
+	}
+	if *imports != "commands" && *imports != "blocks" {
+		return errors.Errorf("export: unknown imports format %q", *imports)
+	}
+
+	r, err := newReconciler(ctx, logger)
+	if err != nil {
+		return err
+	}
+	negs, err := r.listManagedNEGs(ctx, r.regions)
+	if err != nil {
+		return err
+	}
+
+	hcl, importFile, importContent := renderTerraform(r.project, negs, *imports)
+	if err := os.WriteFile(filepath.Join(*outDir, "autoneg.tf"), hcl, 0o644); err != nil {
+		return errors.Wrap(err, "failed to write terraform configuration")
+	}
+	if err := os.WriteFile(filepath.Join(*outDir, importFile), importContent, 0o644); err != nil {
+		return errors.Wrap(err, "failed to write terraform imports")
+	}
+	logger.WithField("negs", len(negs)).Infof("wrote terraform configuration to %s", *outDir)
+	return nil
+}
+
+// renderTerraform renders the HCL for the managed NEGs and the backends they
+// are attached to, and the imports of these resources in the given format.
+// Terraform models backends as blocks of the backend service, so backend
+// services are emitted with their managed backends only and have to be merged
+// into existing definitions.
+func renderTerraform(project string, negs []managedNEG, imports string) (hcl []byte, importFile string, importContent []byte) {
+	var tf, imp bytes.Buffer
+	addImport := func(addr, id string) {
+		if imports == "blocks" {
+			fmt.Fprintf(&imp, "import {\n  to = %s\n  id = %q\n}\n\n", addr, id)
+		} else {
+			fmt.Fprintf(&imp, "terraform import %s %s\n", addr, id)
+		}
+	}
+
+	attached := make(map[backendServiceRef][]string)
+	for _, m := range negs {
+		res := "google_compute_region_network_endpoint_group." + terraformName(m.NEG.Name+"-"+m.Region)
+		fmt.Fprintf(&tf, "resource \"google_compute_region_network_endpoint_group\" %q {\n", terraformName(m.NEG.Name+"-"+m.Region))
+		fmt.Fprintf(&tf, "  name                  = %q\n", m.NEG.Name)
+		fmt.Fprintf(&tf, "  project               = %q\n", project)
+		fmt.Fprintf(&tf, "  region                = %q\n", m.Region)
+		fmt.Fprintf(&tf, "  network_endpoint_type = \"SERVERLESS\"\n")
+		if m.NEG.Description != "" {
+			fmt.Fprintf(&tf, "  description           = %q\n", m.NEG.Description)
+		}
+		if cr := m.NEG.CloudRun; cr != nil {
+			fmt.Fprintf(&tf, "\n  cloud_run {\n    service = %q\n", cr.Service)
+			if cr.Tag != "" {
+				fmt.Fprintf(&tf, "    tag     = %q\n", cr.Tag)
+			}
+			fmt.Fprintf(&tf, "  }\n")
+		}
+		fmt.Fprintf(&tf, "}\n\n")
+		addImport(res, fmt.Sprintf("projects/%s/regions/%s/networkEndpointGroups/%s", project, m.Region, m.NEG.Name))
+		for _, ref := range m.Backends {
+			attached[ref] = append(attached[ref], res)
+		}
+	}
+
+	for _, ref := range discovery.SortedBackendRefs(attached) {
+		typ, id := "google_compute_backend_service", fmt.Sprintf("projects/%s/global/backendServices/%s", project, ref.Name)
+		if ref.Region != "" {
+			typ, id = "google_compute_region_backend_service", fmt.Sprintf("projects/%s/regions/%s/backendServices/%s", project, ref.Region, ref.Name)
+		}
+		name := terraformName(ref.Name + "-" + ref.Scope())
+		fmt.Fprintf(&tf, "# Backends managed by %s on %s; merge them into the\n# existing definition of the backend service.\n", controllerName, ref)
+		fmt.Fprintf(&tf, "resource %q %q {\n", typ, name)
+		fmt.Fprintf(&tf, "  name    = %q\n", ref.Name)
+		fmt.Fprintf(&tf, "  project = %q\n", project)
+		if ref.Region != "" {
+			fmt.Fprintf(&tf, "  region  = %q\n", ref.Region)
+		}
+		for _, res := range attached[ref] {
+			fmt.Fprintf(&tf, "\n  backend {\n    group = %s.id\n  }\n", res)
+		}
+		fmt.Fprintf(&tf, "}\n\n")
+		addImport(typ+"."+name, id)
+	}
+
+	if imports == "blocks" {
+		return tf.Bytes(), "imports.tf", imp.Bytes()
+	}
+	return tf.Bytes(), "import.sh", append([]byte("#!/bin/sh\nset -e\n"), imp.Bytes()...)
+}
+
+// terraformName turns a resource name into a terraform resource identifier.
+func terraformName(s string) string {
+	return invalidNameChars.ReplaceAllString(s, "_")
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Backoff of failing services, doubled with every consecutive failed pass.
+const (
+	serviceInitialBackoff = time.Minute
+	serviceMaxBackoff     = time.Hour
+)
+
+// serviceHealth describes a service whose mutations failed in its last
+// attempted pass.
+type serviceHealth struct {
+	Service             string    `json:"service"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	FailingSince        time.Time `json:"failingSince"`
+	LastError           string    `json:"lastError"`
+	LastErrorKind       errorKind `json:"lastErrorKind"`
+	NextAttempt         time.Time `json:"nextAttempt"`
+}
+
+// serviceFailures tracks consecutive failed passes per service, by resource
+// name, and backs failing services off individually.
+type serviceFailures struct {
+	mu        sync.Mutex
+	byService map[string]*serviceHealth
+}
+
+func newServiceFailures() *serviceFailures {
+	return &serviceFailures{byService: make(map[string]*serviceHealth)}
+}
+
+// record updates the failure count of a service after a pass that attempted
+// its mutations, and reports whether it became degraded or recovered.
+func (f *serviceFailures) record(service string, err error, now time.Time) (degraded, recovered bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, failing := f.byService[service]
+	if err == nil {
+		delete(f.byService, service)
+		return false, failing
+	}
+	if !failing {
+		h = &serviceHealth{Service: service, FailingSince: now}
+		f.byService[service] = h
+	}
+	h.ConsecutiveFailures++
+	h.LastError, h.LastErrorKind = err.Error(), errorKindOf(err)
+	backoff := serviceInitialBackoff << (h.ConsecutiveFailures - 1)
+	if backoff > serviceMaxBackoff || backoff <= 0 {
+		backoff = serviceMaxBackoff
+	}
+	h.NextAttempt = now.Add(backoff)
+	return !failing, false
+}
+
+// failing reports whether a service failed in its last attempted pass.
+func (f *serviceFailures) failing(service string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.byService[service]
+	return ok
+}
+
+// backedOff reports whether a failing service must not be attempted yet.
+func (f *serviceFailures) backedOff(service string, now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h, ok := f.byService[service]
+	return ok && now.Before(h.NextAttempt)
+}
+
+// degraded returns the failing services, sorted by name.
+func (f *serviceFailures) degraded() []serviceHealth {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]serviceHealth, 0, len(f.byService))
+	for _, h := range f.byService {
+		out = append(out, *h)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Service < out[j].Service })
+	return out
+}
+
+// holdBackFailing drops the mutations of services in backoff from the plan.
+func (r *reconciler) holdBackFailing(ctx context.Context, p *plan, now time.Time) {
+	held := make(map[string]bool)
+	p.filter(func(m mutation) bool {
+		if m.Service == "" || !r.failures.backedOff(m.Service, now) {
+			return true
+		}
+		held[m.Service] = true
+		return false
+	})
+	for _, svc := range sortedKeys(held) {
+		r.log(ctx).WithField("service", svc).Info("service is failing, holding back its mutations until its backoff expires")
+	}
+}
+
+// recordFailures updates the failure tracking with the outcome of the
+// applied plan and maintains the status annotation of services that became
+// degraded or recovered.
+func (r *reconciler) recordFailures(ctx context.Context, p *plan, serviceErrors map[string]error) {
+	now := time.Now()
+	attempted := make(map[string]bool)
+	for _, m := range p.Mutations {
+		if m.Service != "" {
+			attempted[m.Service] = true
+		}
+	}
+	for _, region := range sortedKeys(p.desired) {
+		for _, d := range p.desired[region] {
+			if !r.failures.backedOff(d.Service, now) {
+				attempted[d.Service] = true
+			}
+		}
+	}
+	for _, svc := range sortedKeys(attempted) {
+		degraded, recovered := r.failures.record(svc, serviceErrors[svc], now)
+		if !degraded && !recovered {
+			continue
+		}
+		lg := r.log(ctx).WithField("service", svc)
+		if degraded {
+			lg.WithError(serviceErrors[svc]).Warn("service degraded")
+		} else {
+			lg.Info("service recovered")
+		}
+		status := ""
+		if degraded {
+			status = statusDegraded
+		}
+		if err := r.annotateStatus(ctx, svc, status, ""); err != nil {
+			lg.WithError(err).Warn("failed to update status annotation")
+		}
+	}
+}
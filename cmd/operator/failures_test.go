@@ -0,0 +1,91 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func TestServiceFailures(t *testing.T) {
+	f := newServiceFailures()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	errQuota := withKind(kindQuotaExceeded, errors.New("quota exceeded"))
+
+	if degraded, recovered := f.record("a", nil, now); degraded || recovered {
+		t.Errorf("record of a healthy service = %v, %v, want neither degraded nor recovered", degraded, recovered)
+	}
+	for i, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute} {
+		degraded, recovered := f.record("a", errQuota, now)
+		if degraded != (i == 0) || recovered {
+			t.Errorf("failure %d: degraded, recovered = %v, %v, want %v, false", i+1, degraded, recovered, i == 0)
+		}
+		if !f.backedOff("a", now.Add(want-time.Second)) || f.backedOff("a", now.Add(want)) {
+			t.Errorf("failure %d: want backoff of %s", i+1, want)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		f.record("a", errQuota, now)
+	}
+	if f.backedOff("a", now.Add(serviceMaxBackoff)) {
+		t.Errorf("backoff exceeds %s", serviceMaxBackoff)
+	}
+
+	f.record("b", errors.New("boom"), now)
+	hs := f.degraded()
+	if len(hs) != 2 || hs[0].Service != "a" || hs[1].Service != "b" {
+		t.Fatalf("degraded = %+v, want a and b", hs)
+	}
+	if hs[0].ConsecutiveFailures != 23 || hs[0].LastErrorKind != kindQuotaExceeded || !hs[0].FailingSince.Equal(now) {
+		t.Errorf("health of a = %+v", hs[0])
+	}
+	if hs[1].LastErrorKind != kindUnknown {
+		t.Errorf("error kind of b = %s, want %s", hs[1].LastErrorKind, kindUnknown)
+	}
+
+	if degraded, recovered := f.record("a", nil, now); degraded || !recovered {
+		t.Errorf("record of a recovered service = %v, %v, want recovered", degraded, recovered)
+	}
+	if f.failing("a") || f.backedOff("a", now) || !f.failing("b") {
+		t.Error("a still failing after recovering, or b no longer failing")
+	}
+}
+
+func TestHoldBackFailing(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	r := &reconciler{logger: logger, failures: newServiceFailures()}
+	now := time.Now()
+	r.failures.record("failing", errors.New("boom"), now)
+	p := &plan{Mutations: []mutation{
+		{Op: opCreateNEG, NEG: "healthy-neg", Service: "healthy"},
+		{Op: opCreateNEG, NEG: "failing-neg", Service: "failing"},
+		{Op: opCreateNEG, NEG: "psc-neg"},
+	}}
+	r.holdBackFailing(context.Background(), p, now)
+	if len(p.Mutations) != 2 || p.Mutations[0].Service != "healthy" || p.Mutations[1].NEG != "psc-neg" {
+		t.Errorf("mutations = %+v, want those of healthy and the PSC NEG", p.Mutations)
+	}
+	p.Mutations = append(p.Mutations, mutation{Op: opCreateNEG, NEG: "failing-neg", Service: "failing"})
+	r.holdBackFailing(context.Background(), p, now.Add(serviceInitialBackoff))
+	if len(p.Mutations) != 3 {
+		t.Errorf("mutations of failing service held back after its backoff: %+v", p.Mutations)
+	}
+}
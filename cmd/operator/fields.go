@@ -0,0 +1,78 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/run/v2"
+)
+
+// Field selectors select services by attributes of the Cloud Run service
+// rather than its labels, e.g. "ingress=internal,launchStage=GA". They use
+// the syntax of label selectors and are evaluated client-side, as the Cloud
+// Run API can't filter services.
+
+// ingressNames maps the ingress settings of the Cloud Run API to the names
+// used by gcloud, which field selectors match.
+var ingressNames = map[string]string{
+	ingressAll:                      "all",
+	"INGRESS_TRAFFIC_INTERNAL_ONLY": "internal",
+	ingressInternalLB:               "internal-and-cloud-load-balancing",
+}
+
+// serviceFields returns the fields of svc that field selectors match, by
+// name. Unset fields are missing, e.g. maxInstances of services without an
+// instance limit.
+func serviceFields(svc *run.GoogleCloudRunV2Service) map[string]string {
+	fields := make(map[string]string)
+	if svc.Ingress != "" {
+		fields["ingress"] = svc.Ingress
+		if name, ok := ingressNames[svc.Ingress]; ok {
+			fields["ingress"] = name
+		}
+	}
+	if svc.LaunchStage != "" {
+		fields["launchStage"] = svc.LaunchStage
+	}
+	var scaling run.GoogleCloudRunV2RevisionScaling
+	if svc.Template != nil && svc.Template.Scaling != nil {
+		scaling = *svc.Template.Scaling
+	}
+	fields["minInstances"] = strconv.FormatInt(scaling.MinInstanceCount, 10)
+	if scaling.MaxInstanceCount != 0 {
+		fields["maxInstances"] = strconv.FormatInt(scaling.MaxInstanceCount, 10)
+	}
+	return fields
+}
+
+// selectorFields holds the fields field selectors can match.
+var selectorFields = map[string]bool{"ingress": true, "launchStage": true, "minInstances": true, "maxInstances": true}
+
+// parseFieldSelector parses a field selector, rejecting unknown fields.
+func parseFieldSelector(s string) (labelSelector, error) {
+	sel, err := parseLabelSelector(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range sel {
+		if !selectorFields[r.key] {
+			return nil, errors.Errorf("unknown field %q in selector, expected one of %s", r.key, strings.Join(sortedKeys(selectorFields), ", "))
+		}
+	}
+	return sel, nil
+}
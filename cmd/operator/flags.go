@@ -0,0 +1,102 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// Flags can also be set by environment variables, as Cloud Run services and
+// jobs are configured primarily through them, and in the flags section of
+// the configuration file. A flag given on the command line takes precedence
+// over its environment variable, which takes precedence over the
+// configuration file and the default.
+
+// flagEnvPrefix prefixes the environment variables setting flags.
+const flagEnvPrefix = "AUTONEG_"
+
+// flagEnv returns the environment variable setting a flag, e.g.
+// AUTONEG_LABEL_SELECTOR for -label-selector.
+func flagEnv(name string) string {
+	return flagEnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// parseFlags parses the flags of a command and resolves those not given.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return resolveFlags(fs)
+}
+
+// resolveFlags sets the flags of fs not given on the command line from their
+// environment variables or else the configuration file. The configuration
+// file is read after the environment, so that -config itself can be set by
+// AUTONEG_CONFIG.
+func resolveFlags(fs *flag.FlagSet) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var err error
+	set := func(f *flag.Flag, v, source string) {
+		if err == nil {
+			given[f.Name] = true
+			err = errors.Wrapf(fs.Set(f.Name, v), "invalid value %q of %s", v, source)
+		}
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(flagEnv(f.Name)); ok && !given[f.Name] {
+			set(f, v, flagEnv(f.Name))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	fileFlags, err := configFileFlags(flConfig)
+	if err != nil {
+		return err
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if v, ok := fileFlags[f.Name]; ok && !given[f.Name] {
+			set(f, v, "flags."+f.Name+" in "+flConfig)
+		}
+	})
+	return err
+}
+
+// configFileFlags returns the flags section of the configuration file, by
+// flag name. The rest of the file is read by loadConfig.
+func configFileFlags(file string) (map[string]string, error) {
+	if file == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read config file %q", file)
+	}
+	var cfg struct {
+		Flags map[string]string `yaml:"flags"`
+	}
+	if err := yaml.NewDecoder(bytes.NewReader(b)).Decode(&cfg); err != nil && err != io.EOF {
+		return nil, errors.Wrapf(err, "failed to parse config file %q", file)
+	}
+	return cfg.Flags, nil
+}
@@ -0,0 +1,199 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	adminpb "github.com/GoogleCloudPlatform/serverless-autoneg-controller/api/admin/v1"
+)
+
+// serveGRPC serves the gRPC admin API (with server reflection and the
+// standard health service) until ctx is done. It uses the same
+// authentication as the HTTP admin API.
+func (s *server) serveGRPC(ctx context.Context, addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on %s", addr)
+	}
+	gs := grpc.NewServer(
+		grpc.UnaryInterceptor(s.grpcUnaryAuth),
+		grpc.StreamInterceptor(s.grpcStreamAuth),
+	)
+	adminpb.RegisterAdminServiceServer(gs, &adminGRPCServer{s: s})
+	reflection.Register(gs)
+	healthpb.RegisterHealthServer(gs, s.health)
+
+	go func() {
+		<-ctx.Done()
+		s.health.Shutdown()
+		gs.GracefulStop()
+	}()
+	s.logger.WithField("addr", addr).Info("starting grpc server")
+	return gs.Serve(lis)
+}
+
+// grpcAuthorize checks the authorization metadata of a call to the admin
+// service. Reflection and health checks are available without
+// authentication.
+func (s *server) grpcAuthorize(ctx context.Context, method string) error {
+	if strings.HasPrefix(method, "/grpc.reflection.") || strings.HasPrefix(method, "/grpc.health.") {
+		return nil
+	}
+	if s.adminAudience == "" {
+		return status.Error(codes.Unimplemented, "admin API disabled")
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	var authorization string
+	if v := md.Get("authorization"); len(v) != 0 {
+		authorization = v[0]
+	}
+	switch _, err := s.authenticate(ctx, authorization); err {
+	case nil:
+		return nil
+	case errForbidden:
+		return status.Error(codes.PermissionDenied, err.Error())
+	default:
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+}
+
+func (s *server) grpcUnaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := s.grpcAuthorize(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *server) grpcStreamAuth(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := s.grpcAuthorize(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// adminGRPCServer implements the gRPC admin service on top of the server.
+type adminGRPCServer struct {
+	adminpb.UnimplementedAdminServiceServer
+	s *server
+}
+
+func (a *adminGRPCServer) ListManagedResources(ctx context.Context, req *adminpb.ListManagedResourcesRequest) (*adminpb.ListManagedResourcesResponse, error) {
+	a.s.statusMu.RLock()
+	defer a.s.statusMu.RUnlock()
+
+	resp := &adminpb.ListManagedResourcesResponse{LastSyncError: a.s.status.Error}
+	if !a.s.status.LastSync.IsZero() {
+		resp.LastSync = timestamppb.New(a.s.status.LastSync)
+	}
+	for _, m := range a.s.inventory {
+		neg := &adminpb.ManagedNEG{Region: m.Region, Name: m.NEG.Name, Service: m.Owner.Service}
+		for _, ref := range m.Backends {
+			neg.BackendServices = append(neg.BackendServices, ref.String())
+		}
+		resp.Negs = append(resp.Negs, neg)
+	}
+	return resp, nil
+}
+
+func (a *adminGRPCServer) TriggerSync(ctx context.Context, req *adminpb.TriggerSyncRequest) (*adminpb.TriggerSyncResponse, error) {
+	if req.Project != "" && req.Project != a.s.r.project {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown project %s", req.Project)
+	}
+	regions := a.s.managedRegions()
+	if req.Region != "" {
+		if !contains(a.s.r.regions, req.Region) {
+			return nil, status.Errorf(codes.InvalidArgument, "region not managed: %s", req.Region)
+		}
+		if !a.s.manages(req.Region) {
+			return nil, status.Errorf(codes.FailedPrecondition, "region owned by another replica: %s", req.Region)
+		}
+		regions = []string{req.Region}
+	}
+
+	a.s.r.cache.invalidateRegions(regions)
+	res, err := a.s.reconcile(ctx, regions, req.Service, false)
+	resp := &adminpb.TriggerSyncResponse{
+		Mutations:     mutationsToProto(res.Plan.Mutations),
+		Failed:        int32(res.Failed),
+		FailedRegions: res.FailedRegions,
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return resp, nil
+}
+
+func (a *adminGRPCServer) WatchEvents(req *adminpb.WatchEventsRequest, stream adminpb.AdminService_WatchEventsServer) error {
+	events, cancel := a.s.events.subscribe()
+	defer cancel()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e := <-events:
+			if err := stream.Send(eventToProto(e)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+var eventTypesToProto = map[eventType]adminpb.ReconcileEvent_Type{
+	eventStarted: adminpb.ReconcileEvent_STARTED,
+	eventPlanned: adminpb.ReconcileEvent_PLANNED,
+	eventApplied: adminpb.ReconcileEvent_APPLIED,
+	eventFailed:  adminpb.ReconcileEvent_FAILED,
+	eventDrift:   adminpb.ReconcileEvent_DRIFT,
+}
+
+func eventToProto(e reconcileEvent) *adminpb.ReconcileEvent {
+	return &adminpb.ReconcileEvent{
+		Type:      eventTypesToProto[e.Type],
+		Time:      timestamppb.New(e.Time),
+		Regions:   e.Regions,
+		Service:   e.Service,
+		Mutations: mutationsToProto(e.Mutations),
+		Error:     e.Error,
+	}
+}
+
+func mutationsToProto(ms []mutation) []*adminpb.Mutation {
+	out := make([]*adminpb.Mutation, 0, len(ms))
+	for _, m := range ms {
+		out = append(out, &adminpb.Mutation{
+			Op:             string(m.Op),
+			Project:        m.Project,
+			Region:         m.Region,
+			Neg:            m.NEG,
+			Service:        m.Service,
+			BackendService: m.BackendService,
+			BackendRegion:  m.BackendRegion,
+			Drift:          m.Drift,
+		})
+	}
+	return out
+}
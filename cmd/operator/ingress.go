@@ -0,0 +1,151 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/discovery"
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/planner"
+	"github.com/pkg/errors"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/run/v2"
+)
+
+const (
+	ingressAll        = "INGRESS_TRAFFIC_ALL"
+	ingressInternalLB = "INGRESS_TRAFFIC_INTERNAL_LOAD_BALANCER"
+
+	// annotationOriginalIngress records the ingress of a service before the
+	// controller restricted it, to restore it later.
+	annotationOriginalIngress = controllerName + "/original-ingress"
+)
+
+// planIngress plans restricting the ingress of selected services whose NEG
+// is attached to one of their backend services, or is attached by the
+// mutations already planned, to internal and load balancer traffic, if
+// -harden-ingress is set. The original ingress is restored once the NEG is
+// detached, the service is no longer selected or hardening is disabled.
+// Frozen services are left untouched.
+func (r *reconciler) planIngress(region string, svcs, selected []*run.GoogleCloudRunV2Service, frozen map[string]bool, backends map[backendServiceRef]*compute.BackendService, planned *plan) *plan {
+	isSelected := make(map[string]bool, len(selected))
+	for _, svc := range selected {
+		isSelected[svc.Name] = true
+	}
+	attaching := make(map[string]bool)
+	if planned != nil {
+		for _, m := range planned.Mutations {
+			if m.Op == opAttachBackend || m.Op == opAdoptBackend {
+				attaching[m.Service] = true
+			}
+		}
+	}
+	p := &plan{}
+	for _, svc := range svcs {
+		if frozen[svc.Name] {
+			continue
+		}
+		name := r.negNames.render(serviceName(svc), region, r.project)
+		original, hardened := svc.Annotations[annotationOriginalIngress]
+		attached := r.hardenIngress && isSelected[svc.Name] && (attaching[svc.Name] || r.negAttached(svc, region, name, backends))
+		switch {
+		case attached && svc.Ingress != ingressInternalLB:
+			p.add(mutation{Op: opHardenIngress, Project: r.project, Region: region, NEG: name, Service: svc.Name, Ingress: ingressInternalLB, Previous: svc.Ingress})
+		case !attached && hardened:
+			if original == "" {
+				original = ingressAll
+			}
+			p.add(mutation{Op: opRestoreIngress, Project: r.project, Region: region, NEG: name, Service: svc.Name, Ingress: original, Previous: svc.Ingress})
+		}
+	}
+	return p
+}
+
+// negAttached reports whether the NEG of svc, or with -tag-negs one of the
+// NEGs of its revision tags, is a controller-owned backend of any of the
+// service's backend services.
+func (r *reconciler) negAttached(svc *run.GoogleCloudRunV2Service, region, neg string, backends map[backendServiceRef]*compute.BackendService) bool {
+	dbs, err := desiredBackends(svc, region)
+	if err != nil {
+		return false
+	}
+	for _, db := range dbs {
+		bs, ok := backends[db.Ref]
+		if !ok {
+			continue
+		}
+		if b := discovery.FindBackend(bs, r.project, region, neg); b != nil && planner.OwnedBackend(b) {
+			return true
+		}
+		for tag := range r.trafficTags(svc) {
+			if b := discovery.FindBackend(bs, r.project, region, tagNEGName(neg, tag)); b != nil && planner.OwnedBackend(b) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// applyIngressMutation hardens or restores the ingress of a Cloud Run service
+// and returns its ingress before and after the mutation.
+func (r *reconciler) applyIngressMutation(ctx context.Context, m mutation) (before, after interface{}, err error) {
+	svc, err := r.runService.Projects.Locations.Services.Get(m.Service).Context(ctx).Do()
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to get service %q", m.Service)
+	}
+	before = svc.Ingress
+	switch m.Op {
+	case opHardenIngress:
+		if svc.Annotations == nil {
+			svc.Annotations = make(map[string]string)
+		}
+		if _, ok := svc.Annotations[annotationOriginalIngress]; !ok {
+			svc.Annotations[annotationOriginalIngress] = svc.Ingress
+		}
+	case opRestoreIngress:
+		delete(svc.Annotations, annotationOriginalIngress)
+	}
+	svc.Ingress = m.Ingress
+	return before, svc.Ingress, patchCloudRunService(ctx, r.runService, svc)
+}
+
+// runOperationPollInterval is the interval at which Cloud Run operations are
+// polled.
+const runOperationPollInterval = 2 * time.Second
+
+// patchCloudRunService updates a Cloud Run service and waits for the
+// operation to complete, at most for -operation-wait-timeout. The etag of svc
+// guards against concurrent modifications.
+func patchCloudRunService(ctx context.Context, runService *run.Service, svc *run.GoogleCloudRunV2Service) error {
+	ctx, cancel := context.WithTimeout(ctx, flOperationWaitTimeout)
+	defer cancel()
+	op, err := runService.Projects.Locations.Services.Patch(svc.Name, svc).Context(ctx).Do()
+	for err == nil && !op.Done {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(runOperationPollInterval):
+		}
+		op, err = runService.Projects.Locations.Operations.Get(op.Name).Context(ctx).Do()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to update service %q", svc.Name)
+	}
+	if op.Error != nil {
+		return withKind(rpcStatusKind(op.Error.Code), errors.Errorf("failed to update service %q: %s", svc.Name, op.Error.Message))
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/discovery"
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/planner"
+	"google.golang.org/api/compute/v1"
+)
+
+// managedNEG is a serverless NEG managed by the controller together with the
+// backend services it is attached to.
+type managedNEG struct {
+	Region   string
+	NEG      *compute.NetworkEndpointGroup
+	Owner    ownership
+	Backends []backendServiceRef
+}
+
+// listManagedNEGs returns the controller-managed NEGs of the given regions.
+func (r *reconciler) listManagedNEGs(ctx context.Context, regions []string) ([]managedNEG, error) {
+	globalBackends, err := discovery.ListBackendServices(ctx, r.computeService, r.project, "")
+	if err != nil {
+		return nil, err
+	}
+	var out []managedNEG
+	for _, region := range regions {
+		negs, err := listServerlessNEGs(ctx, r.computeService, r.project, region)
+		if err != nil {
+			return nil, err
+		}
+		backends, err := discovery.ListBackendServices(ctx, r.computeService, r.project, region)
+		if err != nil {
+			return nil, err
+		}
+		for ref, bs := range globalBackends {
+			backends[ref] = bs
+		}
+		owners := planner.NEGOwners(r.project, region, negs, backends)
+		for _, name := range sortedKeys(owners) {
+			m := managedNEG{Region: region, NEG: negs[name], Owner: owners[name]}
+			for _, ref := range discovery.SortedBackendRefs(backends) {
+				if discovery.FindBackend(backends[ref], r.project, region, name) != nil {
+					m.Backends = append(m.Backends, ref)
+				}
+			}
+			out = append(out, m)
+		}
+	}
+	return out, nil
+}
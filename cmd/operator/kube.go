@@ -0,0 +1,100 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// kubeClient holds the typed and dynamic clients of a Kubernetes cluster and
+// the namespace of the configuration they were built from.
+type kubeClient struct {
+	namespace string
+	core      kubernetes.Interface
+	dynamic   dynamic.Interface
+}
+
+// newKubeClient builds clients for the given context of a kubeconfig file
+// (the current context if empty). Without file, $KUBECONFIG or
+// ~/.kube/config is loaded. Users are authenticated as configured, including
+// exec credential plugins such as gke-gcloud-auth-plugin.
+func newKubeClient(file, contextName string) (*kubeClient, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = file
+	cc := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: contextName})
+	config, err := cc.ClientConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load kubeconfig")
+	}
+	namespace, _, err := cc.Namespace()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to determine the kubeconfig namespace")
+	}
+	return newKubeClientForConfig(config, namespace)
+}
+
+// inClusterNamespace holds the namespace of the pod the controller runs in.
+const inClusterNamespace = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// newInClusterKubeClient builds clients authenticated as the service account
+// of the pod the controller runs in.
+func newInClusterKubeClient() (*kubeClient, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	namespace := metav1.NamespaceDefault
+	if ns, err := os.ReadFile(inClusterNamespace); err == nil {
+		namespace = strings.TrimSpace(string(ns))
+	}
+	return newKubeClientForConfig(config, namespace)
+}
+
+func newKubeClientForConfig(config *rest.Config, namespace string) (*kubeClient, error) {
+	config.UserAgent = controllerName
+	core, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create Kubernetes client")
+	}
+	dyn, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create Kubernetes client")
+	}
+	return &kubeClient{namespace: namespace, core: core, dynamic: dyn}, nil
+}
+
+// listServices lists the services of a namespace, or of all namespaces if
+// allNamespaces is set.
+func (c *kubeClient) listServices(ctx context.Context, allNamespaces bool) ([]corev1.Service, error) {
+	namespace := c.namespace
+	if allNamespaces {
+		namespace = metav1.NamespaceAll
+	}
+	l, err := c.core.CoreV1().Services(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list Kubernetes services")
+	}
+	return l.Items, nil
+}
@@ -0,0 +1,307 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/planner"
+	"github.com/pkg/errors"
+	"google.golang.org/api/run/v2"
+)
+
+// Labels on Cloud Run services that configure the controller. A service's
+// NEG can be attached to several backend services by listing them separated
+// by labelListSeparator; the other labels then hold either a single value
+// for all backend services or a list of the same length.
+const (
+	// labelPrefix is the common prefix of the controller's labels.
+	labelPrefix = "autoneg-"
+
+	// labelBackendService names the backend services the service's NEG is
+	// attached to.
+	labelBackendService = "autoneg-backend-service"
+	// labelBackendScope is "global" (default) or "regional". Regional backend
+	// services are looked up in the region of the Cloud Run service.
+	labelBackendScope = "autoneg-backend-scope"
+	// labelCapacityScaler sets the capacity scaler of the service's backend
+	// in percent, to weight or drain the region at the load balancer. Label
+	// values can't hold decimals, so 0 or 10-100 is accepted; the default is
+	// 100.
+	labelCapacityScaler = "autoneg-capacity-scaler"
+	// labelBackendProtocol sets the protocol of the backend service to
+	// "http2", "https" or "http". Services whose container port is named
+	// h2c default to "http2"; otherwise the protocol is left alone.
+	labelBackendProtocol = "autoneg-backend-protocol"
+	// labelConnectionDraining sets the connection draining timeout of the
+	// backend service in seconds (0-3600), so that in-flight requests
+	// complete when a NEG is detached or drained. Left alone if unset.
+	labelConnectionDraining = "autoneg-connection-draining"
+	// labelLocalityPolicy sets the locality load balancing policy of
+	// INTERNAL_MANAGED and EXTERNAL_MANAGED backend services, e.g.
+	// "least-request". Left alone if unset.
+	labelLocalityPolicy = "autoneg-locality-policy"
+	// labelOutlierDetection enables outlier detection on INTERNAL_MANAGED and
+	// EXTERNAL_MANAGED backend services: backends, i.e. regions, returning
+	// this many consecutive 5xx errors are ejected. Left alone if unset.
+	labelOutlierDetection = "autoneg-outlier-detection"
+	// labelAuth declares how requests through the load balancer are
+	// authenticated: "iap" enables IAP on the backend service, "token"
+	// (clients send ID tokens for one of the service's audiences) and
+	// "public" disable it. Left alone if unset.
+	labelAuth = "autoneg-auth"
+	// labelPriority is the priority class of the service in the work queue
+	// of serve mode: "high", "normal" (default) or "low".
+	labelPriority = "autoneg-priority"
+	// labelOptOut selects what happens to the service's NEG once the service
+	// is no longer managed: "delete" detaches and deletes it, "detach" only
+	// detaches it and deletes it after the -opt-out-retention period.
+	// Defaults to -opt-out.
+	labelOptOut = "autoneg-opt-out"
+
+	// labelListSeparator separates list values. Label values can't contain
+	// commas, and resource names can't contain underscores.
+	labelListSeparator = "_"
+)
+
+// knownLabels holds the controller's labels, to detect misspelled ones.
+var knownLabels = map[string]bool{
+	labelBackendService:     true,
+	labelBackendScope:       true,
+	labelCapacityScaler:     true,
+	labelBackendProtocol:    true,
+	labelConnectionDraining: true,
+	labelLocalityPolicy:     true,
+	labelOutlierDetection:   true,
+	labelAuth:               true,
+	labelPriority:           true,
+	labelOptOut:             true,
+}
+
+// desiredBackend is a backend service the NEG of a service is attached to,
+// together with the settings of the NEG's backend.
+type desiredBackend = planner.DesiredBackend
+
+// desiredBackends returns the backend services the NEG of svc should be
+// attached to, configured by its backends annotation or its labels. Errors
+// are of kind kindInvalidAnnotation.
+func desiredBackends(svc *run.GoogleCloudRunV2Service, region string) ([]desiredBackend, error) {
+	dbs, err := parseDesiredBackends(svc, region)
+	return dbs, withKind(kindInvalidAnnotation, err)
+}
+
+func parseDesiredBackends(svc *run.GoogleCloudRunV2Service, region string) ([]desiredBackend, error) {
+	if v, ok := svc.Annotations[annotationBackends]; ok {
+		return annotatedBackends(svc, v, region)
+	}
+	v := svc.Labels[labelBackendService]
+	if v == "" {
+		return nil, errors.Errorf("missing label %q or annotation %q", labelBackendService, annotationBackends)
+	}
+	names := strings.Split(v, labelListSeparator)
+	seen := make(map[string]bool)
+	var out []desiredBackend
+	for i, name := range names {
+		if !validResourceName(name) {
+			return nil, errors.Errorf("label %q: invalid backend service name %q", labelBackendService, name)
+		}
+		if seen[name] {
+			return nil, errors.Errorf("label %q: backend service %q listed twice", labelBackendService, name)
+		}
+		seen[name] = true
+
+		scope, err := labelListValue(svc, labelBackendScope, i, len(names))
+		if err != nil {
+			return nil, err
+		}
+		capacity, err := labelListValue(svc, labelCapacityScaler, i, len(names))
+		if err != nil {
+			return nil, err
+		}
+		protocol, err := labelListValue(svc, labelBackendProtocol, i, len(names))
+		if err != nil {
+			return nil, err
+		}
+		draining, err := labelListValue(svc, labelConnectionDraining, i, len(names))
+		if err != nil {
+			return nil, err
+		}
+		locality, err := labelListValue(svc, labelLocalityPolicy, i, len(names))
+		if err != nil {
+			return nil, err
+		}
+		outlier, err := labelListValue(svc, labelOutlierDetection, i, len(names))
+		if err != nil {
+			return nil, err
+		}
+		auth, err := labelListValue(svc, labelAuth, i, len(names))
+		if err != nil {
+			return nil, err
+		}
+
+		d := desiredBackend{}
+		switch scope {
+		case "", "global":
+			d.Ref = backendServiceRef{Name: name}
+		case "regional":
+			d.Ref = backendServiceRef{Region: region, Name: name}
+		default:
+			return nil, errors.Errorf("label %q: unknown scope %q", labelBackendScope, scope)
+		}
+		if d.Capacity, err = parseCapacityScaler(capacity); err != nil {
+			return nil, err
+		}
+		if d.Protocol, err = parseBackendProtocol(svc, protocol); err != nil {
+			return nil, err
+		}
+		if d.DrainingTimeout, err = parseConnectionDraining(draining); err != nil {
+			return nil, err
+		}
+		if d.LocalityPolicy, err = parseLocalityPolicy(locality); err != nil {
+			return nil, err
+		}
+		if d.OutlierErrors, err = parseOutlierDetection(outlier); err != nil {
+			return nil, err
+		}
+		if d.Auth, err = parseAuthMode(auth); err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+// labelListValue returns the i-th of n values of a list-valued label, or its
+// only value.
+func labelListValue(svc *run.GoogleCloudRunV2Service, label string, i, n int) (string, error) {
+	v, ok := svc.Labels[label]
+	if !ok {
+		return "", nil
+	}
+	values := strings.Split(v, labelListSeparator)
+	switch len(values) {
+	case 1:
+		return values[0], nil
+	case n:
+		return values[i], nil
+	}
+	return "", errors.Errorf("label %q: expected 1 or %d values, got %d", label, n, len(values))
+}
+
+// parseCapacityScaler converts the value of the capacity scaler label.
+func parseCapacityScaler(v string) (float64, error) {
+	if v == "" {
+		return 1, nil
+	}
+	pct, err := strconv.Atoi(v)
+	if err != nil || pct < 0 || pct > 100 || (pct > 0 && pct < 10) {
+		return 0, errors.Errorf("label %q: capacity scaler must be 0 or 10-100 percent, got %q", labelCapacityScaler, v)
+	}
+	return float64(pct) / 100, nil
+}
+
+// maxConnectionDraining is the maximum connection draining timeout accepted
+// by Compute Engine, in seconds.
+const maxConnectionDraining = 3600
+
+// parseConnectionDraining converts the value of the connection draining
+// label, returning nil if the controller doesn't manage the timeout.
+func parseConnectionDraining(v string) (*int64, error) {
+	if v == "" {
+		return nil, nil
+	}
+	sec, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || sec < 0 || sec > maxConnectionDraining {
+		return nil, errors.Errorf("label %q: connection draining timeout must be 0-%d seconds, got %q", labelConnectionDraining, maxConnectionDraining, v)
+	}
+	return &sec, nil
+}
+
+// localityPolicies maps the values of the locality policy label to the
+// policies of Compute Engine. Label values can't hold upper case letters,
+// and underscores separate list values.
+var localityPolicies = map[string]string{
+	"round-robin":          "ROUND_ROBIN",
+	"least-request":        "LEAST_REQUEST",
+	"ring-hash":            "RING_HASH",
+	"random":               "RANDOM",
+	"original-destination": "ORIGINAL_DESTINATION",
+	"maglev":               "MAGLEV",
+}
+
+// parseLocalityPolicy converts the value of the locality policy label,
+// returning "" if the controller doesn't manage the policy.
+func parseLocalityPolicy(v string) (string, error) {
+	if v == "" {
+		return "", nil
+	}
+	policy, ok := localityPolicies[v]
+	if !ok {
+		return "", errors.Errorf("label %q: unknown locality policy %q", labelLocalityPolicy, v)
+	}
+	return policy, nil
+}
+
+// parseOutlierDetection converts the value of the outlier detection label,
+// returning nil if the controller doesn't manage outlier detection.
+func parseOutlierDetection(v string) (*int64, error) {
+	if v == "" {
+		return nil, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 1 {
+		return nil, errors.Errorf("label %q: number of consecutive errors must be positive, got %q", labelOutlierDetection, v)
+	}
+	return &n, nil
+}
+
+// parseBackendProtocol converts the value of the protocol label, returning ""
+// if the controller doesn't manage the protocol.
+func parseBackendProtocol(svc *run.GoogleCloudRunV2Service, v string) (string, error) {
+	switch v {
+	case "http2", "https", "http":
+		return strings.ToUpper(v), nil
+	case "":
+	default:
+		return "", errors.Errorf("label %q: unknown protocol %q", labelBackendProtocol, v)
+	}
+	// Cloud Run serves end-to-end HTTP/2, e.g. for gRPC, on ports named h2c.
+	if svc.Template != nil {
+		for _, c := range svc.Template.Containers {
+			for _, p := range c.Ports {
+				if p.Name == "h2c" {
+					return "HTTP2", nil
+				}
+			}
+		}
+	}
+	return "", nil
+}
+
+// propagatedLabels returns the labels of svc that are propagated to its NEG
+// and backends, or nil if none are.
+func (r *reconciler) propagatedLabels(svc *run.GoogleCloudRunV2Service) map[string]string {
+	var out map[string]string
+	for _, k := range r.propagateLabels {
+		if v, ok := svc.Labels[k]; ok {
+			if out == nil {
+				out = make(map[string]string)
+			}
+			out[k] = v
+		}
+	}
+	return out
+}
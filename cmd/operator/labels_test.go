@@ -0,0 +1,131 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"google.golang.org/api/run/v2"
+)
+
+func TestDesiredBackends(t *testing.T) {
+	const region = "us-central1"
+	int64p := func(v int64) *int64 { return &v }
+	h2c := &run.GoogleCloudRunV2RevisionTemplate{Containers: []*run.GoogleCloudRunV2Container{{Ports: []*run.GoogleCloudRunV2ContainerPort{{Name: "h2c"}}}}}
+	for _, tc := range []struct {
+		name     string
+		labels   map[string]string
+		template *run.GoogleCloudRunV2RevisionTemplate
+		want     []desiredBackend
+		wantErr  bool
+	}{
+		{
+			name:   "defaults",
+			labels: map[string]string{labelBackendService: "web"},
+			want:   []desiredBackend{{Ref: backendServiceRef{Name: "web"}, Capacity: 1}},
+		},
+		{
+			name: "settings",
+			labels: map[string]string{
+				labelBackendService:     "web",
+				labelBackendScope:       "regional",
+				labelCapacityScaler:     "50",
+				labelBackendProtocol:    "https",
+				labelConnectionDraining: "30",
+				labelLocalityPolicy:     "least-request",
+				labelOutlierDetection:   "5",
+				labelAuth:               "iap",
+			},
+			want: []desiredBackend{{
+				Ref: backendServiceRef{Region: region, Name: "web"}, Capacity: 0.5, Protocol: "HTTPS", DrainingTimeout: int64p(30),
+				LocalityPolicy: "LEAST_REQUEST", OutlierErrors: int64p(5), Auth: authIAP,
+			}},
+		},
+		{
+			name:     "h2c port",
+			labels:   map[string]string{labelBackendService: "web"},
+			template: h2c,
+			want:     []desiredBackend{{Ref: backendServiceRef{Name: "web"}, Capacity: 1, Protocol: "HTTP2"}},
+		},
+		{
+			name:   "lists",
+			labels: map[string]string{labelBackendService: "web_internal", labelBackendScope: "global_regional", labelCapacityScaler: "0"},
+			want: []desiredBackend{
+				{Ref: backendServiceRef{Name: "web"}},
+				{Ref: backendServiceRef{Region: region, Name: "internal"}},
+			},
+		},
+		{name: "missing", labels: map[string]string{}, wantErr: true},
+		{name: "invalid name", labels: map[string]string{labelBackendService: "Web"}, wantErr: true},
+		{name: "listed twice", labels: map[string]string{labelBackendService: "web_web"}, wantErr: true},
+		{name: "list length", labels: map[string]string{labelBackendService: "a_b_c", labelCapacityScaler: "50_50"}, wantErr: true},
+		{name: "unknown scope", labels: map[string]string{labelBackendService: "web", labelBackendScope: "zonal"}, wantErr: true},
+		{name: "capacity below 10", labels: map[string]string{labelBackendService: "web", labelCapacityScaler: "5"}, wantErr: true},
+		{name: "capacity above 100", labels: map[string]string{labelBackendService: "web", labelCapacityScaler: "101"}, wantErr: true},
+		{name: "unknown protocol", labels: map[string]string{labelBackendService: "web", labelBackendProtocol: "grpc"}, wantErr: true},
+		{name: "draining too long", labels: map[string]string{labelBackendService: "web", labelConnectionDraining: "3601"}, wantErr: true},
+		{name: "unknown locality policy", labels: map[string]string{labelBackendService: "web", labelLocalityPolicy: "fastest"}, wantErr: true},
+		{name: "no outlier errors", labels: map[string]string{labelBackendService: "web", labelOutlierDetection: "0"}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svc := &run.GoogleCloudRunV2Service{Name: "projects/p/locations/" + region + "/services/hello", Labels: tc.labels, Template: tc.template}
+			got, err := desiredBackends(svc, region)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("desiredBackends = %+v, want an error", got)
+				}
+				if kind := errorKindOf(err); kind != kindInvalidAnnotation {
+					t.Errorf("error kind = %s, want %s", kind, kindInvalidAnnotation)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprintf("%+v", describeBackends(got)) != fmt.Sprintf("%+v", describeBackends(tc.want)) {
+				t.Errorf("desiredBackends = %+v, want %+v", describeBackends(got), describeBackends(tc.want))
+			}
+		})
+	}
+}
+
+// describeBackends dereferences the optional settings of desired backends so
+// that they can be compared.
+func describeBackends(dbs []desiredBackend) []string {
+	var out []string
+	for _, d := range dbs {
+		s := fmt.Sprintf("%s capacity=%v protocol=%s locality=%s auth=%s", d.Ref, d.Capacity, d.Protocol, d.LocalityPolicy, d.Auth)
+		if d.DrainingTimeout != nil {
+			s += fmt.Sprintf(" draining=%d", *d.DrainingTimeout)
+		}
+		if d.OutlierErrors != nil {
+			s += fmt.Sprintf(" outlier=%d", *d.OutlierErrors)
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+func TestPropagatedLabels(t *testing.T) {
+	r := &reconciler{propagateLabels: []string{"team", "cost-center"}}
+	svc := &run.GoogleCloudRunV2Service{Labels: map[string]string{"team": "web", "env": "prod"}}
+	if got := r.propagatedLabels(svc); fmt.Sprint(got) != "map[team:web]" {
+		t.Errorf("propagatedLabels = %v, want map[team:web]", got)
+	}
+	if got := r.propagatedLabels(&run.GoogleCloudRunV2Service{}); got != nil {
+		t.Errorf("propagatedLabels of an unlabeled service = %v, want nil", got)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/storage/v1"
+)
+
+// Files the controller writes for other tools, like run summaries and
+// onboarding checkpoints, are given as a local path or as a Cloud Storage
+// object (gs://bucket/object).
+
+// parseObjectLocation splits a gs://bucket/object location. It returns false
+// for local paths.
+func parseObjectLocation(location string) (bucket, object string, ok bool, err error) {
+	if !strings.HasPrefix(location, "gs://") {
+		return "", "", false, nil
+	}
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return "", "", false, errors.Errorf("invalid location %q, expected a path or gs://bucket/object", location)
+	}
+	return u.Host, path.Clean(strings.TrimPrefix(u.Path, "/")), true, nil
+}
+
+func newStorageService(ctx context.Context, cfg *config) (*storage.Service, error) {
+	opts, err := clientOptions(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	s, err := storage.NewService(ctx, opts...)
+	return s, errors.Wrap(err, "failed to initialize Cloud Storage client")
+}
+
+// writeLocation replaces the file or object at location.
+func writeLocation(ctx context.Context, location string, cfg *config, contentType string, b []byte) error {
+	bucket, object, ok, err := parseObjectLocation(location)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.Wrapf(writeFileAtomic(location, b), "failed to write %s", location)
+	}
+	storageService, err := newStorageService(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	_, err = storageService.Objects.Insert(bucket, &storage.Object{Name: object, ContentType: contentType}).
+		Media(bytes.NewReader(b)).
+		Context(ctx).
+		Do()
+	return errors.Wrapf(err, "failed to write %s", location)
+}
+
+// readLocation reads the file or object at location. It returns nil if it
+// doesn't exist.
+func readLocation(ctx context.Context, location string, cfg *config) ([]byte, error) {
+	bucket, object, ok, err := parseObjectLocation(location)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		b, err := os.ReadFile(location)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return b, errors.Wrapf(err, "failed to read %s", location)
+	}
+	storageService, err := newStorageService(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := storageService.Objects.Get(bucket, object).Context(ctx).Download()
+	if errorKindOf(err) == kindNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", location)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	return b, errors.Wrapf(err, "failed to read %s", location)
+}
@@ -15,28 +15,120 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
-	"os/exec"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/compute/metadata"
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/apply"
 	sdlog "github.com/TV4/logrus-stackdriver-formatter"
 	isatty "github.com/mattn/go-isatty"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
 	"google.golang.org/api/run/v2"
+	htransport "google.golang.org/api/transport/http"
 )
 
 var (
 	flLoggingLevel string
 	flHTTPAddr     string
 	flProject      string
+	flQuotaProject string
+	flRegions      string
+	flConfig       string
+
+	flLabelSelector        string
+	flExcludeLabelSelector string
+	flFieldSelector        string
+	flExcludeFieldSelector string
+	flNEGNameTemplate      string
+	flMaxDeletions         int
+	flAdopt                bool
+	flAuditLog             string
+	flOperationsState      string
+	flRegionConcurrency    int
+	flCanaryPercent        int
+	flDriftMode            string
+	flStrict               bool
+	flCloudMonitoring      bool
+	flHardenIngress        bool
+	flTagNEGs              bool
+
+	flAdminAudience          string
+	flAdminMembers           string
+	flDashboard              bool
+	flGRPCAddr               string
+	flEventarc               bool
+	flEventarcRegister       string
+	flEventarcServiceAccount string
+	flAssetFeed              bool
+
+	flSyncPeriod        time.Duration
+	flFullResyncPeriod  time.Duration
+	flComputeCacheTTL   time.Duration
+	flDeletedServiceTTL time.Duration
+	flEventDebounce     time.Duration
+	flStreamServices    bool
+	flReadyzAPICheck    time.Duration
+	flSummary           string
+	flPropagateLabels   string
+	flAllowCoManagement bool
+	flCheckAuth         bool
+	flServingWindow     time.Duration
+	flOptOut            string
+	flOptOutRetention   time.Duration
+	flOptOutState       string
+
+	flRegionFailureThreshold int
+	flRegionCooldown         time.Duration
+
+	flShardMembership      string
+	flShardHeartbeatPeriod time.Duration
+
+	flAPITimeout           time.Duration
+	flMaxRetries           int
+	flRetryInitialBackoff  time.Duration
+	flOperationWaitTimeout time.Duration
+
+	flRecord string
+	flReplay string
+
+	flKubeBindings bool
+	flKubeconfig   string
+	flKubeContext  string
+
+	flDesiredState           string
+	flDesiredStatePollPeriod time.Duration
+
+	flDegradedThreshold time.Duration
+
+	flDryRun     bool
+	flDiffOutput string
+
+	flApprovalWebhook  string
+	flApprovalAudience string
+	flApprovalTimeout  time.Duration
+
+	flPolicies string
+
+	flFrontendProjects string
 )
 
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// version is the version of the controller, set at build time with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
 func init() {
 	defaultAddr := ":8080"
 	if v := os.Getenv("PORT"); v != "" {
@@ -46,16 +138,79 @@ func init() {
 	flag.StringVar(&flLoggingLevel, "verbosity", "info", "the logging level (e.g. debug)")
 	flag.StringVar(&flHTTPAddr, "http-addr", defaultAddr, "address where to listen to http requests (e.g. :8080)")
 	flag.StringVar(&flProject, "project", "", "project in which the service is deployed")
-	flag.Parse()
-
-	args := flag.Args()
-	if len(args) != 0 {
-		logrus.Fatalf("positional arguments not accepted: %v", args)
-	}
+	flag.StringVar(&flQuotaProject, "quota-project", "", "project to bill API quota against (defaults to the credentials' project)")
+	flag.StringVar(&flFrontendProjects, "frontend-projects", "", "comma-separated list of central projects whose load balancers route to backend services of -project through cross-project service referencing; checked by validate and report")
+	flag.StringVar(&flRegions, "regions", "", "comma-separated list of regions to manage (e.g. europe-west1,us-central1)")
+	flag.StringVar(&flConfig, "config", "", "path to the optional YAML configuration file")
+	flag.StringVar(&flLabelSelector, "label-selector", "autoneg=true", "label selector of the Cloud Run services to manage")
+	flag.StringVar(&flExcludeLabelSelector, "exclude-label-selector", "", "label selector of Cloud Run services to never manage, even if matched by -label-selector")
+	flag.StringVar(&flFieldSelector, "field-selector", "", "field selector the Cloud Run services to manage must match besides -label-selector, e.g. ingress=internal,launchStage=GA (fields: ingress, launchStage, minInstances, maxInstances)")
+	flag.StringVar(&flExcludeFieldSelector, "exclude-field-selector", "", "field selector of Cloud Run services to never manage, even if matched by the other selectors")
+	flag.StringVar(&flNEGNameTemplate, "neg-name-template", "{service}-neg", "template of the names of the created NEGs; supports {service}, {region} and {project}")
+	flag.IntVar(&flMaxDeletions, "max-deletions-per-cycle", 10, "maximum number of NEG deletions or backend detachments per cycle before aborting all changes (negative for no limit)")
+	flag.BoolVar(&flAdopt, "adopt", false, "adopt existing unmanaged serverless NEGs that match a service instead of skipping the service")
+	flag.StringVar(&flOperationsState, "operations-state", "", "file or Cloud Storage object (gs://bucket/object) recording the compute operations in flight, which are waited for after a restart before planning")
+	flag.StringVar(&flAuditLog, "audit-log", "", "Cloud Storage location (gs://bucket/prefix) to write a JSONL audit log of all mutations to")
+	flag.StringVar(&flAdminAudience, "admin-audience", "", "expected audience of the ID tokens authenticating admin API requests; the admin API is disabled if empty")
+	flag.StringVar(&flAdminMembers, "admin-members", "", "comma-separated list of account emails allowed to use the admin API")
+	flag.BoolVar(&flDashboard, "dashboard", false, "serve a read-only status dashboard at / (protect it with IAP or Cloud Run IAM)")
+	flag.StringVar(&flGRPCAddr, "grpc-addr", "", "address where to serve the gRPC admin API (e.g. :9090); disabled if empty")
+	flag.IntVar(&flRegionConcurrency, "region-concurrency", 8, "maximum number of regions scanned in parallel (0 for all)")
+	flag.IntVar(&flRegionFailureThreshold, "region-failure-threshold", 3, "number of consecutive passes a region may fail before it is skipped for -region-cooldown (0 to never skip regions)")
+	flag.DurationVar(&flRegionCooldown, "region-cooldown", 5*time.Minute, "how long a region that keeps failing is skipped before it is probed again")
+	flag.DurationVar(&flSyncPeriod, "sync-period", time.Minute, "interval of syncs in serve mode, which reuse cached compute state (0 to only sync at startup)")
+	flag.DurationVar(&flFullResyncPeriod, "full-resync-period", 30*time.Minute, "interval of full resyncs in serve mode, which re-list all compute state; jittered by up to 20%")
+	flag.DurationVar(&flComputeCacheTTL, "compute-cache-ttl", 10*time.Minute, "maximum age of cached compute state reused by syncs before it is listed again (0 to keep it until the next full resync or change)")
+	flag.DurationVar(&flReadyzAPICheck, "readyz-api-check", 0, "make /readyz check that the credentials can list Cloud Run services and NEGs, caching the result for this long (0 to not check)")
+	flag.StringVar(&flSummary, "summary", "", "in run mode, write a JSON summary of the outcome (mutation counts, per-service outcomes, errors) to this file or Cloud Storage object (gs://bucket/object)")
+	flag.BoolVar(&flStreamServices, "stream-services", false, "in serve mode, queue the services of syncs page by page as they are listed instead of planning whole regions; only full resyncs plan whole regions")
+	flag.DurationVar(&flDeletedServiceTTL, "deleted-service-ttl", 5*time.Minute, "how long change notifications for a deleted service are ignored, unless it is recreated (0 to never ignore them)")
+	flag.DurationVar(&flEventDebounce, "event-debounce", 0, "hold a service back for this long after a change notification, coalescing further notifications for it, e.g. of CI pipelines redeploying many services (0 to queue it right away)")
+	flag.StringVar(&flShardMembership, "shard-membership", "", "Cloud Storage object (gs://bucket/object) where serve mode replicas record their membership to split the regions between them; disabled if empty")
+	flag.DurationVar(&flShardHeartbeatPeriod, "shard-heartbeat-period", 10*time.Second, "interval of the heartbeats of replicas to -shard-membership; replicas missing three heartbeats lose their regions")
+	flag.StringVar(&flPropagateLabels, "propagate-labels", "", "comma-separated list of Cloud Run service labels (e.g. team,env,cost-center) to record on the NEGs and backends of the service, for attribution in billing and asset inventory")
+	flag.BoolVar(&flAllowCoManagement, "allow-co-management", false, "modify backend services whose description marks them as managed by Terraform or Config Connector (see coManagementMarkers in -config); otherwise their changes are reported as conflicts")
+	flag.BoolVar(&flCheckAuth, "check-auth", false, "check that requests through the load balancer are authorized by the IAM policy of each service and the IAP setting of its backend services, marking services failing the check as misconfigured in their status annotation")
+	flag.DurationVar(&flServingWindow, "serving-window", 0, "evaluate the load balancer requests of this window in Cloud Monitoring to report whether services actually serve traffic, in /state and their status annotation (0 to disable)")
+	flag.IntVar(&flCanaryPercent, "canary-percent", 100, "only reconcile a stable, hash-based subset of this percentage of the matching services")
+	flag.StringVar(&flDriftMode, "drift-mode", driftCorrect, "what to do about out-of-band changes to converged resources: correct them, or only report them (report)")
+	flag.BoolVar(&flStrict, "strict", false, "never modify or delete NEGs and backend entries lacking the controller's ownership marker; conflicts are logged instead")
+	flag.BoolVar(&flHardenIngress, "harden-ingress", false, "restrict the ingress of services with an attached NEG to internal and load balancer traffic; restored when detached")
+	flag.StringVar(&flOptOut, "opt-out", optOutDelete, "what happens to the NEG of a service that is no longer managed: delete it, or only detach it and delete it after -opt-out-retention (detach); services override it with the autoneg-opt-out label")
+	flag.DurationVar(&flOptOutRetention, "opt-out-retention", 7*24*time.Hour, "how long the detached NEGs of services that opted out in detach mode are retained before being deleted (0 to retain them until deleted by hand)")
+	flag.StringVar(&flOptOutState, "opt-out-state", "", "file or Cloud Storage object (gs://bucket/object) recording since when NEGs are retained, required for the retention period to elapse across one-shot runs and restarts")
+	flag.BoolVar(&flTagNEGs, "tag-negs", false, "give services whose traffic is split across tagged revisions one NEG per tag, with backend capacity scalers mirroring the split, instead of one NEG")
+	flag.BoolVar(&flEventarc, "eventarc", false, "reconcile services on Cloud Run audit log events delivered by Eventarc to /eventarc (require authentication with Cloud Run IAM)")
+	flag.StringVar(&flEventarcRegister, "eventarc-register", "", "with -eventarc, create the Eventarc triggers of the Cloud Run service lifecycle events at startup, delivering them to the controller's Cloud Run service given as REGION/SERVICE")
+	flag.StringVar(&flEventarcServiceAccount, "eventarc-service-account", "", "service account the triggers created by -eventarc-register invoke the controller as; it needs roles/run.invoker and roles/eventarc.eventReceiver")
+	flag.BoolVar(&flAssetFeed, "asset-feed", false, "reconcile services on Cloud Asset feed notifications pushed by Pub/Sub to /asset-feed (require authentication with Cloud Run IAM)")
+	flag.BoolVar(&flCloudMonitoring, "cloud-monitoring", false, "write the controller metrics to Cloud Monitoring as custom metrics")
+	flag.DurationVar(&flAPITimeout, "api-timeout", 30*time.Second, "timeout of each Google API request attempt (0 for none)")
+	flag.IntVar(&flMaxRetries, "max-retries", 3, "maximum number of retries of Google API requests failing with transient errors")
+	flag.DurationVar(&flRetryInitialBackoff, "retry-initial-backoff", time.Second, "backoff before the first retry of a Google API request; doubles with every retry")
+	flag.DurationVar(&flOperationWaitTimeout, "operation-wait-timeout", 5*time.Minute, "maximum time to wait for a Compute Engine or Cloud Run operation to complete")
+	flag.StringVar(&flRecord, "record", "", "record all Google API interactions to this golden file")
+	flag.StringVar(&flReplay, "replay", "", "answer Google API requests from a golden file written with -record, without credentials (requires -project)")
+	flag.BoolVar(&flKubeBindings, "kube-bindings", false, "take the desired state from ServerlessNEGBinding resources of a Kubernetes cluster instead of service labels; -label-selector is ignored")
+	flag.StringVar(&flKubeconfig, "kubeconfig", "", "kubeconfig file of the cluster holding the bindings (defaults to the in-cluster configuration)")
+	flag.StringVar(&flKubeContext, "kube-context", "", "kubeconfig context of the cluster holding the bindings (defaults to the current context)")
+	flag.StringVar(&flDesiredState, "desired-state", "", "take the desired state from a YAML file in Cloud Storage (gs://bucket/object) instead of service labels; -label-selector is ignored")
+	flag.DurationVar(&flDesiredStatePollPeriod, "desired-state-poll-period", 30*time.Second, "interval at which serve mode polls the -desired-state file for changes (0 to only read it on syncs)")
+	flag.DurationVar(&flDegradedThreshold, "degraded-threshold", 30*time.Minute, "duration after which failing services are counted by the autoneg_degraded_services_beyond_threshold metric")
+	flag.BoolVar(&flDryRun, "dry-run", false, "plan the changes of every reconcile pass, but don't apply them")
+	flag.StringVar(&flDiffOutput, "diff-output", "", "file to write the planned changes of every reconcile pass to as JSON, replacing it each pass (- for JSON lines on stdout)")
+	flag.StringVar(&flApprovalWebhook, "approval-webhook", "", "URL to post every plan to before applying it; plans are only applied if the webhook approves them")
+	flag.StringVar(&flApprovalAudience, "approval-audience", "", "audience of the ID token authenticating requests to -approval-webhook (unauthenticated if empty)")
+	flag.DurationVar(&flApprovalTimeout, "approval-timeout", 30*time.Second, "time to wait for the approval of a plan before denying it")
+	flag.StringVar(&flPolicies, "policies", "", "comma-separated list of Rego files or directories with policies that planned mutations must comply with")
 }
 
 func main() {
+	flag.Parse()
 	logger := logrus.New()
+	if err := resolveFlags(flag.CommandLine); err != nil {
+		logger.Fatal(err)
+	}
 	loggingLevel, err := logrus.ParseLevel(flLoggingLevel)
 	if err != nil {
 		logger.Fatalf("invalid logging level: %v", err)
@@ -67,48 +222,238 @@ func main() {
 		if serviceName == "" {
 			serviceName = "serverless-autoneg-controller"
 		}
-		logger.Formatter = sdlog.NewFormatter(
+		logger.Formatter = &traceFormatter{next: sdlog.NewFormatter(
 			sdlog.WithService(serviceName),
-		)
+		)}
 	}
 
+	ctx := context.Background()
+	args := flag.Args()
+	if len(args) == 0 {
+		args = []string{"run"}
+	}
+	if err := runCommand(ctx, logger, args[0], args[1:]); err != nil {
+		code := 1
+		var ee *exitError
+		if errors.As(err, &ee) {
+			code = ee.code
+		}
+		logger.WithError(err).Error("command failed")
+		os.Exit(code)
+	}
+}
+
+// newReconciler detects the project if needed, validates the flags and
+// configuration file, and initializes the API clients.
+func newReconciler(ctx context.Context, logger *logrus.Logger) (*reconciler, error) {
+	if flRecord != "" && flReplay != "" {
+		return nil, errors.New("-record and -replay are mutually exclusive")
+	}
+	if err := setupRecording(); err != nil {
+		return nil, err
+	}
 	if flProject == "" {
 		logger.Info("-project not specified, trying to autodetect one")
-		flProject, err = determineProjectID(logger)
+		v, err := determineProjectID(ctx, logger)
 		if err != nil {
-			logger.Fatalf("failed to detect project, must specify one with -project: %v", err)
-		} else {
-			logger.Infof("project detected: %s", flProject)
+			return nil, errors.Wrap(err, "failed to detect project, must specify one with -project")
 		}
+		flProject = v
+		logger.Infof("project detected: %s", flProject)
 	}
 
-	ctx := context.Background()
-	_, err = getCloudRunServices(ctx, logger, flProject, "europe-west1", "labe=xyz")
-
-}
+	cfg, err := loadConfig(flConfig)
+	if err != nil {
+		return nil, err
+	}
+	include, err := parseLabelSelector(flLabelSelector)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid -label-selector")
+	}
+	exclude, err := parseLabelSelector(flExcludeLabelSelector)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid -exclude-label-selector")
+	}
+	includeFields, err := parseFieldSelector(flFieldSelector)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid -field-selector")
+	}
+	excludeFields, err := parseFieldSelector(flExcludeFieldSelector)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid -exclude-field-selector")
+	}
+	regions := splitList(flRegions)
+	if len(regions) == 0 {
+		return nil, errors.New("-regions must specify at least one region")
+	}
+	negNames, err := parseNameTemplate(flNEGNameTemplate)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid -neg-name-template")
+	}
+	if flCanaryPercent < 0 || flCanaryPercent > 100 {
+		return nil, errors.New("-canary-percent must be between 0 and 100")
+	}
+	if flStrict && flAdopt {
+		return nil, errors.New("-strict and -adopt are mutually exclusive")
+	}
+	driftMode, err := parseDriftMode(flDriftMode)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid -drift-mode")
+	}
+	optOut, err := parseOptOutMode(flOptOut)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid -opt-out")
+	}
+	if flOptOutRetention < 0 {
+		return nil, errors.New("-opt-out-retention must not be negative")
+	}
 
-func getCloudRunServices(ctx context.Context, logger *logrus.Logger, project, region, labelSelector string) ([]*run.GoogleCloudRunV2Service, error) {
-	lg := logger.WithFields(logrus.Fields{
-		"region":        region,
-		"labelSelector": labelSelector,
-	})
+	var source desiredStateSource
+	switch {
+	case flKubeBindings && flDesiredState != "":
+		return nil, errors.New("-kube-bindings and -desired-state are mutually exclusive")
+	case flKubeBindings:
+		var kc *kubeClient
+		if flKubeconfig != "" {
+			kc, err = newKubeClient(flKubeconfig, flKubeContext)
+		} else {
+			kc, err = newInClusterKubeClient()
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to initialize Kubernetes client for -kube-bindings")
+		}
+		source = newBindingSource(ctx, kc, logger)
+	case flDesiredState != "":
+		if source, err = newStateFileSource(ctx, flDesiredState, cfg, regions, flDesiredStatePollPeriod, logger); err != nil {
+			return nil, err
+		}
+	}
+	if source != nil {
+		include = labelSelector{{key: labelBackendService, op: "exists"}}
+	}
 
-	lg.Debug("querying Cloud Run services")
-	runService, err := run.NewService(ctx)
+	opts, err := projectClientOptions(ctx, cfg, flProject)
+	if err != nil {
+		return nil, err
+	}
+	runService, err := run.NewService(ctx, opts...)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to initialize Cloud Run client")
 	}
+	computeService, err := compute.NewService(ctx, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialize Compute Engine client")
+	}
+	// Clients of the frontend projects are created upfront, as the token
+	// sources of impersonated credentials live as long as their context.
+	frontendProjects := splitList(flFrontendProjects)
+	frontendCompute := make(map[string]*compute.Service, len(frontendProjects))
+	for _, fp := range frontendProjects {
+		fopts, err := projectClientOptions(ctx, cfg, fp)
+		if err != nil {
+			return nil, err
+		}
+		if frontendCompute[fp], err = compute.NewService(ctx, fopts...); err != nil {
+			return nil, errors.Wrapf(err, "failed to initialize Compute Engine client of frontend project %q", fp)
+		}
+	}
+
+	var audit *auditLog
+	if flAuditLog != "" {
+		if audit, err = newAuditLog(ctx, flAuditLog, cfg); err != nil {
+			return nil, err
+		}
+	}
 
-	svcs, err := runService.Projects.Locations.Services.List(fmt.Sprintf("projects/%s/locations/%s",project,region)).Do()
+	operations, err := newOperationStore(ctx, flOperationsState, cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	applier := &apply.Client{Compute: computeService, WaitTimeout: flOperationWaitTimeout, Operations: operations}
+
+	metrics := newControllerMetrics()
+	failures := newServiceFailures()
+	metrics.failures, metrics.degradedThreshold = failures, flDegradedThreshold
+	breakers := newRegionBreakers(flRegionFailureThreshold, flRegionCooldown)
+	metrics.breakers = breakers
+	var diffs *diffWriter
+	if flDiffOutput != "" {
+		diffs = &diffWriter{location: flDiffOutput}
+	}
+	var pols *policies
+	if paths := splitList(flPolicies); len(paths) != 0 {
+		if pols, err = loadPolicies(ctx, paths); err != nil {
+			return nil, err
+		}
+	}
+	var approval *approvalWebhook
+	if flApprovalWebhook != "" {
+		if approval, err = newApprovalWebhook(ctx, flApprovalWebhook, flApprovalAudience, flApprovalTimeout); err != nil {
+			return nil, err
+		}
+	}
+	rollout, err := newRollout(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	retention, err := newRetention(ctx, cfg, flOptOutRetention, flOptOutState)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to get services with label %q in region %q", labelSelector, region)
+		return nil, err
 	}
+	serving, err := newServingTracker(ctx, flProject, cfg, flServingWindow)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &reconciler{
+		logger:         logger,
+		project:        flProject,
+		regions:        regions,
+		cfg:            cfg,
+		runService:     runService,
+		computeService: computeService,
+		audit:          audit,
+		applier:        applier,
+		operations:     operations,
+		metrics:        metrics,
+		failures:       failures,
+		breakers:       breakers,
+		priorities:     newServicePriorities(),
+		include:        include,
+		exclude:        exclude,
+		includeFields:  includeFields,
+		excludeFields:  excludeFields,
+		negNames:       negNames,
+		maxDeletions:   flMaxDeletions,
+		adopt:          flAdopt,
+		canaryPercent:  flCanaryPercent,
+		driftMode:      driftMode,
+		strict:         flStrict,
+		hardenIngress:  flHardenIngress,
+		tagNEGs:        flTagNEGs,
+		source:         source,
+		dryRun:         flDryRun,
+		diffs:          diffs,
+		approval:       approval,
+		policies:       pols,
+		rollout:        rollout,
+		optOut:         optOut,
+		retention:      retention,
 
-	lg.WithField("n", len(svcs.Services)).Debug("finished retrieving services from the API")
-	return svcs.Services, nil
+		cache:             computeCache{ttl: flComputeCacheTTL},
+		regionConcurrency: flRegionConcurrency,
+		frontendProjects:  frontendProjects,
+		frontendCompute:   frontendCompute,
+		propagateLabels:   splitList(flPropagateLabels),
+		allowCoManagement: flAllowCoManagement,
+		authChecks:        flCheckAuth,
+		serving:           serving,
+	}
+	applier.OnPatch = r.logPatch
+	return r, nil
 }
 
-func determineProjectID(logger *logrus.Logger) (string, error) {
+func determineProjectID(ctx context.Context, logger *logrus.Logger) (string, error) {
 	if metadata.OnGCE() {
 		logger.Debug("trying gce metadata service for project ID")
 		v, err := metadata.ProjectID()
@@ -119,23 +464,82 @@ func determineProjectID(logger *logrus.Logger) (string, error) {
 		return v, nil
 	}
 
-	logger.Debug("service not running on gce, trying gcloud for core/project")
-	cmd := exec.Command("gcloud", "config", "get-value", "core/project", "-q")
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout, cmd.Stderr = &stdout, &stderr
-	err := cmd.Run()
+	logger.Debug("service not running on gce, trying application default credentials")
+	creds, err := google.FindDefaultCredentials(ctx, cloudPlatformScope)
 	if err != nil {
-		msg := "error when running gcloud command to get default project"
-		if stderr.Len() != 0 {
-			msg += fmt.Sprintf(", stderr=%s", stderr.String())
+		return "", errors.Wrap(err, "error when looking up application default credentials")
+	}
+	if creds.ProjectID != "" {
+		logger.Debug("found project ID in application default credentials")
+		return creds.ProjectID, nil
+	}
+
+	if len(creds.JSON) != 0 {
+		var f struct {
+			QuotaProjectID string `json:"quota_project_id"`
+		}
+		if err := json.Unmarshal(creds.JSON, &f); err != nil {
+			return "", errors.Wrap(err, "error when parsing application default credentials file")
+		}
+		if f.QuotaProjectID != "" {
+			logger.Debug("found quota project ID in application default credentials")
+			return f.QuotaProjectID, nil
 		}
-		return "", errors.Wrap(err, msg)
 	}
+	return "", errors.New("application default credentials do not specify a project")
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// clientOptions returns the options used to construct every Google API
+// client of the controller. Requests are retried and bounded according to
+// -max-retries, -retry-initial-backoff and -api-timeout, and writes are
+// paced according to the project budgets of cfg.
+func clientOptions(ctx context.Context, cfg *config) ([]option.ClientOption, error) {
+	return projectClientOptions(ctx, cfg, "")
+}
 
-	v := strings.TrimSpace(stdout.String())
-	if v == "" {
-		return "", errors.New("gcloud command returned empty project value")
+// projectClientOptions returns the options of clients accessing a project,
+// with the credentials configured for it, if any.
+func projectClientOptions(ctx context.Context, cfg *config, project string) ([]option.ClientOption, error) {
+	if simulation != nil {
+		return []option.ClientOption{option.WithHTTPClient(&http.Client{Transport: simulation})}, nil
+	}
+	opts := []option.ClientOption{option.WithScopes(cloudPlatformScope)}
+	if flQuotaProject != "" {
+		opts = append(opts, option.WithQuotaProject(flQuotaProject))
+	}
+	switch c := cfg.Credentials[project]; {
+	case c.CredentialsFile != "":
+		opts = append(opts, option.WithCredentialsFile(c.CredentialsFile))
+	case c.ImpersonateServiceAccount != "":
+		ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: c.ImpersonateServiceAccount,
+			Scopes:          []string{cloudPlatformScope},
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to impersonate %s for project %q", c.ImpersonateServiceAccount, project)
+		}
+		opts = append(opts, option.WithTokenSource(ts))
+	}
+	t, err := htransport.NewTransport(ctx, apiTransport, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialize API transport")
 	}
-	logger.Debug("found project ID on gcloud")
-	return v, nil
+	client := &http.Client{Transport: &identifyingTransport{next: &retryTransport{
+		next:           newPacedTransport(t, cfg),
+		timeout:        flAPITimeout,
+		maxRetries:     flMaxRetries,
+		initialBackoff: flRetryInitialBackoff,
+	}}}
+	return []option.ClientOption{option.WithHTTPClient(client)}, nil
 }
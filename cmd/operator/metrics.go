@@ -0,0 +1,192 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Results of reconcile passes, as counted by the metrics.
+const (
+	resultSuccess = "success"
+	resultPartial = "partial"
+	resultFailed  = "failed"
+)
+
+// controllerMetrics collects the controller's metrics, which are served in
+// the Prometheus text format and optionally exported to Cloud Monitoring.
+type controllerMetrics struct {
+	mu    sync.Mutex
+	start time.Time
+
+	managedServices int64
+	reconciles      map[string]int64 // by result
+	failedMutations map[errorKind]int64
+	driftMutations  int64
+	// queue is the work queue of serve mode, if any.
+	queue *workQueue
+	// failures tracks the degraded services; those failing for longer than
+	// degradedThreshold are counted separately.
+	failures          *serviceFailures
+	degradedThreshold time.Duration
+	// breakers holds the circuit breakers of the regions.
+	breakers *regionBreakers
+}
+
+func newControllerMetrics() *controllerMetrics {
+	return &controllerMetrics{start: time.Now(), reconciles: make(map[string]int64), failedMutations: make(map[errorKind]int64)}
+}
+
+// failedMutation counts a mutation that failed with an error of the given
+// kind.
+func (m *controllerMetrics) failedMutation(kind errorKind) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failedMutations[kind]++
+}
+
+// observe records the outcome of a reconcile pass. The number of managed
+// services is only taken from complete passes, which covered all regions and
+// services.
+func (m *controllerMetrics) observe(res *reconcileResult, err error, complete bool) {
+	result := resultSuccess
+	if err != nil {
+		result = resultFailed
+		var pe *partialError
+		if errors.As(err, &pe) {
+			result = resultPartial
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reconciles[result]++
+	m.driftMutations += int64(res.Drift)
+	if complete {
+		m.managedServices = int64(res.Services)
+	}
+}
+
+// metricsSnapshot is a consistent copy of the metrics.
+type metricsSnapshot struct {
+	Start           time.Time
+	ManagedServices int64
+	Reconciles      map[string]int64
+	// FailedMutations holds the number of failed mutations by error kind.
+	FailedMutations map[errorKind]int64
+	DriftMutations  int64
+	Queue           *queueStats
+	// Degraded is the number of failing services and DegradedBeyondThreshold
+	// the number of those failing for longer than -degraded-threshold.
+	Degraded                int64
+	DegradedBeyondThreshold int64
+	// OpenCircuits holds the regions skipped after repeated failures.
+	OpenCircuits []string
+}
+
+func (m *controllerMetrics) snapshot() metricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := metricsSnapshot{
+		Start:           m.start,
+		ManagedServices: m.managedServices,
+		Reconciles:      make(map[string]int64, len(m.reconciles)),
+		FailedMutations: make(map[errorKind]int64, len(errorKinds)),
+		DriftMutations:  m.driftMutations,
+		OpenCircuits:    m.breakers.open(),
+	}
+	for k, v := range m.reconciles {
+		s.Reconciles[k] = v
+	}
+	for _, k := range errorKinds {
+		s.FailedMutations[k] = m.failedMutations[k]
+	}
+	if m.queue != nil {
+		qs := m.queue.stats()
+		s.Queue = &qs
+	}
+	if m.failures != nil {
+		for _, h := range m.failures.degraded() {
+			s.Degraded++
+			if time.Since(h.FailingSince) > m.degradedThreshold {
+				s.DegradedBeyondThreshold++
+			}
+		}
+	}
+	return s
+}
+
+// writePrometheus writes the metrics in the Prometheus text format.
+func (s metricsSnapshot) writePrometheus(w io.Writer) {
+	fmt.Fprintln(w, "# HELP autoneg_managed_services Number of Cloud Run services managed by the controller.")
+	fmt.Fprintln(w, "# TYPE autoneg_managed_services gauge")
+	fmt.Fprintf(w, "autoneg_managed_services %d\n", s.ManagedServices)
+	fmt.Fprintln(w, "# HELP autoneg_reconciles_total Number of reconcile passes by result.")
+	fmt.Fprintln(w, "# TYPE autoneg_reconciles_total counter")
+	for _, result := range sortedKeys(s.Reconciles) {
+		fmt.Fprintf(w, "autoneg_reconciles_total{result=%q} %d\n", result, s.Reconciles[result])
+	}
+	fmt.Fprintln(w, "# HELP autoneg_failed_mutations_total Number of mutations that failed to apply, by error kind.")
+	fmt.Fprintln(w, "# TYPE autoneg_failed_mutations_total counter")
+	for _, kind := range errorKinds {
+		fmt.Fprintf(w, "autoneg_failed_mutations_total{kind=%q,misconfiguration=\"%t\"} %d\n", kind, kind.misconfiguration(), s.FailedMutations[kind])
+	}
+	fmt.Fprintln(w, "# HELP autoneg_drift_mutations_total Number of mutations undoing out-of-band changes.")
+	fmt.Fprintln(w, "# TYPE autoneg_drift_mutations_total counter")
+	fmt.Fprintf(w, "autoneg_drift_mutations_total %d\n", s.DriftMutations)
+	fmt.Fprintln(w, "# HELP autoneg_degraded_services Number of services whose mutations failed in their last attempted pass.")
+	fmt.Fprintln(w, "# TYPE autoneg_degraded_services gauge")
+	fmt.Fprintf(w, "autoneg_degraded_services %d\n", s.Degraded)
+	fmt.Fprintln(w, "# HELP autoneg_degraded_services_beyond_threshold Number of services failing for longer than -degraded-threshold.")
+	fmt.Fprintln(w, "# TYPE autoneg_degraded_services_beyond_threshold gauge")
+	fmt.Fprintf(w, "autoneg_degraded_services_beyond_threshold %d\n", s.DegradedBeyondThreshold)
+	fmt.Fprintln(w, "# HELP autoneg_region_circuit_open Regions skipped after repeated failures, until they are probed successfully.")
+	fmt.Fprintln(w, "# TYPE autoneg_region_circuit_open gauge")
+	for _, region := range s.OpenCircuits {
+		fmt.Fprintf(w, "autoneg_region_circuit_open{region=%q} 1\n", region)
+	}
+	if s.Queue == nil {
+		return
+	}
+	fmt.Fprintln(w, "# HELP autoneg_queue_depth Number of items waiting in the work queue.")
+	fmt.Fprintln(w, "# TYPE autoneg_queue_depth gauge")
+	fmt.Fprintf(w, "autoneg_queue_depth %d\n", s.Queue.Depth)
+	fmt.Fprintln(w, "# HELP autoneg_queue_oldest_item_age_seconds Age of the oldest item waiting in the work queue.")
+	fmt.Fprintln(w, "# TYPE autoneg_queue_oldest_item_age_seconds gauge")
+	fmt.Fprintf(w, "autoneg_queue_oldest_item_age_seconds %g\n", s.Queue.OldestAge.Seconds())
+	fmt.Fprintln(w, "# HELP autoneg_queue_retries_total Number of work queue items retried after a failure.")
+	fmt.Fprintln(w, "# TYPE autoneg_queue_retries_total counter")
+	fmt.Fprintf(w, "autoneg_queue_retries_total %d\n", s.Queue.Retries)
+	fmt.Fprintln(w, "# HELP autoneg_queue_coalesced_events_total Number of change notifications coalesced into work queue items already waiting or held back.")
+	fmt.Fprintln(w, "# TYPE autoneg_queue_coalesced_events_total counter")
+	fmt.Fprintf(w, "autoneg_queue_coalesced_events_total %d\n", s.Queue.Coalesced)
+	fmt.Fprintln(w, "# HELP autoneg_queue_wait_seconds Time work queue items waited until they were processed, by priority.")
+	fmt.Fprintln(w, "# TYPE autoneg_queue_wait_seconds summary")
+	for p := priorityHigh; p < numPriorities; p++ {
+		fmt.Fprintf(w, "autoneg_queue_wait_seconds_sum{priority=%q} %g\n", p, s.Queue.WaitSum[p].Seconds())
+		fmt.Fprintf(w, "autoneg_queue_wait_seconds_count{priority=%q} %d\n", p, s.Queue.WaitCount[p])
+	}
+}
+
+// handleMetrics serves the metrics in the Prometheus text format.
+func (s *server) handleMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.r.metrics.snapshot().writePrometheus(w)
+}
@@ -0,0 +1,211 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Annotations of the GKE autoneg controller.
+const (
+	gkeAutonegAnnotation       = "controller.autoneg.dev/neg"
+	legacyGKEAutonegAnnotation = "anthos.cft.dev/autoneg"
+)
+
+// gkeAutonegBackend is a backend service entry of a GKE autoneg annotation.
+type gkeAutonegBackend struct {
+	Name               string  `json:"name"`
+	Region             string  `json:"region"`
+	MaxRatePerEndpoint float64 `json:"max_rate_per_endpoint"`
+	MaxConnections     float64 `json:"max_connections_per_endpoint"`
+}
+
+// migration is the Cloud Run configuration equivalent to a GKE service's
+// autoneg annotations.
+type migration struct {
+	Source  string            `yaml:"source"`
+	Service string            `yaml:"service"`
+	Region  string            `yaml:"region"`
+	Labels  map[string]string `yaml:"labels"`
+}
+
+// runMigrate implements the migrate command, which translates the autoneg
+// annotations of GKE services into the labels this controller expects on the
+// corresponding Cloud Run services.
+func runMigrate(ctx context.Context, logger *logrus.Logger, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	kubeconfigFile := fs.String("kubeconfig", "", "path to the kubeconfig file (defaults to $KUBECONFIG or ~/.kube/config)")
+	kubeContext := fs.String("context", "", "kubeconfig context to use (defaults to the current context)")
+	allNamespaces := fs.Bool("all-namespaces", false, "migrate services of all namespaces instead of the context's namespace")
+	region := fs.String("region", "", "region of the Cloud Run services")
+	output := fs.String("output", "commands", "output format: commands (gcloud commands) or yaml")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *region == "" {
+		return errors.New("migrate: -region is required")
+	}
+	if *output != "commands" && *output != "yaml" {
+		return errors.Errorf("migrate: unknown output format %q", *output)
+	}
+	include, err := parseLabelSelector(flLabelSelector)
+	if err != nil {
+		return errors.Wrap(err, "invalid -label-selector")
+	}
+	selected, err := selectorLabels(include)
+	if err != nil {
+		return errors.Wrap(err, "migrate: invalid -label-selector")
+	}
+
+	kc, err := newKubeClient(*kubeconfigFile, *kubeContext)
+	if err != nil {
+		return err
+	}
+	ksvcs, err := kc.listServices(ctx, *allNamespaces)
+	if err != nil {
+		return err
+	}
+
+	var migrations []migration
+	for _, ksvc := range ksvcs {
+		lg := logger.WithField("source", ksvc.Namespace+"/"+ksvc.Name)
+		backends, err := parseGKEAutonegAnnotations(ksvc.Annotations)
+		if err != nil {
+			lg.WithError(err).Warn("skipping service with invalid autoneg annotation")
+			continue
+		}
+		if len(backends) == 0 {
+			continue
+		}
+		var names, scopes []string
+		regional := false
+		for _, b := range backends {
+			if b.MaxRatePerEndpoint != 0 || b.MaxConnections != 0 {
+				lg.WithField("backendService", b.Name).Warn("capacity settings do not apply to serverless NEGs and are dropped")
+			}
+			if contains(names, b.Name) {
+				continue
+			}
+			scope := "global"
+			if b.Region != "" {
+				if b.Region != *region {
+					lg.WithField("backendRegion", b.Region).Warn("regional backend service is not in the Cloud Run region")
+				}
+				scope = "regional"
+				regional = true
+			}
+			names = append(names, b.Name)
+			scopes = append(scopes, scope)
+		}
+
+		labels := make(map[string]string)
+		for k, v := range selected {
+			labels[k] = v
+		}
+		labels[labelBackendService] = strings.Join(names, labelListSeparator)
+		if regional {
+			labels[labelBackendScope] = strings.Join(scopes, labelListSeparator)
+		}
+		migrations = append(migrations, migration{
+			Source:  ksvc.Namespace + "/" + ksvc.Name,
+			Service: ksvc.Name,
+			Region:  *region,
+			Labels:  labels,
+		})
+	}
+
+	if *output == "yaml" {
+		return yaml.NewEncoder(os.Stdout).Encode(migrations)
+	}
+	return writeMigrationCommands(os.Stdout, migrations)
+}
+
+// parseGKEAutonegAnnotations returns the backend services configured by the
+// current or legacy GKE autoneg annotation, ordered by service port.
+func parseGKEAutonegAnnotations(annotations map[string]string) ([]gkeAutonegBackend, error) {
+	if v, ok := annotations[gkeAutonegAnnotation]; ok {
+		var cfg struct {
+			BackendServices map[string][]gkeAutonegBackend `json:"backend_services"`
+		}
+		if err := json.Unmarshal([]byte(v), &cfg); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse annotation %q", gkeAutonegAnnotation)
+		}
+		var out []gkeAutonegBackend
+		for _, port := range sortedKeys(cfg.BackendServices) {
+			out = append(out, cfg.BackendServices[port]...)
+		}
+		return out, nil
+	}
+	if v, ok := annotations[legacyGKEAutonegAnnotation]; ok {
+		var b gkeAutonegBackend
+		if err := json.Unmarshal([]byte(v), &b); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse annotation %q", legacyGKEAutonegAnnotation)
+		}
+		return []gkeAutonegBackend{b}, nil
+	}
+	return nil, nil
+}
+
+// selectorLabels returns the labels a service needs to match sel: the value
+// of equality requirements, and "true" for existence requirements. Negative
+// requirements are met by leaving the labels unset. It returns an error for
+// a requirement that no set of labels meets together with the others.
+func selectorLabels(sel labelSelector) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, r := range sel {
+		switch r.op {
+		case "=":
+			labels[r.key] = r.value
+		case "exists":
+			if _, ok := labels[r.key]; !ok {
+				labels[r.key] = "true"
+			}
+		}
+	}
+	for _, r := range sel {
+		if !(labelSelector{r}).matches(labels) {
+			return nil, errors.Errorf("requirement %q of selector %q can't be expressed as labels", labelSelector{r}, sel)
+		}
+	}
+	return labels, nil
+}
+
+func writeMigrationCommands(w io.Writer, migrations []migration) error {
+	var project string
+	if flProject != "" {
+		project = " --project=" + flProject
+	}
+	for _, m := range migrations {
+		var labels []string
+		for _, k := range sortedKeys(m.Labels) {
+			labels = append(labels, k+"="+m.Labels[k])
+		}
+		if _, err := fmt.Fprintf(w, "# %s\ngcloud run services update %s%s --region=%s --update-labels=%s\n",
+			m.Source, m.Service, project, m.Region, strings.Join(labels, ",")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
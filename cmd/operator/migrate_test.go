@@ -0,0 +1,116 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestParseGKEAutonegAnnotations(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		annotations map[string]string
+		want        []gkeAutonegBackend
+		wantErr     bool
+	}{
+		{name: "none", annotations: map[string]string{"other": "x"}},
+		{
+			name:        "ports in order",
+			annotations: map[string]string{gkeAutonegAnnotation: `{"backend_services":{"8080":[{"name":"web-alt"}],"80":[{"name":"web","max_rate_per_endpoint":100},{"name":"internal","region":"us-central1"}]}}`},
+			want: []gkeAutonegBackend{
+				{Name: "web", MaxRatePerEndpoint: 100},
+				{Name: "internal", Region: "us-central1"},
+				{Name: "web-alt"},
+			},
+		},
+		{
+			name:        "legacy",
+			annotations: map[string]string{legacyGKEAutonegAnnotation: `{"name":"web","max_connections_per_endpoint":10}`},
+			want:        []gkeAutonegBackend{{Name: "web", MaxConnections: 10}},
+		},
+		{
+			name: "current wins over legacy",
+			annotations: map[string]string{
+				gkeAutonegAnnotation:       `{"backend_services":{"80":[{"name":"new"}]}}`,
+				legacyGKEAutonegAnnotation: `{"name":"old"}`,
+			},
+			want: []gkeAutonegBackend{{Name: "new"}},
+		},
+		{name: "invalid", annotations: map[string]string{gkeAutonegAnnotation: `{"backend_services":`}, wantErr: true},
+		{name: "invalid legacy", annotations: map[string]string{legacyGKEAutonegAnnotation: `web`}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseGKEAutonegAnnotations(tc.annotations)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("err = %v, want error = %v", err, tc.wantErr)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("backends = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSelectorLabels(t *testing.T) {
+	for _, tc := range []struct {
+		sel     string
+		want    map[string]string
+		wantErr bool
+	}{
+		{sel: "", want: map[string]string{}},
+		{sel: "autoneg=true,team", want: map[string]string{"autoneg": "true", "team": "true"}},
+		{sel: "team,team=web", want: map[string]string{"team": "web"}},
+		{sel: "autoneg=true,env!=dev,!legacy", want: map[string]string{"autoneg": "true"}},
+		{sel: "env=prod,env!=prod", wantErr: true},
+		{sel: "team,!team", wantErr: true},
+		{sel: "env=prod,env=dev", wantErr: true},
+	} {
+		sel, err := parseLabelSelector(tc.sel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := selectorLabels(sel)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("selectorLabels(%q) error = %v, want error = %v", tc.sel, err, tc.wantErr)
+			continue
+		}
+		if err == nil && fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("selectorLabels(%q) = %v, want %v", tc.sel, got, tc.want)
+		}
+	}
+}
+
+func TestWriteMigrationCommands(t *testing.T) {
+	project := flProject
+	t.Cleanup(func() { flProject = project })
+	flProject = "p"
+	var b bytes.Buffer
+	err := writeMigrationCommands(&b, []migration{{
+		Source:  "default/web",
+		Service: "web",
+		Region:  "us-central1",
+		Labels:  map[string]string{labelBackendService: "web_internal", labelBackendScope: "global_regional", "autoneg": "true"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = "# default/web\n" +
+		"gcloud run services update web --project=p --region=us-central1 --update-labels=autoneg=true,autoneg-backend-scope=global_regional,autoneg-backend-service=web_internal\n"
+	if b.String() != want {
+		t.Errorf("commands:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/pkg/errors"
+	"google.golang.org/api/monitoring/v3"
+)
+
+// customMetricPrefix is the prefix of the controller's Cloud Monitoring
+// custom metric types.
+const customMetricPrefix = "custom.googleapis.com/serverless-autoneg-controller/"
+
+// monitoringExportPeriod is the interval of Cloud Monitoring exports in serve
+// mode. Cloud Monitoring accepts at most one point per time series every few
+// seconds.
+const monitoringExportPeriod = time.Minute
+
+// monitoringExporter writes the controller metrics to Cloud Monitoring as
+// custom metrics of a generic_task monitored resource identifying the
+// instance, so that the series of replicas, or of the tasks of a job, don't
+// overwrite each other.
+type monitoringExporter struct {
+	project  string
+	service  *monitoring.Service
+	resource *monitoring.MonitoredResource
+}
+
+func newMonitoringExporter(ctx context.Context, project string, cfg *config) (*monitoringExporter, error) {
+	opts, err := projectClientOptions(ctx, cfg, project)
+	if err != nil {
+		return nil, err
+	}
+	service, err := monitoring.NewService(ctx, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialize Cloud Monitoring client")
+	}
+	return &monitoringExporter{project: project, service: service, resource: taskResource(project)}, nil
+}
+
+// taskResource returns the generic_task monitored resource of this instance:
+// the Cloud Run service or job as the job, and the replica ID as the task, in
+// the region the instance runs in.
+func taskResource(project string) *monitoring.MonitoredResource {
+	job := os.Getenv("K_SERVICE")
+	if job == "" {
+		job = os.Getenv("CLOUD_RUN_JOB")
+	}
+	if job == "" {
+		job = "serverless-autoneg-controller"
+	}
+	task := replicaID()
+	if i := os.Getenv("CLOUD_RUN_TASK_INDEX"); i != "" {
+		task = i + "-" + task
+	}
+	location := "global"
+	if metadata.OnGCE() {
+		// The region is returned as projects/NUMBER/regions/REGION.
+		if v, err := metadata.Get("instance/region"); err == nil && v != "" {
+			location = path.Base(v)
+		}
+	}
+	return &monitoring.MonitoredResource{Type: "generic_task", Labels: map[string]string{
+		"project_id": project,
+		"location":   location,
+		"namespace":  "serverless-autoneg-controller",
+		"job":        job,
+		"task_id":    task,
+	}}
+}
+
+// export writes the current value of every metric.
+func (e *monitoringExporter) export(ctx context.Context, s metricsSnapshot) error {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	start := s.Start.UTC().Format(time.RFC3339Nano)
+	series := func(name, kind string, labels map[string]string, v int64) *monitoring.TimeSeries {
+		interval := &monitoring.TimeInterval{EndTime: now}
+		if kind == "CUMULATIVE" {
+			interval.StartTime = start
+		}
+		return &monitoring.TimeSeries{
+			Metric:     &monitoring.Metric{Type: customMetricPrefix + name, Labels: labels},
+			Resource:   e.resource,
+			MetricKind: kind,
+			ValueType:  "INT64",
+			Points:     []*monitoring.Point{{Interval: interval, Value: &monitoring.TypedValue{Int64Value: &v}}},
+		}
+	}
+
+	ts := []*monitoring.TimeSeries{
+		series("managed_services", "GAUGE", nil, s.ManagedServices),
+		series("drift_mutations", "CUMULATIVE", nil, s.DriftMutations),
+		series("degraded_services", "GAUGE", nil, s.Degraded),
+		series("degraded_services_beyond_threshold", "GAUGE", nil, s.DegradedBeyondThreshold),
+	}
+	for _, result := range sortedKeys(s.Reconciles) {
+		ts = append(ts, series("reconciles", "CUMULATIVE", map[string]string{"result": result}, s.Reconciles[result]))
+	}
+	for _, kind := range errorKinds {
+		ts = append(ts, series("failed_mutations", "CUMULATIVE", map[string]string{"kind": string(kind)}, s.FailedMutations[kind]))
+	}
+	if s.Queue != nil {
+		ts = append(ts,
+			series("queue_depth", "GAUGE", nil, s.Queue.Depth),
+			series("queue_oldest_item_age_seconds", "GAUGE", nil, int64(s.Queue.OldestAge.Seconds())),
+			series("queue_retries", "CUMULATIVE", nil, s.Queue.Retries),
+			series("queue_coalesced_events", "CUMULATIVE", nil, s.Queue.Coalesced),
+		)
+	}
+	_, err := e.service.Projects.TimeSeries.Create("projects/"+e.project, &monitoring.CreateTimeSeriesRequest{TimeSeries: ts}).Context(ctx).Do()
+	return errors.Wrap(err, "failed to write metrics to Cloud Monitoring")
+}
+
+// exportLoop exports the metrics every period until ctx is done.
+func (e *monitoringExporter) exportLoop(ctx context.Context, m *controllerMetrics, period time.Duration, onError func(error)) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(period):
+			if err := e.export(ctx, m.snapshot()); err != nil {
+				onError(err)
+			}
+		}
+	}
+}
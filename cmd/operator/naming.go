@@ -0,0 +1,87 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxResourceNameLength is the maximum length of a compute resource name.
+	maxResourceNameLength = 63
+	// nameHashLength is the number of hex characters of the hash suffix
+	// appended to names that had to be shortened.
+	nameHashLength = 8
+)
+
+var (
+	resourceNameRegexp = regexp.MustCompile(`^[a-z]([-a-z0-9]*[a-z0-9])?$`)
+	placeholderRegexp  = regexp.MustCompile(`\{[^}]*\}`)
+	invalidNameChars   = regexp.MustCompile(`[^-a-z0-9]`)
+)
+
+// nameTemplate renders compute resource names from Cloud Run service
+// attributes. Supported placeholders are {service}, {region} and {project}.
+type nameTemplate struct {
+	tmpl string
+}
+
+func parseNameTemplate(tmpl string) (*nameTemplate, error) {
+	for _, p := range placeholderRegexp.FindAllString(tmpl, -1) {
+		switch p {
+		case "{service}", "{region}", "{project}":
+		default:
+			return nil, errors.Errorf("unknown placeholder %s in name template %q", p, tmpl)
+		}
+	}
+	if !strings.Contains(tmpl, "{service}") {
+		return nil, errors.Errorf("name template %q must contain {service}", tmpl)
+	}
+	t := &nameTemplate{tmpl: tmpl}
+	if name := t.render("my-service", "europe-west1", "my-project"); !resourceNameRegexp.MatchString(name) {
+		return nil, errors.Errorf("name template %q renders invalid resource names (e.g. %q)", tmpl, name)
+	}
+	return t, nil
+}
+
+// render expands the template. Characters not allowed in compute resource
+// names are replaced with dashes, and names exceeding the length limit are
+// truncated and suffixed with a hash of the full name to keep them unique.
+func (t *nameTemplate) render(service, region, project string) string {
+	name := strings.NewReplacer(
+		"{service}", service,
+		"{region}", region,
+		"{project}", project,
+	).Replace(t.tmpl)
+	name = invalidNameChars.ReplaceAllString(strings.ToLower(name), "-")
+	if len(name) <= maxResourceNameLength {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	prefix := strings.TrimRight(name[:maxResourceNameLength-nameHashLength-1], "-")
+	return prefix + "-" + hex.EncodeToString(sum[:])[:nameHashLength]
+}
+
+func (t *nameTemplate) String() string { return t.tmpl }
+
+// validResourceName reports whether name satisfies the compute naming rules.
+func validResourceName(name string) bool {
+	return len(name) <= maxResourceNameLength && resourceNameRegexp.MatchString(name)
+}
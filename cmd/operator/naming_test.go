@@ -0,0 +1,90 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseNameTemplate(t *testing.T) {
+	for _, tmpl := range []string{"{service}-neg", "{project}-{region}-{service}", "neg-{service}"} {
+		if _, err := parseNameTemplate(tmpl); err != nil {
+			t.Errorf("parseNameTemplate(%q): %v", tmpl, err)
+		}
+	}
+	for _, tmpl := range []string{
+		"{region}-neg",     // no {service}
+		"{service}-{zone}", // unknown placeholder
+		"{service}-",       // trailing dash
+		"1-{service}",      // leading digit
+		"-{service}",       // leading dash
+	} {
+		if _, err := parseNameTemplate(tmpl); err == nil {
+			t.Errorf("parseNameTemplate(%q) accepted an invalid template", tmpl)
+		}
+	}
+}
+
+func TestNameTemplateRender(t *testing.T) {
+	long := strings.Repeat("a", 70)
+	for _, tc := range []struct {
+		tmpl, service, region, project, want string
+	}{
+		{"{service}-neg", "hello", "us-central1", "p", "hello-neg"},
+		{"{project}-{region}-{service}", "hello", "us-central1", "p", "p-us-central1-hello"},
+		{"{service}-neg", "Hello_World", "us-central1", "p", "hello-world-neg"},
+	} {
+		nt, err := parseNameTemplate(tc.tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := nt.render(tc.service, tc.region, tc.project); got != tc.want {
+			t.Errorf("%s.render(%q, %q, %q) = %q, want %q", tc.tmpl, tc.service, tc.region, tc.project, got, tc.want)
+		}
+	}
+
+	// Long names are truncated and suffixed with a hash of the full name.
+	nt, _ := parseNameTemplate("{service}-neg")
+	a, b := nt.render(long+"x", "r", "p"), nt.render(long+"y", "r", "p")
+	prefix := strings.Repeat("a", maxResourceNameLength-nameHashLength-1) + "-"
+	if len(a) != maxResourceNameLength || !strings.HasPrefix(a, prefix) || !validResourceName(a) {
+		t.Errorf("render of a long service = %q, want %q and a hash", a, prefix)
+	}
+	if a == b {
+		t.Errorf("names of different long services collide: %q", a)
+	}
+	if again := nt.render(long+"x", "r", "p"); again != a {
+		t.Errorf("render of a long service is not stable: %q, then %q", a, again)
+	}
+}
+
+func TestValidResourceName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"hello-neg":             true,
+		"a":                     true,
+		"":                      false,
+		"Hello":                 false,
+		"hello-":                false,
+		"1hello":                false,
+		"hello_neg":             false,
+		strings.Repeat("a", 63): true,
+		strings.Repeat("a", 64): false,
+	} {
+		if got := validResourceName(name); got != want {
+			t.Errorf("validResourceName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// changeKind is the kind of change a notification reports for a service.
+type changeKind int
+
+const (
+	changeUpdated changeKind = iota
+	// changeCreated is also used for notifications that may report the
+	// creation of a service.
+	changeCreated
+	changeDeleted
+)
+
+// deletedServices remembers recently deleted services for a TTL, so that
+// notifications arriving after the deletion, e.g. delayed update events or
+// duplicate deletions, don't trigger reconcile passes that can only find the
+// service gone. A zero TTL disables it.
+type deletedServices struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	expires map[workItem]time.Time
+}
+
+func newDeletedServices(ttl time.Duration) *deletedServices {
+	return &deletedServices{ttl: ttl, expires: make(map[workItem]time.Time)}
+}
+
+// observe records a change of the service and reports whether it needs to be
+// reconciled. Creations always do and end the memory of a deletion.
+func (d *deletedServices) observe(item workItem, kind changeKind, now time.Time) bool {
+	if d.ttl <= 0 {
+		return true
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for k, exp := range d.expires {
+		if !now.Before(exp) {
+			delete(d.expires, k)
+		}
+	}
+	_, deleted := d.expires[item]
+	switch kind {
+	case changeCreated:
+		delete(d.expires, item)
+		return true
+	case changeDeleted:
+		d.expires[item] = now.Add(d.ttl)
+	}
+	return !deleted
+}
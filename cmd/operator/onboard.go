@@ -0,0 +1,219 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os/signal"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// onboardCheckpoint records the progress of the onboard command, so that an
+// interrupted onboarding resumes where it stopped.
+type onboardCheckpoint struct {
+	Project string    `json:"project"`
+	Updated time.Time `json:"updated"`
+	// Regions holds the completed regions.
+	Regions []string `json:"regions"`
+	// Services holds the onboarded services of incomplete regions, by
+	// region.
+	Services map[string][]string `json:"services"`
+}
+
+// runOnboard implements the onboard command, which brings a large existing
+// fleet under management for the first time. Region by region, it creates
+// and attaches the NEGs of the selected services in batches, pausing between
+// them to spread the compute writes, and checkpoints the onboarded services
+// after every batch. It never detaches or deletes anything; that is left to
+// the run and serve commands.
+func runOnboard(ctx context.Context, logger *logrus.Logger, args []string) error {
+	fs := flag.NewFlagSet("onboard", flag.ExitOnError)
+	location := fs.String("checkpoint", "", "file or Cloud Storage object (gs://bucket/object) recording the progress, to resume an interrupted onboarding (required)")
+	batchSize := fs.Int("batch-size", 20, "number of services onboarded per batch")
+	interval := fs.Duration("batch-interval", 10*time.Second, "pause between batches, to spread the compute writes and stay under quota")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *location == "" {
+		return errors.New("-checkpoint is required")
+	}
+	if *batchSize < 1 {
+		return errors.New("-batch-size must be positive")
+	}
+
+	r, err := newReconciler(ctx, logger)
+	if err != nil {
+		return &exitError{code: exitFatal, err: err}
+	}
+	cp := &onboardCheckpoint{Project: r.project, Services: make(map[string][]string)}
+	b, err := readLocation(ctx, *location, r.cfg)
+	if err != nil {
+		return &exitError{code: exitFatal, err: err}
+	}
+	if b != nil {
+		if err := json.Unmarshal(b, cp); err != nil {
+			return &exitError{code: exitFatal, err: errors.Wrapf(err, "failed to parse checkpoint %s", *location)}
+		}
+		if cp.Project != r.project {
+			return &exitError{code: exitFatal, err: errors.Errorf("checkpoint %s belongs to project %q", *location, cp.Project)}
+		}
+		if cp.Services == nil {
+			cp.Services = make(map[string][]string)
+		}
+		logger.WithFields(logrus.Fields{"checkpoint": *location, "completedRegions": cp.Regions}).Info("resuming onboarding")
+	}
+	save := func() error {
+		if r.dryRun {
+			return nil
+		}
+		cp.Updated = time.Now().UTC()
+		b, err := json.MarshalIndent(cp, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "failed to encode checkpoint")
+		}
+		return errors.Wrap(writeLocation(ctx, *location, r.cfg, "application/json", append(b, '\n')), "failed to save checkpoint")
+	}
+
+	// On interruption, stop after the current batch, whose outcome is
+	// checkpointed.
+	interrupted, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var failed []string
+	for _, region := range r.regions {
+		lg := logger.WithField("region", region)
+		if contains(cp.Regions, region) {
+			lg.Info("region already onboarded")
+			continue
+		}
+		ok, err := r.onboardRegion(ctx, interrupted, region, cp, save, *batchSize, *interval)
+		if err != nil {
+			if interrupted.Err() != nil {
+				return &exitError{code: exitPartialFailure, err: errors.Wrap(err, "onboarding interrupted")}
+			}
+			lg.WithError(err).Error("failed to onboard region")
+			failed = append(failed, region)
+			continue
+		}
+		if !ok {
+			failed = append(failed, region)
+			continue
+		}
+		cp.Regions = append(cp.Regions, region)
+		delete(cp.Services, region)
+		if err := save(); err != nil {
+			return &exitError{code: exitFatal, err: err}
+		}
+		lg.Info("region onboarded")
+	}
+	if len(failed) != 0 {
+		return &exitError{code: exitPartialFailure, err: errors.Errorf("failed to onboard regions %v; run onboard again to retry", failed)}
+	}
+	return nil
+}
+
+// onboardRegion onboards the services of a region that are not recorded in
+// the checkpoint, in batches of batchSize services, followed by the settings
+// of their backend services and the PSC NEGs. It reports whether all
+// mutations succeeded, and stops before the next batch once interrupted is
+// done.
+func (r *reconciler) onboardRegion(ctx, interrupted context.Context, region string, cp *onboardCheckpoint, save func() error, batchSize int, interval time.Duration) (bool, error) {
+	globalBackends, err := r.globalBackendServices(ctx)
+	if err != nil {
+		return false, err
+	}
+	p, err := r.planRegion(ctx, region, "", globalBackends)
+	if err != nil {
+		return false, err
+	}
+	done := make(map[string]bool)
+	for _, svc := range cp.Services[region] {
+		done[svc] = true
+	}
+	byService := make(map[string][]mutation)
+	var rest []mutation
+	for _, m := range p.Mutations {
+		switch {
+		case m.Destructive():
+		case m.Service == "":
+			rest = append(rest, m)
+		case !done[path.Base(m.Service)]:
+			byService[m.Service] = append(byService[m.Service], m)
+		}
+	}
+
+	services := sortedKeys(byService)
+	lg := r.log(ctx).WithField("region", region)
+	lg.WithFields(logrus.Fields{"services": len(services), "onboarded": len(done)}).Info("onboarding region")
+	ok := true
+	for start := 0; start <= len(services); start += batchSize {
+		batch := services[start:]
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		bp := &plan{}
+		for _, svc := range batch {
+			bp.merge(&plan{Mutations: byService[svc]})
+		}
+		if len(batch) < batchSize {
+			// The last batch also sets up the backend services.
+			bp.merge(&plan{Mutations: rest})
+		}
+		if bp.empty() {
+			continue
+		}
+		if r.dryRun {
+			bp.log(lg, logrus.InfoLevel)
+			continue
+		}
+		if start > 0 {
+			select {
+			case <-interrupted.Done():
+				return false, interrupted.Err()
+			case <-time.After(interval):
+			}
+		} else if interrupted.Err() != nil {
+			return false, interrupted.Err()
+		}
+		if r.approval != nil {
+			req := approvalRequest{Project: r.project, Regions: []string{region}, Mutations: bp.Mutations, Changes: bp.diffs()}
+			if err := r.approval.approve(ctx, req); err != nil {
+				return false, err
+			}
+		}
+		failed, serviceErrors := r.apply(ctx, bp)
+		r.cache.invalidateMutations(bp.Mutations)
+		if failed != 0 {
+			ok = false
+		}
+		for _, svc := range batch {
+			if serviceErrors[svc] == nil {
+				cp.Services[region] = append(cp.Services[region], path.Base(svc))
+			}
+		}
+		if err := save(); err != nil {
+			return false, err
+		}
+		lg.WithFields(logrus.Fields{"batch": start/batchSize + 1, "services": len(batch), "failed": failed}).Info("onboarded batch")
+	}
+	return ok, nil
+}
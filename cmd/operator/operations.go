@@ -0,0 +1,208 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/apply"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/compute/v1"
+)
+
+// requestIDLifetime is how long Compute Engine remembers request IDs, and so
+// how long resending a request with the same ID is idempotent.
+const requestIDLifetime = time.Hour
+
+// pendingOperation is a compute operation the controller started and has not
+// seen complete. A mutation about to be sent is recorded with its request ID
+// but without a name until the API returned its operation.
+type pendingOperation struct {
+	Project string `json:"project"`
+	// Region is empty for global operations.
+	Region    string    `json:"region,omitempty"`
+	Name      string    `json:"name,omitempty"`
+	Type      string    `json:"type,omitempty"`
+	Target    string    `json:"target"`
+	Key       string    `json:"key,omitempty"`
+	RequestID string    `json:"requestId,omitempty"`
+	Started   time.Time `json:"started"`
+}
+
+// operationStore records the compute operations in flight, keyed by their
+// target resource, in a file or Cloud Storage object (-operations-state).
+// A controller restarted while creating, deleting or patching a resource
+// resumes waiting on the recorded operations before planning, so that it
+// plans against their outcome instead of issuing the same mutation again,
+// and resends a mutation whose operation it never saw with the recorded
+// request ID. Without location the records are only kept in memory.
+type operationStore struct {
+	location string
+	cfg      *config
+	logger   *logrus.Logger
+
+	mu  sync.Mutex
+	ops map[string]pendingOperation
+}
+
+// newOperationStore reads the operations recorded at location.
+func newOperationStore(ctx context.Context, location string, cfg *config, logger *logrus.Logger) (*operationStore, error) {
+	s := &operationStore{location: location, cfg: cfg, logger: logger, ops: make(map[string]pendingOperation)}
+	if location == "" {
+		return s, nil
+	}
+	b, err := readLocation(ctx, location, cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read pending compute operations")
+	}
+	if b != nil {
+		var ops []pendingOperation
+		if err := json.Unmarshal(b, &ops); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse pending compute operations %s", location)
+		}
+		for _, op := range ops {
+			s.ops[op.Target] = op
+		}
+	}
+	return s, nil
+}
+
+// Requested returns the request ID of a mutation of target and records it
+// before the mutation is sent. The ID is derived from the reconcile pass,
+// the target and key, so that retries within the pass send the same one; a
+// mutation recorded by an earlier process whose operation was never seen
+// keeps its ID while Compute Engine remembers it. Failing to record the ID
+// doesn't fail the mutation.
+func (s *operationStore) Requested(ctx context.Context, project, target, key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	if p, ok := s.ops[target]; ok && p.Name == "" && p.Key == key && now.Sub(p.Started) < requestIDLifetime {
+		return p.RequestID
+	}
+	pass, ok := reconcileIDFromContext(ctx)
+	if !ok {
+		pass = randomHex(8)
+	}
+	id := requestID(pass, target, key)
+	s.ops[target] = pendingOperation{Project: project, Target: target, Key: key, RequestID: id, Started: now}
+	s.save(ctx)
+	return id
+}
+
+// requestID derives a request ID, which Compute Engine requires to be a
+// UUID, from the given parts.
+func requestID(parts ...string) string {
+	b := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	b[6] = b[6]&0x0f | 0x50
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// Started records an operation returned by the API. Failing to record it
+// doesn't fail the mutation, which is already in flight.
+func (s *operationStore) Started(ctx context.Context, project string, op *compute.Operation) {
+	if op.Status == "DONE" {
+		return
+	}
+	pending := pendingOperation{Project: project, Name: op.Name, Type: op.OperationType, Target: op.TargetLink, Started: time.Now().UTC()}
+	if op.Region != "" {
+		pending.Region = path.Base(op.Region)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.ops[pending.Target]; ok {
+		pending.Key, pending.RequestID = p.Key, p.RequestID
+	}
+	s.ops[pending.Target] = pending
+	s.save(ctx)
+}
+
+// Done drops the record of a completed operation.
+func (s *operationStore) Done(ctx context.Context, op *compute.Operation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.ops[op.TargetLink]; !ok {
+		return
+	}
+	delete(s.ops, op.TargetLink)
+	s.save(ctx)
+}
+
+// save writes the recorded operations. Must be called with mu held, so that
+// concurrent writes land in order.
+func (s *operationStore) save(ctx context.Context) {
+	if s.location == "" {
+		return
+	}
+	ops := make([]pendingOperation, 0, len(s.ops))
+	for _, target := range sortedKeys(s.ops) {
+		ops = append(ops, s.ops[target])
+	}
+	b, err := json.MarshalIndent(ops, "", "  ")
+	if err == nil {
+		err = writeLocation(ctx, s.location, s.cfg, "application/json", append(b, '\n'))
+	}
+	if err != nil {
+		s.logger.WithError(err).WithField("location", s.location).Warn("failed to record pending compute operations")
+	}
+}
+
+// resume waits for the recorded operations to complete, and drops them.
+// Operations that are no longer known to the API completed long ago, and
+// failed operations are only logged, as the next pass plans against the
+// actual state. It fails, keeping the record, if an operation can't be
+// waited for. Mutations without an operation are kept for their request ID
+// until Compute Engine forgets it. Only commands that apply mutations
+// resume, before their first pass.
+func (s *operationStore) resume(ctx context.Context, computeService *compute.Service) error {
+	client := &apply.Client{Compute: computeService, WaitTimeout: flOperationWaitTimeout}
+	s.mu.Lock()
+	ops := make([]pendingOperation, 0, len(s.ops))
+	for _, target := range sortedKeys(s.ops) {
+		ops = append(ops, s.ops[target])
+	}
+	s.mu.Unlock()
+	for _, p := range ops {
+		op := &compute.Operation{Name: p.Name, Region: p.Region, TargetLink: p.Target}
+		if p.Name == "" {
+			if time.Since(p.Started) >= requestIDLifetime {
+				s.Done(ctx, op)
+			}
+			continue
+		}
+		lg := s.logger.WithFields(logrus.Fields{"operation": p.Name, "type": p.Type, "target": p.Target})
+		lg.Info("waiting for compute operation started before restart")
+		err := client.Wait(ctx, p.Project, op)
+		var opErr *apply.OperationError
+		switch {
+		case err == nil, errorKindOf(err) == kindNotFound && !errors.As(err, &opErr):
+		case errors.As(err, &opErr):
+			lg.WithError(err).Warn("compute operation started before restart failed")
+		default:
+			return errors.Wrapf(err, "failed to resume compute operation %s", p.Name)
+		}
+		s.Done(ctx, op)
+	}
+	return nil
+}
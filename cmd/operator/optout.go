@@ -0,0 +1,232 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/run/v2"
+)
+
+// Opt-out modes, selecting what happens to the NEG of a service that is no
+// longer managed, e.g. because its autoneg label was removed.
+const (
+	// optOutDelete detaches the NEG from its backend services and deletes
+	// it.
+	optOutDelete = "delete"
+	// optOutDetach only detaches the NEG, and deletes it once it has been
+	// retained for the retention period.
+	optOutDetach = "detach"
+)
+
+func parseOptOutMode(mode string) (string, error) {
+	switch mode {
+	case optOutDelete, optOutDetach:
+		return mode, nil
+	}
+	return "", errors.Errorf("unknown opt-out mode %q, expected delete or detach", mode)
+}
+
+// retentionState records since when the NEGs of opted-out services are
+// retained, by region/NEG.
+type retentionState struct {
+	Retained map[string]time.Time `json:"retained"`
+}
+
+// retention keeps the detached NEGs of services that opted out in detach
+// mode, and lets their deletion through once they have been retained for
+// the period. A zero period retains them until they are deleted by hand.
+type retention struct {
+	period   time.Duration
+	location string
+	cfg      *config
+
+	mu    sync.Mutex
+	state retentionState
+}
+
+// newRetention returns the retention of opted-out NEGs, with the retained
+// NEGs read from the state location, if any.
+func newRetention(ctx context.Context, cfg *config, period time.Duration, location string) (*retention, error) {
+	rt := &retention{period: period, location: location, cfg: cfg, state: retentionState{Retained: make(map[string]time.Time)}}
+	if location == "" {
+		return rt, nil
+	}
+	b, err := readLocation(ctx, location, cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read opt-out state")
+	}
+	if b != nil {
+		if err := json.Unmarshal(b, &rt.state); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse opt-out state %s", location)
+		}
+		if rt.state.Retained == nil {
+			rt.state.Retained = make(map[string]time.Time)
+		}
+	}
+	return rt, nil
+}
+
+// save writes the retained NEGs to the state location, if any. Must be
+// called with mu held.
+func (rt *retention) save(ctx context.Context) error {
+	if rt.location == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(rt.state, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode opt-out state")
+	}
+	return errors.Wrap(writeLocation(ctx, rt.location, rt.cfg, "application/json", append(b, '\n')), "failed to save opt-out state")
+}
+
+// optOutMode returns the opt-out mode of a service: its opt-out label, or
+// -opt-out if unset or invalid. Services that no longer exist use -opt-out.
+func (r *reconciler) optOutMode(svc *run.GoogleCloudRunV2Service) string {
+	if svc != nil {
+		if mode, err := parseOptOutMode(svc.Labels[labelOptOut]); err == nil {
+			return mode
+		}
+	}
+	return r.optOut
+}
+
+// retainedNEG is a NEG of a service that opted out in detach mode, planned
+// by a pass.
+type retainedNEG struct {
+	region, neg, service string
+	// detach is set if the NEG was still attached, and its detachment
+	// planned.
+	detach bool
+	// released is set once the NEG was retained for the retention period,
+	// and its deletion is planned.
+	released bool
+}
+
+func (n retainedNEG) key() string { return n.region + "/" + n.neg }
+
+// retainOptedOut drops the planned deletions of NEGs whose service opted out
+// in detach mode, leaving only their detachment, until they have been
+// retained for the retention period, and records the retained NEGs in the
+// plan. The retention only starts once recordRetention saw the NEG detached.
+func (r *reconciler) retainOptedOut(ctx context.Context, region string, svcs []*run.GoogleCloudRunV2Service, p *plan, now time.Time) {
+	rt := r.retention
+	if rt == nil {
+		return
+	}
+	byName := make(map[string]*run.GoogleCloudRunV2Service, len(svcs))
+	for _, svc := range svcs {
+		byName[svc.Name] = svc
+	}
+	detach := make(map[string]bool)
+	for _, m := range p.Mutations {
+		if m.Op == opDetachBackend {
+			detach[m.NEG] = true
+		}
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	p.filter(func(m mutation) bool {
+		if m.Op != opDeleteNEG || m.Service == "" || r.optOutMode(byName[m.Service]) != optOutDetach {
+			return true
+		}
+		n := retainedNEG{region: region, neg: m.NEG, service: m.Service, detach: detach[m.NEG]}
+		since, ok := rt.state.Retained[n.key()]
+		n.released = ok && rt.period > 0 && !now.Before(since.Add(rt.period))
+		if p.retained == nil {
+			p.retained = make(map[string]retainedNEG)
+		}
+		p.retained[n.key()] = n
+		if n.released {
+			r.log(ctx).WithFields(logrus.Fields{"region": region, "neg": m.NEG, "service": m.Service, "retainedSince": since.Format(time.RFC3339)}).
+				Info("opt-out retention period elapsed, deleting NEG")
+		}
+		return n.released
+	})
+}
+
+// recordRetention records since when the NEGs retained by an applied pass
+// are retained: from the pass that detached them, or that found them
+// detached. NEGs whose detachment was deferred or failed aren't retained
+// yet. NEGs that were deleted, or whose service opted back in, are
+// forgotten; full passes forget those of all planned regions. Dry runs and
+// passes that weren't applied must not call it.
+func (r *reconciler) recordRetention(ctx context.Context, res *reconcileResult, service string, serviceErrors map[string]error, now time.Time) {
+	rt := r.retention
+	if rt == nil {
+		return
+	}
+	p := res.Plan
+	detaching := make(map[string]bool)
+	deleted := make(map[string]bool)
+	for _, m := range p.Mutations {
+		switch m.Op {
+		case opDetachBackend:
+			detaching[m.Region+"/"+m.NEG] = true
+		case opDeleteNEG:
+			deleted[m.Region+"/"+m.NEG] = true
+		}
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	changed := false
+	for key, n := range p.retained {
+		if service != "" && path.Base(n.service) != service {
+			continue
+		}
+		_, failed := serviceErrors[n.service]
+		switch {
+		case n.released && deleted[key] && !failed:
+			delete(rt.state.Retained, key)
+			changed = true
+		case n.released:
+			// Deferred or failed; the retention stays elapsed.
+		case failed || (n.detach && !detaching[key]):
+			// Still attached.
+		default:
+			if _, ok := rt.state.Retained[key]; !ok {
+				rt.state.Retained[key] = now.UTC()
+				changed = true
+				r.log(ctx).WithFields(logrus.Fields{"region": n.region, "neg": n.neg, "service": n.service}).Info("service opted out in detach mode, retaining its detached NEG")
+			}
+		}
+	}
+	if service == "" {
+		planned := make(map[string]bool)
+		for _, st := range res.Regions {
+			planned[st.Region] = st.OK
+		}
+		for key := range rt.state.Retained {
+			region, _, _ := strings.Cut(key, "/")
+			if _, ok := p.retained[key]; planned[region] && !ok {
+				delete(rt.state.Retained, key)
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := rt.save(ctx); err != nil {
+		r.log(ctx).WithError(err).WithField("errorKind", errorKindOf(err)).Error("failed to save opt-out state")
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/run/v2"
+)
+
+func TestOptOutMode(t *testing.T) {
+	r := &reconciler{optOut: optOutDelete}
+	for _, tc := range []struct {
+		svc  *run.GoogleCloudRunV2Service
+		want string
+	}{
+		{nil, optOutDelete},
+		{&run.GoogleCloudRunV2Service{}, optOutDelete},
+		{&run.GoogleCloudRunV2Service{Labels: map[string]string{labelOptOut: "detach"}}, optOutDetach},
+		{&run.GoogleCloudRunV2Service{Labels: map[string]string{labelOptOut: "keep"}}, optOutDelete},
+	} {
+		if got := r.optOutMode(tc.svc); got != tc.want {
+			t.Errorf("optOutMode(%+v) = %q, want %q", tc.svc, got, tc.want)
+		}
+	}
+}
+
+// TestRetainOptedOut walks a NEG of a service that opted out in detach mode
+// through its retention: detached first, retained for the period, then
+// deleted.
+func TestRetainOptedOut(t *testing.T) {
+	const (
+		region  = "us-central1"
+		service = "projects/p/locations/us-central1/services/hello"
+		key     = region + "/hello-neg"
+	)
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	ctx := context.Background()
+	rt, err := newRetention(ctx, nil, time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &reconciler{logger: logger, optOut: optOutDelete, retention: rt}
+	svcs := []*run.GoogleCloudRunV2Service{{Name: service, Labels: map[string]string{labelOptOut: optOutDetach}}}
+	detach := mutation{Op: opDetachBackend, Region: region, NEG: "hello-neg", Service: service, BackendService: "web"}
+	del := mutation{Op: opDeleteNEG, Region: region, NEG: "hello-neg", Service: service}
+
+	pass := func(now time.Time, serviceErrors map[string]error, ms ...mutation) *plan {
+		t.Helper()
+		p := &plan{Mutations: append([]mutation(nil), ms...)}
+		r.retainOptedOut(ctx, region, svcs, p, now)
+		res := &reconcileResult{Plan: p, Regions: []regionStatus{{Region: region, OK: true}}}
+		r.recordRetention(ctx, res, "", serviceErrors, now)
+		return p
+	}
+	ops := func(p *plan) []mutationOp {
+		var out []mutationOp
+		for _, m := range p.Mutations {
+			out = append(out, m.Op)
+		}
+		return out
+	}
+	retainedSince := func() (time.Time, bool) {
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		since, ok := rt.state.Retained[key]
+		return since, ok
+	}
+
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	// A failed detachment doesn't start the retention.
+	if p := pass(t0, map[string]error{service: errors.New("boom")}, detach, del); len(p.Mutations) != 1 || p.Mutations[0].Op != opDetachBackend {
+		t.Fatalf("mutations = %v, want only the detachment", ops(p))
+	}
+	if _, ok := retainedSince(); ok {
+		t.Fatal("NEG retained although its detachment failed")
+	}
+
+	pass(t0, nil, detach, del)
+	if since, ok := retainedSince(); !ok || !since.Equal(t0) {
+		t.Fatalf("NEG retained since %v, %v, want %v", since, ok, t0)
+	}
+	if p := pass(t0.Add(59*time.Minute), nil, del); len(p.Mutations) != 0 {
+		t.Fatalf("mutations within the retention period = %v, want none", ops(p))
+	}
+	if p := pass(t0.Add(time.Hour), nil, del); len(p.Mutations) != 1 || p.Mutations[0].Op != opDeleteNEG {
+		t.Fatalf("mutations after the retention period = %v, want the deletion", ops(p))
+	}
+	if _, ok := retainedSince(); ok {
+		t.Error("deleted NEG still retained")
+	}
+
+	// A NEG whose service opted back in is forgotten by the next full pass.
+	pass(t0, nil, detach, del)
+	pass(t0.Add(time.Minute), nil)
+	if _, ok := retainedSince(); ok {
+		t.Error("NEG of a service that opted back in still retained")
+	}
+}
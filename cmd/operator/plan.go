@@ -0,0 +1,122 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/planner"
+	"github.com/sirupsen/logrus"
+)
+
+// Mutation ops, see planner.
+type mutationOp = planner.Op
+
+const (
+	opCreateNEG           = planner.OpCreateNEG
+	opAttachBackend       = planner.OpAttachBackend
+	opAdoptBackend        = planner.OpAdoptBackend
+	opUpdateBackend       = planner.OpUpdateBackend
+	opSetProtocol         = planner.OpSetProtocol
+	opSetDraining         = planner.OpSetDraining
+	opSetLocalityPolicy   = planner.OpSetLocalityPolicy
+	opSetOutlierDetection = planner.OpSetOutlierDetection
+	opSetIAP              = planner.OpSetIAP
+	opLabelBackend        = planner.OpLabelBackend
+	opHardenIngress       = planner.OpHardenIngress
+	opRestoreIngress      = planner.OpRestoreIngress
+	opDetachBackend       = planner.OpDetachBackend
+	opDeleteNEG           = planner.OpDeleteNEG
+)
+
+// mutation is a single change the controller intends to make.
+type mutation = planner.Mutation
+
+// plan is the ordered list of mutations computed by a reconcile pass.
+type plan struct {
+	Mutations []mutation `json:"mutations"`
+
+	// desired holds the desired NEGs of the planned regions.
+	desired map[string]map[string]desiredNEG
+	// status holds the status annotations of the planned services, and auth
+	// the issues found by the authentication checks, if enabled, both by
+	// service resource name.
+	status map[string]serviceStatus
+	auth   map[string]string
+	// retained holds the NEGs of services that opted out in detach mode, by
+	// region/NEG.
+	retained map[string]retainedNEG
+}
+
+func (p *plan) add(m mutation) { p.Mutations = append(p.Mutations, m) }
+
+func (p *plan) empty() bool { return len(p.Mutations) == 0 }
+
+// merge appends the mutations of o and restores the apply order.
+func (p *plan) merge(o *plan) {
+	p.Mutations = append(p.Mutations, o.Mutations...)
+	for region, desired := range o.desired {
+		if p.desired == nil {
+			p.desired = make(map[string]map[string]desiredNEG)
+		}
+		p.desired[region] = desired
+	}
+	for svc, st := range o.status {
+		if p.status == nil {
+			p.status = make(map[string]serviceStatus)
+		}
+		p.status[svc] = st
+	}
+	for svc, issue := range o.auth {
+		if p.auth == nil {
+			p.auth = make(map[string]string)
+		}
+		p.auth[svc] = issue
+	}
+	for key, n := range o.retained {
+		if p.retained == nil {
+			p.retained = make(map[string]retainedNEG)
+		}
+		p.retained[key] = n
+	}
+	planner.Sort(p.Mutations)
+}
+
+// filter drops the mutations for which keep returns false.
+func (p *plan) filter(keep func(mutation) bool) {
+	out := p.Mutations[:0]
+	for _, m := range p.Mutations {
+		if keep(m) {
+			out = append(out, m)
+		}
+	}
+	p.Mutations = out
+}
+
+// count returns the number of mutations with the given op.
+func (p *plan) count(op mutationOp) int {
+	var n int
+	for _, m := range p.Mutations {
+		if m.Op == op {
+			n++
+		}
+	}
+	return n
+}
+
+// log writes every mutation of the plan to the logger at the given level.
+func (p *plan) log(logger *logrus.Entry, level logrus.Level) {
+	for _, m := range p.Mutations {
+		logger.WithFields(m.Fields()).Log(level, "planned mutation")
+	}
+}
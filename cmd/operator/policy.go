@@ -0,0 +1,129 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/pkg/errors"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/run/v2"
+)
+
+// policyQuery is the query evaluated for every mutation; each message of the
+// deny set blocks the mutation.
+const policyQuery = "data.autoneg.deny"
+
+// policyInput is the input document of policies.
+type policyInput struct {
+	Mutation mutation `json:"mutation"`
+	// BackendService is the current state of the backend service changed by
+	// the mutation, if any.
+	BackendService *compute.BackendService `json:"backendService,omitempty"`
+	// Service is the Cloud Run service the mutation is made for, if any.
+	Service *run.GoogleCloudRunV2Service `json:"service,omitempty"`
+}
+
+// policies evaluates Rego policies against planned mutations.
+type policies struct {
+	query rego.PreparedEvalQuery
+}
+
+// loadPolicies compiles the Rego files and directories at paths.
+func loadPolicies(ctx context.Context, paths []string) (*policies, error) {
+	q, err := rego.New(rego.Query(policyQuery), rego.Load(paths, nil)).PrepareForEval(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load policies")
+	}
+	return &policies{query: q}, nil
+}
+
+// violations returns the deny messages of the policies for the input.
+func (p *policies) violations(ctx context.Context, in policyInput) ([]string, error) {
+	// Evaluate the JSON representation, as policies are written against the
+	// API resources rather than Go structs.
+	b, err := json.Marshal(in)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode policy input")
+	}
+	var doc interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, errors.Wrap(err, "failed to decode policy input")
+	}
+	rs, err := p.query.Eval(ctx, rego.EvalInput(doc))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to evaluate policies")
+	}
+	var out []string
+	for _, r := range rs {
+		for _, e := range r.Expressions {
+			msgs, ok := e.Value.([]interface{})
+			if !ok {
+				return nil, errors.Errorf("%s must be a set, got %T", policyQuery, e.Value)
+			}
+			for _, msg := range msgs {
+				out = append(out, fmt.Sprint(msg))
+			}
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// enforcePolicies drops the mutations of the plan violating the policies. A
+// violation blocks all mutations of the same service, which depend on each
+// other; settings of backend services are blocked individually. Mutations
+// that cannot be evaluated are blocked as well.
+func (r *reconciler) enforcePolicies(ctx context.Context, p *plan, svcs []*run.GoogleCloudRunV2Service, backends map[backendServiceRef]*compute.BackendService) {
+	if r.policies == nil {
+		return
+	}
+	byName := make(map[string]*run.GoogleCloudRunV2Service, len(svcs))
+	for _, svc := range svcs {
+		byName[svc.Name] = svc
+	}
+	blocked := make(map[int]bool)
+	blockedServices := make(map[string]bool)
+	for i, m := range p.Mutations {
+		in := policyInput{Mutation: m, Service: byName[m.Service]}
+		if m.BackendService != "" {
+			in.BackendService = backends[m.BackendServiceRef()]
+		}
+		lg := r.log(ctx).WithFields(m.Fields())
+		msgs, err := r.policies.violations(ctx, in)
+		if err != nil {
+			lg.WithError(err).Error("blocking mutation that could not be checked against the policies")
+			msgs = []string{err.Error()}
+		}
+		for _, msg := range msgs {
+			lg.WithField("rule", msg).Error("policy violation, blocking mutation")
+		}
+		if len(msgs) != 0 {
+			blocked[i] = true
+			if m.Service != "" {
+				blockedServices[m.Service] = true
+			}
+		}
+	}
+	i := -1
+	p.filter(func(m mutation) bool {
+		i++
+		return !blocked[i] && (m.Service == "" || !blockedServices[m.Service])
+	})
+}
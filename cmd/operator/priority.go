@@ -0,0 +1,95 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/run/v2"
+)
+
+// priority is the priority class of a service, set with labelPriority. The
+// work queue hands out items of higher priority first, so that production
+// services converge before others when the queue is deep.
+type priority int
+
+const (
+	priorityHigh priority = iota
+	priorityNormal
+	priorityLow
+	numPriorities
+)
+
+var priorityNames = [numPriorities]string{"high", "normal", "low"}
+
+func (p priority) String() string { return priorityNames[p] }
+
+// parsePriority converts the value of the priority label.
+func parsePriority(v string) (priority, error) {
+	if v == "" {
+		return priorityNormal, nil
+	}
+	for p, name := range priorityNames {
+		if v == name {
+			return priority(p), nil
+		}
+	}
+	return priorityNormal, errors.Errorf("label %q: unknown priority %q, expected high, normal or low", labelPriority, v)
+}
+
+// servicePriorities remembers the priorities of the services seen by
+// reconcile passes, for the work items of change notifications, which don't
+// carry labels. A nil *servicePriorities knows no priorities.
+type servicePriorities struct {
+	mu     sync.Mutex
+	byItem map[workItem]priority
+}
+
+func newServicePriorities() *servicePriorities {
+	return &servicePriorities{byItem: make(map[workItem]priority)}
+}
+
+// record remembers the priorities of services of a region. Invalid labels
+// count as normal; validate reports them.
+func (s *servicePriorities) record(region string, svcs []*run.GoogleCloudRunV2Service) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, svc := range svcs {
+		item := workItem{region: region, service: serviceName(svc)}
+		if p, _ := parsePriority(svc.Labels[labelPriority]); p != priorityNormal {
+			s.byItem[item] = p
+		} else {
+			delete(s.byItem, item)
+		}
+	}
+}
+
+// of returns the priority of a work item. Whole regions and unknown services
+// have normal priority.
+func (s *servicePriorities) of(item workItem) priority {
+	if s == nil {
+		return priorityNormal
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.byItem[item]; ok {
+		return p
+	}
+	return priorityNormal
+}
@@ -0,0 +1,80 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"google.golang.org/api/run/v2"
+)
+
+func TestParsePriority(t *testing.T) {
+	for v, want := range map[string]priority{"": priorityNormal, "high": priorityHigh, "normal": priorityNormal, "low": priorityLow} {
+		if p, err := parsePriority(v); err != nil || p != want {
+			t.Errorf("parsePriority(%q) = %v, %v, want %v", v, p, err, want)
+		}
+	}
+	if _, err := parsePriority("urgent"); err == nil {
+		t.Error("parsePriority accepted an unknown priority")
+	}
+}
+
+func TestWorkQueuePriorities(t *testing.T) {
+	priorities := newServicePriorities()
+	priorities.record("r", []*run.GoogleCloudRunV2Service{
+		{Name: "projects/p/locations/r/services/prod", Labels: map[string]string{labelPriority: "high"}},
+		{Name: "projects/p/locations/r/services/batch", Labels: map[string]string{labelPriority: "low"}},
+		{Name: "projects/p/locations/r/services/typo", Labels: map[string]string{labelPriority: "urgent"}},
+		{Name: "projects/p/locations/r/services/web"},
+	})
+	for item, want := range map[workItem]priority{
+		{"r", "prod"}:  priorityHigh,
+		{"r", "batch"}: priorityLow,
+		{"r", "typo"}:  priorityNormal,
+		{"r", "web"}:   priorityNormal,
+		{"r", ""}:      priorityNormal,
+		{"o", "prod"}:  priorityNormal,
+	} {
+		if p := priorities.of(item); p != want {
+			t.Errorf("priority of %v = %v, want %v", item, p, want)
+		}
+	}
+
+	q := newWorkQueue()
+	defer q.close()
+	q.priority = priorities.of
+	for _, item := range []workItem{{"r", "batch"}, {"r", "web"}, {"r", "prod"}, {"r", ""}} {
+		q.add(item)
+	}
+	// Items of the same priority keep their order.
+	for _, want := range []workItem{{"r", "prod"}, {"r", "web"}, {"r", ""}, {"r", "batch"}} {
+		if item, _ := q.get(); item != want {
+			t.Errorf("get = %v, want %v", item, want)
+		}
+	}
+	if s := q.stats(); s.WaitCount != [numPriorities]int64{1, 2, 1} {
+		t.Errorf("wait counts = %v, want [1 2 1]", s.WaitCount)
+	}
+
+	// A service whose label was removed falls back to normal priority.
+	priorities.record("r", []*run.GoogleCloudRunV2Service{{Name: "projects/p/locations/r/services/prod"}})
+	if p := priorities.of(workItem{"r", "prod"}); p != priorityNormal {
+		t.Errorf("priority after removing the label = %v, want normal", p)
+	}
+	var none *servicePriorities
+	if p := none.of(workItem{"r", "prod"}); p != priorityNormal {
+		t.Errorf("priority without priorities = %v, want normal", p)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/discovery"
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/planner"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/run/v2"
+)
+
+// Reasons of stale backends.
+const (
+	staleNEGGone     = "negNotFound"
+	staleServiceGone = "serviceNotFound"
+)
+
+// planPruning plans detaching the stale backends of the region from the
+// backend services the controller manages: backends whose NEG no longer
+// exists, or whose serverless NEG points to a Cloud Run service that no
+// longer exists. The load balancer answers requests routed to them with 502s.
+// Backends already detached by p are skipped.
+func (r *reconciler) planPruning(ctx context.Context, region string, svcs []*run.GoogleCloudRunV2Service, st *regionComputeState, backends map[backendServiceRef]*compute.BackendService, p *plan) *plan {
+	services := make(map[string]bool, len(svcs))
+	for _, svc := range svcs {
+		services[serviceName(svc)] = true
+	}
+	managed := make(map[backendServiceRef]bool)
+	for _, d := range p.desired[region] {
+		for _, db := range d.Backends {
+			managed[db.Ref] = true
+		}
+	}
+	detached := make(map[backendServiceRef]map[string]bool)
+	for _, m := range p.Mutations {
+		if m.Op == opDetachBackend {
+			if detached[m.BackendServiceRef()] == nil {
+				detached[m.BackendServiceRef()] = make(map[string]bool)
+			}
+			detached[m.BackendServiceRef()][m.NEG] = true
+		}
+	}
+
+	out := &plan{}
+	for _, ref := range discovery.SortedBackendRefs(backends) {
+		bs := backends[ref]
+		if !managed[ref] && !hasOwnedBackend(bs) {
+			continue
+		}
+		for _, b := range bs.Backends {
+			project, negRegion, name, ok := discovery.ParseNEGURL(b.Group)
+			if !ok || project != r.project || negRegion != region || detached[ref][name] {
+				continue
+			}
+			var reason string
+			if neg, ok := st.negs[name]; ok {
+				if cr := neg.CloudRun; cr != nil && cr.Service != "" && !services[cr.Service] {
+					reason = staleServiceGone
+				}
+			} else if _, ok := st.otherNEGs[name]; !ok {
+				reason = staleNEGGone
+			}
+			if reason == "" {
+				continue
+			}
+			lg := r.log(ctx).WithFields(logrus.Fields{"neg": name, "backendService": ref.String(), "stale": reason})
+			if r.strict && !planner.OwnedBackend(b) {
+				lg.Warn("conflict: stale backend entry lacks ownership marker, not pruning it in strict mode")
+				continue
+			}
+			lg.Info("pruning stale backend")
+			// The Service is left empty: the service may be gone, and stale
+			// backends must not count against the health of another one.
+			out.add(mutation{Op: opDetachBackend, Project: r.project, Region: region, NEG: name,
+				BackendService: ref.Name, BackendRegion: ref.Region, Stale: reason})
+		}
+	}
+	return out
+}
+
+// hasOwnedBackend reports whether any backend of bs is owned by the
+// controller.
+func hasOwnedBackend(bs *compute.BackendService) bool {
+	for _, b := range bs.Backends {
+		if planner.OwnedBackend(b) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/discovery"
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/planner"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/compute/v1"
+)
+
+// planPSC computes the mutations reconciling the PSC NEGs of a region with
+// the desired ones declared in the configuration file: missing NEGs are
+// created and attached to their backend services, and controller-owned NEGs
+// that are no longer declared are detached and deleted. negs holds the
+// non-serverless NEGs of the region.
+func (r *reconciler) planPSC(ctx context.Context, region string, desired map[string]pscNEG, negs map[string]*compute.NetworkEndpointGroup, backends map[backendServiceRef]*compute.BackendService) *plan {
+	p := &plan{}
+	attach := make(map[string]map[backendServiceRef]bool)
+	for _, name := range sortedKeys(desired) {
+		d := desired[name]
+		lg := r.log(ctx).WithFields(logrus.Fields{"neg": name, "serviceAttachment": d.ServiceAttachment})
+		if neg, ok := negs[name]; !ok {
+			p.add(mutation{Op: opCreateNEG, Project: r.project, Region: region, NEG: name, PSCTarget: d.ServiceAttachment})
+		} else if _, owned := planner.ParseOwnership(neg.Description); !owned {
+			lg.Warn("NEG exists but is not managed by the controller, skipping PSC NEG")
+			continue
+		} else if resourcePath(neg.PscTargetService) != resourcePath(d.ServiceAttachment) {
+			// NEGs cannot be modified; the old one must be deleted first.
+			lg.WithField("current", neg.PscTargetService).Error("PSC NEG points to a different service attachment, rename it to replace it")
+			continue
+		}
+		attach[name] = make(map[backendServiceRef]bool)
+		for _, b := range d.Backends {
+			ref, _ := b.ref(region)
+			attach[name][ref] = true
+			bs, ok := backends[ref]
+			if !ok {
+				lg.WithField("backendService", ref.String()).Error("backend service does not exist")
+				continue
+			}
+			if discovery.FindBackend(bs, r.project, region, name) == nil {
+				p.add(mutation{Op: opAttachBackend, Project: r.project, Region: region, NEG: name,
+					BackendService: ref.Name, BackendRegion: ref.Region})
+			}
+		}
+	}
+
+	// Detach owned PSC NEGs from the backend services they should no longer
+	// be part of, and delete those no longer declared.
+	for _, name := range sortedKeys(negs) {
+		neg := negs[name]
+		if neg.NetworkEndpointType != "PRIVATE_SERVICE_CONNECT" {
+			continue
+		}
+		if _, owned := planner.ParseOwnership(neg.Description); !owned {
+			continue
+		}
+		_, declared := desired[name]
+		if declared && attach[name] == nil {
+			// Skipped above.
+			continue
+		}
+		for _, ref := range discovery.SortedBackendRefs(backends) {
+			b := discovery.FindBackend(backends[ref], r.project, region, name)
+			if b == nil || attach[name][ref] {
+				continue
+			}
+			if r.strict && !planner.OwnedBackend(b) {
+				r.log(ctx).WithFields(logrus.Fields{"neg": name, "backendService": ref.String()}).
+					Warn("conflict: backend entry lacks ownership marker, not detaching it in strict mode")
+				continue
+			}
+			p.add(mutation{Op: opDetachBackend, Project: r.project, Region: region, NEG: name,
+				BackendService: ref.Name, BackendRegion: ref.Region})
+		}
+		if !declared {
+			p.add(mutation{Op: opDeleteNEG, Project: r.project, Region: region, NEG: name})
+		}
+	}
+	return p
+}
@@ -0,0 +1,289 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Backoff of failed work items, doubled with every consecutive failure.
+const (
+	queueInitialBackoff = 5 * time.Second
+	queueMaxBackoff     = 5 * time.Minute
+)
+
+// workItem is the unit of work of the queue: a service of a region, or the
+// whole region if service is empty.
+type workItem struct {
+	region  string
+	service string
+}
+
+func (i workItem) String() string { return i.region + "/" + i.service }
+
+// workQueue holds the work of serve mode. Items are deduplicated while they
+// wait, an item added while it is processed is processed again afterwards,
+// and failed items are retried with per-item exponential backoff.
+type workQueue struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// items holds the waiting items by priority.
+	items      [numPriorities][]workItem
+	added      map[workItem]time.Time // waiting items and when they were added
+	processing map[workItem]bool
+	dirty      map[workItem]bool // added again while processing
+	failures   map[workItem]int
+	retries    int64
+	shutdown   bool
+	// priority returns the priority of an item; all items have normal
+	// priority if nil.
+	priority func(workItem) priority
+	// waitSum and waitCount sum up the time items waited, by priority.
+	waitSum   [numPriorities]time.Duration
+	waitCount [numPriorities]int64
+	// debounce is the window in which addDebounced coalesces the changes
+	// of an item; 0 adds them right away.
+	debounce time.Duration
+	// debounced holds the items held back by addDebounced.
+	debounced map[workItem]bool
+	coalesced int64
+}
+
+func newWorkQueue() *workQueue {
+	q := &workQueue{
+		added:      make(map[workItem]time.Time),
+		processing: make(map[workItem]bool),
+		dirty:      make(map[workItem]bool),
+		failures:   make(map[workItem]int),
+		debounced:  make(map[workItem]bool),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *workQueue) add(item workItem) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.shutdown {
+		return
+	}
+	if _, waiting := q.added[item]; waiting {
+		return
+	}
+	if q.processing[item] {
+		q.dirty[item] = true
+		return
+	}
+	p := priorityNormal
+	if q.priority != nil {
+		p = q.priority(item)
+	}
+	q.items[p] = append(q.items[p], item)
+	q.added[item] = time.Now()
+	q.cond.Signal()
+}
+
+// addDebounced adds an item after a change notification. Bursts of
+// notifications, e.g. of a CI pipeline redeploying many services, would
+// otherwise reconcile a service on the first one and again while it is
+// processed, reading the same compute resources over and over: the item is
+// held back for the debounce window, and notifications for an item already
+// held back or waiting, or whose whole region is waiting, are coalesced
+// into it.
+func (q *workQueue) addDebounced(item workItem) {
+	q.mu.Lock()
+	_, waiting := q.added[item]
+	_, regionWaiting := q.added[workItem{region: item.region}]
+	if waiting || regionWaiting || q.debounced[item] {
+		q.coalesced++
+		q.mu.Unlock()
+		return
+	}
+	if q.debounce <= 0 {
+		q.mu.Unlock()
+		q.add(item)
+		return
+	}
+	q.debounced[item] = true
+	q.mu.Unlock()
+	time.AfterFunc(q.debounce, func() {
+		q.mu.Lock()
+		delete(q.debounced, item)
+		q.mu.Unlock()
+		q.add(item)
+	})
+}
+
+// close makes get return false and drops future items.
+func (q *workQueue) close() {
+	q.mu.Lock()
+	q.shutdown = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// get waits for an item of the highest priority and marks it as processing.
+// It returns false once the queue is closed.
+func (q *workQueue) get() (workItem, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.depth() == 0 && !q.shutdown {
+		q.cond.Wait()
+	}
+	if q.shutdown {
+		return workItem{}, false
+	}
+	p := priorityHigh
+	for len(q.items[p]) == 0 {
+		p++
+	}
+	item := q.items[p][0]
+	q.items[p] = q.items[p][1:]
+	q.waitSum[p] += time.Since(q.added[item])
+	q.waitCount[p]++
+	delete(q.added, item)
+	q.processing[item] = true
+	return item, true
+}
+
+// done finishes processing an item. Failed items are added again after their
+// backoff; the backoff of succeeded items is reset.
+func (q *workQueue) done(item workItem, failed bool) {
+	q.mu.Lock()
+	delete(q.processing, item)
+	dirty := q.dirty[item]
+	delete(q.dirty, item)
+	var backoff time.Duration
+	if failed {
+		backoff = queueInitialBackoff << q.failures[item]
+		if backoff > queueMaxBackoff || backoff <= 0 {
+			backoff = queueMaxBackoff
+		} else {
+			q.failures[item]++
+		}
+		q.retries++
+	} else {
+		delete(q.failures, item)
+	}
+	q.mu.Unlock()
+
+	switch {
+	case dirty:
+		q.add(item)
+	case failed:
+		time.AfterFunc(jitter(backoff, 0.2), func() { q.add(item) })
+	}
+}
+
+// depth returns the number of waiting items. q.mu must be held.
+func (q *workQueue) depth() int {
+	n := 0
+	for _, items := range q.items {
+		n += len(items)
+	}
+	return n
+}
+
+// queueStats describes the state of the queue for the metrics.
+type queueStats struct {
+	Depth     int64
+	OldestAge time.Duration
+	Retries   int64
+	// Coalesced counts the change notifications coalesced by
+	// addDebounced.
+	Coalesced int64
+	// WaitSum and WaitCount sum up the time items waited until they were
+	// processed, by priority.
+	WaitSum   [numPriorities]time.Duration
+	WaitCount [numPriorities]int64
+}
+
+func (q *workQueue) stats() queueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s := queueStats{Depth: int64(q.depth()), Retries: q.retries, Coalesced: q.coalesced, WaitSum: q.waitSum, WaitCount: q.waitCount}
+	for _, t := range q.added {
+		if age := time.Since(t); age > s.OldestAge {
+			s.OldestAge = age
+		}
+	}
+	return s
+}
+
+// processQueue reconciles the items of the queue one at a time until ctx is
+// done.
+func (s *server) processQueue(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		s.queue.close()
+	}()
+	for {
+		item, ok := s.queue.get()
+		if !ok {
+			return
+		}
+		lg := s.logger.WithFields(logrus.Fields{"region": item.region, "service": item.service})
+		if !s.manages(item.region) {
+			// The region moved to another replica.
+			lg.Debug("dropping queued work of unowned region")
+			s.queue.done(item, false)
+			continue
+		}
+		_, err := s.reconcile(ctx, []string{item.region}, item.service, false)
+		// Misconfiguration fails again until a user acts; the next sync or
+		// event for the service picks the item up again.
+		retry := err != nil && errorKindOf(err).retryable()
+		switch {
+		case retry:
+			lg.WithError(err).Error("queued reconcile failed, retrying with backoff")
+		case err != nil:
+			lg.WithError(err).WithField("errorKind", errorKindOf(err)).Error("queued reconcile failed, not retrying")
+		}
+		s.queue.done(item, retry)
+	}
+}
+
+// requeueFailures adds the work of a failed pass to the queue: its failed
+// regions, and the services with planned mutations if mutations failed,
+// unless they failed due to misconfiguration.
+func (s *server) requeueFailures(res *reconcileResult) {
+	if res == nil {
+		return
+	}
+	for _, st := range res.Regions {
+		if !st.OK && st.ErrorKind.retryable() {
+			s.queue.add(workItem{region: st.Region})
+		}
+	}
+	if res.Failed == 0 {
+		return
+	}
+	for _, m := range res.Plan.Mutations {
+		if !res.ServiceErrorKinds[m.Service].retryable() {
+			continue
+		}
+		item := workItem{region: m.Region}
+		if m.Service != "" {
+			item.service = path.Base(m.Service)
+		}
+		s.queue.add(item)
+	}
+}
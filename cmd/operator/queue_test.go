@@ -0,0 +1,138 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWorkQueueDeduplicates(t *testing.T) {
+	q := newWorkQueue()
+	defer q.close()
+	a, b := workItem{"r", "a"}, workItem{"r", "b"}
+	q.add(a)
+	q.add(b)
+	q.add(a)
+	if s := q.stats(); s.Depth != 2 {
+		t.Fatalf("depth = %d, want 2", s.Depth)
+	}
+	if item, _ := q.get(); item != a {
+		t.Errorf("get = %v, want %v", item, a)
+	}
+	// Items added while processed are processed again afterwards, once.
+	q.add(a)
+	q.add(a)
+	if s := q.stats(); s.Depth != 1 {
+		t.Errorf("depth while processing = %d, want 1", s.Depth)
+	}
+	q.done(a, false)
+	if s := q.stats(); s.Depth != 2 {
+		t.Errorf("depth after done = %d, want 2", s.Depth)
+	}
+	for _, want := range []workItem{b, a} {
+		if item, _ := q.get(); item != want {
+			t.Errorf("get = %v, want %v", item, want)
+		}
+	}
+}
+
+func TestWorkQueueBackoff(t *testing.T) {
+	q := newWorkQueue()
+	defer q.close()
+	item := workItem{"r", "a"}
+	backoff := func() int {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return q.failures[item]
+	}
+	for i := 1; i <= 10; i++ {
+		q.add(item)
+		got, _ := q.get()
+		q.done(got, true)
+		// The backoff doubles from 5s until it reaches 5m.
+		want := i
+		if want > 6 {
+			want = 6
+		}
+		if n := backoff(); n != want {
+			t.Errorf("after %d failures, backoff exponent = %d, want %d", i, n, want)
+		}
+		// Failed items are retried after their backoff, not right away.
+		if s := q.stats(); s.Depth != 0 {
+			t.Fatalf("failed item requeued right away")
+		}
+	}
+	if s := q.stats(); s.Retries != 10 {
+		t.Errorf("retries = %d, want 10", s.Retries)
+	}
+	q.add(item)
+	got, _ := q.get()
+	q.done(got, false)
+	if n := backoff(); n != 0 {
+		t.Errorf("backoff exponent after success = %d, want 0", n)
+	}
+}
+
+func TestWorkQueueClose(t *testing.T) {
+	q := newWorkQueue()
+	done := make(chan bool)
+	go func() {
+		_, ok := q.get()
+		done <- ok
+	}()
+	q.close()
+	if ok := <-done; ok {
+		t.Error("get returned an item from a closed queue")
+	}
+	q.add(workItem{"r", "a"})
+	if s := q.stats(); s.Depth != 0 {
+		t.Errorf("closed queue accepted an item")
+	}
+}
+
+func TestWorkQueueDebounce(t *testing.T) {
+	q := newWorkQueue()
+	defer q.close()
+	q.debounce = 50 * time.Millisecond
+	a := workItem{"r", "a"}
+	q.addDebounced(a)
+	q.addDebounced(a)
+	if s := q.stats(); s.Depth != 0 || s.Coalesced != 1 {
+		t.Fatalf("depth = %d and %d coalesced within the window, want 0 and 1", s.Depth, s.Coalesced)
+	}
+	got, ok := q.get()
+	if !ok || got != a {
+		t.Fatalf("get = %v, %v, want %v", got, ok, a)
+	}
+	q.done(got, false)
+
+	// Notifications for waiting items, or items whose region is waiting,
+	// are coalesced into them.
+	b := workItem{"r", "b"}
+	q.add(b)
+	q.add(workItem{region: "s"})
+	q.addDebounced(b)
+	q.addDebounced(workItem{"s", "c"})
+	if s := q.stats(); s.Depth != 2 || s.Coalesced != 3 {
+		t.Errorf("depth = %d and %d coalesced, want 2 and 3", s.Depth, s.Coalesced)
+	}
+
+	q.debounce = 0
+	q.addDebounced(workItem{"t", "d"})
+	if s := q.stats(); s.Depth != 3 {
+		t.Errorf("depth = %d without debounce window, want 3", s.Depth)
+	}
+}
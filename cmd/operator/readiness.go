@@ -0,0 +1,80 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// apiCheck verifies that the controller's credentials can still use the
+// Cloud Run and Compute Engine APIs, so that a broken service account binding
+// makes the controller unready instead of failing every reconcile. Results
+// are cached for ttl to keep probes cheap.
+type apiCheck struct {
+	r   *reconciler
+	ttl time.Duration
+
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func newAPICheck(r *reconciler, ttl time.Duration) *apiCheck {
+	return &apiCheck{r: r, ttl: ttl}
+}
+
+// result returns the outcome of the last check, checking again if it is
+// older than the ttl. Concurrent probes wait for a running check.
+func (c *apiCheck) result(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.checked.IsZero() && time.Since(c.checked) < c.ttl {
+		return c.err
+	}
+	err := c.check(ctx)
+	if ctx.Err() != nil {
+		// An aborted probe says nothing about the credentials.
+		return err
+	}
+	c.err, c.checked = err, time.Now()
+	return err
+}
+
+// check lists one Cloud Run service and one NEG per managed region and
+// succeeds as soon as both work in one of them.
+func (c *apiCheck) check(ctx context.Context) error {
+	var errs []string
+	for _, region := range c.r.regions {
+		_, err := c.r.runService.Projects.Locations.Services.List(fmt.Sprintf("projects/%s/locations/%s", c.r.project, region)).
+			PageSize(1).Context(ctx).Do()
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "failed to list services in region %q", region).Error())
+			continue
+		}
+		_, err = c.r.computeService.RegionNetworkEndpointGroups.List(c.r.project, region).MaxResults(1).Context(ctx).Do()
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "failed to list network endpoint groups in region %q", region).Error())
+			continue
+		}
+		return nil
+	}
+	return errors.New(strings.Join(errs, "; "))
+}
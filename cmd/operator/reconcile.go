@@ -0,0 +1,548 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/apply"
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/discovery"
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/planner"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/run/v2"
+)
+
+// reconciler holds the clients and settings shared by reconcile passes.
+type reconciler struct {
+	logger  *logrus.Logger
+	project string
+	regions []string
+	cfg     *config
+
+	runService     *run.Service
+	computeService *compute.Service
+	audit          *auditLog
+	// applier executes mutations and records the compute operations in
+	// flight in operations, persisted if -operations-state is set.
+	applier    *apply.Client
+	operations *operationStore
+	events     *eventBus
+	metrics    *controllerMetrics
+	cache      computeCache
+	// backendLocks serializes writes to each backend service across
+	// concurrent reconcile passes.
+	backendLocks keyedMutex
+
+	include, exclude labelSelector
+	// includeFields and excludeFields are the field selectors.
+	includeFields, excludeFields labelSelector
+	negNames                     *nameTemplate
+	// maxDeletions is the maximum number of NEG deletions and backend
+	// detachments per cycle; negative values disable the limit.
+	maxDeletions int
+	// regionConcurrency bounds the number of regions planned in parallel;
+	// zero or negative values plan all regions at once.
+	regionConcurrency int
+	// canaryPercent is the size of the subset of matching services that is
+	// reconciled, in percent.
+	canaryPercent int
+	// adopt enables taking over unmanaged serverless NEGs that match the
+	// desired spec of a service.
+	adopt bool
+	// strict refuses to modify or delete NEGs and backend entries that lack
+	// the ownership marker, logging a conflict instead.
+	strict bool
+	// hardenIngress restricts the ingress of services with an attached NEG
+	// to internal and load balancer traffic.
+	hardenIngress bool
+	// tagNEGs gives services whose traffic is split across tagged
+	// revisions one NEG per tag.
+	tagNEGs bool
+	// driftMode is driftCorrect to undo out-of-band changes, or driftReport
+	// to only report them.
+	driftMode string
+	converged convergedState
+	// failures tracks services whose mutations keep failing.
+	failures *serviceFailures
+	// priorities remembers the priority classes of the services.
+	priorities *servicePriorities
+	// breakers skip regions that keep failing for a cooldown.
+	breakers *regionBreakers
+	// source, if set, replaces the labels of services as the source of the
+	// desired state.
+	source desiredStateSource
+	// dryRun plans reconcile passes without applying them.
+	dryRun bool
+	// diffs, if set, receives the planned changes of every pass.
+	diffs *diffWriter
+	// approval, if set, must approve plans before they are applied.
+	approval *approvalWebhook
+	// policies, if set, block the planned mutations violating them.
+	policies *policies
+	// rollout, if set, stages destructive changes across regions.
+	rollout *rollout
+	// optOut is the default opt-out mode of services, see labelOptOut.
+	optOut string
+	// retention retains the NEGs of services that opted out in detach mode.
+	retention *retention
+	// allowCoManagement permits modifying backend services that appear to
+	// be managed by another tool.
+	allowCoManagement bool
+	// authChecks enables checking whether requests through the load
+	// balancer are authorized, see checkAuth.
+	authChecks bool
+	// serving, if set, tracks whether the managed services serve traffic.
+	serving *servingTracker
+	// propagateLabels holds the keys of the service labels propagated to
+	// the NEGs and backends of the service.
+	propagateLabels []string
+	// frontendProjects holds the projects whose load balancers reference
+	// backend services of the project through cross-project service
+	// referencing.
+	frontendProjects []string
+	// frontendCompute holds the Compute Engine clients of the frontend
+	// projects, with the credentials configured for them.
+	frontendCompute map[string]*compute.Service
+}
+
+// reconcileResult is the outcome of a reconcile pass.
+type reconcileResult struct {
+	Plan          *plan          `json:"plan"`
+	Failed        int            `json:"failed"`
+	Drift         int            `json:"drift"`
+	Services      int            `json:"services"`
+	FailedRegions []string       `json:"failedRegions,omitempty"`
+	Regions       []regionStatus `json:"regions"`
+	DryRun        bool           `json:"dryRun,omitempty"`
+	// Deferred is the number of mutations deferred to a mutation window.
+	Deferred int `json:"deferred,omitempty"`
+	// ServiceErrors holds the first error of every service whose mutations
+	// failed, and ServiceErrorKinds its kind.
+	ServiceErrors     map[string]string    `json:"serviceErrors,omitempty"`
+	ServiceErrorKinds map[string]errorKind `json:"serviceErrorKinds,omitempty"`
+}
+
+// regionStatus is the outcome of planning one region.
+type regionStatus struct {
+	Region    string    `json:"region"`
+	OK        bool      `json:"ok"`
+	Error     string    `json:"error,omitempty"`
+	ErrorKind errorKind `json:"errorKind,omitempty"`
+	Mutations int       `json:"mutations"`
+	Duration  string    `json:"duration"`
+}
+
+// reconcile runs one reconcile pass over the given regions: it plans the
+// changes for all regions, checks them against the deletion budget and then
+// applies them. Compute state is taken from the cache if available; call
+// cache.invalidate first for a full, authoritative resync. If service is not
+// empty, only mutations for the Cloud Run service of that name are applied.
+func (r *reconciler) reconcile(ctx context.Context, regions []string, service string) (res *reconcileResult, err error) {
+	ctx = withReconcileID(startSpan(ctx))
+	res = &reconcileResult{Plan: &plan{}}
+	r.events.publish(reconcileEvent{Type: eventStarted, Regions: regions, Service: service})
+	defer func() {
+		e := reconcileEvent{Type: eventApplied, Regions: regions, Service: service, Mutations: res.Plan.Mutations}
+		if res.DryRun {
+			e.Mutations = nil
+		}
+		if err != nil {
+			e.Type, e.Error, e.ErrorKind = eventFailed, err.Error(), errorKindOf(err)
+		}
+		r.events.publish(e)
+		complete := service == "" && len(regions) == len(r.regions) && len(res.FailedRegions) == 0
+		r.metrics.observe(res, err, complete)
+	}()
+
+	if r.source != nil {
+		// Without the desired state, every NEG would look unwanted.
+		if err := r.source.refresh(ctx); err != nil {
+			return res, err
+		}
+		defer func() {
+			if !res.DryRun {
+				r.source.report(ctx, r, res, regions, service, err)
+			}
+		}()
+	}
+
+	globalBackends, err := r.globalBackendServices(ctx)
+	if err != nil {
+		return res, err
+	}
+
+	plans := r.planRegions(ctx, regions, service, globalBackends)
+	var regionErrors []error
+	for i, region := range regions {
+		rp := plans[i]
+		st := regionStatus{Region: region, OK: rp.err == nil, Duration: rp.duration.Round(time.Millisecond).String()}
+		if rp.err != nil {
+			st.Error, st.ErrorKind = rp.err.Error(), errorKindOf(rp.err)
+			r.log(ctx).WithFields(logrus.Fields{"region": region, "errorKind": st.ErrorKind}).WithError(rp.err).Error("failed to plan region")
+			regionErrors = append(regionErrors, rp.err)
+			res.FailedRegions = append(res.FailedRegions, region)
+		} else {
+			st.Mutations = len(rp.plan.Mutations)
+			res.Plan.merge(rp.plan)
+		}
+		res.Regions = append(res.Regions, st)
+	}
+	for _, desired := range res.Plan.desired {
+		// Services with revision tag NEGs have several desired NEGs.
+		services := make(map[string]bool, len(desired))
+		for _, d := range desired {
+			services[d.Service] = true
+		}
+		res.Services += len(services)
+	}
+	if service != "" {
+		res.Plan.filter(func(m mutation) bool { return path.Base(m.Service) == service })
+	}
+
+	r.reportDrift(ctx, res, regions, service)
+	r.stageRollout(ctx, res, service, time.Now())
+	r.holdBackFailing(ctx, res.Plan, time.Now())
+	r.deferOutsideWindow(ctx, res, time.Now())
+
+	r.events.publish(reconcileEvent{Type: eventPlanned, Regions: regions, Service: service, Mutations: res.Plan.Mutations})
+
+	if r.diffs != nil {
+		d := planDiff{Time: time.Now(), Project: r.project, Regions: regions, DryRun: r.dryRun, Changes: res.Plan.diffs()}
+		if err := r.diffs.write(d); err != nil {
+			// Changes must not be applied without being described.
+			return res, err
+		}
+	}
+
+	if err := r.checkDeletionBudget(res.Plan); err != nil {
+		res.Plan.log(r.log(ctx), logrus.WarnLevel)
+		return res, err
+	}
+	if r.dryRun {
+		res.DryRun = true
+		res.Plan.log(r.log(ctx), logrus.InfoLevel)
+		return res, nil
+	}
+
+	if r.approval != nil && !res.Plan.empty() {
+		id, _ := reconcileIDFromContext(ctx)
+		req := approvalRequest{ReconcileID: id, Project: r.project, Regions: regions, Service: service,
+			Mutations: res.Plan.Mutations, Changes: res.Plan.diffs()}
+		if err := r.approval.approve(ctx, req); err != nil {
+			res.Plan.log(r.log(ctx), logrus.WarnLevel)
+			return res, err
+		}
+	}
+
+	var serviceErrors map[string]error
+	if res.Plan.empty() {
+		r.log(ctx).Debug("all regions up to date")
+	} else {
+		res.Failed, serviceErrors = r.apply(ctx, res.Plan)
+		for svc, err := range serviceErrors {
+			if res.ServiceErrors == nil {
+				res.ServiceErrors = make(map[string]string)
+				res.ServiceErrorKinds = make(map[string]errorKind)
+			}
+			res.ServiceErrors[svc] = err.Error()
+			res.ServiceErrorKinds[svc] = errorKindOf(err)
+		}
+		r.recordRollout(ctx, res.Plan, serviceErrors, time.Now())
+		// The cached compute state of the changed scopes no longer reflects
+		// the changes made.
+		r.cache.invalidateMutations(res.Plan.Mutations)
+	}
+	r.recordFailures(ctx, res.Plan, serviceErrors)
+	r.recordRetention(ctx, res, service, serviceErrors, time.Now())
+	var serving map[string]servingCondition
+	if r.serving != nil {
+		var serr error
+		if serving, serr = r.serving.update(ctx, res.Plan, service == ""); serr != nil {
+			r.log(ctx).WithError(serr).WithField("errorKind", errorKindOf(serr)).Warn("failed to check whether services serve traffic")
+		}
+	}
+	r.reportStatus(ctx, res.Plan, serving)
+	if service == "" && res.Failed == 0 {
+		r.converged.update(res.Plan.desired)
+	}
+	// Partial failures are classified by the kind shared by their errors,
+	// if any, so that callers can decide whether to retry them.
+	if res.Failed != 0 {
+		errs := make([]error, 0, len(serviceErrors))
+		for _, err := range serviceErrors {
+			errs = append(errs, err)
+		}
+		return res, &partialError{withKind(commonErrorKind(errs), errors.Errorf("%d of %d mutations failed", res.Failed, len(res.Plan.Mutations)))}
+	}
+	if len(res.FailedRegions) != 0 {
+		return res, &partialError{withKind(commonErrorKind(regionErrors), errors.Errorf("failed to reconcile regions %v", res.FailedRegions))}
+	}
+	return res, nil
+}
+
+// partialError is returned by reconcile passes that ran, but failed for some
+// regions or mutations.
+type partialError struct {
+	error
+}
+
+func (e *partialError) Unwrap() error { return e.error }
+
+// reportDrift logs and publishes the mutations of the plan that undo
+// out-of-band changes and, in report-only mode, drops them from the plan.
+func (r *reconciler) reportDrift(ctx context.Context, res *reconcileResult, regions []string, service string) {
+	var drift []mutation
+	for _, m := range res.Plan.Mutations {
+		if m.Drift {
+			r.log(ctx).WithFields(m.Fields()).Warn("drift detected")
+			drift = append(drift, m)
+		}
+	}
+	res.Drift = len(drift)
+	if len(drift) == 0 {
+		return
+	}
+	r.events.publish(reconcileEvent{Type: eventDrift, Regions: regions, Service: service, Mutations: drift})
+	if r.driftMode == driftReport {
+		res.Plan.filter(func(m mutation) bool { return !m.Drift })
+	}
+}
+
+type regionPlan struct {
+	plan     *plan
+	err      error
+	duration time.Duration
+}
+
+// planRegions plans the given regions concurrently, bounded by the region
+// concurrency. A failing region does not affect the others; the results are
+// returned in the order of regions.
+func (r *reconciler) planRegions(ctx context.Context, regions []string, service string, globalBackends map[backendServiceRef]*compute.BackendService) []regionPlan {
+	limit := r.regionConcurrency
+	if limit <= 0 || limit > len(regions) {
+		limit = len(regions)
+	}
+	sem := make(chan struct{}, limit)
+	plans := make([]regionPlan, len(regions))
+	var wg sync.WaitGroup
+	for i, region := range regions {
+		wg.Add(1)
+		go func(i int, region string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			start := time.Now()
+			if ok, until := r.breakers.allow(region, start); !ok {
+				plans[i] = regionPlan{err: withKind(kindUnavailable, errors.Errorf("circuit open until %s after repeated failures", until.Format(time.RFC3339)))}
+				return
+			}
+			p, err := r.planRegion(ctx, region, service, globalBackends)
+			plans[i] = regionPlan{plan: p, err: err, duration: time.Since(start)}
+			if ctx.Err() == nil {
+				r.recordRegionOutcome(ctx, region, err)
+			}
+		}(i, region)
+	}
+	wg.Wait()
+	return plans
+}
+
+// recordRegionOutcome updates the circuit breaker of a region after planning
+// it, and reports circuits that opened or closed.
+func (r *reconciler) recordRegionOutcome(ctx context.Context, region string, err error) {
+	opened, closed := r.breakers.record(region, err, time.Now())
+	lg := r.log(ctx).WithField("region", region)
+	switch {
+	case opened:
+		lg.WithError(err).WithField("cooldown", r.breakers.cooldown).Warn("region keeps failing, opening its circuit")
+		r.events.publish(reconcileEvent{Type: eventCircuitOpened, Regions: []string{region}, Error: err.Error()})
+	case closed:
+		lg.Info("region recovered, closing its circuit")
+		r.events.publish(reconcileEvent{Type: eventCircuitClosed, Regions: []string{region}})
+	}
+}
+
+// checkDeletionBudget refuses plans that would delete more NEGs or detach more
+// backends than allowed per cycle, which usually indicates a bad selector
+// change rather than intended removals.
+func (r *reconciler) checkDeletionBudget(p *plan) error {
+	if r.maxDeletions < 0 {
+		return nil
+	}
+	if n := p.count(opDeleteNEG); n > r.maxDeletions {
+		return errors.Errorf("plan deletes %d NEGs, more than the allowed %d per cycle; not applying any changes", n, r.maxDeletions)
+	}
+	if n := p.count(opDetachBackend); n > r.maxDeletions {
+		return errors.Errorf("plan detaches %d backends, more than the allowed %d per cycle; not applying any changes", n, r.maxDeletions)
+	}
+	return nil
+}
+
+// planRegion lists the selected Cloud Run services and the compute resources
+// of one region and computes the mutations needed to reconcile them. If
+// service is not empty, only that service is fetched; the mutations planned
+// for resources of other services are filtered out by the caller.
+func (r *reconciler) planRegion(ctx context.Context, region, service string, globalBackends map[backendServiceRef]*compute.BackendService) (*plan, error) {
+	var svcs []*run.GoogleCloudRunV2Service
+	if service == "" {
+		var err error
+		if svcs, err = discovery.Services(ctx, r.log(ctx), r.runService, r.project, region); err != nil {
+			return nil, err
+		}
+	} else {
+		svc, err := discovery.GetService(ctx, r.runService, r.project, region, service)
+		if err != nil {
+			return nil, err
+		}
+		if svc != nil {
+			svcs = append(svcs, svc)
+		}
+	}
+	if r.source != nil {
+		svcs = r.source.overlay(region, svcs)
+	}
+	selected, frozen := r.selectServices(svcs)
+	r.priorities.record(region, selected)
+
+	st, err := r.regionComputeState(ctx, region)
+	if err != nil {
+		return nil, err
+	}
+	backends := mergeBackends(st.backends, globalBackends)
+	p := r.computePlan(ctx, region, selected, frozen, st.negs, backends)
+	p.recordStatus(selected)
+	r.retainOptedOut(ctx, region, svcs, p, time.Now())
+	if r.authChecks {
+		r.checkAuth(ctx, region, selected, backends, p)
+	}
+	p.merge(r.planIngress(region, svcs, selected, frozen, backends, p))
+	p.merge(r.planPSC(ctx, region, r.cfg.pscNEGsIn(region), st.otherNEGs, backends))
+	// A targeted pass doesn't know the other services, so it would take all
+	// their backends for stale ones; pruning is left to full passes.
+	if service == "" {
+		p.merge(r.planPruning(ctx, region, svcs, st, backends, p))
+	}
+	r.holdBackCoManaged(ctx, p, backends)
+	r.holdBackIncompatibleProtocols(ctx, p)
+	r.enforcePolicies(ctx, p, svcs, backends)
+	return p, nil
+}
+
+// mergeBackends returns the regional and global backend services in one map.
+func mergeBackends(regional, global map[backendServiceRef]*compute.BackendService) map[backendServiceRef]*compute.BackendService {
+	backends := make(map[backendServiceRef]*compute.BackendService, len(regional)+len(global))
+	for ref, bs := range regional {
+		backends[ref] = bs
+	}
+	for ref, bs := range global {
+		backends[ref] = bs
+	}
+	return backends
+}
+
+// desiredNEG is the state the controller wants for a serverless NEG.
+type desiredNEG = planner.DesiredNEG
+
+// computePlan computes the mutations needed for the given services, based on
+// the serverless NEGs and backend services currently present in the region.
+// It renders and validates the desired NEGs of the services, and leaves
+// comparing them with the region to planner.Compute. Resources owned by
+// frozen services are left untouched.
+func (r *reconciler) computePlan(ctx context.Context, region string, svcs []*run.GoogleCloudRunV2Service, frozen map[string]bool, negs map[string]*compute.NetworkEndpointGroup, backends map[backendServiceRef]*compute.BackendService) *plan {
+	desired := make(map[string]desiredNEG)
+	// keep holds NEGs that must not be deleted even though they are not
+	// desired, e.g. because their service is misconfigured or collides.
+	keep := make(map[string]bool)
+	for _, svc := range svcs {
+		name := r.negNames.render(serviceName(svc), region, r.project)
+		lg := r.log(ctx).WithFields(logrus.Fields{"service": svc.Name, "neg": name})
+		if !validResourceName(name) {
+			lg.Error("rendered NEG name is not a valid resource name, skipping service")
+			continue
+		}
+		tags := r.trafficTags(svc)
+		for _, tag := range sortedKeys(tags) {
+			if !validResourceName(tagNEGName(name, tag)) {
+				lg.WithField("tag", tag).Error("NEG name of revision tag is not a valid resource name, ignoring the tags of the service")
+				tags = nil
+				break
+			}
+		}
+		skip := func() {
+			keep[name] = true
+			for tag := range tags {
+				keep[tagNEGName(name, tag)] = true
+			}
+		}
+		bs, err := desiredBackends(svc, region)
+		if err != nil {
+			lg.WithError(err).WithField("errorKind", errorKindOf(err)).Error("invalid service configuration, skipping service")
+			skip()
+			continue
+		}
+		if err := r.cfg.checkTenant(svc, r.project, bs); err != nil {
+			lg.WithError(err).Error("rejecting service configuration, skipping service")
+			skip()
+			continue
+		}
+		d := desiredNEG{Service: svc.Name, Backends: bs, Labels: r.propagatedLabels(svc)}
+		negs := map[string]desiredNEG{name: d}
+		if tags != nil {
+			negs = desiredTagNEGs(name, d, tags)
+		}
+		for _, name := range sortedKeys(negs) {
+			if other, ok := desired[name]; ok {
+				lg.WithFields(logrus.Fields{"neg": name, "other": other.Service}).Error("NEG name collides with another service, skipping both")
+				keep[name] = true
+				continue
+			}
+			desired[name] = negs[name]
+		}
+	}
+	for name := range keep {
+		delete(desired, name)
+	}
+
+	pp := planner.Compute(planner.Options{
+		Project: r.project,
+		Adopt:   r.adopt,
+		Strict:  r.strict,
+		Drifted: r.converged.drifted,
+		Logger:  r.log(ctx),
+	}, planner.Input{
+		Region:          region,
+		Desired:         desired,
+		Keep:            keep,
+		Frozen:          frozen,
+		NEGs:            negs,
+		BackendServices: backends,
+	})
+	return &plan{Mutations: pp.Mutations, desired: map[string]map[string]desiredNEG{region: pp.Desired}}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,200 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// interaction is a recorded Google API request and its response, stored as
+// one JSON line of a golden file. Request headers, including credentials,
+// are not recorded.
+type interaction struct {
+	Method       string `json:"method"`
+	URL          string `json:"url"`
+	Body         string `json:"body,omitempty"`
+	Status       int    `json:"status"`
+	ContentType  string `json:"contentType,omitempty"`
+	ResponseBody string `json:"responseBody"`
+}
+
+// apiTransport carries the requests of all Google API clients beneath their
+// credentials. With -record it is the process's single recorder.
+var apiTransport http.RoundTripper = http.DefaultTransport
+
+// setupRecording installs the recorder for -record, or answers the requests
+// of all clients from the -replay file, once per process.
+func setupRecording() error {
+	if _, ok := apiTransport.(*recordingTransport); ok || simulation != nil {
+		return nil
+	}
+	switch {
+	case flRecord != "":
+		f, err := os.Create(flRecord)
+		if err != nil {
+			return errors.Wrap(err, "failed to create record file")
+		}
+		apiTransport = &recordingTransport{next: apiTransport, f: f}
+	case flReplay != "":
+		t, err := newReplayTransport(flReplay)
+		if err != nil {
+			return err
+		}
+		simulation = t
+	}
+	return nil
+}
+
+// recordingTransport appends every request and response passing through it
+// to a golden file.
+type recordingTransport struct {
+	next http.RoundTripper
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	in := interaction{Method: req.Method, URL: req.URL.String()}
+	if req.Body != nil {
+		b, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		in.Body = string(b)
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(b))
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	in.Status, in.ContentType, in.ResponseBody = resp.StatusCode, resp.Header.Get("Content-Type"), string(b)
+
+	var line bytes.Buffer
+	enc := json.NewEncoder(&line)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(in); err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := t.f.Write(line.Bytes()); err != nil {
+		return nil, errors.Wrap(err, "failed to record interaction")
+	}
+	return resp, nil
+}
+
+// replayTransport answers requests from a golden file written with -record,
+// without contacting Google APIs. Requests are matched by interactionKey;
+// repeated requests, e.g. the pages of a list, get the recorded responses in
+// order.
+type replayTransport struct {
+	mu      sync.Mutex
+	pending map[string][]interaction
+}
+
+func newReplayTransport(file string) (*replayTransport, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open replay file")
+	}
+	defer f.Close()
+	t := &replayTransport{pending: make(map[string][]interaction)}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 64<<20)
+	for line := 1; sc.Scan(); line++ {
+		var in interaction
+		if err := json.Unmarshal(sc.Bytes(), &in); err != nil {
+			return nil, errors.Wrapf(err, "invalid interaction on line %d of replay file", line)
+		}
+		u, err := url.Parse(in.URL)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid URL on line %d of replay file", line)
+		}
+		key := interactionKey(in.Method, u)
+		t.pending[key] = append(t.pending[key], in)
+	}
+	return t, errors.Wrap(sc.Err(), "failed to read replay file")
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	key := interactionKey(req.Method, req.URL)
+	t.mu.Lock()
+	queue := t.pending[key]
+	var in interaction
+	ok := len(queue) != 0
+	if ok {
+		in, t.pending[key] = queue[0], queue[1:]
+	}
+	t.mu.Unlock()
+
+	resp := &http.Response{
+		Status:     fmt.Sprintf("%d %s", in.Status, http.StatusText(in.Status)),
+		StatusCode: in.Status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": {in.ContentType}},
+		Body:       io.NopCloser(strings.NewReader(in.ResponseBody)),
+		Request:    req,
+	}
+	if !ok {
+		// Not retryable, so that missing recordings fail fast.
+		resp.StatusCode, resp.Status = http.StatusNotImplemented, "501 Not Implemented"
+		resp.Header.Set("Content-Type", "text/plain")
+		resp.Body = io.NopCloser(strings.NewReader("no recorded response for " + key))
+	}
+	return resp, nil
+}
+
+// volatileParams are query parameters that differ between otherwise equal
+// requests and are left out of interaction keys.
+var volatileParams = []string{"pageToken", "requestId", "alt", "prettyPrint"}
+
+// interactionKey identifies a request by its method, path and the remaining
+// query parameters, in canonical order.
+func interactionKey(method string, u *url.URL) string {
+	q := u.Query()
+	for _, p := range volatileParams {
+		q.Del(p)
+	}
+	key := method + " " + u.Path
+	if len(q) != 0 {
+		key += "?" + q.Encode()
+	}
+	return key
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/url"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+const wantPlan = `createNEG      us-central1/hello-neg
+attachBackend  us-central1/hello-neg backend service global/web
+`
+
+// replay runs a reconcile pass against a golden file of testdata and checks
+// that every recorded interaction was used.
+func replay(t *testing.T, file string, dryRun bool) *reconcileResult {
+	t.Helper()
+	project, regions, replayFile := flProject, flRegions, flReplay
+	t.Cleanup(func() {
+		flProject, flRegions, flReplay = project, regions, replayFile
+		simulation = nil
+	})
+	flProject, flRegions, flReplay = "p", "us-central1", "testdata/"+file
+	simulation = nil
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	r, err := newReconciler(context.Background(), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.dryRun = dryRun
+	res, err := r.reconcile(context.Background(), r.regions, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, queue := range simulation.(*replayTransport).pending {
+		if len(queue) != 0 {
+			t.Errorf("%d recorded responses to %s not used", len(queue), key)
+		}
+	}
+	return res
+}
+
+func TestReplayPlan(t *testing.T) {
+	res := replay(t, "plan.jsonl", true)
+	var b bytes.Buffer
+	printPlan(&b, res.Plan)
+	if b.String() != wantPlan {
+		t.Errorf("plan:\n%s\nwant:\n%s", b.String(), wantPlan)
+	}
+	if res.Services != 2 {
+		t.Errorf("services = %d, want 2", res.Services)
+	}
+}
+
+func TestReplayApply(t *testing.T) {
+	res := replay(t, "apply.jsonl", false)
+	var b bytes.Buffer
+	printPlan(&b, res.Plan)
+	if b.String() != wantPlan {
+		t.Errorf("plan:\n%s\nwant:\n%s", b.String(), wantPlan)
+	}
+	if res.Failed != 0 {
+		t.Errorf("%d mutations failed: %v", res.Failed, res.ServiceErrors)
+	}
+}
+
+func TestInteractionKey(t *testing.T) {
+	for _, tc := range []struct {
+		method, url, want string
+	}{
+		{"GET", "https://run.googleapis.com/v2/projects/p/locations/r/services?alt=json&prettyPrint=false", "GET /v2/projects/p/locations/r/services"},
+		{"GET", "https://run.googleapis.com/v2/projects/p/locations/r/services?alt=json&pageToken=abc&prettyPrint=false", "GET /v2/projects/p/locations/r/services"},
+		{"PATCH", "https://compute.googleapis.com/compute/v1/projects/p/global/backendServices/web?requestId=1234", "PATCH /compute/v1/projects/p/global/backendServices/web"},
+		{"GET", "https://compute.googleapis.com/compute/v1/projects/p/regions/r/networkEndpointGroups?maxResults=1&alt=json", "GET /compute/v1/projects/p/regions/r/networkEndpointGroups?maxResults=1"},
+	} {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := interactionKey(tc.method, u); got != tc.want {
+			t.Errorf("interactionKey(%s %s) = %q, want %q", tc.method, tc.url, got, tc.want)
+		}
+	}
+}
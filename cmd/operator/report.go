@@ -0,0 +1,250 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/discovery"
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/planner"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/compute/v1"
+)
+
+// inventoryRow describes how one Cloud Run service is fronted by one backend
+// service. Services without a NEG, or with a NEG that is not attached, have a
+// single row without backend service.
+type inventoryRow struct {
+	Project        string   `json:"project"`
+	Region         string   `json:"region"`
+	Service        string   `json:"service"`
+	Ingress        string   `json:"ingress"`
+	NEG            string   `json:"neg,omitempty"`
+	Managed        bool     `json:"managed"`
+	BackendService string   `json:"backendService,omitempty"`
+	Scheme         string   `json:"scheme,omitempty"`
+	SecurityPolicy string   `json:"securityPolicy,omitempty"`
+	URLMaps        []string `json:"urlMaps,omitempty"`
+}
+
+var inventoryColumns = []string{"project", "region", "service", "ingress", "neg", "managed", "backend_service", "scheme", "security_policy", "url_maps"}
+
+func (row inventoryRow) csv() []string {
+	return []string{row.Project, row.Region, row.Service, row.Ingress, row.NEG, strconv.FormatBool(row.Managed),
+		row.BackendService, row.Scheme, row.SecurityPolicy, strings.Join(row.URLMaps, ";")}
+}
+
+// runReport implements the report command: an inventory of every Cloud Run
+// service of the managed regions, selected or not, and the load balancers
+// fronting it.
+func runReport(ctx context.Context, logger *logrus.Logger, args []string) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	format := fs.String("format", "csv", "output format: csv or json")
+	out := fs.String("out", "-", "file to write the report to (- for stdout)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *format != "csv" && *format != "json" {
+		return errors.Errorf("report: unknown format %q", *format)
+	}
+
+	r, err := newReconciler(ctx, logger)
+	if err != nil {
+		return err
+	}
+	rows, err := r.inventory(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return errors.Wrap(err, "failed to create report")
+		}
+		defer f.Close()
+		w = f
+	}
+	if *format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return errors.Wrap(enc.Encode(rows), "failed to write report")
+	}
+	cw := csv.NewWriter(w)
+	cw.Write(inventoryColumns)
+	for _, row := range rows {
+		cw.Write(row.csv())
+	}
+	cw.Flush()
+	return errors.Wrap(cw.Error(), "failed to write report")
+}
+
+// inventory lists the Cloud Run services of the managed regions with the
+// serverless NEGs pointing to them, the backend services these are attached
+// to and the URL maps using those backend services.
+func (r *reconciler) inventory(ctx context.Context) ([]inventoryRow, error) {
+	globalBackends, err := discovery.ListBackendServices(ctx, r.computeService, r.project, "")
+	if err != nil {
+		return nil, err
+	}
+	urlMaps, err := r.urlMapUsers(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []inventoryRow
+	for _, region := range r.regions {
+		svcs, err := discovery.Services(ctx, r.log(ctx), r.runService, r.project, region)
+		if err != nil {
+			return nil, err
+		}
+		negs, err := listServerlessNEGs(ctx, r.computeService, r.project, region)
+		if err != nil {
+			return nil, err
+		}
+		regional, err := discovery.ListBackendServices(ctx, r.computeService, r.project, region)
+		if err != nil {
+			return nil, err
+		}
+		regionalURLMaps, err := r.urlMapUsers(ctx, region)
+		if err != nil {
+			return nil, err
+		}
+		for bs, names := range regionalURLMaps {
+			urlMaps[bs] = names
+		}
+		backends := mergeBackends(regional, globalBackends)
+		owners := planner.NEGOwners(r.project, region, negs, backends)
+
+		sort.Slice(svcs, func(i, j int) bool { return svcs[i].Name < svcs[j].Name })
+		for _, svc := range svcs {
+			row := inventoryRow{Project: r.project, Region: region, Service: serviceName(svc), Ingress: svc.Ingress}
+			fronted := false
+			for _, name := range sortedKeys(negs) {
+				if cr := negs[name].CloudRun; cr == nil || cr.Service != row.Service {
+					continue
+				}
+				row := row
+				row.NEG = name
+				_, row.Managed = owners[name]
+				attached := false
+				for _, ref := range discovery.SortedBackendRefs(backends) {
+					if discovery.FindBackend(backends[ref], r.project, region, name) == nil {
+						continue
+					}
+					bs := backends[ref]
+					row := row
+					row.BackendService, row.Scheme, row.SecurityPolicy = ref.String(), bs.LoadBalancingScheme, resourceName(bs.SecurityPolicy)
+					row.URLMaps = urlMaps[resourcePath(bs.SelfLink)]
+					rows = append(rows, row)
+					attached = true
+				}
+				if !attached {
+					rows = append(rows, row)
+				}
+				fronted = true
+			}
+			if !fronted {
+				rows = append(rows, row)
+			}
+		}
+	}
+	return rows, nil
+}
+
+// urlMapUsers returns the URL maps of the project and of the frontend
+// projects in the given scope by the path of the backend services they route
+// to. URL maps of frontend projects are prefixed with their project.
+func (r *reconciler) urlMapUsers(ctx context.Context, region string) (map[string][]string, error) {
+	users, err := listURLMapUsers(ctx, r.computeService, r.project, region)
+	if err != nil {
+		return nil, err
+	}
+	for _, fp := range r.frontendProjects {
+		fu, err := listURLMapUsers(ctx, r.frontendCompute[fp], fp, region)
+		if err != nil {
+			return nil, errors.Wrapf(err, "frontend project %q", fp)
+		}
+		for bs, names := range fu {
+			for _, name := range names {
+				users[bs] = append(users[bs], fp+"/"+name)
+			}
+		}
+	}
+	return users, nil
+}
+
+// listURLMapUsers returns the names of the global URL maps of the project if
+// region is empty, or of the URL maps of the given region otherwise, by the
+// path of the backend services they route to.
+func listURLMapUsers(ctx context.Context, computeService *compute.Service, project, region string) (map[string][]string, error) {
+	users := make(map[string][]string)
+	add := func(l *compute.UrlMapList) error {
+		for _, um := range l.Items {
+			for _, bs := range urlMapBackendServices(um) {
+				users[bs] = append(users[bs], um.Name)
+			}
+		}
+		return nil
+	}
+	var err error
+	if region == "" {
+		err = computeService.UrlMaps.List(project).Pages(ctx, add)
+	} else {
+		err = computeService.RegionUrlMaps.List(project, region).Pages(ctx, add)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list URL maps in %q", backendServiceRef{Region: region}.Scope())
+	}
+	return users, nil
+}
+
+// urlMapBackendServices returns the paths of the backend services a URL map
+// routes to, each once.
+func urlMapBackendServices(um *compute.UrlMap) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, u := range urlMapServices(um) {
+		if p := resourcePath(u); p != "" && strings.Contains(p, "/backendServices/") && !seen[p] {
+			seen[p] = true
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// resourcePath strips the API prefix of a Compute Engine resource URL,
+// returning the path starting with projects/.
+func resourcePath(u string) string {
+	if i := strings.Index(u, "projects/"); i >= 0 {
+		return u[i:]
+	}
+	return ""
+}
+
+// resourceName returns the last path segment of a resource URL.
+func resourceName(u string) string {
+	return u[strings.LastIndex(u, "/")+1:]
+}
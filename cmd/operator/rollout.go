@@ -0,0 +1,231 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// rolloutConfig orders the rollout of destructive changes across regions,
+// e.g. to detach backends in one region and observe the load balancer before
+// detaching them everywhere else.
+type rolloutConfig struct {
+	// Stages holds the regions of each stage, in rollout order. Regions not
+	// listed form a last stage.
+	Stages [][]string `yaml:"stages"`
+	// Bake is how long the changes applied in a stage are observed before
+	// the next stage is rolled out.
+	Bake time.Duration `yaml:"bake"`
+	// State is a file or Cloud Storage object (gs://bucket/object) keeping
+	// the progress of the rollout across restarts and one-shot runs.
+	State string `yaml:"state"`
+}
+
+// validate checks that every region belongs to at most one stage.
+func (c *rolloutConfig) validate() error {
+	if c.Bake < 0 {
+		return errors.New("bake must not be negative")
+	}
+	seen := make(map[string]bool)
+	for i, stage := range c.Stages {
+		if len(stage) == 0 {
+			return errors.Errorf("stages[%d] is empty", i)
+		}
+		for _, region := range stage {
+			if seen[region] {
+				return errors.Errorf("stages[%d]: region %q is listed in more than one stage", i, region)
+			}
+			seen[region] = true
+		}
+	}
+	return nil
+}
+
+// stage returns the index of the stage of a region.
+func (c *rolloutConfig) stage(region string) int {
+	for i, stage := range c.Stages {
+		if contains(stage, region) {
+			return i
+		}
+	}
+	return len(c.Stages)
+}
+
+// rolloutState is the progress of a staged rollout, by region.
+type rolloutState struct {
+	// Applied holds when destructive changes were last applied.
+	Applied map[string]time.Time `json:"applied"`
+	// Pending holds the number of destructive changes planned or failed by
+	// the last pass over the region.
+	Pending map[string]int `json:"pending"`
+}
+
+// rollout holds back the destructive changes of a stage while an earlier
+// stage has destructive changes pending, failed or applied less than the
+// bake time ago. A failure in one stage thereby halts the later ones until
+// the stage is rolled out and baked.
+type rollout struct {
+	cfg    rolloutConfig
+	appCfg *config
+
+	mu    sync.Mutex
+	state rolloutState
+}
+
+// newRollout returns the rollout of the configuration, with its progress
+// read from the state location, if any. It returns nil if no stages are
+// configured.
+func newRollout(ctx context.Context, cfg *config) (*rollout, error) {
+	if len(cfg.Rollout.Stages) == 0 {
+		return nil, nil
+	}
+	ro := &rollout{cfg: cfg.Rollout, appCfg: cfg, state: rolloutState{Applied: make(map[string]time.Time), Pending: make(map[string]int)}}
+	if cfg.Rollout.State == "" {
+		return ro, nil
+	}
+	b, err := readLocation(ctx, cfg.Rollout.State, cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read rollout state")
+	}
+	if b != nil {
+		if err := json.Unmarshal(b, &ro.state); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse rollout state %s", cfg.Rollout.State)
+		}
+		if ro.state.Applied == nil {
+			ro.state.Applied = make(map[string]time.Time)
+		}
+		if ro.state.Pending == nil {
+			ro.state.Pending = make(map[string]int)
+		}
+	}
+	return ro, nil
+}
+
+// save writes the progress to the state location, if any. Must be called with
+// mu held.
+func (ro *rollout) save(ctx context.Context) error {
+	if ro.cfg.State == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(ro.state, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode rollout state")
+	}
+	return errors.Wrap(writeLocation(ctx, ro.cfg.State, ro.appCfg, "application/json", append(b, '\n')), "failed to save rollout state")
+}
+
+// blocked returns the first stage whose destructive changes must wait, and
+// the reason, or the number of stages if none must. Must be called with mu
+// held.
+func (ro *rollout) blocked(now time.Time) (int, string) {
+	for i := range ro.cfg.Stages {
+		var applied time.Time
+		for _, region := range ro.cfg.Stages[i] {
+			if ro.state.Pending[region] != 0 {
+				return i + 1, "changes of region " + region + " are pending"
+			}
+			if t := ro.state.Applied[region]; t.After(applied) {
+				applied = t
+			}
+		}
+		if baked := applied.Add(ro.cfg.Bake); now.Before(baked) {
+			return i + 1, "stage baking until " + baked.UTC().Format(time.RFC3339)
+		}
+	}
+	return len(ro.cfg.Stages) + 1, ""
+}
+
+// stageRollout records the destructive changes planned for the regions, and
+// defers those of stages that must wait for an earlier stage. Passes for a
+// single service leave the recorded changes alone, as they don't plan the
+// other services.
+func (r *reconciler) stageRollout(ctx context.Context, res *reconcileResult, service string, now time.Time) {
+	ro := r.rollout
+	if ro == nil {
+		return
+	}
+	ro.mu.Lock()
+	defer ro.mu.Unlock()
+	if service == "" {
+		planned := make(map[string]int)
+		for _, m := range res.Plan.Mutations {
+			if m.Destructive() {
+				planned[m.Region]++
+			}
+		}
+		for _, st := range res.Regions {
+			if st.OK {
+				ro.state.Pending[st.Region] = planned[st.Region]
+			}
+		}
+	}
+
+	stage, reason := ro.blocked(now)
+	deferred := 0
+	res.Plan.filter(func(m mutation) bool {
+		if m.Destructive() && ro.cfg.stage(m.Region) >= stage {
+			deferred++
+			return false
+		}
+		return true
+	})
+	if deferred != 0 {
+		res.Deferred += deferred
+		r.log(ctx).WithFields(logrus.Fields{"deferred": deferred, "stage": stage + 1, "reason": reason}).Info("deferring destructive changes of later rollout stages")
+	}
+}
+
+// recordRollout records the destructive changes applied by a pass, keeping
+// those of failed services pending so that later stages stay halted.
+func (r *reconciler) recordRollout(ctx context.Context, p *plan, serviceErrors map[string]error, now time.Time) {
+	ro := r.rollout
+	if ro == nil {
+		return
+	}
+	ro.mu.Lock()
+	defer ro.mu.Unlock()
+	applied := make(map[string]bool)
+	failed := make(map[string]int)
+	for _, m := range p.Mutations {
+		if !m.Destructive() {
+			continue
+		}
+		if _, ok := serviceErrors[m.Service]; ok {
+			failed[m.Region]++
+		} else {
+			applied[m.Region] = true
+		}
+	}
+	if len(applied) == 0 && len(failed) == 0 {
+		return
+	}
+	for region := range applied {
+		ro.state.Applied[region] = now.UTC()
+		ro.state.Pending[region] = 0
+	}
+	for region, n := range failed {
+		ro.state.Pending[region] = n
+		r.log(ctx).WithFields(logrus.Fields{"region": region, "stage": ro.cfg.stage(region) + 1, "failed": n}).Warn("destructive changes failed, halting the rollout of later stages")
+	}
+	if err := ro.save(ctx); err != nil {
+		r.log(ctx).WithError(err).WithField("errorKind", errorKindOf(err)).Error("failed to save rollout state")
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func TestRolloutConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		cfg rolloutConfig
+		ok  bool
+	}{
+		{rolloutConfig{Stages: [][]string{{"a"}, {"b", "c"}}, Bake: time.Hour}, true},
+		{rolloutConfig{}, true},
+		{rolloutConfig{Stages: [][]string{{"a"}, {}}}, false},
+		{rolloutConfig{Stages: [][]string{{"a"}, {"b", "a"}}}, false},
+		{rolloutConfig{Stages: [][]string{{"a"}}, Bake: -time.Minute}, false},
+	} {
+		if err := tc.cfg.validate(); (err == nil) != tc.ok {
+			t.Errorf("validate(%+v) = %v, want ok = %v", tc.cfg, err, tc.ok)
+		}
+	}
+
+	cfg := rolloutConfig{Stages: [][]string{{"a"}, {"b", "c"}}}
+	for region, want := range map[string]int{"a": 0, "b": 1, "c": 1, "d": 2} {
+		if got := cfg.stage(region); got != want {
+			t.Errorf("stage(%s) = %d, want %d", region, got, want)
+		}
+	}
+}
+
+// TestStageRollout rolls a detachment out to two stages of one region each.
+func TestStageRollout(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	ctx := context.Background()
+	ro, err := newRollout(ctx, &config{Rollout: rolloutConfig{Stages: [][]string{{"a"}, {"b"}}, Bake: time.Hour}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &reconciler{logger: logger, rollout: ro}
+	detach := func(region string) mutation {
+		return mutation{Op: opDetachBackend, Region: region, NEG: "neg", Service: "svc-" + region, BackendService: "web"}
+	}
+	// pass plans the given mutations for a full pass over both regions,
+	// applies those that weren't deferred, failing the given services, and
+	// returns the regions of the applied ones.
+	pass := func(now time.Time, failed map[string]error, ms ...mutation) []string {
+		t.Helper()
+		res := &reconcileResult{
+			Plan:    &plan{Mutations: ms},
+			Regions: []regionStatus{{Region: "a", OK: true}, {Region: "b", OK: true}},
+		}
+		r.stageRollout(ctx, res, "", now)
+		r.recordRollout(ctx, res.Plan, failed, now)
+		var regions []string
+		for _, m := range res.Plan.Mutations {
+			regions = append(regions, m.Region)
+		}
+		return regions
+	}
+
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if got := pass(t0, map[string]error{"svc-a": errors.New("boom")}, detach("a"), detach("b")); len(got) != 1 || got[0] != "a" {
+		t.Fatalf("applied in %v, want only a", got)
+	}
+	// The failed stage halts the later one.
+	if got := pass(t0.Add(2*time.Hour), nil, detach("a"), detach("b")); len(got) != 1 || got[0] != "a" {
+		t.Fatalf("applied in %v after a failure, want only a", got)
+	}
+	// The later stage waits for the bake time of the first.
+	if got := pass(t0.Add(150*time.Minute), nil, detach("b")); len(got) != 0 {
+		t.Fatalf("applied in %v while baking, want none", got)
+	}
+	if got := pass(t0.Add(3*time.Hour), nil, detach("b")); len(got) != 1 || got[0] != "b" {
+		t.Fatalf("applied in %v after baking, want b", got)
+	}
+	// Non-destructive changes are never deferred.
+	create := mutation{Op: opCreateNEG, Region: "b", NEG: "neg", Service: "svc-b"}
+	if got := pass(t0.Add(3*time.Hour), nil, detach("a"), create); len(got) != 2 {
+		t.Fatalf("applied in %v, want a and b", got)
+	}
+}
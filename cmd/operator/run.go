@@ -0,0 +1,71 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"hash/fnv"
+	"path"
+
+	"google.golang.org/api/run/v2"
+)
+
+// selectServices returns the services matching the include selectors that are
+// neither matched by the exclude selectors nor on the configured denylist,
+// and fall into the canary subset. Matching services that are excluded,
+// denied or outside of the canary are returned as frozen: the controller must
+// not touch their resources at all.
+func (r *reconciler) selectServices(svcs []*run.GoogleCloudRunV2Service) (selected []*run.GoogleCloudRunV2Service, frozen map[string]bool) {
+	frozen = make(map[string]bool)
+	for _, svc := range svcs {
+		if !r.include.matches(svc.Labels) || !r.includeFields.matches(serviceFields(svc)) {
+			continue
+		}
+		lg := r.logger.WithField("service", svc.Name)
+		switch {
+		case !r.exclude.empty() && r.exclude.matches(svc.Labels):
+			lg.WithField("selector", r.exclude.String()).Debug("service excluded by label selector")
+		case !r.excludeFields.empty() && r.excludeFields.matches(serviceFields(svc)):
+			lg.WithField("selector", r.excludeFields.String()).Debug("service excluded by field selector")
+		case r.cfg.denied(serviceName(svc)):
+			lg.Debug("service excluded by denylist")
+		case !inCanary(serviceName(svc), r.canaryPercent):
+			lg.WithField("canaryPercent", r.canaryPercent).Debug("service outside of canary subset")
+		default:
+			selected = append(selected, svc)
+			continue
+		}
+		frozen[svc.Name] = true
+	}
+	return selected, frozen
+}
+
+// inCanary reports whether a service belongs to the canary subset of the
+// given size. The subset is stable: a service keeps its bucket across runs,
+// regions and controller versions, and growing the percentage only adds
+// services.
+func inCanary(service string, percent int) bool {
+	if percent >= 100 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(service))
+	return int(h.Sum32()%100) < percent
+}
+
+// serviceName returns the short name of a Cloud Run service, i.e. the last
+// segment of its resource name.
+func serviceName(svc *run.GoogleCloudRunV2Service) string {
+	return path.Base(svc.Name)
+}
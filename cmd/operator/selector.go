@@ -0,0 +1,109 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// labelRequirement is a single clause of a label selector.
+type labelRequirement struct {
+	key   string
+	value string
+	op    string // "=", "!=", "exists" or "!exists"
+}
+
+// labelSelector is a comma-separated list of requirements that must all match,
+// e.g. "autoneg=true,env!=dev,team,!legacy".
+type labelSelector []labelRequirement
+
+func parseLabelSelector(s string) (labelSelector, error) {
+	var sel labelSelector
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		var r labelRequirement
+		switch {
+		case strings.Contains(part, "!="):
+			kv := strings.SplitN(part, "!=", 2)
+			r = labelRequirement{key: kv[0], value: kv[1], op: "!="}
+		case strings.Contains(part, "=="):
+			kv := strings.SplitN(part, "==", 2)
+			r = labelRequirement{key: kv[0], value: kv[1], op: "="}
+		case strings.Contains(part, "="):
+			kv := strings.SplitN(part, "=", 2)
+			r = labelRequirement{key: kv[0], value: kv[1], op: "="}
+		case strings.HasPrefix(part, "!"):
+			r = labelRequirement{key: part[1:], op: "!exists"}
+		default:
+			r = labelRequirement{key: part, op: "exists"}
+		}
+		r.key, r.value = strings.TrimSpace(r.key), strings.TrimSpace(r.value)
+		if r.key == "" {
+			return nil, errors.Errorf("empty label key in selector clause %q", part)
+		}
+		sel = append(sel, r)
+	}
+	return sel, nil
+}
+
+// empty reports whether the selector has no requirements. An empty selector
+// matches every set of labels.
+func (s labelSelector) empty() bool { return len(s) == 0 }
+
+func (s labelSelector) matches(labels map[string]string) bool {
+	for _, r := range s {
+		v, ok := labels[r.key]
+		switch r.op {
+		case "=":
+			if !ok || v != r.value {
+				return false
+			}
+		case "!=":
+			if ok && v == r.value {
+				return false
+			}
+		case "exists":
+			if !ok {
+				return false
+			}
+		case "!exists":
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s labelSelector) String() string {
+	parts := make([]string, 0, len(s))
+	for _, r := range s {
+		switch r.op {
+		case "exists":
+			parts = append(parts, r.key)
+		case "!exists":
+			parts = append(parts, "!"+r.key)
+		default:
+			parts = append(parts, fmt.Sprintf("%s%s%s", r.key, r.op, r.value))
+		}
+	}
+	return strings.Join(parts, ",")
+}
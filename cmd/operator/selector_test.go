@@ -0,0 +1,130 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/run/v2"
+)
+
+func TestParseLabelSelector(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want labelSelector
+		str  string
+	}{
+		{"", nil, ""},
+		{"autoneg=true", labelSelector{{key: "autoneg", value: "true", op: "="}}, "autoneg=true"},
+		{"autoneg==true", labelSelector{{key: "autoneg", value: "true", op: "="}}, "autoneg=true"},
+		{" env != dev , team,!legacy ,", labelSelector{
+			{key: "env", value: "dev", op: "!="},
+			{key: "team", op: "exists"},
+			{key: "legacy", op: "!exists"},
+		}, "env!=dev,team,!legacy"},
+		{"tier=", labelSelector{{key: "tier", op: "="}}, "tier="},
+	} {
+		sel, err := parseLabelSelector(tc.in)
+		if err != nil {
+			t.Errorf("parseLabelSelector(%q): %v", tc.in, err)
+			continue
+		}
+		if fmt.Sprint(sel) != fmt.Sprint(tc.want) {
+			t.Errorf("parseLabelSelector(%q) = %#v, want %#v", tc.in, sel, tc.want)
+		}
+		if sel.String() != tc.str {
+			t.Errorf("parseLabelSelector(%q).String() = %q, want %q", tc.in, sel.String(), tc.str)
+		}
+	}
+	for _, in := range []string{"=true", "!=dev", "!", "a,=b"} {
+		if _, err := parseLabelSelector(in); err == nil {
+			t.Errorf("parseLabelSelector(%q) accepted an empty key", in)
+		}
+	}
+}
+
+func TestLabelSelectorMatches(t *testing.T) {
+	labels := map[string]string{"autoneg": "true", "env": "prod", "team": "web"}
+	for _, tc := range []struct {
+		sel  string
+		want bool
+	}{
+		{"", true},
+		{"autoneg=true", true},
+		{"autoneg=false", false},
+		{"env!=dev", true},
+		{"env!=prod", false},
+		{"owner!=me", true},
+		{"team", true},
+		{"owner", false},
+		{"!legacy", true},
+		{"!team", false},
+		{"autoneg=true,env!=dev,team,!legacy", true},
+		{"autoneg=true,env=dev", false},
+	} {
+		sel, err := parseLabelSelector(tc.sel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sel.matches(labels); got != tc.want {
+			t.Errorf("%q matches %v = %v, want %v", tc.sel, labels, got, tc.want)
+		}
+	}
+}
+
+func TestSelectServices(t *testing.T) {
+	include, _ := parseLabelSelector("autoneg=true")
+	exclude, _ := parseLabelSelector("env=dev")
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	r := &reconciler{
+		logger:        logger,
+		include:       include,
+		exclude:       exclude,
+		cfg:           &config{Denylist: []string{"legacy-*"}},
+		canaryPercent: 100,
+	}
+	svc := func(name string, labels map[string]string) *run.GoogleCloudRunV2Service {
+		return &run.GoogleCloudRunV2Service{Name: "projects/p/locations/r/services/" + name, Labels: labels}
+	}
+	selected, frozen := r.selectServices([]*run.GoogleCloudRunV2Service{
+		svc("web", map[string]string{"autoneg": "true"}),
+		svc("unlabeled", nil),
+		svc("dev", map[string]string{"autoneg": "true", "env": "dev"}),
+		svc("legacy-api", map[string]string{"autoneg": "true"}),
+	})
+	if len(selected) != 1 || serviceName(selected[0]) != "web" {
+		t.Errorf("selected %v, want web", selected)
+	}
+	want := map[string]bool{
+		"projects/p/locations/r/services/dev":        true,
+		"projects/p/locations/r/services/legacy-api": true,
+	}
+	if fmt.Sprint(frozen) != fmt.Sprint(want) {
+		t.Errorf("frozen = %v, want %v", frozen, want)
+	}
+}
+
+func TestConfigDenied(t *testing.T) {
+	cfg := &config{Denylist: []string{"legacy-*", "admin"}}
+	for name, want := range map[string]bool{"legacy-api": true, "admin": true, "admin-ui": false, "web": false} {
+		if got := cfg.denied(name); got != want {
+			t.Errorf("denied(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,527 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"math/rand"
+	"net/http"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/discovery"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/idtoken"
+	"google.golang.org/api/run/v2"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// server is the long-running HTTP frontend of the controller.
+type server struct {
+	logger *logrus.Logger
+	r      *reconciler
+
+	// mu serializes reconcile passes.
+	mu sync.Mutex
+
+	statusMu       sync.RWMutex
+	status         syncStatus
+	inventory      []managedNEG
+	inventoryError string
+
+	adminAudience string
+	adminMembers  map[string]bool
+
+	events *eventBus
+	// queue holds the work triggered by change notifications and failed
+	// syncs.
+	queue *workQueue
+	// deleted holds the recently deleted services, whose further change
+	// notifications are ignored.
+	deleted *deletedServices
+	// shard, if set, restricts the replica to the regions it owns.
+	shard *shardMembership
+	// stream makes syncs other than full resyncs queue the listed services
+	// instead of planning whole regions.
+	stream bool
+	// apiCheck, if set, makes /readyz verify access to the APIs.
+	apiCheck *apiCheck
+
+	// health is the gRPC health service, which reports SERVING once the
+	// first reconcile pass has completed, like /readyz.
+	health *health.Server
+}
+
+// syncStatus describes the last completed reconcile pass.
+type syncStatus struct {
+	LastSync time.Time
+	Duration time.Duration
+	Result   *reconcileResult
+	Error    string
+}
+
+// runServe implements the serve command: it runs an initial reconcile pass
+// and then serves HTTP requests, including the admin API, until terminated.
+func runServe(ctx context.Context, logger *logrus.Logger, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	r, err := newReconciler(ctx, logger)
+	if err != nil {
+		return err
+	}
+	if err := r.operations.resume(ctx, r.computeService); err != nil {
+		return err
+	}
+	s := &server{
+		logger:        logger,
+		r:             r,
+		adminAudience: flAdminAudience,
+		adminMembers:  make(map[string]bool),
+		health:        health.NewServer(),
+		queue:         newWorkQueue(),
+		deleted:       newDeletedServices(flDeletedServiceTTL),
+		stream:        flStreamServices,
+	}
+	s.queue.priority = r.priorities.of
+	s.queue.debounce = flEventDebounce
+	r.metrics.queue = s.queue
+	if flReadyzAPICheck > 0 {
+		s.apiCheck = newAPICheck(r, flReadyzAPICheck)
+	}
+	s.health.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	r.events = newEventBus()
+	s.events = r.events
+	for _, m := range splitList(flAdminMembers) {
+		s.adminMembers[m] = true
+	}
+	if s.adminAudience == "" {
+		logger.Info("-admin-audience not specified, admin API disabled")
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if flEventarc && flEventarcRegister != "" {
+		if err := r.registerEventarcTriggers(ctx, flEventarcRegister, flEventarcServiceAccount); err != nil {
+			return err
+		}
+	}
+
+	if flShardMembership != "" {
+		if s.shard, err = newShardMembership(ctx, flShardMembership, r.cfg, r.regions, flShardHeartbeatPeriod, logger); err != nil {
+			return err
+		}
+		if err := s.shard.heartbeat(ctx); err != nil {
+			return errors.Wrap(err, "failed to join shard membership")
+		}
+		go s.shard.run(ctx, s.enqueueRegions)
+	}
+	// A cold cache makes the first pass list everything while events are
+	// already queued; warm it first so that both plan against the existing
+	// NEGs and backends.
+	warm := true
+	if err := r.warmCache(ctx, s.managedRegions()); err != nil {
+		logger.WithError(err).Warn("failed to warm compute cache, starting with a full resync")
+		r.cache.invalidate()
+		warm = false
+	}
+	go s.syncLoop(ctx, flSyncPeriod, flFullResyncPeriod, warm)
+	go s.processQueue(ctx)
+	if r.source != nil {
+		go r.source.watch(ctx, s.enqueueRegions)
+	}
+
+	if flCloudMonitoring {
+		e, err := newMonitoringExporter(ctx, r.project, r.cfg)
+		if err != nil {
+			return err
+		}
+		go e.exportLoop(ctx, r.metrics, monitoringExportPeriod, func(err error) {
+			logger.WithError(err).Warn("failed to export metrics")
+		})
+	}
+
+	if flGRPCAddr != "" {
+		go func() {
+			if err := s.serveGRPC(ctx, flGRPCAddr); err != nil {
+				logger.WithError(err).Error("grpc server failed")
+				stop()
+			}
+		}()
+	}
+
+	srv := &http.Server{Addr: flHTTPAddr, Handler: traced(s.handler())}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	logger.WithField("addr", flHTTPAddr).Info("starting http server")
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return errors.Wrap(err, "http server failed")
+	}
+	return nil
+}
+
+// fullResyncJitter is the maximum fraction by which full resyncs are
+// delayed, to spread the load of many controllers.
+const fullResyncJitter = 0.2
+
+// syncLoop syncs immediately and then every syncPeriod, using cached compute
+// state except for full resyncs, which happen every fullResyncPeriod (plus
+// jitter). The first sync is a full resync unless the cache was just warmed
+// or services are streamed. A zero syncPeriod disables periodic syncs.
+func (s *server) syncLoop(ctx context.Context, syncPeriod, fullResyncPeriod time.Duration, warm bool) {
+	nextFull := time.Now()
+	if warm || s.stream {
+		nextFull = nextFull.Add(jitter(fullResyncPeriod, fullResyncJitter))
+	}
+	for {
+		full := !time.Now().Before(nextFull)
+		if full {
+			nextFull = time.Now().Add(jitter(fullResyncPeriod, fullResyncJitter))
+		}
+		// Replicas owning no regions still sync, to report readiness.
+		if s.stream && !full {
+			if err := s.streamRegions(ctx, s.managedRegions()); err != nil {
+				s.logger.WithError(err).Error("sync failed")
+			}
+		} else if res, err := s.reconcile(ctx, s.managedRegions(), "", full); err != nil {
+			s.logger.WithError(err).WithField("full", full).Error("sync failed")
+			s.requeueFailures(res)
+		}
+		if syncPeriod <= 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(syncPeriod):
+		}
+	}
+}
+
+// streamRegions lists the services of the regions page by page and queues the
+// selected ones as they are listed, so that they are reconciled one by one
+// while listing continues, without holding all services of a region. NEGs of
+// deleted services and stale backends are left to full resyncs, which plan
+// whole regions.
+func (s *server) streamRegions(ctx context.Context, regions []string) error {
+	if s.r.source != nil {
+		s.mu.Lock()
+		err := s.r.source.refresh(ctx)
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	start := time.Now()
+	var failed []string
+	for _, region := range regions {
+		n := 0
+		err := discovery.ListServices(ctx, s.logger, s.r.runService, s.r.project, region, func(page []*run.GoogleCloudRunV2Service) error {
+			if s.r.source != nil {
+				page = s.r.source.overlay(region, page)
+			}
+			selected, _ := s.r.selectServices(page)
+			s.r.priorities.record(region, selected)
+			for _, svc := range selected {
+				s.queue.add(workItem{region: region, service: serviceName(svc)})
+			}
+			n += len(selected)
+			return nil
+		})
+		if err != nil {
+			s.logger.WithField("region", region).WithError(err).Error("failed to list services")
+			s.queue.add(workItem{region: region})
+			failed = append(failed, region)
+			continue
+		}
+		s.logger.WithFields(logrus.Fields{"region": region, "services": n}).Debug("queued listed services")
+	}
+
+	st := syncStatus{LastSync: time.Now(), Duration: time.Since(start).Round(time.Millisecond)}
+	var err error
+	if len(failed) != 0 {
+		err = &partialError{errors.Errorf("failed to list services of regions %v", failed)}
+		st.Error = err.Error()
+	}
+	s.statusMu.Lock()
+	s.status = st
+	s.statusMu.Unlock()
+	s.health.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	return err
+}
+
+// enqueueRegions queues the managed ones of the given regions after a change
+// of the desired state or of the shard.
+func (s *server) enqueueRegions(regions []string) {
+	for _, region := range regions {
+		if s.manages(region) {
+			s.logger.WithField("region", region).Info("queueing changed region")
+			s.queue.add(workItem{region: region})
+		}
+	}
+}
+
+// manages reports whether the replica reconciles the region: it must be
+// managed and, with sharding, owned by the replica.
+func (s *server) manages(region string) bool {
+	return contains(s.r.regions, region) && (s.shard == nil || s.shard.owns(region))
+}
+
+// managedRegions returns the regions the replica reconciles.
+func (s *server) managedRegions() []string {
+	if s.shard == nil {
+		return s.r.regions
+	}
+	return s.shard.owned(s.r.regions)
+}
+
+// jitter returns d extended by a random fraction of up to factor.
+func jitter(d time.Duration, factor float64) time.Duration {
+	return d + time.Duration(rand.Float64()*factor*float64(d))
+}
+
+// reconcile runs a reconcile pass, records its outcome and refreshes the
+// inventory of managed resources shown on the dashboard, unless the pass
+// planned nothing for a single service. Full passes drop the cached compute
+// state first.
+func (s *server) reconcile(ctx context.Context, regions []string, service string, full bool) (*reconcileResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if full {
+		s.r.cache.invalidate()
+	}
+
+	start := time.Now()
+	res, err := s.r.reconcile(ctx, regions, service)
+	st := syncStatus{LastSync: time.Now(), Duration: time.Since(start).Round(time.Millisecond), Result: res}
+	if err != nil {
+		st.Error = err.Error()
+	}
+
+	s.statusMu.Lock()
+	s.status = st
+	s.statusMu.Unlock()
+	// Passes for a single service that planned nothing, e.g. those of
+	// streamed syncs, leave the inventory as it is.
+	if service == "" || res == nil || !res.Plan.empty() {
+		s.refreshInventory(ctx)
+	}
+	s.health.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	return res, err
+}
+
+// refreshInventory lists the managed resources shown on the dashboard.
+func (s *server) refreshInventory(ctx context.Context) {
+	inv, err := s.r.listManagedNEGs(ctx, s.r.regions)
+	if err != nil {
+		s.logger.WithError(err).Warn("failed to refresh inventory of managed resources")
+	}
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	if err != nil {
+		s.inventoryError = err.Error()
+		return
+	}
+	s.inventory = inv
+	s.inventoryError = ""
+}
+
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.Handle("/api/v1/reconcile", s.admin(http.HandlerFunc(s.handleReconcile)))
+	mux.Handle("/events", s.admin(http.HandlerFunc(s.handleEvents)))
+	if flEventarc {
+		mux.HandleFunc("/eventarc", s.handleEventarc)
+	}
+	if flAssetFeed {
+		mux.HandleFunc("/asset-feed", s.handleAssetFeed)
+	}
+	mux.HandleFunc("/state", s.handleState)
+	if flDashboard {
+		mux.HandleFunc("/", s.handleDashboard)
+		mux.Handle("/static/", dashboardStaticHandler())
+	}
+	return mux
+}
+
+// handleHealthz reports that the server is alive.
+func (s *server) handleHealthz(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz reports whether the first reconcile pass has completed and,
+// with -readyz-api-check, whether the APIs can still be used.
+func (s *server) handleReadyz(w http.ResponseWriter, req *http.Request) {
+	s.statusMu.RLock()
+	ready := !s.status.LastSync.IsZero()
+	s.statusMu.RUnlock()
+	if !ready {
+		http.Error(w, "initial sync pending", http.StatusServiceUnavailable)
+		return
+	}
+	if s.apiCheck != nil {
+		if err := s.apiCheck.result(req.Context()); err != nil {
+			s.logger.WithError(err).Warn("readiness API check failed")
+			http.Error(w, "API check failed: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// handleState serves the outcome of the last sync, the degraded services and
+// the serving conditions of the services as JSON.
+func (s *server) handleState(w http.ResponseWriter, req *http.Request) {
+	s.statusMu.RLock()
+	st := s.status
+	s.statusMu.RUnlock()
+	writeJSON(w, http.StatusOK, struct {
+		LastSync time.Time          `json:"lastSync"`
+		Error    string             `json:"error,omitempty"`
+		Result   *reconcileResult   `json:"result,omitempty"`
+		Degraded []serviceHealth    `json:"degraded"`
+		Serving  []servingCondition `json:"serving,omitempty"`
+	}{st.LastSync, st.Error, st.Result, s.r.failures.degraded(), s.r.serving.all()})
+}
+
+// admin authenticates requests with a Google-signed ID token for the admin
+// audience, issued to one of the admin members.
+func (s *server) admin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if s.adminAudience == "" {
+			http.Error(w, "admin API disabled", http.StatusNotFound)
+			return
+		}
+		email, err := s.authenticate(req.Context(), req.Header.Get("Authorization"))
+		switch err {
+		case nil:
+		case errForbidden:
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		default:
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), adminEmailKey{}, email)))
+	})
+}
+
+var errForbidden = errors.New("forbidden")
+
+// authenticate validates the bearer token of an Authorization header and
+// returns the email of the admin it was issued to. It returns errForbidden
+// for valid tokens of accounts that are not admin members.
+func (s *server) authenticate(ctx context.Context, authorization string) (string, error) {
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return "", errors.New("missing bearer token")
+	}
+	payload, err := idtoken.Validate(ctx, strings.TrimPrefix(authorization, "Bearer "), s.adminAudience)
+	if err != nil {
+		s.logger.WithError(err).Debug("rejected admin request with invalid token")
+		return "", errors.New("invalid token")
+	}
+	email, _ := payload.Claims["email"].(string)
+	verified, _ := payload.Claims["email_verified"].(bool)
+	if !verified || !s.adminMembers[email] {
+		s.logger.WithField("email", email).Warn("rejected admin request from unauthorized account")
+		return "", errForbidden
+	}
+	return email, nil
+}
+
+type adminEmailKey struct{}
+
+// handleReconcile forces an immediate reconcile pass, optionally restricted
+// to one region and/or one service, and responds with its outcome.
+func (s *server) handleReconcile(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := req.URL.Query()
+	if p := q.Get("project"); p != "" && p != s.r.project {
+		http.Error(w, "unknown project "+p, http.StatusBadRequest)
+		return
+	}
+	regions := s.managedRegions()
+	if region := q.Get("region"); region != "" {
+		if !contains(s.r.regions, region) {
+			http.Error(w, "region not managed: "+region, http.StatusBadRequest)
+			return
+		}
+		if !s.manages(region) {
+			http.Error(w, "region owned by another replica: "+region, http.StatusConflict)
+			return
+		}
+		regions = []string{region}
+	}
+	service := q.Get("service")
+
+	s.logger.WithContext(req.Context()).WithFields(logrus.Fields{
+		"admin":   req.Context().Value(adminEmailKey{}),
+		"regions": regions,
+		"service": service,
+	}).Info("reconcile triggered through admin API")
+
+	s.r.cache.invalidateRegions(regions)
+	res, err := s.reconcile(req.Context(), regions, service, false)
+
+	resp := struct {
+		*reconcileResult
+		Error string `json:"error,omitempty"`
+	}{reconcileResult: res}
+	status := http.StatusOK
+	if err != nil {
+		resp.Error = err.Error()
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, resp)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func contains(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
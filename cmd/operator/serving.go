@@ -0,0 +1,209 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/monitoring/v3"
+)
+
+// Statuses of serving conditions.
+const (
+	conditionTrue    = "True"
+	conditionFalse   = "False"
+	conditionUnknown = "Unknown"
+)
+
+const (
+	// servingRefresh is the minimum interval between two queries of the load
+	// balancer metrics.
+	servingRefresh = time.Minute
+	// servingMinRequests is the number of requests below which a service's
+	// serving condition is unknown.
+	servingMinRequests = 10
+	// servingMaxErrorRatio is the share of 5xx responses above which a
+	// service is not serving.
+	servingMaxErrorRatio = 0.5
+)
+
+// lbBackendRequestMetrics are the backend request counts of the global
+// external, regional external and internal Application Load Balancers.
+var lbBackendRequestMetrics = []string{
+	"loadbalancing.googleapis.com/https/backend_request_count",
+	"loadbalancing.googleapis.com/https/external/regional/backend_request_count",
+	"loadbalancing.googleapis.com/https/internal/backend_request_count",
+}
+
+// servingCondition tells whether a service's NEG actually serves the
+// requests of its load balancers, rather than just being attached.
+type servingCondition struct {
+	Service string `json:"service"`
+	Region  string `json:"region"`
+	NEG     string `json:"neg"`
+	// Serving is True, False or Unknown if there were too few requests.
+	Serving  string    `json:"serving"`
+	Reason   string    `json:"reason"`
+	Requests int64     `json:"requests"`
+	Errors   int64     `json:"errors"`
+	Checked  time.Time `json:"checked"`
+}
+
+// requestCounts are the requests of the load balancers to a NEG and how many
+// of them failed with 5xx.
+type requestCounts struct {
+	requests, errors int64
+}
+
+// servingTracker derives the serving conditions of services from the request
+// metrics of their load balancers in Cloud Monitoring. A nil *servingTracker
+// tracks nothing.
+type servingTracker struct {
+	monitoring *monitoring.Service
+	project    string
+	window     time.Duration
+
+	mu         sync.Mutex
+	queried    time.Time
+	counts     map[string]requestCounts    // by region/NEG
+	conditions map[string]servingCondition // by service resource name
+}
+
+// newServingTracker returns a tracker evaluating the requests of the given
+// window, or nil if window is not positive.
+func newServingTracker(ctx context.Context, project string, cfg *config, window time.Duration) (*servingTracker, error) {
+	if window <= 0 {
+		return nil, nil
+	}
+	opts, err := projectClientOptions(ctx, cfg, project)
+	if err != nil {
+		return nil, err
+	}
+	service, err := monitoring.NewService(ctx, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialize Cloud Monitoring client")
+	}
+	return &servingTracker{monitoring: service, project: project, window: window.Truncate(time.Minute),
+		conditions: make(map[string]servingCondition)}, nil
+}
+
+// update evaluates the serving conditions of the desired NEGs of the plan and
+// returns them by service. Conditions of services that are no longer desired
+// are dropped after full passes.
+func (t *servingTracker) update(ctx context.Context, p *plan, full bool) (map[string]servingCondition, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if time.Since(t.queried) >= servingRefresh {
+		counts, err := t.query(ctx)
+		if err != nil {
+			return nil, err
+		}
+		t.counts, t.queried = counts, time.Now()
+	}
+
+	out := make(map[string]servingCondition)
+	for region, desired := range p.desired {
+		for name, d := range desired {
+			c := t.condition(region, name, d.Service)
+			t.conditions[d.Service], out[d.Service] = c, c
+		}
+		if !full {
+			continue
+		}
+		for svc, c := range t.conditions {
+			if _, ok := out[svc]; !ok && c.Region == region {
+				delete(t.conditions, svc)
+			}
+		}
+	}
+	return out, nil
+}
+
+func (t *servingTracker) condition(region, neg, service string) servingCondition {
+	n := t.counts[region+"/"+neg]
+	c := servingCondition{Service: service, Region: region, NEG: neg, Requests: n.requests, Errors: n.errors, Checked: t.queried}
+	if n.requests < servingMinRequests {
+		c.Serving = conditionUnknown
+		c.Reason = fmt.Sprintf("%d requests through the load balancer in the last %s", n.requests, t.window)
+		return c
+	}
+	c.Serving = conditionTrue
+	if float64(n.errors) > servingMaxErrorRatio*float64(n.requests) {
+		c.Serving = conditionFalse
+	}
+	c.Reason = fmt.Sprintf("%d of %d requests through the load balancer in the last %s failed with 5xx", n.errors, n.requests, t.window)
+	return c
+}
+
+// query sums the backend requests of the window per NEG.
+func (t *servingTracker) query(ctx context.Context) (map[string]requestCounts, error) {
+	end := time.Now().UTC()
+	counts := make(map[string]requestCounts)
+	for _, metric := range lbBackendRequestMetrics {
+		call := t.monitoring.Projects.TimeSeries.List("projects/"+t.project).
+			Filter(fmt.Sprintf("metric.type=%q", metric)).
+			IntervalStartTime(end.Add(-t.window).Format(time.RFC3339)).
+			IntervalEndTime(end.Format(time.RFC3339)).
+			AggregationAlignmentPeriod(fmt.Sprintf("%ds", int64(t.window.Seconds()))).
+			AggregationPerSeriesAligner("ALIGN_SUM").
+			AggregationCrossSeriesReducer("REDUCE_SUM").
+			AggregationGroupByFields("resource.label.backend_name", "resource.label.backend_scope", "metric.label.response_code_class")
+		err := call.Pages(ctx, func(resp *monitoring.ListTimeSeriesResponse) error {
+			for _, ts := range resp.TimeSeries {
+				if ts.Resource == nil || ts.Metric == nil {
+					continue
+				}
+				key := ts.Resource.Labels["backend_scope"] + "/" + ts.Resource.Labels["backend_name"]
+				n := counts[key]
+				for _, pt := range ts.Points {
+					if pt.Value == nil || pt.Value.Int64Value == nil {
+						continue
+					}
+					n.requests += *pt.Value.Int64Value
+					if strings.HasPrefix(ts.Metric.Labels["response_code_class"], "5") {
+						n.errors += *pt.Value.Int64Value
+					}
+				}
+				counts[key] = n
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to query %s", metric)
+		}
+	}
+	return counts, nil
+}
+
+// all returns the serving conditions of all services, sorted by service.
+func (t *servingTracker) all() []servingCondition {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]servingCondition, 0, len(t.conditions))
+	for _, c := range t.conditions {
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Service < out[j].Service })
+	return out
+}
@@ -0,0 +1,252 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"hash/fnv"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/storage/v1"
+)
+
+// membershipRecord is the shared record of the live replicas, keyed by
+// replica ID with the time of their last heartbeat.
+type membershipRecord struct {
+	Members map[string]time.Time `json:"members"`
+}
+
+// shardMembership splits the managed regions between the replicas of a
+// serve deployment. Replicas heartbeat into a shared record in Cloud Storage,
+// updated with generation preconditions, and each region is owned by one of
+// the live replicas chosen by rendezvous hashing, so that replicas joining
+// or leaving only move the regions they gain or lose.
+type shardMembership struct {
+	storageService *storage.Service
+	bucket, object string
+	id             string
+	period         time.Duration
+	// ttl is the time after which replicas that missed their heartbeats
+	// are considered gone.
+	ttl     time.Duration
+	regions []string
+	logger  *logrus.Logger
+
+	mu       sync.Mutex
+	members  []string
+	lastBeat time.Time
+}
+
+// newShardMembership returns a membership using the record at the
+// gs://bucket/object location, heartbeating every period.
+func newShardMembership(ctx context.Context, location string, cfg *config, regions []string, period time.Duration, logger *logrus.Logger) (*shardMembership, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme != "gs" || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return nil, errors.Errorf("invalid shard membership location %q, expected gs://bucket/object", location)
+	}
+	if period <= 0 {
+		return nil, errors.New("the shard heartbeat period must be positive")
+	}
+	opts, err := clientOptions(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	storageService, err := storage.NewService(ctx, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialize Cloud Storage client")
+	}
+	return &shardMembership{
+		storageService: storageService,
+		bucket:         u.Host,
+		object:         strings.Trim(u.Path, "/"),
+		id:             replicaID(),
+		period:         period,
+		ttl:            3 * period,
+		regions:        regions,
+		logger:         logger,
+	}, nil
+}
+
+// replicaID returns a unique ID of this replica, prefixed with the host name
+// for readability.
+func replicaID() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	rand.Read(b)
+	return host + "-" + hex.EncodeToString(b)
+}
+
+func (m *shardMembership) location() string { return "gs://" + m.bucket + "/" + m.object }
+
+// update applies fn to the membership record, retrying when the record was
+// changed concurrently, and returns the live members.
+func (m *shardMembership) update(ctx context.Context, fn func(rec *membershipRecord, now time.Time)) ([]string, error) {
+	const maxAttempts = 5
+	for attempt := 1; ; attempt++ {
+		rec, gen, err := m.read(ctx)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		fn(rec, now)
+		var members []string
+		for id, beat := range rec.Members {
+			if now.Sub(beat) > m.ttl {
+				delete(rec.Members, id)
+			} else {
+				members = append(members, id)
+			}
+		}
+		sort.Strings(members)
+		b, err := json.Marshal(rec)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to encode shard membership")
+		}
+		// A generation of 0 requires that the record doesn't exist yet.
+		_, err = m.storageService.Objects.Insert(m.bucket, &storage.Object{Name: m.object, ContentType: "application/json"}).
+			Media(bytes.NewReader(b)).IfGenerationMatch(gen).Context(ctx).Do()
+		if errorKindOf(err) == kindConflict && attempt < maxAttempts {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to write shard membership %s", m.location())
+		}
+		return members, nil
+	}
+}
+
+// read returns the membership record and its generation, or an empty record
+// and generation 0 if it doesn't exist.
+func (m *shardMembership) read(ctx context.Context) (*membershipRecord, int64, error) {
+	rec := &membershipRecord{Members: make(map[string]time.Time)}
+	resp, err := m.storageService.Objects.Get(m.bucket, m.object).Context(ctx).Download()
+	if errorKindOf(err) == kindNotFound {
+		return rec, 0, nil
+	}
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "failed to read shard membership %s", m.location())
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "failed to read shard membership %s", m.location())
+	}
+	if err := json.Unmarshal(b, rec); err != nil {
+		return nil, 0, errors.Wrapf(err, "invalid shard membership %s", m.location())
+	}
+	if rec.Members == nil {
+		rec.Members = make(map[string]time.Time)
+	}
+	gen, _ := strconv.ParseInt(resp.Header.Get("X-Goog-Generation"), 10, 64)
+	return rec, gen, nil
+}
+
+// heartbeat renews the membership of this replica.
+func (m *shardMembership) heartbeat(ctx context.Context) error {
+	members, err := m.update(ctx, func(rec *membershipRecord, now time.Time) { rec.Members[m.id] = now })
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.members, m.lastBeat = members, time.Now()
+	m.mu.Unlock()
+	return nil
+}
+
+// run heartbeats until ctx is done, calls gained with the regions this
+// replica takes over, and finally leaves the membership so that the other
+// replicas take over its regions right away.
+func (m *shardMembership) run(ctx context.Context, gained func(regions []string)) {
+	t := time.NewTicker(m.period)
+	defer t.Stop()
+	owned := m.owned(m.regions)
+	for {
+		select {
+		case <-ctx.Done():
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if _, err := m.update(ctx, func(rec *membershipRecord, _ time.Time) { delete(rec.Members, m.id) }); err != nil {
+				m.logger.WithError(err).Warn("failed to leave shard membership")
+			}
+			return
+		case <-t.C:
+		}
+		if err := m.heartbeat(ctx); err != nil {
+			m.logger.WithError(err).Warn("shard membership heartbeat failed")
+		}
+		now := m.owned(m.regions)
+		var added []string
+		for _, region := range now {
+			if !contains(owned, region) {
+				added = append(added, region)
+			}
+		}
+		if len(added) != 0 || len(now) != len(owned) {
+			m.mu.Lock()
+			members := len(m.members)
+			m.mu.Unlock()
+			m.logger.WithFields(logrus.Fields{"replica": m.id, "members": members, "regions": now}).Info("shard changed")
+		}
+		if len(added) != 0 {
+			gained(added)
+		}
+		owned = now
+	}
+}
+
+// owns reports whether this replica owns the region. Replicas whose own
+// heartbeats failed for longer than the TTL own nothing, as the others have
+// taken over their regions.
+func (m *shardMembership) owns(region string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if time.Since(m.lastBeat) > m.ttl {
+		return false
+	}
+	var owner string
+	var best uint64
+	for _, id := range m.members {
+		h := fnv.New64a()
+		h.Write([]byte(id + "/" + region))
+		if w := h.Sum64(); owner == "" || w > best {
+			owner, best = id, w
+		}
+	}
+	return owner == m.id
+}
+
+// owned returns the regions this replica owns.
+func (m *shardMembership) owned(regions []string) []string {
+	var out []string
+	for _, region := range regions {
+		if m.owns(region) {
+			out = append(out, region)
+		}
+	}
+	return out
+}
@@ -0,0 +1,277 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/discovery"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/run/v2"
+)
+
+// stateSnapshot is the state of the Cloud Run services and compute resources
+// of a project, written by export state and read by simulate.
+type stateSnapshot struct {
+	Project               string                     `json:"project"`
+	Time                  time.Time                  `json:"time"`
+	GlobalBackendServices []*compute.BackendService  `json:"globalBackendServices"`
+	Regions               map[string]*regionSnapshot `json:"regions"`
+}
+
+// regionSnapshot is the state of one region.
+type regionSnapshot struct {
+	Services              []*run.GoogleCloudRunV2Service  `json:"services"`
+	NetworkEndpointGroups []*compute.NetworkEndpointGroup `json:"networkEndpointGroups"`
+	BackendServices       []*compute.BackendService       `json:"backendServices"`
+}
+
+// snapshot lists the state of all services and compute resources the
+// controller looks at in the managed regions, selected or not.
+func (r *reconciler) snapshot(ctx context.Context) (*stateSnapshot, error) {
+	s := &stateSnapshot{Project: r.project, Time: time.Now().UTC(), Regions: make(map[string]*regionSnapshot)}
+	global, err := discovery.ListBackendServices(ctx, r.computeService, r.project, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range discovery.SortedBackendRefs(global) {
+		s.GlobalBackendServices = append(s.GlobalBackendServices, global[ref])
+	}
+	for _, region := range r.regions {
+		rs := &regionSnapshot{}
+		if rs.Services, err = discovery.Services(ctx, r.logger, r.runService, r.project, region); err != nil {
+			return nil, err
+		}
+		negs, others, err := discovery.ListRegionNEGs(ctx, r.computeService, r.project, region)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range []map[string]*compute.NetworkEndpointGroup{negs, others} {
+			for _, name := range sortedKeys(m) {
+				rs.NetworkEndpointGroups = append(rs.NetworkEndpointGroups, m[name])
+			}
+		}
+		backends, err := discovery.ListBackendServices(ctx, r.computeService, r.project, region)
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range discovery.SortedBackendRefs(backends) {
+			rs.BackendServices = append(rs.BackendServices, backends[ref])
+		}
+		s.Regions[region] = rs
+	}
+	return s, nil
+}
+
+// runExportState implements export state: it writes a snapshot of the state
+// for simulate.
+func runExportState(ctx context.Context, logger *logrus.Logger, args []string) error {
+	fs := flag.NewFlagSet("export state", flag.ExitOnError)
+	out := fs.String("out", "state.json", "file to write the snapshot to, or - for stdout")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	r, err := newReconciler(ctx, logger)
+	if err != nil {
+		return err
+	}
+	s, err := r.snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode snapshot")
+	}
+	b = append(b, '\n')
+	if *out == "-" {
+		_, err = os.Stdout.Write(b)
+		return errors.Wrap(err, "failed to write snapshot")
+	}
+	if err := writeFileAtomic(*out, b); err != nil {
+		return errors.Wrapf(err, "failed to write snapshot to %s", *out)
+	}
+	logger.WithField("regions", len(s.Regions)).Infof("wrote state snapshot to %s", *out)
+	return nil
+}
+
+// simulation, if set, answers the Google API requests of all clients, see
+// clientOptions. It is set by the simulate command and by -replay.
+var simulation http.RoundTripper
+
+// runSimulate implements the simulate command: it plans a reconcile pass
+// against a snapshot written by export state, with the flags and
+// configuration file given, and prints the mutations the controller would
+// make, without any API access. This allows reviewing changes to selectors,
+// the naming template or the configuration file safely.
+func runSimulate(ctx context.Context, logger *logrus.Logger, args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	state := fs.String("state", "state.json", "snapshot written by export state")
+	format := fs.String("format", "text", "output format: text or json")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *format != "text" && *format != "json" {
+		return errors.Errorf("simulate: unknown format %q", *format)
+	}
+	switch {
+	case flKubeBindings || flDesiredState != "":
+		return errors.New("simulate: -kube-bindings and -desired-state are not supported")
+	case flApprovalWebhook != "" || flAuditLog != "" || flOperationsState != "" || flOptOutState != "":
+		logger.Info("simulate: ignoring -approval-webhook, -audit-log, -operations-state and -opt-out-state")
+		flApprovalWebhook, flAuditLog, flOperationsState, flOptOutState = "", "", "", ""
+	}
+
+	b, err := os.ReadFile(*state)
+	if err != nil {
+		return errors.Wrap(err, "failed to read snapshot")
+	}
+	var s stateSnapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.Wrapf(err, "failed to parse snapshot %s", *state)
+	}
+	if flProject == "" {
+		flProject = s.Project
+	}
+	if flRegions == "" {
+		flRegions = strings.Join(sortedKeys(s.Regions), ",")
+	}
+	simulation = &snapshotTransport{s: &s}
+
+	r, err := newReconciler(ctx, logger)
+	if err != nil {
+		return err
+	}
+	for _, region := range r.regions {
+		if _, ok := s.Regions[region]; !ok {
+			return errors.Errorf("simulate: region %q is not part of snapshot %s", region, *state)
+		}
+	}
+	r.dryRun = true
+	res, err := r.reconcile(ctx, r.regions, "")
+	if err != nil {
+		return err
+	}
+	if *format == "json" {
+		d := planDiff{Time: s.Time, Project: r.project, Regions: r.regions, DryRun: true, Changes: res.Plan.diffs()}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return errors.Wrap(enc.Encode(d), "failed to write changes")
+	}
+	if res.Plan.empty() {
+		fmt.Println("no changes")
+		return nil
+	}
+	printPlan(os.Stdout, res.Plan)
+	fmt.Printf("%d mutations for %d services\n", len(res.Plan.Mutations), res.Services)
+	return nil
+}
+
+// snapshotTransport answers the requests of the controller's reconcile
+// passes from a snapshot. All other requests, including any change, fail.
+type snapshotTransport struct {
+	s *stateSnapshot
+}
+
+func (t *snapshotTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	if req.Method != http.MethodGet {
+		return snapshotResponse(req, http.StatusNotImplemented, "simulate makes no changes")
+	}
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	var items interface{}
+	var project, region string
+	switch {
+	// /v2/projects/P/locations/R/services[/S]
+	case len(parts) >= 6 && parts[0] == "v2" && parts[3] == "locations" && parts[5] == "services":
+		project, region = parts[2], parts[4]
+		rs, ok := t.s.Regions[region]
+		if !ok || project != t.s.Project {
+			break
+		}
+		if len(parts) == 6 {
+			return snapshotResponse(req, http.StatusOK, map[string]interface{}{"services": rs.Services})
+		}
+		for _, svc := range rs.Services {
+			if len(parts) == 7 && serviceName(svc) == parts[6] {
+				return snapshotResponse(req, http.StatusOK, svc)
+			}
+		}
+		return snapshotResponse(req, http.StatusNotFound, "service not found in snapshot")
+	// /compute/v1/projects/P/global/backendServices
+	case len(parts) == 6 && parts[0] == "compute" && parts[4] == "global" && parts[5] == "backendServices":
+		if parts[3] == t.s.Project {
+			items = t.s.GlobalBackendServices
+		}
+	// /compute/v1/projects/P/regions/R/{networkEndpointGroups,backendServices}
+	case len(parts) == 7 && parts[0] == "compute" && parts[4] == "regions":
+		project, region = parts[3], parts[5]
+		rs, ok := t.s.Regions[region]
+		if !ok || project != t.s.Project {
+			break
+		}
+		switch parts[6] {
+		case "networkEndpointGroups":
+			items = rs.NetworkEndpointGroups
+		case "backendServices":
+			items = rs.BackendServices
+		}
+	}
+	// Frontends are not part of snapshots; they are simulated as absent.
+	if items == nil && len(parts) >= 6 && parts[0] == "compute" && parts[3] == t.s.Project {
+		switch parts[len(parts)-1] {
+		case "urlMaps", "targetHttpProxies", "targetHttpsProxies":
+			items = []interface{}{}
+		}
+	}
+	if items == nil {
+		return snapshotResponse(req, http.StatusNotFound, fmt.Sprintf("%s is not part of the snapshot", req.URL.Path))
+	}
+	return snapshotResponse(req, http.StatusOK, map[string]interface{}{"items": items})
+}
+
+// snapshotResponse returns a JSON response with the given body, or an API
+// error if body is a string.
+func snapshotResponse(req *http.Request, status int, body interface{}) (*http.Response, error) {
+	if msg, ok := body.(string); ok {
+		body = map[string]interface{}{"error": map[string]interface{}{"code": status, "message": msg}}
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode simulated response")
+	}
+	return &http.Response{
+		Status:        http.StatusText(status),
+		StatusCode:    status,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(b)),
+		ContentLength: int64(len(b)),
+		Request:       req,
+	}, nil
+}
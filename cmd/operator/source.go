@@ -0,0 +1,173 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/run/v2"
+)
+
+// desiredStateSource replaces the labels of Cloud Run services as the source
+// of the controller's desired state.
+type desiredStateSource interface {
+	// refresh loads the desired state at the start of a reconcile pass.
+	refresh(ctx context.Context) error
+	// overlay returns copies of the services of a region carrying the
+	// controller labels of their desired state.
+	overlay(region string, svcs []*run.GoogleCloudRunV2Service) []*run.GoogleCloudRunV2Service
+	// report is called with the outcome of every reconcile pass.
+	report(ctx context.Context, r *reconciler, res *reconcileResult, regions []string, service string, err error)
+	// watch calls changed with the regions affected by changes of the
+	// desired state until ctx is done.
+	watch(ctx context.Context, changed func(regions []string))
+}
+
+// serviceBinding declares the backend services the NEG of a Cloud Run
+// service is attached to. It mirrors the controller's labels.
+type serviceBinding struct {
+	Service  string           `json:"service" yaml:"service"`
+	Region   string           `json:"region" yaml:"region"`
+	Backends []bindingBackend `json:"backends" yaml:"backends"`
+}
+
+type bindingBackend struct {
+	Name           string `json:"name" yaml:"name"`
+	Scope          string `json:"scope,omitempty" yaml:"scope"`
+	CapacityScaler *int   `json:"capacityScaler,omitempty" yaml:"capacityScaler"`
+	Protocol       string `json:"protocol,omitempty" yaml:"protocol"`
+	// ConnectionDraining is the connection draining timeout in seconds.
+	ConnectionDraining *int `json:"connectionDraining,omitempty" yaml:"connectionDraining"`
+	// LocalityPolicy, OutlierDetection and Auth take the values of the
+	// corresponding labels.
+	LocalityPolicy   string `json:"localityPolicy,omitempty" yaml:"localityPolicy"`
+	OutlierDetection *int   `json:"outlierDetection,omitempty" yaml:"outlierDetection"`
+	Auth             string `json:"auth,omitempty" yaml:"auth"`
+}
+
+func bindingKey(region, service string) string { return region + "/" + service }
+
+// labels returns the controller labels equivalent to the binding.
+func (b serviceBinding) labels() (map[string]string, error) {
+	if b.Service == "" || b.Region == "" {
+		return nil, errors.New("service and region are required")
+	}
+	if len(b.Backends) == 0 {
+		return nil, errors.New("backends must list at least one backend service")
+	}
+	n := len(b.Backends)
+	names, scopes, capacities, protocols := make([]string, n), make([]string, n), make([]string, n), make([]string, n)
+	draining, localities, outliers, auths := make([]string, n), make([]string, n), make([]string, n), make([]string, n)
+	for i, be := range b.Backends {
+		if !validResourceName(be.Name) {
+			return nil, errors.Errorf("backends[%d]: invalid backend service name %q", i, be.Name)
+		}
+		names[i], scopes[i], protocols[i], localities[i], auths[i] = be.Name, be.Scope, be.Protocol, be.LocalityPolicy, be.Auth
+		if be.CapacityScaler != nil {
+			capacities[i] = strconv.Itoa(*be.CapacityScaler)
+		}
+		if be.ConnectionDraining != nil {
+			draining[i] = strconv.Itoa(*be.ConnectionDraining)
+		}
+		if be.OutlierDetection != nil {
+			outliers[i] = strconv.Itoa(*be.OutlierDetection)
+		}
+	}
+	labels := map[string]string{labelBackendService: strings.Join(names, labelListSeparator)}
+	for label, values := range map[string][]string{
+		labelBackendScope:       scopes,
+		labelCapacityScaler:     capacities,
+		labelBackendProtocol:    protocols,
+		labelConnectionDraining: draining,
+		labelLocalityPolicy:     localities,
+		labelOutlierDetection:   outliers,
+		labelAuth:               auths,
+	} {
+		if strings.Join(values, "") != "" {
+			labels[label] = strings.Join(values, labelListSeparator)
+		}
+	}
+	if _, err := desiredBackends(&run.GoogleCloudRunV2Service{Labels: labels}, b.Region); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+// invalidServiceLabels are overlaid on services with an invalid binding.
+// Like services with invalid labels, they are skipped without touching their
+// NEG.
+var invalidServiceLabels = map[string]string{labelBackendService: ""}
+
+// serviceLabels overlays controller labels, keyed by bindingKey, on Cloud
+// Run services.
+type serviceLabels struct {
+	mu     sync.Mutex
+	labels map[string]map[string]string
+	// found holds the keys whose service was seen since the last set.
+	found map[string]bool
+}
+
+func (o *serviceLabels) set(labels map[string]map[string]string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.labels = labels
+	o.found = make(map[string]bool)
+}
+
+// overlay returns copies of the services of a region whose controller labels
+// are replaced by the overlaid ones, or removed if there are none. The
+// backends annotation is removed as well.
+func (o *serviceLabels) overlay(region string, svcs []*run.GoogleCloudRunV2Service) []*run.GoogleCloudRunV2Service {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	out := make([]*run.GoogleCloudRunV2Service, 0, len(svcs))
+	for _, svc := range svcs {
+		c := *svc
+		c.Labels = make(map[string]string)
+		for k, v := range svc.Labels {
+			if !strings.HasPrefix(k, labelPrefix) {
+				c.Labels[k] = v
+			}
+		}
+		if _, ok := svc.Annotations[annotationBackends]; ok {
+			c.Annotations = make(map[string]string)
+			for k, v := range svc.Annotations {
+				if k != annotationBackends {
+					c.Annotations[k] = v
+				}
+			}
+		}
+		key := bindingKey(region, serviceName(svc))
+		if l, ok := o.labels[key]; ok {
+			for k, v := range l {
+				c.Labels[k] = v
+			}
+			o.found[key] = true
+		}
+		out = append(out, &c)
+	}
+	return out
+}
+
+// seen reports whether the service was seen since the last set.
+func (o *serviceLabels) seen(region, service string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.found[bindingKey(region, service)]
+}
@@ -0,0 +1,172 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/storage/v1"
+	"gopkg.in/yaml.v3"
+)
+
+// stateFile is the YAML desired-state file given with -desired-state.
+type stateFile struct {
+	Services []serviceBinding `yaml:"services"`
+}
+
+// stateFileSource takes the desired state from a YAML file in Cloud Storage
+// instead of the labels of Cloud Run services, so that the load balancer
+// wiring is controlled by whoever can write the file.
+type stateFileSource struct {
+	serviceLabels
+	storageService *storage.Service
+	bucket, object string
+	regions        []string
+	pollPeriod     time.Duration
+	logger         *logrus.Logger
+
+	mu         sync.Mutex
+	generation int64
+	services   []serviceBinding
+}
+
+// newStateFileSource returns a source reading the gs://bucket/object
+// location, polled for changes every pollPeriod in serve mode.
+func newStateFileSource(ctx context.Context, location string, cfg *config, regions []string, pollPeriod time.Duration, logger *logrus.Logger) (*stateFileSource, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme != "gs" || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return nil, errors.Errorf("invalid desired state location %q, expected gs://bucket/object", location)
+	}
+	opts, err := clientOptions(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	storageService, err := storage.NewService(ctx, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to initialize Cloud Storage client")
+	}
+	return &stateFileSource{
+		storageService: storageService,
+		bucket:         u.Host,
+		object:         strings.Trim(u.Path, "/"),
+		regions:        regions,
+		pollPeriod:     pollPeriod,
+		logger:         logger,
+	}, nil
+}
+
+func (s *stateFileSource) location() string { return "gs://" + s.bucket + "/" + s.object }
+
+// refresh reads the file. An unreadable or invalid file fails the pass
+// rather than releasing every service.
+func (s *stateFileSource) refresh(ctx context.Context) error {
+	resp, err := s.storageService.Objects.Get(s.bucket, s.object).Context(ctx).Download()
+	if err != nil {
+		return errors.Wrapf(err, "failed to read desired state %s", s.location())
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read desired state %s", s.location())
+	}
+	f, labels, err := parseStateFile(b)
+	if err != nil {
+		return errors.Wrapf(err, "invalid desired state %s", s.location())
+	}
+	gen, _ := strconv.ParseInt(resp.Header.Get("X-Goog-Generation"), 10, 64)
+
+	s.set(labels)
+	s.mu.Lock()
+	s.generation, s.services = gen, f.Services
+	s.mu.Unlock()
+	return nil
+}
+
+// parseStateFile parses and validates a desired-state file and returns the
+// controller labels of its services.
+func parseStateFile(b []byte) (*stateFile, map[string]map[string]string, error) {
+	var f stateFile
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&f); err != nil && err != io.EOF {
+		return nil, nil, errors.Wrap(err, "failed to parse YAML")
+	}
+	labels := make(map[string]map[string]string)
+	for i, sb := range f.Services {
+		l, err := sb.labels()
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "services[%d]", i)
+		}
+		key := bindingKey(sb.Region, sb.Service)
+		if _, dup := labels[key]; dup {
+			return nil, nil, errors.Errorf("services[%d]: service %q in region %q listed twice", i, sb.Service, sb.Region)
+		}
+		labels[key] = l
+	}
+	return &f, labels, nil
+}
+
+// report warns about services of the file that don't exist.
+func (s *stateFileSource) report(ctx context.Context, r *reconciler, res *reconcileResult, regions []string, service string, err error) {
+	s.mu.Lock()
+	services := s.services
+	s.mu.Unlock()
+	for _, sb := range services {
+		if !contains(regions, sb.Region) || (service != "" && sb.Service != service) || contains(res.FailedRegions, sb.Region) {
+			continue
+		}
+		if !s.seen(sb.Region, sb.Service) {
+			r.log(ctx).WithFields(logrus.Fields{"service": sb.Service, "region": sb.Region}).Warn("service of desired state file not found")
+		}
+	}
+}
+
+// watch polls the generation of the file and reports all regions as changed
+// when it differs from the one last read.
+func (s *stateFileSource) watch(ctx context.Context, changed func(regions []string)) {
+	if s.pollPeriod <= 0 {
+		return
+	}
+	t := time.NewTicker(s.pollPeriod)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		obj, err := s.storageService.Objects.Get(s.bucket, s.object).Context(ctx).Do()
+		if err != nil {
+			s.logger.WithError(err).WithField("location", s.location()).Warn("failed to poll desired state")
+			continue
+		}
+		s.mu.Lock()
+		modified := obj.Generation != s.generation
+		s.mu.Unlock()
+		if modified {
+			s.logger.WithFields(logrus.Fields{"location": s.location(), "generation": obj.Generation}).Info("desired state changed")
+			changed(s.regions)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/run/v2"
+)
+
+// annotationStatus marks Cloud Run services that need attention, with the
+// reason in annotationStatusReason if known. Healthy services have neither.
+const (
+	annotationStatus       = controllerName + "/status"
+	annotationStatusReason = controllerName + "/status-reason"
+)
+
+// Service statuses, by precedence.
+const (
+	// statusDegraded: the service's mutations keep failing, see
+	// recordFailures.
+	statusDegraded = "degraded"
+	// statusMisconfigured: requests through the load balancer will be
+	// rejected, see checkAuth.
+	statusMisconfigured = "misconfigured"
+	// statusNotServing: the load balancer's requests to the service mostly
+	// fail, see checkServing.
+	statusNotServing = "not-serving"
+)
+
+// serviceStatus is the value of the status annotations of a service.
+type serviceStatus struct {
+	Status string
+	Reason string
+}
+
+// recordStatus records the status annotations of the given services.
+func (p *plan) recordStatus(svcs []*run.GoogleCloudRunV2Service) {
+	for _, svc := range svcs {
+		if p.status == nil {
+			p.status = make(map[string]serviceStatus)
+		}
+		p.status[svc.Name] = serviceStatus{Status: svc.Annotations[annotationStatus], Reason: svc.Annotations[annotationStatusReason]}
+	}
+}
+
+// reportStatus maintains the misconfigured and not-serving statuses of the
+// planned services, given their serving conditions. The degraded status of
+// failing services is maintained by recordFailures and takes precedence.
+func (r *reconciler) reportStatus(ctx context.Context, p *plan, serving map[string]servingCondition) {
+	for _, svc := range sortedKeys(p.status) {
+		cur := p.status[svc]
+		if r.failures.failing(svc) {
+			continue
+		}
+		// Statuses of checks that were skipped, e.g. because an API failed,
+		// are kept.
+		issue, authChecked := p.auth[svc]
+		c, servingChecked := serving[svc]
+		var want serviceStatus
+		switch {
+		case issue != "":
+			want = serviceStatus{Status: statusMisconfigured, Reason: issue}
+		case cur.Status == statusMisconfigured && r.authChecks && !authChecked:
+			continue
+		case servingChecked && c.Serving == conditionFalse:
+			want = serviceStatus{Status: statusNotServing, Reason: c.Reason}
+		case cur.Status == statusNotServing && r.serving != nil && !servingChecked:
+			continue
+		}
+		if cur == want || cur.Status == statusDegraded && want.Status == "" {
+			continue
+		}
+		lg := r.log(ctx).WithFields(logrus.Fields{"service": svc, "status": want.Status})
+		if err := r.annotateStatus(ctx, svc, want.Status, want.Reason); err != nil {
+			lg.WithError(err).Warn("failed to update status annotation")
+			continue
+		}
+		lg.Info("updated status annotation")
+	}
+}
+
+// annotateStatus sets the status annotation of a Cloud Run service and its
+// reason, removing them if empty.
+func (r *reconciler) annotateStatus(ctx context.Context, service, status, reason string) error {
+	svc, err := r.runService.Projects.Locations.Services.Get(service).Context(ctx).Do()
+	if err != nil {
+		return errors.Wrapf(err, "failed to get service %q", service)
+	}
+	if svc.Annotations[annotationStatus] == status && svc.Annotations[annotationStatusReason] == reason {
+		return nil
+	}
+	if svc.Annotations == nil {
+		svc.Annotations = make(map[string]string)
+	}
+	for k, v := range map[string]string{annotationStatus: status, annotationStatusReason: reason} {
+		if v == "" {
+			delete(svc.Annotations, k)
+		} else {
+			svc.Annotations[k] = v
+		}
+	}
+	return patchCloudRunService(ctx, r.runService, svc)
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Outcomes of services in the run summary.
+const (
+	outcomeUnchanged = "unchanged"
+	outcomeChanged   = "changed"
+	outcomeFailed    = "failed"
+)
+
+// runSummary is the machine-readable outcome of a one-shot run, written for
+// CI pipelines by -summary.
+type runSummary struct {
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Project string    `json:"project"`
+	Regions []string  `json:"regions"`
+	DryRun  bool      `json:"dryRun,omitempty"`
+	// Result is success, partial or failed, like the reconcile metrics.
+	Result    string    `json:"result"`
+	Error     string    `json:"error,omitempty"`
+	ErrorKind errorKind `json:"errorKind,omitempty"`
+	// Created, Updated and Deleted count the planned mutations by kind;
+	// Failed counts those that failed and Deferred those deferred to a
+	// mutation window.
+	Created       int              `json:"created"`
+	Updated       int              `json:"updated"`
+	Deleted       int              `json:"deleted"`
+	Failed        int              `json:"failed"`
+	Deferred      int              `json:"deferred"`
+	RegionResults []regionStatus   `json:"regionResults"`
+	Services      []serviceOutcome `json:"services"`
+}
+
+// serviceOutcome is the outcome of one managed service.
+type serviceOutcome struct {
+	Service   string    `json:"service"`
+	Outcome   string    `json:"outcome"`
+	Mutations int       `json:"mutations"`
+	Error     string    `json:"error,omitempty"`
+	ErrorKind errorKind `json:"errorKind,omitempty"`
+}
+
+// newRunSummary summarizes the outcome of a reconcile pass.
+func newRunSummary(start time.Time, project string, regions []string, res *reconcileResult, err error) *runSummary {
+	s := &runSummary{Start: start.UTC(), End: time.Now().UTC(), Project: project, Regions: regions, Result: resultSuccess}
+	if err != nil {
+		s.Result, s.Error, s.ErrorKind = resultFailed, err.Error(), errorKindOf(err)
+		var pe *partialError
+		if errors.As(err, &pe) {
+			s.Result = resultPartial
+		}
+	}
+	if res == nil {
+		return s
+	}
+	s.DryRun, s.Failed, s.Deferred, s.RegionResults = res.DryRun, res.Failed, res.Deferred, res.Regions
+
+	outcomes := make(map[string]*serviceOutcome)
+	outcome := func(svc string) *serviceOutcome {
+		o, ok := outcomes[svc]
+		if !ok {
+			o = &serviceOutcome{Service: svc, Outcome: outcomeUnchanged}
+			outcomes[svc] = o
+		}
+		return o
+	}
+	for _, desired := range res.Plan.desired {
+		for _, d := range desired {
+			outcome(d.Service)
+		}
+	}
+	for _, m := range res.Plan.Mutations {
+		switch m.Op {
+		case opCreateNEG, opAttachBackend, opAdoptBackend:
+			s.Created++
+		case opDetachBackend, opDeleteNEG:
+			s.Deleted++
+		default:
+			s.Updated++
+		}
+		if m.Service != "" {
+			o := outcome(m.Service)
+			o.Outcome = outcomeChanged
+			o.Mutations++
+		}
+	}
+	for svc, msg := range res.ServiceErrors {
+		o := outcome(svc)
+		o.Outcome, o.Error, o.ErrorKind = outcomeFailed, msg, res.ServiceErrorKinds[svc]
+	}
+	s.Services = make([]serviceOutcome, 0, len(outcomes))
+	for _, svc := range sortedKeys(outcomes) {
+		s.Services = append(s.Services, *outcomes[svc])
+	}
+	return s
+}
+
+// writeSummary writes the summary as JSON to a file or to a Cloud Storage
+// object given as gs://bucket/object.
+func writeSummary(ctx context.Context, location string, cfg *config, s *runSummary) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode run summary")
+	}
+	return errors.Wrap(writeLocation(ctx, location, cfg, "application/json", append(b, '\n')), "failed to write run summary")
+}
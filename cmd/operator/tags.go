@@ -0,0 +1,83 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "google.golang.org/api/run/v2"
+
+// minCapacityScaler is the smallest capacity scaler of a backend that is not
+// drained.
+const minCapacityScaler = 0.1
+
+// trafficTags returns, with -tag-negs, the traffic percent of each revision
+// tag of svc if its traffic is split across tagged revisions, or nil. A
+// split involving untagged revisions can't be mirrored, as a NEG can't route
+// to them, so the service keeps its single NEG.
+func (r *reconciler) trafficTags(svc *run.GoogleCloudRunV2Service) map[string]int64 {
+	if !r.tagNEGs {
+		return nil
+	}
+	tags := make(map[string]int64)
+	for _, t := range svc.TrafficStatuses {
+		if t.Percent == 0 {
+			continue
+		}
+		if t.Tag == "" {
+			return nil
+		}
+		tags[t.Tag] += t.Percent
+	}
+	if len(tags) < 2 {
+		return nil
+	}
+	return tags
+}
+
+// tagNEGName returns the name of the NEG routing to a revision tag of the
+// service whose NEG is named neg.
+func tagNEGName(neg, tag string) string {
+	return neg + "-" + tag
+}
+
+// desiredTagNEGs returns the desired NEGs of the revision tags of a service, by
+// name, given its desired NEG d and the traffic percent of each tag. Their
+// backends mirror the traffic split with capacity scalers relative to the
+// tag with the most traffic, which keeps the desired capacity. Capacity
+// scalers can't be set below 0.1 without draining the backend, so smaller
+// shares are raised to 0.1.
+func desiredTagNEGs(neg string, d desiredNEG, tags map[string]int64) map[string]desiredNEG {
+	var max int64
+	for _, percent := range tags {
+		if percent > max {
+			max = percent
+		}
+	}
+	negs := make(map[string]desiredNEG, len(tags))
+	for tag, percent := range tags {
+		t := d
+		t.Tag = tag
+		t.Backends = make([]desiredBackend, len(d.Backends))
+		for i, b := range d.Backends {
+			if b.Capacity > 0 {
+				b.Capacity = b.Capacity * float64(percent) / float64(max)
+				if b.Capacity < minCapacityScaler {
+					b.Capacity = minCapacityScaler
+				}
+			}
+			t.Backends[i] = b
+		}
+		negs[tagNEGName(neg, tag)] = t
+	}
+	return negs
+}
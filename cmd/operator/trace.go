@@ -0,0 +1,150 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// traceContext identifies the Cloud Trace trace and span that log entries
+// belong to.
+type traceContext struct {
+	TraceID string // 32 hex digits
+	SpanID  string // 16 hex digits
+	Sampled bool
+}
+
+type traceContextKey struct{}
+
+func withTrace(ctx context.Context, tc traceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, tc)
+}
+
+func traceFromContext(ctx context.Context) (traceContext, bool) {
+	tc, ok := ctx.Value(traceContextKey{}).(traceContext)
+	return tc, ok
+}
+
+// startSpan returns ctx with a new span, which is a child of the trace in
+// ctx or the root of a new trace.
+func startSpan(ctx context.Context) context.Context {
+	tc, ok := traceFromContext(ctx)
+	if !ok {
+		tc = traceContext{TraceID: randomHex(16)}
+	}
+	tc.SpanID = randomHex(8)
+	return withTrace(ctx, tc)
+}
+
+type reconcileIDKey struct{}
+
+// withReconcileID returns ctx with a new ID identifying a reconcile pass in
+// logs and in the audit logs of the API calls it makes.
+func withReconcileID(ctx context.Context) context.Context {
+	return context.WithValue(ctx, reconcileIDKey{}, randomHex(8))
+}
+
+func reconcileIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(reconcileIDKey{}).(string)
+	return id, ok
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// traceFromRequest extracts the trace context of an incoming request from
+// its W3C traceparent or X-Cloud-Trace-Context header.
+func traceFromRequest(req *http.Request) (traceContext, bool) {
+	// traceparent: 00-<trace id>-<span id>-<flags>
+	if parts := strings.Split(req.Header.Get("Traceparent"), "-"); len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		flags, _ := strconv.ParseUint(parts[3], 16, 8)
+		return traceContext{TraceID: parts[1], SpanID: parts[2], Sampled: flags&1 == 1}, true
+	}
+	// X-Cloud-Trace-Context: <trace id>/<decimal span id>;o=<sampled>
+	h := req.Header.Get("X-Cloud-Trace-Context")
+	traceID, rest, ok := strings.Cut(h, "/")
+	if !ok || len(traceID) != 32 {
+		return traceContext{}, false
+	}
+	span, options, _ := strings.Cut(rest, ";")
+	spanID, err := strconv.ParseUint(span, 10, 64)
+	if err != nil {
+		return traceContext{}, false
+	}
+	return traceContext{TraceID: traceID, SpanID: fmt.Sprintf("%016x", spanID), Sampled: options == "o=1"}, true
+}
+
+// traced adds the trace context of incoming requests to their context.
+func traced(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if tc, ok := traceFromRequest(req); ok {
+			req = req.WithContext(withTrace(req.Context(), tc))
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// log returns the logger for work done on behalf of ctx, which ties log
+// entries to the trace and reconcile pass in ctx.
+func (r *reconciler) log(ctx context.Context) *logrus.Entry {
+	lg := r.logger.WithContext(ctx)
+	if id, ok := reconcileIDFromContext(ctx); ok {
+		lg = lg.WithField("reconcileId", id)
+	}
+	return lg
+}
+
+// traceFormatter adds the Cloud Logging trace fields to the JSON log entries
+// of the wrapped formatter, for entries logged with a traced context.
+type traceFormatter struct {
+	next logrus.Formatter
+}
+
+func (f *traceFormatter) Format(e *logrus.Entry) ([]byte, error) {
+	b, err := f.next.Format(e)
+	if err != nil || e.Context == nil {
+		return b, err
+	}
+	tc, ok := traceFromContext(e.Context)
+	if !ok {
+		return b, nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return b, nil
+	}
+	// The project is known once the reconciler has been created, before
+	// any traced work starts.
+	fields["logging.googleapis.com/trace"] = fmt.Sprintf("projects/%s/traces/%s", flProject, tc.TraceID)
+	fields["logging.googleapis.com/spanId"] = tc.SpanID
+	fields["logging.googleapis.com/trace_sampled"] = tc.Sampled
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return b, nil
+	}
+	return append(out, '\n'), nil
+}
@@ -0,0 +1,212 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// identifyingTransport identifies the controller, its version and the
+// reconcile pass in the User-Agent of Google API requests, which shows in
+// Cloud Audit Logs, and propagates the trace of the pass.
+type identifyingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *identifyingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	req = req.Clone(ctx)
+	ua := controllerName + "/" + version
+	if id, ok := reconcileIDFromContext(ctx); ok {
+		ua += " reconcile/" + id
+	}
+	if orig := req.Header.Get("User-Agent"); orig != "" {
+		ua += " " + orig
+	}
+	req.Header.Set("User-Agent", ua)
+	if tc, ok := traceFromContext(ctx); ok {
+		span, _ := strconv.ParseUint(tc.SpanID, 16, 64)
+		sampled := 0
+		if tc.Sampled {
+			sampled = 1
+		}
+		req.Header.Set("X-Cloud-Trace-Context", fmt.Sprintf("%s/%d;o=%d", tc.TraceID, span, sampled))
+	}
+	return t.next.RoundTrip(req)
+}
+
+// maxRetryBackoff caps the exponential backoff between retries.
+const maxRetryBackoff = 30 * time.Second
+
+// retryTransport retries Google API requests that failed with a transient
+// error, with exponential backoff, and bounds the duration of each attempt.
+// Operation waits, which long-poll, are bounded by -operation-wait-timeout
+// instead.
+type retryTransport struct {
+	next           http.RoundTripper
+	timeout        time.Duration
+	maxRetries     int
+	initialBackoff time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	backoff := t.initialBackoff
+	for attempt := 0; ; attempt++ {
+		resp, err := t.attempt(req)
+		if attempt >= t.maxRetries || !retryable(req, resp, err) || (req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(jitter(backoff, 0.5)):
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// attempt sends the request once, bounded by the API timeout.
+func (t *retryTransport) attempt(req *http.Request) (*http.Response, error) {
+	if t.timeout <= 0 || strings.HasSuffix(req.URL.Path, "/wait") {
+		return t.next.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// retryable reports whether a failed request can be retried: reads,
+// including waits for operations, and mutations carrying a request ID, which
+// the APIs deduplicate. Other mutations may have been applied even if they
+// failed, e.g. the patch of a Cloud Run service, and are never retried.
+func retryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	idempotent := req.Method == http.MethodGet || req.Method == http.MethodHead ||
+		strings.HasSuffix(req.URL.Path, "/wait") || req.URL.Query().Get("requestId") != ""
+	if !idempotent {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// cancelOnClose releases the context of a request once its response body is
+// closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// pacedTransport paces write requests to the projects with a write QPS
+// budget. The project is taken from the request path.
+type pacedTransport struct {
+	next   http.RoundTripper
+	pacers map[string]*pacer
+}
+
+func newPacedTransport(next http.RoundTripper, cfg *config) http.RoundTripper {
+	if len(cfg.pacers) == 0 {
+		return next
+	}
+	return &pacedTransport{next: next, pacers: cfg.pacers}
+}
+
+func (t *pacedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	write := req.Method != http.MethodGet && req.Method != http.MethodHead && !strings.HasSuffix(req.URL.Path, "/wait")
+	if p, ok := t.pacers[requestProject(req)]; ok && write {
+		if err := p.wait(req.Context()); err != nil {
+			return nil, err
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+// requestProject returns the project of a Google API request path containing
+// projects/<project>/, or "".
+func requestProject(req *http.Request) string {
+	parts := strings.Split(req.URL.Path, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if parts[i] == "projects" {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+// pacer spaces out events to at most one per interval.
+type pacer struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// wait blocks until the next event may happen.
+func (p *pacer) wait(ctx context.Context) error {
+	p.mu.Lock()
+	now := time.Now()
+	slot := p.next
+	if slot.Before(now) {
+		slot = now
+	}
+	p.next = slot.Add(p.interval)
+	p.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Until(slot)):
+		return nil
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type okTransport struct{}
+
+func (okTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("{}")), Request: req}, nil
+}
+
+func TestLoadConfigBudgets(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(file, []byte("projects:\n  busy:\n    maxConcurrentMutations: 4\n    writeQPS: 2\n  quiet:\n    maxConcurrentMutations: 2\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for project, want := range map[string]int{"busy": 4, "quiet": 2, "other": 1} {
+		if got := cfg.budget(project).concurrency(); got != want {
+			t.Errorf("concurrency of %s = %d, want %d", project, got, want)
+		}
+	}
+	if p := cfg.pacers["busy"]; p == nil || p.interval != 500*time.Millisecond {
+		t.Errorf("pacer of busy = %+v, want one every 500ms", p)
+	}
+	if _, ok := cfg.pacers["quiet"]; ok {
+		t.Error("quiet has a pacer without a write QPS budget")
+	}
+
+	if err := os.WriteFile(file, []byte("projects:\n  busy:\n    writeQPS: -1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(file); err == nil {
+		t.Error("negative budget accepted")
+	}
+}
+
+func TestPacedTransportPacesPerProject(t *testing.T) {
+	cfg := &config{pacers: map[string]*pacer{"busy": {interval: time.Hour}}}
+	tr := newPacedTransport(okTransport{}, cfg)
+	send := func(method, project string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, method, "https://compute.googleapis.com/compute/v1/projects/"+project+"/global/backendServices/web", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tr.RoundTrip(req)
+		return err
+	}
+	if err := send(http.MethodPatch, "busy"); err != nil {
+		t.Fatalf("first write to busy: %v", err)
+	}
+	if err := send(http.MethodPatch, "busy"); err == nil {
+		t.Error("second write to busy was not paced")
+	}
+	if err := send(http.MethodGet, "busy"); err != nil {
+		t.Errorf("read of busy was paced: %v", err)
+	}
+	if err := send(http.MethodPatch, "quiet"); err != nil {
+		t.Errorf("write to quiet was paced by busy: %v", err)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	const bs = "https://compute.googleapis.com/compute/v1/projects/p/global/backendServices/web"
+	for _, tc := range []struct {
+		method, url string
+		status      int
+		err         error
+		want        bool
+	}{
+		{http.MethodGet, bs, http.StatusServiceUnavailable, nil, true},
+		{http.MethodGet, bs, http.StatusBadGateway, nil, true},
+		{http.MethodGet, bs, 0, io.ErrUnexpectedEOF, true},
+		{http.MethodGet, bs, http.StatusNotFound, nil, false},
+		{http.MethodPatch, bs + "?requestId=1234", http.StatusTooManyRequests, nil, true},
+		{http.MethodPatch, bs + "?requestId=1234", 0, io.ErrUnexpectedEOF, true},
+		{http.MethodPatch, bs + "?requestId=1234", http.StatusPreconditionFailed, nil, false},
+		{http.MethodPost, "https://compute.googleapis.com/compute/v1/projects/p/global/operations/op/wait", http.StatusServiceUnavailable, nil, true},
+		{http.MethodPatch, "https://run.googleapis.com/v2/projects/p/locations/r/services/hello", http.StatusTooManyRequests, nil, false},
+		{http.MethodPatch, "https://run.googleapis.com/v2/projects/p/locations/r/services/hello", http.StatusServiceUnavailable, nil, false},
+	} {
+		req, err := http.NewRequest(tc.method, tc.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp *http.Response
+		if tc.err == nil {
+			resp = &http.Response{StatusCode: tc.status}
+		}
+		if got := retryable(req, resp, tc.err); got != tc.want {
+			t.Errorf("retryable(%s %s, %d, %v) = %v, want %v", tc.method, tc.url, tc.status, tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/discovery"
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/planner"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/compute/v1"
+)
+
+type severity string
+
+const (
+	severityError   severity = "ERROR"
+	severityWarning severity = "WARNING"
+)
+
+// diagnostic is a problem found by the validate command.
+type diagnostic struct {
+	Severity severity
+	Subject  string
+	Message  string
+}
+
+// runValidate implements the validate command. It checks the flags and the
+// configuration file and, unless -offline is set, the labels of the selected
+// Cloud Run services, without changing anything.
+func runValidate(ctx context.Context, logger *logrus.Logger, args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	offline := fs.Bool("offline", false, "only validate flags and the configuration file, without querying any API")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	diags := validateSettings()
+	if !*offline && !hasErrors(diags) {
+		r, err := newReconciler(ctx, logger)
+		if err != nil {
+			return err
+		}
+		sd, err := r.validateServices(ctx)
+		if err != nil {
+			return err
+		}
+		diags = append(diags, sd...)
+	}
+
+	printDiagnostics(os.Stdout, diags)
+	if hasErrors(diags) {
+		return errors.New("validation failed")
+	}
+	return nil
+}
+
+// validateSettings checks the configuration file and the flags that the
+// controller parses.
+func validateSettings() []diagnostic {
+	var diags []diagnostic
+	add := func(subject string, err error) {
+		if err != nil {
+			diags = append(diags, diagnostic{Severity: severityError, Subject: subject, Message: err.Error()})
+		}
+	}
+	cfg, err := loadConfig(flConfig)
+	add("config", err)
+	if cfg != nil {
+		regions := splitList(flRegions)
+		for _, n := range cfg.PSCNEGs {
+			if !contains(regions, n.Region) {
+				diags = append(diags, diagnostic{Severity: severityWarning, Subject: "config",
+					Message: fmt.Sprintf("PSC NEG %q is in unmanaged region %q and is ignored", n.Name, n.Region)})
+			}
+		}
+	}
+	_, err = parseLabelSelector(flLabelSelector)
+	add("-label-selector", err)
+	_, err = parseLabelSelector(flExcludeLabelSelector)
+	add("-exclude-label-selector", err)
+	_, err = parseFieldSelector(flFieldSelector)
+	add("-field-selector", err)
+	_, err = parseFieldSelector(flExcludeFieldSelector)
+	add("-exclude-field-selector", err)
+	_, err = parseNameTemplate(flNEGNameTemplate)
+	add("-neg-name-template", err)
+	if flCanaryPercent < 0 || flCanaryPercent > 100 {
+		add("-canary-percent", errors.New("must be between 0 and 100"))
+	}
+	if flStrict && flAdopt {
+		add("-strict", errors.New("mutually exclusive with -adopt"))
+	}
+	_, err = parseDriftMode(flDriftMode)
+	add("-drift-mode", err)
+	if len(splitList(flRegions)) == 0 {
+		add("-regions", errors.New("at least one region is required"))
+	}
+	return diags
+}
+
+// validateServices checks the labels of the selected services of all regions
+// and whether their configuration can be applied.
+func (r *reconciler) validateServices(ctx context.Context) ([]diagnostic, error) {
+	var diags []diagnostic
+	globalBackends, err := discovery.ListBackendServices(ctx, r.computeService, r.project, "")
+	if err != nil {
+		return nil, err
+	}
+	// proxyProtocols caches the target proxy protocols per scope.
+	proxyProtocols := make(map[string]map[backendServiceRef][]string)
+	protocols := make(map[backendServiceRef]string)
+	draining := make(map[backendServiceRef]int64)
+	localityPolicies := make(map[backendServiceRef]string)
+	outlierErrors := make(map[backendServiceRef]int64)
+	used := make(map[backendServiceRef]*compute.BackendService)
+	for _, region := range r.regions {
+		svcs, err := discovery.Services(ctx, r.logger, r.runService, r.project, region)
+		if err != nil {
+			return nil, err
+		}
+		regionalBackends, err := discovery.ListBackendServices(ctx, r.computeService, r.project, region)
+		if err != nil {
+			return nil, err
+		}
+
+		names := make(map[string]string)
+		allBackends := mergeBackends(regionalBackends, globalBackends)
+		selected, _ := r.selectServices(svcs)
+		for _, svc := range selected {
+			subject := region + "/" + serviceName(svc)
+			add := func(sev severity, format string, args ...interface{}) {
+				diags = append(diags, diagnostic{Severity: sev, Subject: subject, Message: fmt.Sprintf(format, args...)})
+			}
+
+			_, annotated := svc.Annotations[annotationBackends]
+			for _, k := range sortedKeys(svc.Labels) {
+				if strings.HasPrefix(k, labelPrefix) && !knownLabels[k] {
+					add(severityWarning, "unknown label %q", k)
+				} else if k == labelPriority {
+					if _, err := parsePriority(svc.Labels[k]); err != nil {
+						add(severityError, "%v", err)
+					}
+				} else if k == labelOptOut {
+					if _, err := parseOptOutMode(svc.Labels[k]); err != nil {
+						add(severityError, "label %q: %v", k, err)
+					}
+				} else if annotated && knownLabels[k] && k != labelBackendService {
+					add(severityWarning, "label %q is ignored in favor of annotation %q", k, annotationBackends)
+				}
+			}
+
+			name := r.negNames.render(serviceName(svc), region, r.project)
+			if !validResourceName(name) {
+				add(severityError, "NEG name %q is not a valid resource name", name)
+			} else if other, ok := names[name]; ok {
+				add(severityError, "NEG name %q collides with service %s", name, other)
+			}
+			names[name] = serviceName(svc)
+			for _, tag := range sortedKeys(r.trafficTags(svc)) {
+				if tagName := tagNEGName(name, tag); !validResourceName(tagName) {
+					add(severityWarning, "NEG name %q of revision tag %q is not a valid resource name, the tags are ignored", tagName, tag)
+				}
+			}
+
+			dbs, err := desiredBackends(svc, region)
+			if err != nil {
+				add(severityError, "%v", err)
+				continue
+			}
+			if err := r.cfg.checkTenant(svc, r.project, dbs); err != nil {
+				add(severityError, "%v", err)
+				continue
+			}
+			if r.authChecks {
+				issue, err := r.serviceAuthIssue(ctx, svc.Name, dbs, allBackends)
+				if err != nil {
+					return nil, err
+				}
+				if issue != "" {
+					add(severityError, "%s", issue)
+				}
+			}
+			for _, db := range dbs {
+				ref, protocol := db.Ref, db.Protocol
+				backends := globalBackends
+				if ref.Region != "" {
+					backends = regionalBackends
+				}
+				bs, ok := backends[ref]
+				if !ok {
+					add(severityError, "backend service %s does not exist", ref)
+					continue
+				}
+				used[ref] = bs
+				if marker := r.cfg.coManagementMarker(bs); marker != "" && !r.allowCoManagement {
+					add(severityError, "backend service %s appears to be managed by another tool (description matches %q); it is only modified with -allow-co-management", ref, marker)
+				}
+				switch bs.LoadBalancingScheme {
+				case "EXTERNAL", "EXTERNAL_MANAGED", "INTERNAL_MANAGED":
+				default:
+					add(severityError, "backend service %s uses scheme %s, which does not support serverless NEGs", ref, bs.LoadBalancingScheme)
+				}
+				if protocol != "" {
+					if other, ok := protocols[ref]; ok && other != protocol {
+						add(severityError, "protocol %s conflicts with protocol %s of another service of backend service %s", protocol, other, ref)
+					}
+					protocols[ref] = protocol
+				}
+				if db.DrainingTimeout != nil {
+					if other, ok := draining[ref]; ok && other != *db.DrainingTimeout {
+						add(severityError, "connection draining timeout %ds conflicts with timeout %ds of another service of backend service %s", *db.DrainingTimeout, other, ref)
+					}
+					draining[ref] = *db.DrainingTimeout
+				}
+				if (db.LocalityPolicy != "" || db.OutlierErrors != nil) && !planner.AdvancedTrafficManagement(bs) {
+					add(severityError, "backend service %s uses scheme %s, which does not support locality policies and outlier detection", ref, bs.LoadBalancingScheme)
+				}
+				if db.LocalityPolicy != "" {
+					if other, ok := localityPolicies[ref]; ok && other != db.LocalityPolicy {
+						add(severityError, "locality policy %s conflicts with policy %s of another service of backend service %s", db.LocalityPolicy, other, ref)
+					}
+					localityPolicies[ref] = db.LocalityPolicy
+				}
+				if db.OutlierErrors != nil {
+					if other, ok := outlierErrors[ref]; ok && other != *db.OutlierErrors {
+						add(severityError, "outlier detection after %d errors conflicts with %d errors of another service of backend service %s", *db.OutlierErrors, other, ref)
+					}
+					outlierErrors[ref] = *db.OutlierErrors
+				}
+				if protocol == "HTTP2" {
+					pp, ok := proxyProtocols[ref.Scope()]
+					if !ok {
+						if pp, err = r.listAllProxyProtocols(ctx, ref.Region); err != nil {
+							return nil, err
+						}
+						proxyProtocols[ref.Scope()] = pp
+					}
+					if http2Incompatible(pp[ref]) {
+						add(severityWarning, "backend service %s uses HTTP2 but is only served by target HTTP proxies, which can't carry gRPC", ref)
+					}
+				}
+				if ref.Region != "" {
+					if _, global := globalBackends[backendServiceRef{Name: ref.Name}]; global {
+						add(severityWarning, "label %s is regional, but a global backend service %q exists as well", labelBackendScope, ref.Name)
+					}
+				}
+			}
+		}
+	}
+	cd, err := r.validateCrossProject(ctx, used)
+	if err != nil {
+		return nil, err
+	}
+	return append(diags, cd...), nil
+}
+
+func hasErrors(diags []diagnostic) bool {
+	for _, d := range diags {
+		if d.Severity == severityError {
+			return true
+		}
+	}
+	return false
+}
+
+func printDiagnostics(w io.Writer, diags []diagnostic) {
+	for _, d := range diags {
+		fmt.Fprintf(w, "%-7s %s: %s\n", d.Severity, d.Subject, d.Message)
+	}
+	if len(diags) == 0 {
+		fmt.Fprintln(w, "no problems found")
+	}
+}
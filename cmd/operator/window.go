@@ -0,0 +1,130 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+	// Time zones of mutation windows must resolve in minimal images.
+	_ "time/tzdata"
+
+	"github.com/pkg/errors"
+)
+
+// mutationWindow is a recurring time range in which destructive changes may
+// be made, e.g. to honor change freezes. End may be before start for windows
+// spanning midnight; such windows belong to the day they start.
+type mutationWindow struct {
+	// Days holds the weekdays (Mon, Tue, ...) the window starts on; every
+	// day if empty.
+	Days []string `yaml:"days"`
+	// Start and End are times of day (HH:MM).
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+	// TimeZone is an IANA time zone, e.g. Europe/Berlin; UTC if empty.
+	TimeZone string `yaml:"timeZone"`
+
+	days       map[time.Weekday]bool
+	start, end time.Duration // since midnight
+	loc        *time.Location
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// compile validates the window and prepares it for contains.
+func (w *mutationWindow) compile() error {
+	var err error
+	if w.start, err = parseTimeOfDay(w.Start); err != nil {
+		return errors.Wrap(err, "start")
+	}
+	if w.end, err = parseTimeOfDay(w.End); err != nil {
+		return errors.Wrap(err, "end")
+	}
+	if w.start == w.end {
+		return errors.New("start and end must differ")
+	}
+	if w.loc, err = time.LoadLocation(w.TimeZone); err != nil {
+		return errors.Wrapf(err, "invalid time zone %q", w.TimeZone)
+	}
+	w.days = make(map[time.Weekday]bool)
+	for _, d := range w.Days {
+		wd, ok := weekdays[strings.ToLower(d)]
+		if !ok {
+			return errors.Errorf("invalid day %q, expected one of Mon, Tue, Wed, Thu, Fri, Sat, Sun", d)
+		}
+		w.days[wd] = true
+	}
+	return nil
+}
+
+func parseTimeOfDay(v string) (time.Duration, error) {
+	t, err := time.Parse("15:04", v)
+	if err != nil {
+		return 0, errors.Errorf("invalid time of day %q, expected HH:MM", v)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// contains reports whether the window is open at the given time.
+func (w *mutationWindow) contains(now time.Time) bool {
+	now = now.In(w.loc)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, w.loc)
+	since := now.Sub(midnight)
+	startsOn := func(d time.Weekday) bool { return len(w.days) == 0 || w.days[d] }
+	if w.start < w.end {
+		return startsOn(now.Weekday()) && since >= w.start && since < w.end
+	}
+	// The window spans midnight: it is either in its first part, started
+	// today, or in its second part, started yesterday.
+	yesterday := (now.Weekday() + 6) % 7
+	return (startsOn(now.Weekday()) && since >= w.start) || (startsOn(yesterday) && since < w.end)
+}
+
+// inMutationWindow reports whether destructive changes may be made at the
+// given time.
+func (c *config) inMutationWindow(now time.Time) bool {
+	if len(c.MutationWindows) == 0 {
+		return true
+	}
+	for i := range c.MutationWindows {
+		if c.MutationWindows[i].contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// deferOutsideWindow drops detachments, deletions and drift corrections from
+// the plan outside of the mutation windows. They are planned again by the
+// first pass within a window; drift is still reported in the meantime.
+func (r *reconciler) deferOutsideWindow(ctx context.Context, res *reconcileResult, now time.Time) {
+	if r.cfg.inMutationWindow(now) {
+		return
+	}
+	res.Plan.filter(func(m mutation) bool {
+		if m.Drift || m.Destructive() {
+			res.Deferred++
+			return false
+		}
+		return true
+	})
+	if res.Deferred != 0 {
+		r.log(ctx).WithField("deferred", res.Deferred).Info("outside of the mutation windows, deferring destructive changes")
+	}
+}
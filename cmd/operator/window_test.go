@@ -0,0 +1,116 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestMutationWindowCompile(t *testing.T) {
+	for _, w := range []mutationWindow{
+		{Start: "9:00", End: "17:00"},
+		{Start: "22:00", End: "02:00", Days: []string{"Fri", "sat"}, TimeZone: "Europe/Berlin"},
+	} {
+		if err := w.compile(); err != nil {
+			t.Errorf("compile(%+v): %v", w, err)
+		}
+	}
+	for _, w := range []mutationWindow{
+		{Start: "9", End: "17:00"},
+		{Start: "09:00", End: "25:00"},
+		{Start: "09:00", End: "09:00"},
+		{Start: "09:00", End: "17:00", Days: []string{"Monday"}},
+		{Start: "09:00", End: "17:00", TimeZone: "Mars/Olympus"},
+	} {
+		if err := w.compile(); err == nil {
+			t.Errorf("compile(%+v) accepted an invalid window", w)
+		}
+	}
+}
+
+func TestMutationWindowContains(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2020-01-03 is a Friday.
+	at := func(day, hour, min int, loc *time.Location) time.Time {
+		return time.Date(2020, 1, day, hour, min, 0, 0, loc)
+	}
+	office := mutationWindow{Start: "09:00", End: "17:00", Days: []string{"Mon", "Tue", "Wed", "Thu", "Fri"}}
+	night := mutationWindow{Start: "22:00", End: "02:00", Days: []string{"Fri"}, TimeZone: "Europe/Berlin"}
+	for _, w := range []*mutationWindow{&office, &night} {
+		if err := w.compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		w    *mutationWindow
+		now  time.Time
+		want bool
+	}{
+		{&office, at(3, 9, 0, time.UTC), true},
+		{&office, at(3, 16, 59, time.UTC), true},
+		{&office, at(3, 17, 0, time.UTC), false},
+		{&office, at(3, 8, 59, time.UTC), false},
+		{&office, at(4, 12, 0, time.UTC), false}, // Saturday
+		{&office, at(3, 10, 30, berlin), true},   // 09:30 UTC
+		{&office, at(3, 9, 30, berlin), false},   // 08:30 UTC
+		{&night, at(3, 23, 0, berlin), true},
+		{&night, at(4, 1, 59, berlin), true}, // Saturday, window started on Friday
+		{&night, at(4, 2, 0, berlin), false},
+		{&night, at(4, 23, 0, berlin), false}, // Saturday
+		{&night, at(3, 1, 0, berlin), false},  // Friday, window started on Thursday
+		{&night, at(3, 21, 30, time.UTC), true},
+	} {
+		if got := tc.w.contains(tc.now); got != tc.want {
+			t.Errorf("%s-%s %v contains %s = %v, want %v", tc.w.Start, tc.w.End, tc.w.Days, tc.now, got, tc.want)
+		}
+	}
+}
+
+func TestDeferOutsideWindow(t *testing.T) {
+	w := mutationWindow{Start: "09:00", End: "17:00"}
+	if err := w.compile(); err != nil {
+		t.Fatal(err)
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	r := &reconciler{logger: logger, cfg: &config{MutationWindows: []mutationWindow{w}}}
+	newResult := func() *reconcileResult {
+		return &reconcileResult{Plan: &plan{Mutations: []mutation{
+			{Op: opCreateNEG, NEG: "a"},
+			{Op: opUpdateBackend, NEG: "b", Drift: true},
+			{Op: opDetachBackend, NEG: "c"},
+			{Op: opDeleteNEG, NEG: "c"},
+		}}}
+	}
+
+	res := newResult()
+	r.deferOutsideWindow(context.Background(), res, time.Date(2020, 1, 3, 12, 0, 0, 0, time.UTC))
+	if len(res.Plan.Mutations) != 4 || res.Deferred != 0 {
+		t.Errorf("within the window: %d mutations, %d deferred, want 4 and 0", len(res.Plan.Mutations), res.Deferred)
+	}
+	res = newResult()
+	r.deferOutsideWindow(context.Background(), res, time.Date(2020, 1, 3, 20, 0, 0, 0, time.UTC))
+	if len(res.Plan.Mutations) != 1 || res.Plan.Mutations[0].NEG != "a" || res.Deferred != 3 {
+		t.Errorf("outside of the window: %v, %d deferred, want only the creation and 3", res.Plan.Mutations, res.Deferred)
+	}
+}
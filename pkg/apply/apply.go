@@ -0,0 +1,223 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package apply executes the mutations planned by package planner against
+// the Compute Engine API.
+package apply
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/discovery"
+	"github.com/pkg/errors"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// OperationRecorder is told about the compute operations a Client starts and
+// waits for, e.g. to resume waiting on them after a restart.
+type OperationRecorder interface {
+	// Requested is called before a mutation of the target resource is sent
+	// and returns the request ID to send it with, which makes resending it
+	// idempotent. key tells the mutations of a target apart, e.g. "insert"
+	// or the fingerprint a patch is based on.
+	Requested(ctx context.Context, project, target, key string) string
+	// Started is called when the API returned an operation.
+	Started(ctx context.Context, project string, op *compute.Operation)
+	// Done is called when the operation is done, successfully or not.
+	Done(ctx context.Context, op *compute.Operation)
+}
+
+// Client executes mutations. A Client is safe for concurrent use, but
+// callers must serialize the updates of one backend service.
+type Client struct {
+	Compute *compute.Service
+	// WaitTimeout bounds waiting for a single operation; 0 waits as long as
+	// the context allows.
+	WaitTimeout time.Duration
+	// Operations, if not nil, records the operations in flight.
+	Operations OperationRecorder
+	// OnPatch, if not nil, is called with the changes of every patch of a
+	// backend service before it is sent, e.g. to log them.
+	OnPatch func(ctx context.Context, project string, ref discovery.BackendServiceRef, changes []Change)
+}
+
+// Wait blocks until the given global or regional compute operation is done
+// and returns its error, if any.
+func (c *Client) Wait(ctx context.Context, project string, op *compute.Operation) error {
+	if c.Operations != nil {
+		c.Operations.Started(ctx, project, op)
+	}
+	wctx := ctx
+	if c.WaitTimeout > 0 {
+		var cancel context.CancelFunc
+		wctx, cancel = context.WithTimeout(ctx, c.WaitTimeout)
+		defer cancel()
+	}
+	var err error
+	for op.Status != "DONE" {
+		if op.Region != "" {
+			op, err = c.Compute.RegionOperations.Wait(project, path.Base(op.Region), op.Name).Context(wctx).Do()
+		} else {
+			op, err = c.Compute.GlobalOperations.Wait(project, op.Name).Context(wctx).Do()
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to wait for compute operation")
+		}
+	}
+	if c.Operations != nil {
+		c.Operations.Done(ctx, op)
+	}
+	if op.Error != nil && len(op.Error.Errors) != 0 {
+		return &OperationError{Operation: op.Name, Errors: op.Error.Errors}
+	}
+	return nil
+}
+
+// OperationError is the error of a compute operation that completed
+// unsuccessfully.
+type OperationError struct {
+	Operation string
+	Errors    []*compute.OperationErrorErrors
+}
+
+func (e *OperationError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", err.Code, err.Message))
+	}
+	return fmt.Sprintf("compute operation %s failed: %s", e.Operation, strings.Join(msgs, "; "))
+}
+
+// Codes returns the error codes of the operation, e.g.
+// RESOURCE_IN_USE_BY_ANOTHER_RESOURCE.
+func (e *OperationError) Codes() []string {
+	codes := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		codes = append(codes, err.Code)
+	}
+	return codes
+}
+
+// ErrStale is wrapped by errors of mutations that no longer apply to the
+// current state of a backend service, which changed since it was planned.
+var ErrStale = errors.New("backend service changed since the plan")
+
+// requestID returns the request ID of a mutation of target, or "" if the
+// client records no operations.
+func (c *Client) requestID(ctx context.Context, project, target, key string) string {
+	if c.Operations == nil {
+		return ""
+	}
+	return c.Operations.Requested(ctx, project, target, key)
+}
+
+// rejected tells the recorder that the API answered the mutation of target
+// with an error, so no operation was started. Mutations that failed without
+// an answer stay recorded, as they may have reached the API.
+func (c *Client) rejected(ctx context.Context, target string, err error) {
+	var gerr *googleapi.Error
+	if c.Operations != nil && errors.As(err, &gerr) {
+		c.Operations.Done(ctx, &compute.Operation{TargetLink: target})
+	}
+}
+
+// CreateNEG creates a regional network endpoint group.
+func (c *Client) CreateNEG(ctx context.Context, project, region string, neg *compute.NetworkEndpointGroup) error {
+	target := discovery.NEGURL(project, region, neg.Name)
+	call := c.Compute.RegionNetworkEndpointGroups.Insert(project, region, neg)
+	if id := c.requestID(ctx, project, target, "insert"); id != "" {
+		call.RequestId(id)
+	}
+	op, err := call.Context(ctx).Do()
+	if err != nil {
+		c.rejected(ctx, target, err)
+		return errors.Wrapf(err, "failed to create network endpoint group %q", neg.Name)
+	}
+	return errors.Wrapf(c.Wait(ctx, project, op), "failed to create network endpoint group %q", neg.Name)
+}
+
+// DeleteNEG deletes a regional network endpoint group.
+func (c *Client) DeleteNEG(ctx context.Context, project, region, name string) error {
+	target := discovery.NEGURL(project, region, name)
+	call := c.Compute.RegionNetworkEndpointGroups.Delete(project, region, name)
+	if id := c.requestID(ctx, project, target, "delete"); id != "" {
+		call.RequestId(id)
+	}
+	op, err := call.Context(ctx).Do()
+	if err != nil {
+		c.rejected(ctx, target, err)
+		return errors.Wrapf(err, "failed to delete network endpoint group %q", name)
+	}
+	return errors.Wrapf(c.Wait(ctx, project, op), "failed to delete network endpoint group %q", name)
+}
+
+// BackendServiceSettings are the settings of a backend service the
+// controller manages besides its backends. Zero values are left unchanged.
+type BackendServiceSettings struct {
+	Protocol           string
+	ConnectionDraining *compute.ConnectionDraining
+	LocalityPolicy     string
+	OutlierDetection   *compute.OutlierDetection
+	IAP                *compute.BackendServiceIAP
+}
+
+// PatchBackends replaces the backends of a backend service and changes the
+// given settings. The fingerprint of bs guards against concurrent
+// modifications.
+func (c *Client) PatchBackends(ctx context.Context, project string, ref discovery.BackendServiceRef, bs *compute.BackendService, backends []*compute.Backend, settings BackendServiceSettings) error {
+	return c.patchBackends(ctx, project, ref, bs, backends, settings, BackendServiceChanges(bs, backends, settings))
+}
+
+func (c *Client) patchBackends(ctx context.Context, project string, ref discovery.BackendServiceRef, bs *compute.BackendService, backends []*compute.Backend, settings BackendServiceSettings, changes []Change) error {
+	if c.OnPatch != nil {
+		c.OnPatch(ctx, project, ref, changes)
+	}
+	patch := &compute.BackendService{
+		Backends:           backends,
+		Protocol:           settings.Protocol,
+		ConnectionDraining: settings.ConnectionDraining,
+		LocalityLbPolicy:   settings.LocalityPolicy,
+		OutlierDetection:   settings.OutlierDetection,
+		Iap:                settings.IAP,
+		Fingerprint:        bs.Fingerprint,
+		ForceSendFields:    []string{"Backends"},
+	}
+	target := "https://www.googleapis.com/compute/v1/projects/" + project + "/" + ref.Path()
+	id := c.requestID(ctx, project, target, "patch "+bs.Fingerprint)
+	var op *compute.Operation
+	var err error
+	if ref.Region == "" {
+		call := c.Compute.BackendServices.Patch(project, ref.Name, patch)
+		if id != "" {
+			call.RequestId(id)
+		}
+		op, err = call.Context(ctx).Do()
+	} else {
+		call := c.Compute.RegionBackendServices.Patch(project, ref.Region, ref.Name, patch)
+		if id != "" {
+			call.RequestId(id)
+		}
+		op, err = call.Context(ctx).Do()
+	}
+	if err != nil {
+		c.rejected(ctx, target, err)
+		return errors.Wrapf(err, "failed to patch backend service %q", ref)
+	}
+	return errors.Wrapf(c.Wait(ctx, project, op), "failed to patch backend service %q", ref)
+}
@@ -0,0 +1,176 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apply
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/discovery"
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/planner"
+	"github.com/pkg/errors"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// UpdateBackends applies all attach, adopt, update and detach mutations and
+// changes of backend service settings of one backend service with a single
+// patch, so that changes for many Cloud Run services sharing a backend
+// service don't race each other. It returns the backends before and after the
+// change, and the changes of the patch, if any. Patches conflicting with a
+// concurrent change of the backend service, e.g. by another task of a sharded
+// job, are retried on the new state. The first attempt starts from cached,
+// the state listed for the plan, if not nil, rather than reading the backend
+// service again.
+func (c *Client) UpdateBackends(ctx context.Context, project string, ref discovery.BackendServiceRef, cached *compute.BackendService, ms []planner.Mutation) (before, after []*compute.Backend, changes []Change, err error) {
+	const maxAttempts = 3
+	for attempt := 1; ; attempt++ {
+		before, after, changes, err = c.updateBackendsOnce(ctx, project, ref, cached, ms)
+		if attempt == maxAttempts || !isConflict(err) {
+			return before, after, changes, err
+		}
+		cached = nil
+	}
+}
+
+func (c *Client) updateBackendsOnce(ctx context.Context, project string, ref discovery.BackendServiceRef, cached *compute.BackendService, ms []planner.Mutation) (before, after []*compute.Backend, changes []Change, err error) {
+	bs := cached
+	if bs == nil {
+		if bs, err = discovery.GetBackendService(ctx, c.Compute, project, ref); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	backends := append([]*compute.Backend(nil), bs.Backends...)
+	var settings BackendServiceSettings
+	var changed bool
+	for _, m := range ms {
+		group := discovery.NEGURL(m.Project, m.Region, m.NEG)
+		i := indexBackend(backends, group)
+		switch m.Op {
+		case planner.OpAttachBackend:
+			if i < 0 {
+				b := &compute.Backend{
+					Group:       group,
+					Description: planner.NewOwnership(m.Service).WithLabels(m.Labels).String(),
+				}
+				setCapacityScaler(b, m.CapacityScaler)
+				backends = append(backends, b)
+				changed = true
+			}
+		case planner.OpAdoptBackend:
+			if i < 0 {
+				return nil, nil, nil, errors.Wrapf(ErrStale, "NEG %q is no longer a backend of %q", m.NEG, ref)
+			}
+			stamped := *backends[i]
+			stamped.Description = planner.NewOwnership(m.Service).WithLabels(m.Labels).String()
+			backends[i] = &stamped
+			changed = true
+		case planner.OpLabelBackend:
+			if i < 0 {
+				return nil, nil, nil, errors.Wrapf(ErrStale, "NEG %q is no longer a backend of %q", m.NEG, ref)
+			}
+			o, ok := planner.ParseOwnership(backends[i].Description)
+			if !ok {
+				return nil, nil, nil, errors.Wrapf(ErrStale, "backend of NEG %q in %q is no longer managed by the controller", m.NEG, ref)
+			}
+			labeled := *backends[i]
+			labeled.Description = o.WithLabels(m.Labels).String()
+			backends[i] = &labeled
+			changed = true
+		case planner.OpUpdateBackend:
+			if i < 0 {
+				return nil, nil, nil, errors.Wrapf(ErrStale, "NEG %q is no longer a backend of %q", m.NEG, ref)
+			}
+			updated := *backends[i]
+			setCapacityScaler(&updated, m.CapacityScaler)
+			backends[i] = &updated
+			changed = true
+		case planner.OpSetProtocol:
+			if bs.Protocol != m.Protocol {
+				settings.Protocol = m.Protocol
+				changed = true
+			}
+		case planner.OpSetDraining:
+			if bs.ConnectionDraining == nil || bs.ConnectionDraining.DrainingTimeoutSec != *m.DrainingTimeout {
+				settings.ConnectionDraining = &compute.ConnectionDraining{
+					DrainingTimeoutSec: *m.DrainingTimeout,
+					ForceSendFields:    []string{"DrainingTimeoutSec"},
+				}
+				changed = true
+			}
+		case planner.OpSetLocalityPolicy:
+			if bs.LocalityLbPolicy != m.LocalityPolicy {
+				settings.LocalityPolicy = m.LocalityPolicy
+				changed = true
+			}
+		case planner.OpSetOutlierDetection:
+			od := bs.OutlierDetection
+			if od == nil || od.ConsecutiveErrors != *m.OutlierErrors || od.EnforcingConsecutiveErrors != 100 {
+				// Only the fields the service declares are set; the others
+				// are kept as configured outside of the controller.
+				merged := &compute.OutlierDetection{}
+				if od != nil {
+					*merged = *od
+				}
+				merged.ConsecutiveErrors, merged.EnforcingConsecutiveErrors = *m.OutlierErrors, 100
+				settings.OutlierDetection = merged
+				changed = true
+			}
+		case planner.OpSetIAP:
+			if planner.IAPEnabled(bs) != *m.IAP {
+				settings.IAP = &compute.BackendServiceIAP{Enabled: *m.IAP, ForceSendFields: []string{"Enabled"}}
+				changed = true
+			}
+		case planner.OpDetachBackend:
+			if i >= 0 {
+				backends = append(backends[:i:i], backends[i+1:]...)
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return bs.Backends, bs.Backends, nil, nil
+	}
+	changes = BackendServiceChanges(bs, backends, settings)
+	return bs.Backends, backends, changes, c.patchBackends(ctx, project, ref, bs, backends, settings, changes)
+}
+
+// setCapacityScaler sets the capacity scaler of b, if given. A scaler of 0
+// drains the backend and must be sent explicitly.
+func setCapacityScaler(b *compute.Backend, scaler *float64) {
+	if scaler == nil {
+		return
+	}
+	b.CapacityScaler = *scaler
+	b.ForceSendFields = append(b.ForceSendFields[:len(b.ForceSendFields):len(b.ForceSendFields)], "CapacityScaler")
+}
+
+// indexBackend returns the index of the backend referring to the given NEG
+// group, or -1.
+func indexBackend(backends []*compute.Backend, group string) int {
+	for i, b := range backends {
+		if discovery.SameNEG(b.Group, group) {
+			return i
+		}
+	}
+	return -1
+}
+
+// isConflict reports whether err is a conflict with a concurrent change,
+// e.g. a stale fingerprint.
+func isConflict(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && (gerr.Code == http.StatusConflict || gerr.Code == http.StatusPreconditionFailed)
+}
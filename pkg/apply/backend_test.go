@@ -0,0 +1,143 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apply
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/discovery"
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/planner"
+	"github.com/pkg/errors"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+)
+
+// fakeBackendService serves one global backend service, rejecting patches
+// whose fingerprint is not the current one like the Compute Engine API does.
+// Every accepted patch gets a new fingerprint.
+type fakeBackendService struct {
+	mu      sync.Mutex
+	bs      compute.BackendService
+	gets    int
+	patches int
+	// conflicts is the number of patches still to reject regardless of
+	// their fingerprint, as if another writer changed the backend service
+	// in between.
+	conflicts int
+}
+
+func (f *fakeBackendService) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	switch req.Method {
+	case http.MethodGet:
+		f.gets++
+		json.NewEncoder(w).Encode(&f.bs)
+	case http.MethodPatch:
+		f.patches++
+		var patch compute.BackendService
+		if err := json.NewDecoder(req.Body).Decode(&patch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if f.conflicts > 0 || patch.Fingerprint != f.bs.Fingerprint {
+			if f.conflicts > 0 {
+				f.conflicts--
+				f.bs.Fingerprint += "x"
+			}
+			w.WriteHeader(http.StatusPreconditionFailed)
+			w.Write([]byte(`{"error":{"code":412,"message":"fingerprint mismatch"}}`))
+			return
+		}
+		f.bs.Backends = patch.Backends
+		f.bs.Fingerprint += "+"
+		json.NewEncoder(w).Encode(&compute.Operation{Name: "op", Status: "DONE"})
+	default:
+		http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestUpdateBackends(t *testing.T) {
+	ref := discovery.BackendServiceRef{Name: "web"}
+	existing := &compute.Backend{Group: discovery.NEGURL("p", "us-central1", "other"), CapacityScaler: 1}
+	attach := planner.Mutation{Op: planner.OpAttachBackend, Project: "p", Region: "us-central1", NEG: "hello", Service: "s", BackendService: "web"}
+	detach := planner.Mutation{Op: planner.OpDetachBackend, Project: "p", Region: "us-central1", NEG: "other", BackendService: "web"}
+	adopt := planner.Mutation{Op: planner.OpAdoptBackend, Project: "p", Region: "us-central1", NEG: "gone", Service: "s", BackendService: "web"}
+	for _, tc := range []struct {
+		name        string
+		ms          []planner.Mutation
+		stale       bool
+		conflicts   int
+		wantErr     error
+		wantGets    int
+		wantPatches int
+		wantGroups  int
+	}{
+		{name: "cached", ms: []planner.Mutation{attach}, wantPatches: 1, wantGroups: 2},
+		{name: "stale cache", ms: []planner.Mutation{attach}, stale: true, wantGets: 1, wantPatches: 2, wantGroups: 2},
+		{name: "concurrent change", ms: []planner.Mutation{attach, detach}, conflicts: 1, wantGets: 1, wantPatches: 2, wantGroups: 1},
+		{name: "persistent conflict", ms: []planner.Mutation{attach}, conflicts: 3, wantErr: errConflict, wantGets: 2, wantPatches: 3, wantGroups: 1},
+		{name: "nothing to do", ms: []planner.Mutation{{Op: planner.OpDetachBackend, Project: "p", Region: "us-central1", NEG: "hello", BackendService: "web"}}, wantGroups: 1},
+		{name: "stale plan", ms: []planner.Mutation{adopt}, wantErr: ErrStale, wantGroups: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &fakeBackendService{bs: compute.BackendService{Name: "web", Fingerprint: "f", Backends: []*compute.Backend{existing}}, conflicts: tc.conflicts}
+			srv := httptest.NewServer(fake)
+			defer srv.Close()
+			ctx := context.Background()
+			computeService, err := compute.NewService(ctx, option.WithEndpoint(srv.URL), option.WithHTTPClient(srv.Client()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cached := &compute.BackendService{Name: "web", Fingerprint: "f", Backends: []*compute.Backend{existing}}
+			if tc.stale {
+				cached.Fingerprint = "old"
+			}
+
+			c := &Client{Compute: computeService}
+			_, after, _, err := c.UpdateBackends(ctx, "p", ref, cached, tc.ms)
+			switch {
+			case tc.wantErr == errConflict:
+				if !isConflict(err) {
+					t.Errorf("err = %v, want a conflict", err)
+				}
+			case tc.wantErr != nil:
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("err = %v, want %v", err, tc.wantErr)
+				}
+			case err != nil:
+				t.Fatal(err)
+			}
+			if fake.gets != tc.wantGets || fake.patches != tc.wantPatches {
+				t.Errorf("%d gets and %d patches, want %d and %d", fake.gets, fake.patches, tc.wantGets, tc.wantPatches)
+			}
+			if len(fake.bs.Backends) != tc.wantGroups {
+				t.Errorf("backend service has %d backends, want %d", len(fake.bs.Backends), tc.wantGroups)
+			}
+			if err == nil && len(after) != tc.wantGroups {
+				t.Errorf("UpdateBackends returned %d backends after, want %d", len(after), tc.wantGroups)
+			}
+		})
+	}
+}
+
+// errConflict marks test cases expecting the conflict to be returned.
+var errConflict = errors.New("conflict")
@@ -0,0 +1,116 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apply
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/discovery"
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/planner"
+	"google.golang.org/api/compute/v1"
+)
+
+// Change is the change of one field of a backend service by a patch. Old is
+// nil for added backends and New for removed ones.
+type Change struct {
+	// Field is the path of the field, e.g. "protocol". Backends are
+	// identified by their group rather than their index, which is not
+	// stable: "backends[group=projects/P/regions/R/networkEndpointGroups/N]".
+	Field string      `json:"field"`
+	Old   interface{} `json:"old,omitempty"`
+	New   interface{} `json:"new,omitempty"`
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.Field, changeValue(c.Old), changeValue(c.New))
+}
+
+// changeValue formats the old or new value of a change as JSON.
+func changeValue(v interface{}) string {
+	if v == nil {
+		return "none"
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// BackendServiceChanges returns the changes of a patch replacing the backends
+// of bs and changing the given settings.
+func BackendServiceChanges(bs *compute.BackendService, backends []*compute.Backend, settings BackendServiceSettings) []Change {
+	var changes []Change
+	old := make(map[string]*compute.Backend, len(bs.Backends))
+	for _, b := range bs.Backends {
+		old[backendField(b.Group)] = b
+	}
+	for _, b := range backends {
+		field := backendField(b.Group)
+		o, ok := old[field]
+		delete(old, field)
+		switch {
+		case !ok:
+			changes = append(changes, Change{Field: field, New: b})
+		case o == b:
+		default:
+			if o.CapacityScaler != b.CapacityScaler {
+				changes = append(changes, Change{Field: field + ".capacityScaler", Old: o.CapacityScaler, New: b.CapacityScaler})
+			}
+			if o.Description != b.Description {
+				changes = append(changes, Change{Field: field + ".description", Old: o.Description, New: b.Description})
+			}
+		}
+	}
+	for _, b := range bs.Backends {
+		if field := backendField(b.Group); old[field] != nil {
+			changes = append(changes, Change{Field: field, Old: b})
+		}
+	}
+
+	if settings.Protocol != "" && settings.Protocol != bs.Protocol {
+		changes = append(changes, Change{Field: "protocol", Old: bs.Protocol, New: settings.Protocol})
+	}
+	if cd := settings.ConnectionDraining; cd != nil {
+		c := Change{Field: "connectionDraining.drainingTimeoutSec", New: cd.DrainingTimeoutSec}
+		if bs.ConnectionDraining != nil {
+			c.Old = bs.ConnectionDraining.DrainingTimeoutSec
+		}
+		changes = append(changes, c)
+	}
+	if settings.LocalityPolicy != "" && settings.LocalityPolicy != bs.LocalityLbPolicy {
+		changes = append(changes, Change{Field: "localityLbPolicy", Old: bs.LocalityLbPolicy, New: settings.LocalityPolicy})
+	}
+	if od := settings.OutlierDetection; od != nil {
+		c := Change{Field: "outlierDetection.consecutiveErrors", New: od.ConsecutiveErrors}
+		if bs.OutlierDetection != nil {
+			c.Old = bs.OutlierDetection.ConsecutiveErrors
+		}
+		changes = append(changes, c)
+	}
+	if settings.IAP != nil {
+		changes = append(changes, Change{Field: "iap.enabled", Old: planner.IAPEnabled(bs), New: settings.IAP.Enabled})
+	}
+	return changes
+}
+
+// backendField returns the field path of the backend referring to group.
+func backendField(group string) string {
+	if project, region, name, ok := discovery.ParseNEGURL(group); ok {
+		group = fmt.Sprintf("projects/%s/regions/%s/networkEndpointGroups/%s", project, region, name)
+	}
+	return fmt.Sprintf("backends[group=%s]", group)
+}
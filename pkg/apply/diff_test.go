@@ -0,0 +1,94 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apply
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/discovery"
+	"google.golang.org/api/compute/v1"
+)
+
+func TestBackendServiceChanges(t *testing.T) {
+	a := &compute.Backend{Group: discovery.NEGURL("p", "us-central1", "a"), CapacityScaler: 1}
+	b := &compute.Backend{Group: discovery.NEGURL("p", "us-central1", "b"), CapacityScaler: 1}
+	// Partial URLs refer to the same group as full ones.
+	aPartial := &compute.Backend{Group: "projects/p/regions/us-central1/networkEndpointGroups/a", CapacityScaler: 0.5, Description: "d"}
+	const fieldA = "backends[group=projects/p/regions/us-central1/networkEndpointGroups/a]"
+	const fieldB = "backends[group=projects/p/regions/us-central1/networkEndpointGroups/b]"
+	for _, tc := range []struct {
+		name     string
+		bs       *compute.BackendService
+		backends []*compute.Backend
+		settings BackendServiceSettings
+		want     []string
+	}{
+		{
+			name:     "unchanged",
+			bs:       &compute.BackendService{Backends: []*compute.Backend{a, b}},
+			backends: []*compute.Backend{a, b},
+		},
+		{
+			name:     "added",
+			bs:       &compute.BackendService{Backends: []*compute.Backend{a}},
+			backends: []*compute.Backend{a, b},
+			want:     []string{fieldB},
+		},
+		{
+			name:     "removed",
+			bs:       &compute.BackendService{Backends: []*compute.Backend{a, b}},
+			backends: []*compute.Backend{b},
+			want:     []string{fieldA},
+		},
+		{
+			name:     "updated",
+			bs:       &compute.BackendService{Backends: []*compute.Backend{a}},
+			backends: []*compute.Backend{aPartial},
+			want:     []string{fieldA + ".capacityScaler", fieldA + ".description"},
+		},
+		{
+			name:     "settings",
+			bs:       &compute.BackendService{Protocol: "HTTP", LocalityLbPolicy: "ROUND_ROBIN"},
+			settings: BackendServiceSettings{Protocol: "HTTP2", LocalityPolicy: "ROUND_ROBIN", ConnectionDraining: &compute.ConnectionDraining{DrainingTimeoutSec: 30}, OutlierDetection: &compute.OutlierDetection{ConsecutiveErrors: 5}, IAP: &compute.BackendServiceIAP{Enabled: true}},
+			want:     []string{"protocol", "connectionDraining.drainingTimeoutSec", "outlierDetection.consecutiveErrors", "iap.enabled"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var fields []string
+			for _, c := range BackendServiceChanges(tc.bs, tc.backends, tc.settings) {
+				fields = append(fields, c.Field)
+			}
+			if fmt.Sprint(fields) != fmt.Sprint(tc.want) {
+				t.Errorf("changed fields = %v, want %v", fields, tc.want)
+			}
+		})
+	}
+}
+
+func TestChangeString(t *testing.T) {
+	for _, tc := range []struct {
+		c    Change
+		want string
+	}{
+		{Change{Field: "protocol", Old: "HTTP", New: "HTTP2"}, `protocol: "HTTP" -> "HTTP2"`},
+		{Change{Field: "backends[group=g].capacityScaler", Old: 1.0, New: 0.5}, "backends[group=g].capacityScaler: 1 -> 0.5"},
+		{Change{Field: "backends[group=g]", Old: &compute.Backend{Group: "g"}}, `backends[group=g]: {"group":"g"} -> none`},
+	} {
+		if got := tc.c.String(); got != tc.want {
+			t.Errorf("String() = %s, want %s", got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package discovery lists the Cloud Run services and the Compute Engine
+// resources the controller reconciles: serverless NEGs and the backend
+// services they are attached to.
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// BackendServiceRef identifies a backend service of a project. Region is
+// empty for global backend services.
+type BackendServiceRef struct {
+	Region string
+	Name   string
+}
+
+func (b BackendServiceRef) String() string {
+	if b.Region == "" {
+		return "global/" + b.Name
+	}
+	return fmt.Sprintf("regions/%s/%s", b.Region, b.Name)
+}
+
+// Path returns the path of the backend service relative to its project.
+func (b BackendServiceRef) Path() string {
+	if b.Region == "" {
+		return "global/backendServices/" + b.Name
+	}
+	return fmt.Sprintf("regions/%s/backendServices/%s", b.Region, b.Name)
+}
+
+// Scope returns the region of the backend service, or "global".
+func (b BackendServiceRef) Scope() string {
+	if b.Region == "" {
+		return "global"
+	}
+	return b.Region
+}
+
+// SortedBackendRefs returns the keys of m in order.
+func SortedBackendRefs[V any](m map[BackendServiceRef]V) []BackendServiceRef {
+	refs := make([]BackendServiceRef, 0, len(m))
+	for ref := range m {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].String() < refs[j].String() })
+	return refs
+}
+
+// ListRegionNEGs returns the serverless and the other network endpoint groups
+// in the given region, keyed by name.
+func ListRegionNEGs(ctx context.Context, computeService *compute.Service, project, region string) (negs, others map[string]*compute.NetworkEndpointGroup, err error) {
+	negs = make(map[string]*compute.NetworkEndpointGroup)
+	others = make(map[string]*compute.NetworkEndpointGroup)
+	err = computeService.RegionNetworkEndpointGroups.List(project, region).
+		Pages(ctx, func(l *compute.NetworkEndpointGroupList) error {
+			for _, neg := range l.Items {
+				if neg.NetworkEndpointType == "SERVERLESS" {
+					negs[neg.Name] = neg
+				} else {
+					others[neg.Name] = neg
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to list network endpoint groups in region %q", region)
+	}
+	return negs, others, nil
+}
+
+// GetRegionNEG returns a regional network endpoint group.
+func GetRegionNEG(ctx context.Context, computeService *compute.Service, project, region, name string) (*compute.NetworkEndpointGroup, error) {
+	neg, err := computeService.RegionNetworkEndpointGroups.Get(project, region, name).Context(ctx).Do()
+	return neg, errors.Wrapf(err, "failed to get network endpoint group %q", name)
+}
+
+// ListBackendServices returns the global backend services of the project if
+// region is empty, or the backend services of the given region otherwise.
+func ListBackendServices(ctx context.Context, computeService *compute.Service, project, region string) (map[BackendServiceRef]*compute.BackendService, error) {
+	bss := make(map[BackendServiceRef]*compute.BackendService)
+	add := func(l *compute.BackendServiceList) error {
+		for _, bs := range l.Items {
+			bss[BackendServiceRef{Region: region, Name: bs.Name}] = bs
+		}
+		return nil
+	}
+	var err error
+	if region == "" {
+		err = computeService.BackendServices.List(project).Pages(ctx, add)
+	} else {
+		err = computeService.RegionBackendServices.List(project, region).Pages(ctx, add)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list backend services in %q", BackendServiceRef{Region: region}.Scope())
+	}
+	return bss, nil
+}
+
+// GetBackendService returns a global or regional backend service.
+func GetBackendService(ctx context.Context, computeService *compute.Service, project string, ref BackendServiceRef) (*compute.BackendService, error) {
+	var bs *compute.BackendService
+	var err error
+	if ref.Region == "" {
+		bs, err = computeService.BackendServices.Get(project, ref.Name).Context(ctx).Do()
+	} else {
+		bs, err = computeService.RegionBackendServices.Get(project, ref.Region, ref.Name).Context(ctx).Do()
+	}
+	return bs, errors.Wrapf(err, "failed to get backend service %q", ref)
+}
+
+// ParseBackendServiceURL returns the project and the backend service a (full
+// or partial) global or regional backend service URL refers to.
+func ParseBackendServiceURL(u string) (string, BackendServiceRef, bool) {
+	i := strings.Index(u, "projects/")
+	if i < 0 {
+		return "", BackendServiceRef{}, false
+	}
+	parts := strings.Split(u[i:], "/")
+	switch {
+	case len(parts) == 5 && parts[2] == "global" && parts[3] == "backendServices":
+		return parts[1], BackendServiceRef{Name: parts[4]}, true
+	case len(parts) == 6 && parts[2] == "regions" && parts[4] == "backendServices":
+		return parts[1], BackendServiceRef{Region: parts[3], Name: parts[5]}, true
+	}
+	return "", BackendServiceRef{}, false
+}
+
+// NEGURL returns the URL of a regional network endpoint group, as used in
+// backend groups.
+func NEGURL(project, region, name string) string {
+	return fmt.Sprintf("https://www.googleapis.com/compute/v1/projects/%s/regions/%s/networkEndpointGroups/%s", project, region, name)
+}
+
+// ParseNEGURL extracts project, region and name from a (full or partial)
+// regional network endpoint group URL.
+func ParseNEGURL(u string) (project, region, name string, ok bool) {
+	i := strings.Index(u, "projects/")
+	if i < 0 {
+		return "", "", "", false
+	}
+	parts := strings.Split(u[i:], "/")
+	if len(parts) != 6 || parts[2] != "regions" || parts[4] != "networkEndpointGroups" {
+		return "", "", "", false
+	}
+	return parts[1], parts[3], parts[5], true
+}
+
+// SameNEG reports whether two network endpoint group URLs refer to the same
+// group, regardless of whether they are full or partial URLs.
+func SameNEG(a, b string) bool {
+	ap, ar, an, aok := ParseNEGURL(a)
+	bp, br, bn, bok := ParseNEGURL(b)
+	return aok && bok && ap == bp && ar == br && an == bn
+}
+
+// FindBackend returns the backend of bs referring to the given NEG, or nil.
+func FindBackend(bs *compute.BackendService, project, region, neg string) *compute.Backend {
+	group := NEGURL(project, region, neg)
+	for _, b := range bs.Backends {
+		if SameNEG(b.Group, group) {
+			return b
+		}
+	}
+	return nil
+}
+
+func isNotFound(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusNotFound
+}
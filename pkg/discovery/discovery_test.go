@@ -0,0 +1,115 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"testing"
+
+	"google.golang.org/api/compute/v1"
+)
+
+func TestParseNEGURL(t *testing.T) {
+	for _, tc := range []struct {
+		url                   string
+		project, region, name string
+		ok                    bool
+	}{
+		{"https://www.googleapis.com/compute/v1/projects/p/regions/us-central1/networkEndpointGroups/n", "p", "us-central1", "n", true},
+		{"https://compute.googleapis.com/compute/beta/projects/p/regions/us-central1/networkEndpointGroups/n", "p", "us-central1", "n", true},
+		{"projects/p/regions/us-central1/networkEndpointGroups/n", "p", "us-central1", "n", true},
+		{"projects/p/zones/us-central1-a/networkEndpointGroups/n", "", "", "", false},
+		{"projects/p/regions/us-central1/instanceGroups/n", "", "", "", false},
+		{"projects/p/global/networkEndpointGroups/n", "", "", "", false},
+		{"n", "", "", "", false},
+	} {
+		project, region, name, ok := ParseNEGURL(tc.url)
+		if project != tc.project || region != tc.region || name != tc.name || ok != tc.ok {
+			t.Errorf("ParseNEGURL(%q) = %q, %q, %q, %v, want %q, %q, %q, %v", tc.url, project, region, name, ok, tc.project, tc.region, tc.name, tc.ok)
+		}
+	}
+
+	if u := NEGURL("p", "us-central1", "n"); !SameNEG(u, "projects/p/regions/us-central1/networkEndpointGroups/n") {
+		t.Errorf("SameNEG(%q, partial URL) = false", u)
+	}
+	if SameNEG("projects/p/regions/us-central1/networkEndpointGroups/n", "projects/p/regions/europe-west1/networkEndpointGroups/n") {
+		t.Error("SameNEG of NEGs in different regions = true")
+	}
+	if SameNEG("invalid", "invalid") {
+		t.Error("SameNEG of invalid URLs = true")
+	}
+}
+
+func TestParseBackendServiceURL(t *testing.T) {
+	for _, tc := range []struct {
+		url     string
+		project string
+		ref     BackendServiceRef
+		ok      bool
+	}{
+		{"https://www.googleapis.com/compute/v1/projects/p/global/backendServices/web", "p", BackendServiceRef{Name: "web"}, true},
+		{"projects/p/regions/us-central1/backendServices/web", "p", BackendServiceRef{Region: "us-central1", Name: "web"}, true},
+		{"projects/p/global/backendBuckets/web", "", BackendServiceRef{}, false},
+		{"projects/p/regions/us-central1/backendServices", "", BackendServiceRef{}, false},
+		{"web", "", BackendServiceRef{}, false},
+	} {
+		project, ref, ok := ParseBackendServiceURL(tc.url)
+		if project != tc.project || ref != tc.ref || ok != tc.ok {
+			t.Errorf("ParseBackendServiceURL(%q) = %q, %v, %v, want %q, %v, %v", tc.url, project, ref, ok, tc.project, tc.ref, tc.ok)
+		}
+	}
+}
+
+func TestBackendServiceRef(t *testing.T) {
+	for _, tc := range []struct {
+		ref              BackendServiceRef
+		str, path, scope string
+	}{
+		{BackendServiceRef{Name: "web"}, "global/web", "global/backendServices/web", "global"},
+		{BackendServiceRef{Region: "us-central1", Name: "web"}, "regions/us-central1/web", "regions/us-central1/backendServices/web", "us-central1"},
+	} {
+		if got := tc.ref.String(); got != tc.str {
+			t.Errorf("String() = %q, want %q", got, tc.str)
+		}
+		if got := tc.ref.Path(); got != tc.path {
+			t.Errorf("Path() = %q, want %q", got, tc.path)
+		}
+		if got := tc.ref.Scope(); got != tc.scope {
+			t.Errorf("Scope() = %q, want %q", got, tc.scope)
+		}
+		if project, ref, ok := ParseBackendServiceURL("projects/p/" + tc.ref.Path()); !ok || project != "p" || ref != tc.ref {
+			t.Errorf("ParseBackendServiceURL of Path() = %q, %v, %v, want p, %v", project, ref, ok, tc.ref)
+		}
+	}
+}
+
+func TestFindBackend(t *testing.T) {
+	bs := &compute.BackendService{Backends: []*compute.Backend{
+		{Group: "projects/p/regions/us-central1/networkEndpointGroups/a"},
+		{Group: NEGURL("p", "us-central1", "b")},
+	}}
+	for _, tc := range []struct {
+		region, neg string
+		want        *compute.Backend
+	}{
+		{"us-central1", "a", bs.Backends[0]},
+		{"us-central1", "b", bs.Backends[1]},
+		{"europe-west1", "a", nil},
+		{"us-central1", "c", nil},
+	} {
+		if got := FindBackend(bs, "p", tc.region, tc.neg); got != tc.want {
+			t.Errorf("FindBackend(%s, %s) = %v, want %v", tc.region, tc.neg, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/run/v2"
+)
+
+// Services returns the Cloud Run services of a region.
+func Services(ctx context.Context, logger logrus.FieldLogger, runService *run.Service, project, region string) ([]*run.GoogleCloudRunV2Service, error) {
+	var svcs []*run.GoogleCloudRunV2Service
+	err := ListServices(ctx, logger, runService, project, region, func(page []*run.GoogleCloudRunV2Service) error {
+		svcs = append(svcs, page...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return svcs, nil
+}
+
+// ListServices calls fn with every page of the Cloud Run services of a region
+// as it is listed, so that callers need not hold all services at once.
+// Listing stops at the first error returned by fn.
+func ListServices(ctx context.Context, logger logrus.FieldLogger, runService *run.Service, project, region string, fn func([]*run.GoogleCloudRunV2Service) error) error {
+	lg := logger.WithFields(logrus.Fields{
+		"project": project,
+		"region":  region,
+	})
+
+	lg.Debug("querying Cloud Run services")
+	n := 0
+	err := runService.Projects.Locations.Services.List(fmt.Sprintf("projects/%s/locations/%s", project, region)).
+		Pages(ctx, func(resp *run.GoogleCloudRunV2ListServicesResponse) error {
+			n += len(resp.Services)
+			return fn(resp.Services)
+		})
+	if err != nil {
+		return errors.Wrapf(err, "failed to list services in region %q", region)
+	}
+
+	lg.WithField("n", n).Debug("finished retrieving services from the API")
+	return nil
+}
+
+// GetService returns a Cloud Run service of a region by its short name, or
+// nil if it doesn't exist.
+func GetService(ctx context.Context, runService *run.Service, project, region, name string) (*run.GoogleCloudRunV2Service, error) {
+	svc, err := runService.Projects.Locations.Services.Get(fmt.Sprintf("projects/%s/locations/%s/services/%s", project, region, name)).Context(ctx).Do()
+	if isNotFound(err) {
+		return nil, nil
+	}
+	return svc, errors.Wrapf(err, "failed to get service %q in region %q", name, region)
+}
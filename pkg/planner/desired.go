@@ -0,0 +1,75 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package planner
+
+import (
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/discovery"
+)
+
+// DesiredNEG is the state the controller wants for a serverless NEG.
+type DesiredNEG struct {
+	// Service is the resource name of the Cloud Run service.
+	Service  string
+	Backends []DesiredBackend
+	// Labels holds the service's labels propagated to its resources.
+	Labels map[string]string
+	// Tag is the revision tag the NEG routes to; empty NEGs route to the
+	// service's own traffic split.
+	Tag string
+}
+
+// AttachedTo reports whether the NEG should be a backend of the given backend
+// service.
+func (d DesiredNEG) AttachedTo(ref discovery.BackendServiceRef) bool {
+	for _, b := range d.Backends {
+		if b.Ref == ref {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthMode is how requests through the load balancer are authenticated.
+type AuthMode string
+
+const (
+	// AuthIAP: IAP authenticates users at the load balancer and invokes the
+	// service as its service agent.
+	AuthIAP AuthMode = "iap"
+	// AuthToken: clients send ID tokens for the service's URL or one of its
+	// custom audiences, which the load balancer passes through.
+	AuthToken AuthMode = "token"
+	// AuthPublic: the service allows unauthenticated invocations.
+	AuthPublic AuthMode = "public"
+)
+
+// DesiredBackend is a backend service the NEG of a service is attached to,
+// together with the settings of the NEG's backend. Settings with zero values
+// are left unchanged.
+type DesiredBackend struct {
+	Ref      discovery.BackendServiceRef
+	Capacity float64
+	Protocol string
+	// DrainingTimeout is the connection draining timeout in seconds.
+	DrainingTimeout *int64
+	// LocalityPolicy is the locality load balancing policy.
+	LocalityPolicy string
+	// OutlierErrors is the number of consecutive errors ejecting a
+	// backend.
+	OutlierErrors *int64
+	// Auth is the authentication mode; AuthIAP enables IAP on the backend
+	// service, the other modes disable it.
+	Auth AuthMode
+}
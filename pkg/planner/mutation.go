@@ -0,0 +1,197 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package planner computes the changes that bring the serverless NEGs of a
+// region and their backends in line with the desired state of the Cloud Run
+// services: the NEGs to create and delete, the backends to attach, update and
+// detach, and the settings of the backend services.
+package planner
+
+import (
+	"sort"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/discovery"
+	"github.com/sirupsen/logrus"
+)
+
+// Op is the kind of a mutation.
+type Op string
+
+const (
+	OpCreateNEG     Op = "createNEG"
+	OpAttachBackend Op = "attachBackend"
+	OpAdoptBackend  Op = "adoptBackend"
+	OpUpdateBackend Op = "updateBackend"
+	OpSetProtocol   Op = "setProtocol"
+	OpSetDraining   Op = "setConnectionDraining"
+	// Locality policies and outlier detection are only supported by
+	// INTERNAL_MANAGED and EXTERNAL_MANAGED backend services.
+	OpSetLocalityPolicy   Op = "setLocalityPolicy"
+	OpSetOutlierDetection Op = "setOutlierDetection"
+	// OpSetIAP enables or disables IAP on a backend service.
+	OpSetIAP Op = "setIAP"
+	// OpLabelBackend updates the propagated labels in the ownership marker
+	// of a backend.
+	OpLabelBackend Op = "labelBackend"
+	// Ingress mutations change the Cloud Run service rather than compute
+	// resources.
+	OpHardenIngress  Op = "hardenIngress"
+	OpRestoreIngress Op = "restoreIngress"
+	OpDetachBackend  Op = "detachBackend"
+	OpDeleteNEG      Op = "deleteNEG"
+)
+
+// stages is the order in which mutations are applied: NEGs must exist
+// before being attached, and must be detached before being deleted.
+var stages = map[Op]int{
+	OpCreateNEG:           0,
+	OpAttachBackend:       1,
+	OpAdoptBackend:        1,
+	OpUpdateBackend:       1,
+	OpLabelBackend:        1,
+	OpSetProtocol:         1,
+	OpSetDraining:         1,
+	OpSetLocalityPolicy:   1,
+	OpSetOutlierDetection: 1,
+	OpSetIAP:              1,
+	// Ingress is restored before detaching the NEG, so that the service
+	// stays reachable, and only hardened once the NEG is attached.
+	OpRestoreIngress: 1,
+	OpHardenIngress:  2,
+	OpDetachBackend:  3,
+	OpDeleteNEG:      4,
+}
+
+// Stage returns the position of the op in the apply order. Mutations of the
+// same stage are independent of each other.
+func (op Op) Stage() int { return stages[op] }
+
+// Sort orders mutations by stage, keeping the order of the mutations of each
+// stage.
+func Sort(ms []Mutation) {
+	sort.SliceStable(ms, func(i, j int) bool { return ms[i].Op.Stage() < ms[j].Op.Stage() })
+}
+
+// Mutation is a single change to compute resources the controller intends to
+// make.
+type Mutation struct {
+	Op      Op     `json:"op"`
+	Project string `json:"project"`
+	Region  string `json:"region"`
+	NEG     string `json:"neg"`
+	// Service is the resource name of the Cloud Run service the mutation is
+	// made for, if any.
+	Service string `json:"service,omitempty"`
+	// BackendService and BackendRegion identify the backend service of
+	// attach and detach mutations. BackendRegion is empty for global
+	// backend services.
+	BackendService string `json:"backendService,omitempty"`
+	BackendRegion  string `json:"backendRegion,omitempty"`
+	// CapacityScaler is the capacity scaler set by attach and update
+	// mutations.
+	CapacityScaler *float64 `json:"capacityScaler,omitempty"`
+	// Protocol is the backend service protocol set by setProtocol
+	// mutations.
+	Protocol string `json:"protocol,omitempty"`
+	// DrainingTimeout is the connection draining timeout in seconds set by
+	// setConnectionDraining mutations.
+	DrainingTimeout *int64 `json:"drainingTimeout,omitempty"`
+	// LocalityPolicy is the locality load balancing policy set by
+	// setLocalityPolicy mutations.
+	LocalityPolicy string `json:"localityPolicy,omitempty"`
+	// OutlierErrors is the number of consecutive errors ejecting a backend
+	// set by setOutlierDetection mutations.
+	OutlierErrors *int64 `json:"outlierErrors,omitempty"`
+	// IAP is whether setIAP mutations enable IAP.
+	IAP *bool `json:"iap,omitempty"`
+	// PSCTarget is the service attachment of created PSC NEGs. Mutations
+	// of PSC NEGs have no Service.
+	PSCTarget string `json:"pscTarget,omitempty"`
+	// Tag is the revision tag created serverless NEGs route to, if any.
+	Tag string `json:"tag,omitempty"`
+	// Labels holds the propagated labels of the service, stamped on created
+	// NEGs and on attached, adopted and labeled backends.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Ingress is the ingress setting of ingress mutations.
+	Ingress string `json:"ingress,omitempty"`
+	// Previous is the value replaced by update, setting and ingress
+	// mutations, if any. It is only used to describe changes.
+	Previous interface{} `json:"previous,omitempty"`
+	// Stale is the reason a detach mutation prunes a backend whose NEG or
+	// Cloud Run service no longer exists.
+	Stale string `json:"stale,omitempty"`
+	// Drift is set on mutations that undo out-of-band changes to resources
+	// the controller had already converged.
+	Drift bool `json:"drift,omitempty"`
+}
+
+// BackendServiceRef returns the backend service of the mutation.
+func (m Mutation) BackendServiceRef() discovery.BackendServiceRef {
+	return discovery.BackendServiceRef{Region: m.BackendRegion, Name: m.BackendService}
+}
+
+// Destructive reports whether the mutation removes a NEG or a backend.
+func (m Mutation) Destructive() bool {
+	return m.Op == OpDeleteNEG || m.Op == OpDetachBackend
+}
+
+// Fields returns the log fields describing the mutation.
+func (m Mutation) Fields() logrus.Fields {
+	f := logrus.Fields{
+		"op":      m.Op,
+		"project": m.Project,
+		"region":  m.Region,
+		"neg":     m.NEG,
+	}
+	if m.Service != "" {
+		f["service"] = m.Service
+	}
+	if m.BackendService != "" {
+		f["backendService"] = m.BackendServiceRef().String()
+	}
+	if m.CapacityScaler != nil {
+		f["capacityScaler"] = *m.CapacityScaler
+	}
+	if m.Protocol != "" {
+		f["protocol"] = m.Protocol
+	}
+	if m.DrainingTimeout != nil {
+		f["drainingTimeout"] = *m.DrainingTimeout
+	}
+	if m.LocalityPolicy != "" {
+		f["localityPolicy"] = m.LocalityPolicy
+	}
+	if m.OutlierErrors != nil {
+		f["outlierErrors"] = *m.OutlierErrors
+	}
+	if m.IAP != nil {
+		f["iap"] = *m.IAP
+	}
+	if m.PSCTarget != "" {
+		f["pscTarget"] = m.PSCTarget
+	}
+	if m.Tag != "" {
+		f["tag"] = m.Tag
+	}
+	if m.Ingress != "" {
+		f["ingress"] = m.Ingress
+	}
+	if m.Stale != "" {
+		f["stale"] = m.Stale
+	}
+	if m.Drift {
+		f["drift"] = true
+	}
+	return f
+}
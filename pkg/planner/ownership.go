@@ -0,0 +1,82 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package planner
+
+import (
+	"encoding/json"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// ControllerName identifies resources managed by the controller.
+const ControllerName = "serverless-autoneg-controller"
+
+// Ownership is the marker the controller stores (as JSON) in the description
+// of the compute resources it manages.
+type Ownership struct {
+	ManagedBy string `json:"managedBy"`
+	// Service is the resource name of the Cloud Run service the resource
+	// was created for.
+	Service string `json:"service,omitempty"`
+	// Labels holds the propagated labels of the service, to attribute the
+	// resource, e.g. in billing and asset inventory exports.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// NewOwnership returns the marker of a resource created for a service.
+func NewOwnership(service string) Ownership {
+	return Ownership{ManagedBy: ControllerName, Service: service}
+}
+
+// WithLabels returns the marker carrying the given propagated labels.
+func (o Ownership) WithLabels(labels map[string]string) Ownership {
+	o.Labels = labels
+	return o
+}
+
+// SameLabels reports whether two label sets are equal, treating nil as
+// empty.
+func SameLabels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (o Ownership) String() string {
+	b, _ := json.Marshal(o)
+	return string(b)
+}
+
+// ParseOwnership extracts the ownership marker from a resource description.
+// It returns false if the resource is not managed by the controller.
+func ParseOwnership(description string) (Ownership, bool) {
+	var o Ownership
+	if err := json.Unmarshal([]byte(description), &o); err != nil {
+		return Ownership{}, false
+	}
+	return o, o.ManagedBy == ControllerName
+}
+
+// OwnedBackend reports whether a backend carries the ownership marker.
+func OwnedBackend(b *compute.Backend) bool {
+	_, ok := ParseOwnership(b.Description)
+	return ok
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package planner
+
+import (
+	"testing"
+
+	"google.golang.org/api/compute/v1"
+)
+
+func TestParseOwnership(t *testing.T) {
+	for _, tc := range []struct {
+		description string
+		want        Ownership
+		owned       bool
+	}{
+		{`{"managedBy":"serverless-autoneg-controller","service":"s"}`, Ownership{ManagedBy: ControllerName, Service: "s"}, true},
+		{`{"managedBy":"serverless-autoneg-controller","service":"s","labels":{"team":"a"}}`, Ownership{ManagedBy: ControllerName, Service: "s", Labels: map[string]string{"team": "a"}}, true},
+		{`{"managedBy":"someone-else","service":"s"}`, Ownership{ManagedBy: "someone-else", Service: "s"}, false},
+		{"created by hand", Ownership{}, false},
+		{"", Ownership{}, false},
+	} {
+		got, owned := ParseOwnership(tc.description)
+		if owned != tc.owned || got.ManagedBy != tc.want.ManagedBy || got.Service != tc.want.Service || !SameLabels(got.Labels, tc.want.Labels) {
+			t.Errorf("ParseOwnership(%q) = %+v, %v, want %+v, %v", tc.description, got, owned, tc.want, tc.owned)
+		}
+		if OwnedBackend(&compute.Backend{Description: tc.description}) != tc.owned {
+			t.Errorf("OwnedBackend(%q) = %v, want %v", tc.description, !tc.owned, tc.owned)
+		}
+	}
+
+	o := NewOwnership("s").WithLabels(map[string]string{"team": "a"})
+	if got, owned := ParseOwnership(o.String()); !owned || got.Service != "s" || !SameLabels(got.Labels, o.Labels) {
+		t.Errorf("ParseOwnership(%q) = %+v, %v, want %+v", o.String(), got, owned, o)
+	}
+}
+
+func TestSameLabels(t *testing.T) {
+	for _, tc := range []struct {
+		a, b map[string]string
+		want bool
+	}{
+		{nil, nil, true},
+		{nil, map[string]string{}, true},
+		{map[string]string{"a": "1"}, map[string]string{"a": "1"}, true},
+		{map[string]string{"a": "1"}, map[string]string{"a": "2"}, false},
+		{map[string]string{"a": "1"}, map[string]string{"b": "1"}, false},
+		{map[string]string{"a": "1"}, nil, false},
+	} {
+		if got := SameLabels(tc.a, tc.b); got != tc.want {
+			t.Errorf("SameLabels(%v, %v) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
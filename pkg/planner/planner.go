@@ -0,0 +1,387 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package planner
+
+import (
+	"path"
+	"sort"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/discovery"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/compute/v1"
+)
+
+// Options configure how the changes of a project are planned.
+type Options struct {
+	// Project is the project of the Cloud Run services, NEGs and backend
+	// services.
+	Project string
+	// Adopt takes over unmanaged serverless NEGs that match the desired spec
+	// of a service instead of creating new ones.
+	Adopt bool
+	// Strict refuses to modify or delete NEGs and backends that lack the
+	// ownership marker, logging a conflict instead.
+	Strict bool
+	// Drifted, if set, reports whether a NEG had the same desired state
+	// when the region last converged, so that the mutations restoring it
+	// are marked as drift corrections.
+	Drifted func(region, neg string, d DesiredNEG) bool
+	// Logger receives the conflicts and skipped services; logrus's
+	// standard logger if nil.
+	Logger *logrus.Entry
+}
+
+// Input is the desired and the current state of a region.
+type Input struct {
+	Region string
+	// Desired holds the desired NEGs, by name.
+	Desired map[string]DesiredNEG
+	// Keep holds NEGs that must not be deleted even though they are not
+	// desired, e.g. because their service is misconfigured.
+	Keep map[string]bool
+	// Frozen holds the resource names of services whose resources must not
+	// be touched at all.
+	Frozen map[string]bool
+	// NEGs holds the serverless NEGs of the region, by name.
+	NEGs map[string]*compute.NetworkEndpointGroup
+	// BackendServices holds the global and regional backend services.
+	BackendServices map[discovery.BackendServiceRef]*compute.BackendService
+}
+
+// Plan is the outcome of planning a region.
+type Plan struct {
+	// Mutations holds the changes, in apply order.
+	Mutations []Mutation
+	// Desired holds the desired NEGs by name, after adoption: NEGs adopted
+	// for a service replace the names the service would get otherwise.
+	Desired map[string]DesiredNEG
+}
+
+func (p *Plan) add(m Mutation) { p.Mutations = append(p.Mutations, m) }
+
+// Compute computes the mutations needed to reach the desired NEGs of a
+// region, based on the serverless NEGs and backend services currently
+// present. Resources owned by frozen services are left untouched.
+func Compute(opts Options, in Input) *Plan {
+	lg := opts.Logger
+	if lg == nil {
+		lg = logrus.NewEntry(logrus.StandardLogger())
+	}
+	drifted := func(name string, d DesiredNEG) bool {
+		return opts.Drifted != nil && opts.Drifted(in.Region, name, d)
+	}
+	project, region, negs, backends := opts.Project, in.Region, in.NEGs, in.BackendServices
+	desired := make(map[string]DesiredNEG, len(in.Desired))
+	for name, d := range in.Desired {
+		desired[name] = d
+	}
+	owners := NEGOwners(project, region, negs, backends)
+
+	p := &Plan{}
+	protocols := newDeclaredSettings[string]("protocols")
+	draining := newDeclaredSettings[int64]("connection draining timeouts")
+	localityPolicies := newDeclaredSettings[string]("locality policies")
+	outlierErrors := newDeclaredSettings[int64]("outlier detection")
+	iap := newDeclaredSettings[bool]("IAP settings")
+	for _, name := range sortedKeys(desired) {
+		d := desired[name]
+		lg := lg.WithFields(logrus.Fields{"service": d.Service, "neg": name})
+		if neg, ok := negs[name]; !ok {
+			if adopted := adoptableNEG(opts, d, negs, owners, desired); adopted != "" {
+				lg.WithField("adopted", adopted).Info("adopting existing NEG instead of creating one")
+				delete(desired, name)
+				name = adopted
+				desired[name] = d
+				owners[name] = NewOwnership(d.Service)
+				lg = lg.WithField("neg", name)
+			} else {
+				p.add(Mutation{Op: OpCreateNEG, Project: project, Region: region, NEG: name, Service: d.Service,
+					Tag: d.Tag, Labels: d.Labels, Drift: drifted(name, d)})
+			}
+		} else if o, owned := owners[name]; !owned {
+			if !opts.Adopt || !MatchesServerlessSpec(neg, d.Service, d.Tag) {
+				lg.Warn("NEG exists but is not managed by the controller, skipping service")
+				continue
+			}
+			lg.Info("adopting existing NEG")
+			owners[name] = NewOwnership(d.Service)
+		} else if o.Service != d.Service {
+			lg.WithField("owner", o.Service).Warn("NEG is managed for a different service, skipping service")
+			continue
+		}
+
+		// Backend services are handled independently: one missing or
+		// conflicting backend service doesn't hold up the others.
+		drift := drifted(name, d)
+		for _, db := range d.Backends {
+			lg := lg.WithField("backendService", db.Ref.String())
+			bs, ok := backends[db.Ref]
+			if !ok {
+				lg.Error("backend service does not exist")
+				continue
+			}
+			if db.Protocol != "" {
+				protocols.declare(db.Ref, db.Protocol)
+			}
+			if db.DrainingTimeout != nil {
+				draining.declare(db.Ref, *db.DrainingTimeout)
+			}
+			if db.LocalityPolicy != "" {
+				localityPolicies.declare(db.Ref, db.LocalityPolicy)
+			}
+			if db.OutlierErrors != nil {
+				outlierErrors.declare(db.Ref, *db.OutlierErrors)
+			}
+			if db.Auth != "" {
+				iap.declare(db.Ref, db.Auth == AuthIAP)
+			}
+			capacity := db.Capacity
+			b := discovery.FindBackend(bs, project, region, name)
+			if b == nil {
+				p.add(Mutation{Op: OpAttachBackend, Project: project, Region: region, NEG: name, Service: d.Service,
+					BackendService: db.Ref.Name, BackendRegion: db.Ref.Region, CapacityScaler: &capacity, Labels: d.Labels, Drift: drift})
+				continue
+			}
+			if !OwnedBackend(b) && opts.Strict {
+				lg.Warn("conflict: backend entry lacks ownership marker, not modifying it in strict mode")
+				continue
+			}
+			if o, owned := ParseOwnership(b.Description); !owned {
+				p.add(Mutation{Op: OpAdoptBackend, Project: project, Region: region, NEG: name, Service: d.Service,
+					BackendService: db.Ref.Name, BackendRegion: db.Ref.Region, Labels: d.Labels, Drift: drift})
+			} else if !SameLabels(o.Labels, d.Labels) {
+				p.add(Mutation{Op: OpLabelBackend, Project: project, Region: region, NEG: name, Service: d.Service,
+					BackendService: db.Ref.Name, BackendRegion: db.Ref.Region, Labels: d.Labels, Previous: o.Labels})
+			}
+			if b.CapacityScaler != capacity {
+				p.add(Mutation{Op: OpUpdateBackend, Project: project, Region: region, NEG: name, Service: d.Service,
+					BackendService: db.Ref.Name, BackendRegion: db.Ref.Region, CapacityScaler: &capacity, Previous: b.CapacityScaler, Drift: drift})
+			}
+		}
+	}
+
+	protocols.each(lg, func(ref discovery.BackendServiceRef, protocol string) {
+		if backends[ref].Protocol != protocol {
+			p.add(Mutation{Op: OpSetProtocol, Project: project, Region: region,
+				BackendService: ref.Name, BackendRegion: ref.Region, Protocol: protocol, Previous: backends[ref].Protocol})
+		}
+	})
+	draining.each(lg, func(ref discovery.BackendServiceRef, timeout int64) {
+		if cd := backends[ref].ConnectionDraining; cd == nil || cd.DrainingTimeoutSec != timeout {
+			m := Mutation{Op: OpSetDraining, Project: project, Region: region,
+				BackendService: ref.Name, BackendRegion: ref.Region, DrainingTimeout: &timeout}
+			if cd != nil {
+				m.Previous = cd.DrainingTimeoutSec
+			}
+			p.add(m)
+		}
+	})
+	localityPolicies.each(lg, func(ref discovery.BackendServiceRef, policy string) {
+		if !AdvancedTrafficManagement(backends[ref]) {
+			lg.WithField("backendService", ref.String()).Error("locality policies require an INTERNAL_MANAGED or EXTERNAL_MANAGED backend service, leaving it unchanged")
+			return
+		}
+		if backends[ref].LocalityLbPolicy != policy {
+			p.add(Mutation{Op: OpSetLocalityPolicy, Project: project, Region: region,
+				BackendService: ref.Name, BackendRegion: ref.Region, LocalityPolicy: policy, Previous: backends[ref].LocalityLbPolicy})
+		}
+	})
+	outlierErrors.each(lg, func(ref discovery.BackendServiceRef, errs int64) {
+		if !AdvancedTrafficManagement(backends[ref]) {
+			lg.WithField("backendService", ref.String()).Error("outlier detection requires an INTERNAL_MANAGED or EXTERNAL_MANAGED backend service, leaving it unchanged")
+			return
+		}
+		if od := backends[ref].OutlierDetection; od == nil || od.ConsecutiveErrors != errs || od.EnforcingConsecutiveErrors != 100 {
+			m := Mutation{Op: OpSetOutlierDetection, Project: project, Region: region,
+				BackendService: ref.Name, BackendRegion: ref.Region, OutlierErrors: &errs}
+			if od != nil {
+				m.Previous = od.ConsecutiveErrors
+			}
+			p.add(m)
+		}
+	})
+
+	iap.each(lg, func(ref discovery.BackendServiceRef, enabled bool) {
+		if IAPEnabled(backends[ref]) != enabled {
+			p.add(Mutation{Op: OpSetIAP, Project: project, Region: region,
+				BackendService: ref.Name, BackendRegion: ref.Region, IAP: &enabled, Previous: IAPEnabled(backends[ref])})
+		}
+	})
+
+	// Detach owned NEGs from backend services they should no longer be part of.
+	for _, ref := range discovery.SortedBackendRefs(backends) {
+		for _, b := range backends[ref].Backends {
+			negProject, negRegion, name, ok := discovery.ParseNEGURL(b.Group)
+			if !ok || negProject != project || negRegion != region || in.Keep[name] {
+				continue
+			}
+			neg, ok := negs[name]
+			if !ok {
+				continue
+			}
+			o, owned := owners[name]
+			if !owned || in.Frozen[o.Service] {
+				continue
+			}
+			// Adopted NEGs may be used by backend services outside of the
+			// controller's control; only detach them where we attached them.
+			if _, created := ParseOwnership(neg.Description); !created && !OwnedBackend(b) {
+				continue
+			}
+			if d, ok := desired[name]; ok && d.AttachedTo(ref) {
+				continue
+			}
+			if opts.Strict && !OwnedBackend(b) {
+				lg.WithFields(logrus.Fields{"neg": name, "backendService": ref.String()}).
+					Warn("conflict: backend entry lacks ownership marker, not detaching it in strict mode")
+				continue
+			}
+			p.add(Mutation{Op: OpDetachBackend, Project: project, Region: region, NEG: name, Service: o.Service,
+				BackendService: ref.Name, BackendRegion: ref.Region})
+		}
+	}
+
+	for _, name := range sortedKeys(negs) {
+		o, owned := owners[name]
+		if !owned || in.Keep[name] || in.Frozen[o.Service] {
+			continue
+		}
+		if _, ok := desired[name]; ok {
+			continue
+		}
+		if _, created := ParseOwnership(negs[name].Description); !created && opts.Strict {
+			lg.WithField("neg", name).Warn("conflict: NEG lacks ownership marker, not deleting it in strict mode")
+			continue
+		}
+		p.add(Mutation{Op: OpDeleteNEG, Project: project, Region: region, NEG: name, Service: o.Service})
+	}
+	p.Desired = desired
+	return p
+}
+
+// NEGOwners returns the ownership of the controller-managed NEGs of a region.
+// NEGs cannot be modified after creation, so besides the marker in the
+// description of NEGs the controller created, ownership of adopted NEGs is
+// recorded on the backends referring to them.
+func NEGOwners(project, region string, negs map[string]*compute.NetworkEndpointGroup, backends map[discovery.BackendServiceRef]*compute.BackendService) map[string]Ownership {
+	owners := make(map[string]Ownership)
+	for name, neg := range negs {
+		if o, ok := ParseOwnership(neg.Description); ok {
+			owners[name] = o
+		}
+	}
+	for _, bs := range backends {
+		for _, b := range bs.Backends {
+			o, ok := ParseOwnership(b.Description)
+			if !ok {
+				continue
+			}
+			p, r, name, ok := discovery.ParseNEGURL(b.Group)
+			if !ok || p != project || r != region {
+				continue
+			}
+			if _, exists := negs[name]; exists {
+				if _, known := owners[name]; !known {
+					owners[name] = o
+				}
+			}
+		}
+	}
+	return owners
+}
+
+// declaredSettings collects the values services declare for a setting of
+// their backend services. Backend services for which services declare
+// different values are left unchanged.
+type declaredSettings[V comparable] struct {
+	name      string
+	values    map[discovery.BackendServiceRef]V
+	conflicts map[discovery.BackendServiceRef]bool
+}
+
+func newDeclaredSettings[V comparable](name string) *declaredSettings[V] {
+	return &declaredSettings[V]{name: name, values: make(map[discovery.BackendServiceRef]V), conflicts: make(map[discovery.BackendServiceRef]bool)}
+}
+
+func (s *declaredSettings[V]) declare(ref discovery.BackendServiceRef, v V) {
+	if other, ok := s.values[ref]; ok && other != v {
+		s.conflicts[ref] = true
+	}
+	s.values[ref] = v
+}
+
+// each calls fn with the value of every backend service without conflicts,
+// in order, and logs the conflicts.
+func (s *declaredSettings[V]) each(lg *logrus.Entry, fn func(ref discovery.BackendServiceRef, v V)) {
+	for _, ref := range discovery.SortedBackendRefs(s.values) {
+		if s.conflicts[ref] {
+			lg.WithField("backendService", ref.String()).Errorf("services declare conflicting %s for backend service, leaving it unchanged", s.name)
+			continue
+		}
+		fn(ref, s.values[ref])
+	}
+}
+
+// AdvancedTrafficManagement reports whether the backend service supports
+// locality policies and outlier detection.
+func AdvancedTrafficManagement(bs *compute.BackendService) bool {
+	switch bs.LoadBalancingScheme {
+	case "INTERNAL_MANAGED", "EXTERNAL_MANAGED":
+		return true
+	}
+	return false
+}
+
+// IAPEnabled reports whether IAP is enabled on the backend service.
+func IAPEnabled(bs *compute.BackendService) bool {
+	return bs.Iap != nil && bs.Iap.Enabled
+}
+
+// adoptableNEG returns the name of an unmanaged serverless NEG of the region
+// that can be adopted for the desired NEG d, or "".
+func adoptableNEG(opts Options, d DesiredNEG, negs map[string]*compute.NetworkEndpointGroup, owners map[string]Ownership, desired map[string]DesiredNEG) string {
+	if !opts.Adopt {
+		return ""
+	}
+	for _, name := range sortedKeys(negs) {
+		if _, owned := owners[name]; owned {
+			continue
+		}
+		if _, taken := desired[name]; taken {
+			continue
+		}
+		if MatchesServerlessSpec(negs[name], d.Service, d.Tag) {
+			return name
+		}
+	}
+	return ""
+}
+
+// MatchesServerlessSpec reports whether neg routes all traffic to the given
+// Cloud Run service, or to its revisions with the given tag, i.e. is
+// equivalent to a NEG the controller would create.
+func MatchesServerlessSpec(neg *compute.NetworkEndpointGroup, service, tag string) bool {
+	cr := neg.CloudRun
+	return cr != nil && cr.Service == path.Base(service) && cr.Tag == tag && cr.UrlMask == ""
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
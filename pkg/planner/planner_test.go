@@ -0,0 +1,311 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package planner
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/serverless-autoneg-controller/pkg/discovery"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/compute/v1"
+)
+
+const (
+	project = "p"
+	region  = "us-central1"
+	service = "projects/p/locations/us-central1/services/hello"
+)
+
+var web = discovery.BackendServiceRef{Name: "web"}
+
+func testLogger() *logrus.Entry {
+	l := logrus.New()
+	l.SetOutput(io.Discard)
+	return logrus.NewEntry(l)
+}
+
+func ownedNEG(service string) *compute.NetworkEndpointGroup {
+	return &compute.NetworkEndpointGroup{
+		Description: NewOwnership(service).String(),
+		CloudRun:    &compute.NetworkEndpointGroupCloudRun{Service: "hello"},
+	}
+}
+
+func unmanagedNEG() *compute.NetworkEndpointGroup {
+	return &compute.NetworkEndpointGroup{CloudRun: &compute.NetworkEndpointGroupCloudRun{Service: "hello"}}
+}
+
+func backend(neg string, scaler float64, owner string) *compute.Backend {
+	b := &compute.Backend{Group: discovery.NEGURL(project, region, neg), CapacityScaler: scaler}
+	if owner != "" {
+		b.Description = NewOwnership(owner).String()
+	}
+	return b
+}
+
+func backendServices(backends ...*compute.Backend) map[discovery.BackendServiceRef]*compute.BackendService {
+	return map[discovery.BackendServiceRef]*compute.BackendService{web: {Name: "web", Backends: backends}}
+}
+
+func desiredHello(backends ...DesiredBackend) map[string]DesiredNEG {
+	return map[string]DesiredNEG{"hello-neg": {Service: service, Backends: backends}}
+}
+
+// describe returns the op, NEG and backend service of every mutation, one per
+// line.
+func describe(ms []Mutation) string {
+	var b strings.Builder
+	for _, m := range ms {
+		fmt.Fprintf(&b, "%s %s", m.Op, m.NEG)
+		if m.BackendService != "" {
+			fmt.Fprintf(&b, " %s", m.BackendServiceRef())
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func TestCompute(t *testing.T) {
+	int64p := func(v int64) *int64 { return &v }
+	for _, tc := range []struct {
+		name    string
+		opts    Options
+		in      Input
+		want    string
+		desired []string
+	}{
+		{
+			name: "create and attach",
+			in: Input{
+				Desired:         desiredHello(DesiredBackend{Ref: web, Capacity: 1}),
+				BackendServices: backendServices(),
+			},
+			want: "createNEG hello-neg\nattachBackend hello-neg global/web\n",
+		},
+		{
+			name: "converged",
+			in: Input{
+				Desired:         desiredHello(DesiredBackend{Ref: web, Capacity: 1}),
+				NEGs:            map[string]*compute.NetworkEndpointGroup{"hello-neg": ownedNEG(service)},
+				BackendServices: backendServices(backend("hello-neg", 1, service)),
+			},
+		},
+		{
+			name: "capacity changed",
+			in: Input{
+				Desired:         desiredHello(DesiredBackend{Ref: web, Capacity: 0.5}),
+				NEGs:            map[string]*compute.NetworkEndpointGroup{"hello-neg": ownedNEG(service)},
+				BackendServices: backendServices(backend("hello-neg", 1, service)),
+			},
+			want: "updateBackend hello-neg global/web\n",
+		},
+		{
+			name: "missing backend service",
+			in: Input{
+				Desired:         desiredHello(DesiredBackend{Ref: discovery.BackendServiceRef{Name: "missing"}, Capacity: 1}),
+				NEGs:            map[string]*compute.NetworkEndpointGroup{"hello-neg": ownedNEG(service)},
+				BackendServices: backendServices(),
+			},
+		},
+		{
+			name: "no longer desired",
+			in: Input{
+				NEGs:            map[string]*compute.NetworkEndpointGroup{"hello-neg": ownedNEG(service)},
+				BackendServices: backendServices(backend("hello-neg", 1, service)),
+			},
+			want: "detachBackend hello-neg global/web\ndeleteNEG hello-neg\n",
+		},
+		{
+			name: "kept",
+			in: Input{
+				Keep:            map[string]bool{"hello-neg": true},
+				NEGs:            map[string]*compute.NetworkEndpointGroup{"hello-neg": ownedNEG(service)},
+				BackendServices: backendServices(backend("hello-neg", 1, service)),
+			},
+		},
+		{
+			name: "frozen",
+			in: Input{
+				Frozen:          map[string]bool{service: true},
+				NEGs:            map[string]*compute.NetworkEndpointGroup{"hello-neg": ownedNEG(service)},
+				BackendServices: backendServices(backend("hello-neg", 1, service)),
+			},
+		},
+		{
+			name: "unmanaged NEG is skipped",
+			in: Input{
+				Desired:         desiredHello(DesiredBackend{Ref: web, Capacity: 1}),
+				NEGs:            map[string]*compute.NetworkEndpointGroup{"hello-neg": unmanagedNEG()},
+				BackendServices: backendServices(),
+			},
+		},
+		{
+			name: "unmanaged NEG is adopted",
+			opts: Options{Adopt: true},
+			in: Input{
+				Desired:         desiredHello(DesiredBackend{Ref: web, Capacity: 1}),
+				NEGs:            map[string]*compute.NetworkEndpointGroup{"hello-neg": unmanagedNEG()},
+				BackendServices: backendServices(),
+			},
+			want:    "attachBackend hello-neg global/web\n",
+			desired: []string{"hello-neg"},
+		},
+		{
+			name: "NEG of another name is adopted",
+			opts: Options{Adopt: true},
+			in: Input{
+				Desired:         desiredHello(DesiredBackend{Ref: web, Capacity: 1}),
+				NEGs:            map[string]*compute.NetworkEndpointGroup{"legacy": unmanagedNEG()},
+				BackendServices: backendServices(),
+			},
+			want:    "attachBackend legacy global/web\n",
+			desired: []string{"legacy"},
+		},
+		{
+			name: "NEG of another service",
+			in: Input{
+				Desired:         desiredHello(DesiredBackend{Ref: web, Capacity: 1}),
+				NEGs:            map[string]*compute.NetworkEndpointGroup{"hello-neg": ownedNEG("projects/p/locations/us-central1/services/other")},
+				BackendServices: backendServices(),
+			},
+		},
+		{
+			name: "unowned backend is adopted",
+			in: Input{
+				Desired:         desiredHello(DesiredBackend{Ref: web, Capacity: 1}),
+				NEGs:            map[string]*compute.NetworkEndpointGroup{"hello-neg": ownedNEG(service)},
+				BackendServices: backendServices(backend("hello-neg", 1, "")),
+			},
+			want: "adoptBackend hello-neg global/web\n",
+		},
+		{
+			name: "unowned backend in strict mode",
+			opts: Options{Strict: true},
+			in: Input{
+				Desired:         desiredHello(DesiredBackend{Ref: web, Capacity: 0.5}),
+				NEGs:            map[string]*compute.NetworkEndpointGroup{"hello-neg": ownedNEG(service)},
+				BackendServices: backendServices(backend("hello-neg", 1, "")),
+			},
+		},
+		{
+			name: "backend settings",
+			in: Input{
+				Desired: desiredHello(DesiredBackend{Ref: web, Capacity: 1, Protocol: "HTTP2", DrainingTimeout: int64p(30),
+					LocalityPolicy: "ROUND_ROBIN", OutlierErrors: int64p(5), Auth: AuthIAP}),
+				NEGs:            map[string]*compute.NetworkEndpointGroup{"hello-neg": ownedNEG(service)},
+				BackendServices: map[discovery.BackendServiceRef]*compute.BackendService{web: {Name: "web", LoadBalancingScheme: "EXTERNAL_MANAGED", Backends: []*compute.Backend{backend("hello-neg", 1, service)}}},
+			},
+			want: "setProtocol  global/web\nsetConnectionDraining  global/web\nsetLocalityPolicy  global/web\nsetOutlierDetection  global/web\nsetIAP  global/web\n",
+		},
+		{
+			name: "advanced settings on a classic backend service",
+			in: Input{
+				Desired:         desiredHello(DesiredBackend{Ref: web, Capacity: 1, LocalityPolicy: "ROUND_ROBIN", OutlierErrors: int64p(5)}),
+				NEGs:            map[string]*compute.NetworkEndpointGroup{"hello-neg": ownedNEG(service)},
+				BackendServices: backendServices(backend("hello-neg", 1, service)),
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.opts.Project = project
+			tc.opts.Logger = testLogger()
+			tc.in.Region = region
+			p := Compute(tc.opts, tc.in)
+			if got := describe(p.Mutations); got != tc.want {
+				t.Errorf("mutations:\n%s\nwant:\n%s", got, tc.want)
+			}
+			if tc.desired != nil {
+				if got := sortedKeys(p.Desired); fmt.Sprint(got) != fmt.Sprint(tc.desired) {
+					t.Errorf("desired NEGs = %v, want %v", got, tc.desired)
+				}
+			}
+		})
+	}
+}
+
+func TestNEGOwners(t *testing.T) {
+	const other = "projects/p/locations/us-central1/services/other"
+	negs := map[string]*compute.NetworkEndpointGroup{
+		"created":   ownedNEG(service),
+		"adopted":   unmanagedNEG(),
+		"unmanaged": unmanagedNEG(),
+		"both":      ownedNEG(service),
+	}
+	elsewhere := backend("adopted", 1, other)
+	elsewhere.Group = discovery.NEGURL(project, "europe-west1", "unmanaged")
+	backends := backendServices(
+		backend("adopted", 1, service),
+		backend("both", 1, other),
+		backend("gone", 1, service),
+		elsewhere,
+	)
+	owners := NEGOwners(project, region, negs, backends)
+	want := map[string]string{"created": service, "adopted": service, "both": service}
+	if len(owners) != len(want) {
+		t.Errorf("owners = %v, want %v", owners, want)
+	}
+	for name, svc := range want {
+		if got := owners[name].Service; got != svc {
+			t.Errorf("owner of %s = %q, want %q", name, got, svc)
+		}
+	}
+}
+
+func TestDeclaredSettings(t *testing.T) {
+	other := discovery.BackendServiceRef{Region: region, Name: "internal"}
+	for _, tc := range []struct {
+		name    string
+		declare func(s *declaredSettings[string])
+		want    map[discovery.BackendServiceRef]string
+	}{
+		{
+			name:    "none",
+			declare: func(s *declaredSettings[string]) {},
+			want:    map[discovery.BackendServiceRef]string{},
+		},
+		{
+			name: "agreeing",
+			declare: func(s *declaredSettings[string]) {
+				s.declare(web, "HTTP2")
+				s.declare(web, "HTTP2")
+				s.declare(other, "HTTPS")
+			},
+			want: map[discovery.BackendServiceRef]string{web: "HTTP2", other: "HTTPS"},
+		},
+		{
+			name: "conflicting",
+			declare: func(s *declaredSettings[string]) {
+				s.declare(web, "HTTP2")
+				s.declare(web, "HTTPS")
+				s.declare(web, "HTTP2")
+				s.declare(other, "HTTPS")
+			},
+			want: map[discovery.BackendServiceRef]string{other: "HTTPS"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newDeclaredSettings[string]("protocols")
+			tc.declare(s)
+			got := make(map[discovery.BackendServiceRef]string)
+			s.each(testLogger(), func(ref discovery.BackendServiceRef, v string) { got[ref] = v })
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("settings = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}